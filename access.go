@@ -0,0 +1,95 @@
+package fscache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// accessLog batches the access times recorded in the Index, see
+// WithAccessTracking.
+type accessLog struct {
+	interval time.Duration
+	mu       sync.Mutex
+	pending  map[string]time.Time // last access of each key since the flush
+	stop     context.CancelFunc
+}
+
+// WithAccessTracking records the last access of entries in the Index as
+// IndexEntry.Accessed, for caches using WithIndex. Hits don't write to the
+// Index: their times are collected and written in the background every
+// interval, so an entry's access time is updated at most once per interval
+// however hot it is.
+func WithAccessTracking(interval time.Duration) Option {
+	return func(c *FsCache) {
+		c.access = &accessLog{
+			interval: interval,
+			pending:  make(map[string]time.Time),
+		}
+	}
+}
+
+// startAccessLog starts flushing the access log, if there's one.
+func (c *FsCache) startAccessLog() {
+	if c.access == nil || c.streams.index == nil || c.access.interval <= 0 {
+		c.access = nil
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.access.stop = cancel
+	go func() {
+		ticker := time.NewTicker(c.access.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.flushAccesses()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stopAccessLog stops the background flushes and flushes what's pending.
+func (c *FsCache) stopAccessLog() {
+	if c.access == nil {
+		return
+	}
+	c.access.stop()
+	c.flushAccesses()
+}
+
+func (c *FsCache) recordAccess(key string) {
+	if c.access == nil {
+		return
+	}
+	now := c.clock.Now()
+	c.access.mu.Lock()
+	c.access.pending[key] = now
+	c.access.mu.Unlock()
+}
+
+// flushAccesses writes the pending access times to the Index.
+func (c *FsCache) flushAccesses() {
+	c.access.mu.Lock()
+	pending := c.access.pending
+	c.access.pending = make(map[string]time.Time, len(pending))
+	c.access.mu.Unlock()
+
+	idx := c.streams.index
+	for key, accessed := range pending {
+		e, ok, err := idx.Get(key)
+		if err != nil {
+			logger.Errorf("recording access of %s: %s", key, err)
+			continue
+		}
+		if !ok || !e.Accessed.Before(accessed) {
+			continue
+		}
+		e.Accessed = accessed
+		if err := idx.Put(e); err != nil {
+			logger.Errorf("recording access of %s: %s", key, err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package fscache
+
+import "time"
+
+// adaptiveTTL scales the expiry of entries with their hits, see
+// WithAdaptiveTTL.
+type adaptiveTTL struct {
+	min, max time.Duration
+	pivot    int64
+}
+
+// WithAdaptiveTTL makes the expiry of each entry depend on how often it's
+// hit: an entry with pivot hits keeps the expiry of the cache, one with
+// twice as many twice the expiry and so on, within min and max. Entries
+// which were never hit expire after min. Hits are counted in memory since
+// the entry was filled or loaded, see EntryInfo.Hits. The reaper still runs
+// every expiry, so a TTL shorter than it takes effect on the next pass.
+func WithAdaptiveTTL(min, max time.Duration, pivot int64) Option {
+	return func(c *FsCache) {
+		if pivot < 1 {
+			pivot = 1
+		}
+		c.adaptive = &adaptiveTTL{min: min, max: max, pivot: pivot}
+	}
+}
+
+// ttl returns how long s may go unread before it expires, given the expiry
+// of the cache.
+func (c *FsCache) ttl(s *Stream, expiry time.Duration) time.Duration {
+	a := c.adaptive
+	if a == nil {
+		return expiry
+	}
+	ttl := time.Duration(float64(expiry) * float64(s.hits()) /
+		float64(a.pivot))
+	if ttl < a.min {
+		ttl = a.min
+	}
+	if ttl > a.max {
+		ttl = a.max
+	}
+	return ttl
+}
+
+// hit counts a Get which found the stream.
+func (s *Stream) hit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.info.Hits++
+}
+
+func (s *Stream) hits() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info.Hits
+}
@@ -0,0 +1,119 @@
+package fscache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// Linker is implemented by FileSystems which can hard link files between
+// the cache and paths outside of it, like the one returned by NewFs. Without
+// it Adopt and Export copy the files.
+type Linker interface {
+	// Link links the file at path as the File name.
+	Link(path, name string) error
+
+	// LinkTo links the File name at path.
+	LinkTo(name, path string) error
+}
+
+// Adopt makes the file at path the complete entry name, e.g. when its
+// producer already wrote it elsewhere on the same volume. The file is hard
+// linked into the cache without reading it if possible, and copied
+// otherwise: when the FileSystem isn't a Linker, path is on another volume,
+// or the cache encodes entries WithCodec or writer middleware. It fails with
+// ErrEntryExists if name is in the cache.
+func (c *FsCache) Adopt(name, path string) error {
+	if err := c.validate(name); err != nil {
+		return wrapError(OpAdopt, name, err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return wrapError(OpAdopt, name, err)
+	}
+	linker, ok := c.fs.(Linker)
+	if ok && len(c.codecs) == 0 && len(c.writer_mw) == 0 {
+		linked, err := c.link(name, path, linker)
+		if linked || err != nil {
+			return wrapError(OpAdopt, name, err)
+		}
+	}
+	return wrapError(OpAdopt, name, c.copyIn(name, path, fi.Size()))
+}
+
+// link hard links path as the entry name. It returns false without an error
+// if the link failed and the file should be copied instead.
+func (c *FsCache) link(name, path string, linker Linker) (bool, error) {
+	if err := c.beginWrite(context.Background(), true); err != nil {
+		return false, err
+	}
+	defer c.endWrite()
+	key := c.key(name)
+	c.mu.Lock()
+	if _, ok := c.streams.get(key); ok || c.tombstones[key] != nil ||
+		c.removingDir(key) != nil {
+		c.mu.Unlock()
+		return false, ErrEntryExists
+	}
+	s := c.newStream(key)
+	s.info.Name = name
+	if err := linker.Link(path, s.Name()); err != nil {
+		c.mu.Unlock()
+		logger.Debugf("linking %s, copying it instead: %s", path, err)
+		return false, nil
+	}
+	s.markComplete()
+	c.streams.put(key, s, EntryComplete)
+	c.unlock()
+	c.enforceMaxSize()
+	return true, nil
+}
+
+// copyIn fills the entry name with a copy of the file at path.
+func (c *FsCache) copyIn(name, path string, size int64) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if len(c.codecs) > 0 {
+		size = UnknownSize
+	}
+	s, err := c.lookup(name, UnknownSize)
+	if err != nil {
+		return err
+	}
+	if s != nil {
+		return ErrEntryExists
+	}
+	s, cw, err := c.fill(context.Background(), name, size, true)
+	if err != nil {
+		return err
+	}
+	w := c.wrapWriter(name, cw)
+	if _, err := copyFile(w, src); err != nil {
+		cw.abort(err)
+		c.discard(s)
+		return err
+	}
+	return w.Close()
+}
+
+func (fs *stdFs) Link(path, name string) error {
+	err := os.Link(path, name)
+	if err != nil && os.IsNotExist(err) {
+		// the parent of a hierarchical key, see HierarchicalKeys.
+		if err := os.MkdirAll(filepath.Dir(name), fs.mode); err != nil {
+			return err
+		}
+		err = os.Link(path, name)
+	}
+	if err != nil {
+		return err
+	}
+	return fs.syncDirs(name, true)
+}
+
+func (fs *stdFs) LinkTo(name, path string) error {
+	return os.Link(name, path)
+}
@@ -0,0 +1,150 @@
+package fscache
+
+import (
+	"context"
+	"io"
+)
+
+// Archiver preserves entries which are evicted by the janitor (see Expiry and
+// MaxSize), e.g. by uploading them to cold storage, so that they can be
+// restored instead of refilled.
+type Archiver interface {
+	// Archive stores the contents of the entry key, which is deleted from
+	// the cache once Archive returns without error.
+	Archive(key string, r io.Reader) error
+
+	// Restore writes the contents of an archived entry to w.
+	Restore(key string, w io.Writer) error
+}
+
+// WithArchiver archives evicted entries with a before they are deleted. A
+// later Get of an archived entry restores it in the background and returns
+// a Reader with w == nil, as if the entry had never been evicted. Pointers to
+// archived entries are kept in memory and don't survive a restart.
+func WithArchiver(a Archiver) Option {
+	return func(c *FsCache) {
+		c.archiver = a
+	}
+}
+
+// evict removes the entry key from the cache on behalf of the janitor,
+// archiving it first if an Archiver is configured. c.mu must be held.
+func (c *FsCache) evict(key string, reason EvictionReason) error {
+	if c.dry_run {
+		if s, ok := c.streams.get(key); ok {
+			logger.Infof("dry run: would evict %s (%s)", truncateKey(key),
+				reason)
+			c.notifyEvicted(s, reason)
+		}
+		return nil
+	}
+	s, ok := c.streams.delete(key)
+	if !ok {
+		return nil
+	}
+	c.notifyEvicted(s, reason)
+	if reason == EvictionSize {
+		c.addGhost(key, s)
+	}
+	if c.archiver == nil {
+		s.markRemoving()
+		s.grp.Wait()
+		return c.removeFile(s)
+	}
+	done := make(chan struct{})
+	c.archiving[key] = done
+	go c.archive(key, s, done)
+	return nil
+}
+
+func (c *FsCache) archive(key string, s *Stream, done chan struct{}) {
+	size, err := s.Size()
+	if err == nil {
+		var f File
+		f, err = s.fs.Open(s.Name())
+		if err == nil {
+			err = c.archiver.Archive(key, f)
+			f.Close()
+		}
+	}
+	if err != nil {
+		logger.Errorf("archiving %s: %s", s.Name(), err)
+	}
+	c.awaitSnapshot()
+	if rerr := s.Remove(); rerr != nil {
+		logger.Error(rerr)
+	}
+
+	c.mu.Lock()
+	delete(c.archiving, key)
+	if err == nil {
+		c.archived[key] = size
+	}
+	c.mu.Unlock()
+	close(done)
+}
+
+// awaitArchive blocks until the entry key is no longer being archived.
+func (c *FsCache) awaitArchive(key string) {
+	c.mu.RLock()
+	done := c.archiving[key]
+	c.mu.RUnlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// unarchive forgets the archived copy of key, if any.
+func (c *FsCache) unarchive(key string) {
+	if c.archiver == nil {
+		return
+	}
+	c.awaitArchive(key)
+	c.mu.Lock()
+	delete(c.archived, key)
+	c.mu.Unlock()
+}
+
+// restore refills name from its archived copy if there is one of the given
+// size, returning its Stream, which is nil if name isn't archived.
+func (c *FsCache) restore(ctx context.Context, name string, size int64,
+	wait bool) (r ReaderAtCloser, s *Stream, err error) {
+	if c.archiver == nil {
+		return nil, nil, nil
+	}
+	key := c.key(name)
+	c.awaitArchive(key)
+	c.mu.Lock()
+	archived, ok := c.archived[key]
+	delete(c.archived, key)
+	c.mu.Unlock()
+	if !ok || archived != size {
+		return nil, nil, nil
+	}
+
+	s, w, err := c.fill(ctx, name, size, wait)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := s.NextReader()
+	if err != nil {
+		w.Close()
+		c.discard(s)
+		return nil, nil, err
+	}
+	go func() {
+		var err error
+		c.labelled(context.Background(), "restore", key,
+			func(context.Context) {
+				err = c.archiver.Restore(key, w)
+			})
+		if err != nil {
+			logger.Errorf("restoring %s: %s", s.Name(), err)
+			w.abort(err)
+			c.discard(s)
+			return
+		}
+		w.Close()
+	}()
+	return c.wrapReader(name, reader), s, nil
+}
@@ -0,0 +1,67 @@
+package fscache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+type mapArchiver struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (a *mapArchiver) Archive(key string, r io.Reader) error {
+	p, err := ioutil.ReadAll(r)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.files[key] = p
+	return err
+}
+
+func (a *mapArchiver) Restore(key string, w io.Writer) error {
+	a.mu.Lock()
+	p := a.files[key]
+	a.mu.Unlock()
+	_, err := io.Copy(w, bytes.NewReader(p))
+	return err
+}
+
+func TestArchiver(t *testing.T) {
+	test := Wrap(t, "archive")
+	defer test.Close()
+	archiver := &mapArchiver{files: make(map[string][]byte)}
+	cache, err := New(test.Dir(), 0700, 0, WithMaxSize(5),
+		WithArchiver(archiver))
+	test.AssertNoError(err)
+
+	for _, name := range []string{"a", "b"} {
+		r, w, err := cache.Get(name, 5)
+		test.AssertNoError(err)
+		_, err = w.Write([]byte(name + "aaaa"))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+		test.AssertNoError(r.Close())
+	}
+	cache.awaitArchive(fileName("a"))
+	test.Assert(!cache.Exists("a"), "expected a to be evicted")
+	test.AssertByteEqual([]byte("aaaaa"), archiver.files[fileName("a")])
+
+	r, w, err := cache.Get("a", 5)
+	test.AssertNoError(err)
+	test.Assert(w == nil, "expected a to be restored")
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual([]byte("aaaaa"), p)
+	test.AssertNoError(r.Close())
+
+	cache.awaitArchive(fileName("b"))
+	test.AssertNoError(cache.Remove("b"))
+	r, w, err = cache.Get("b", 5)
+	test.AssertNoError(err)
+	test.Assert(w != nil, "removed entries should not be restored")
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+}
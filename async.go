@@ -0,0 +1,204 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrNoFiller is returned by GetAsync when the cache has no FillFunc for an
+// entry, see WithFiller and WithFillMux.
+var ErrNoFiller = errors.New("no filler registered")
+
+// WithFiller registers fill as the producer of the entries missed by
+// GetAsync.
+func WithFiller(fill FillFunc) Option {
+	return func(c *FsCache) {
+		c.fillers = NewFillMux()
+		c.fillers.Handle("", fill)
+	}
+}
+
+// WithFillMux makes GetAsync fill each missed entry with the FillFunc m
+// routes its name to, so entries of different families can come from
+// different origins. m can still be changed while the cache is running.
+func WithFillMux(m *FillMux) Option {
+	return func(c *FsCache) {
+		c.fillers = m
+	}
+}
+
+// FillMux routes the names of entries to FillFuncs by prefix, like an
+// http.ServeMux, see WithFillMux.
+type FillMux struct {
+	mu     sync.RWMutex
+	routes []fillRoute // longest prefix first
+}
+
+type fillRoute struct {
+	prefix string
+	fill   FillFunc
+}
+
+// NewFillMux creates a FillMux without routes.
+func NewFillMux() *FillMux {
+	return &FillMux{}
+}
+
+// Handle routes the names starting with prefix to fill, unless a longer
+// prefix matches them too. The empty prefix matches every name. A nil fill
+// removes the route of prefix.
+func (m *FillMux) Handle(prefix string, fill FillFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, r := range m.routes {
+		if r.prefix == prefix {
+			m.routes = append(m.routes[:i], m.routes[i+1:]...)
+			break
+		}
+	}
+	if fill == nil {
+		return
+	}
+	i := sort.Search(len(m.routes), func(i int) bool {
+		return len(m.routes[i].prefix) < len(prefix)
+	})
+	m.routes = append(m.routes, fillRoute{})
+	copy(m.routes[i+1:], m.routes[i:])
+	m.routes[i] = fillRoute{prefix: prefix, fill: fill}
+}
+
+// Match returns the FillFunc name is routed to, nil if none.
+func (m *FillMux) Match(name string) FillFunc {
+	_, fill := m.route(name)
+	return fill
+}
+
+// route returns the route of name, a nil FillFunc if none.
+func (m *FillMux) route(name string) (prefix string, fill FillFunc) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, r := range m.routes {
+		if strings.HasPrefix(name, r.prefix) {
+			return r.prefix, r.fill
+		}
+	}
+	return "", nil
+}
+
+// Fill is a FillFunc which fills name with the FillFunc it's routed to, and
+// fails with ErrNoFiller if there's none.
+func (m *FillMux) Fill(ctx context.Context, name string, w io.Writer) error {
+	fill := m.Match(name)
+	if fill == nil {
+		return ErrNoFiller
+	}
+	return fill(ctx, name, w)
+}
+
+// GetAsync returns a Reader of the entry name without handing out a writer.
+// On a miss it starts filling the entry in the background with the FillFunc
+// registered WithFiller or WithFillMux and returns right away: the Reader
+// streams the bytes as they're written. A failed fill fails its Readers with
+// the error of fill and removes the entry, see WithFillRetry. The fill
+// outlives ctx, which only bounds the wait for the writer limits of the
+// cache and gives the entry its priority.
+func (c *FsCache) GetAsync(ctx context.Context, name string) (
+	ReaderAtCloser, error) {
+	r, err := c.getAsync(ctx, name)
+	return r, wrapError(OpGet, name, err)
+}
+
+func (c *FsCache) getAsync(ctx context.Context, name string) (
+	ReaderAtCloser, error) {
+	for {
+		r, err := c.getAsyncOnce(ctx, name)
+		if err != ErrEntryExists && err != ErrRemoving {
+			return r, err
+		}
+		// another Get created the entry after the lookup, or it's being
+		// removed: look it up again, and fill a fresh one if needed.
+	}
+}
+
+func (c *FsCache) getAsyncOnce(ctx context.Context, name string) (
+	ReaderAtCloser, error) {
+	if err := c.validate(name); err != nil {
+		return nil, err
+	}
+	s, err := c.lookup(name, UnknownSize)
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		return c.open(ctx, name, s, true)
+	}
+	if err := c.failure(c.key(name)); err != nil {
+		return nil, err
+	}
+	var prefix string
+	var fill FillFunc
+	if c.fillers != nil {
+		prefix, fill = c.fillers.route(name)
+	}
+	if fill == nil {
+		return nil, ErrNoFiller
+	}
+
+	if r, s, err := c.restore(ctx, name, UnknownSize, true); s != nil ||
+		err != nil {
+		return r, err
+	}
+
+	b := c.breakerFor(prefix)
+	if b != nil && !b.allow(c.clock.Now(), c.breaker_n) {
+		return nil, ErrCircuitOpen
+	}
+	c.ghostMiss(c.key(name))
+	s, cw, err := c.fill(ctx, name, UnknownSize, true)
+	if err != nil {
+		if b != nil {
+			b.abandon()
+		}
+		return nil, err
+	}
+	r, err := s.NextReader()
+	if err != nil {
+		if b != nil {
+			b.abandon()
+		}
+		cw.abort(err)
+		c.discard(s)
+		return nil, err
+	}
+	fill_ctx := WithPriority(context.Background(), PriorityFrom(ctx))
+	go c.fillAsync(fill_ctx, name, s, cw, fill, b)
+	return c.wrapReader(name, r), nil
+}
+
+// fillAsync fills the entry s of name with fill, reporting the outcome to
+// b if it isn't nil.
+func (c *FsCache) fillAsync(ctx context.Context, name string, s *Stream,
+	cw *cacheWriter, fill FillFunc, b *breaker) {
+	w := c.wrapWriter(name, cw)
+	var err error
+	c.labelled(ctx, "fill", s.info.Key, func(ctx context.Context) {
+		err = c.retryFill(ctx, name, s, w, fill)
+	})
+	if b != nil {
+		b.done(err, c.clock.Now(), c.breaker_n, c.breaker_cooldown)
+	}
+	if err != nil {
+		logger.Warnf("filling %s: %s", name, err)
+		c.failed(s.info.Key, err)
+		cw.abort(err)
+		c.discard(s)
+		return
+	}
+	if err := w.Close(); err != nil {
+		logger.Errorf("filling %s: %s", name, err)
+	}
+}
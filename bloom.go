@@ -0,0 +1,87 @@
+package fscache
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+// bloom is a counting Bloom filter of keys, so keys can be removed as well
+// as added. Counters saturate and then stay set, which can only cause false
+// positives.
+type bloom struct {
+	mu       sync.Mutex
+	counters []uint8
+	k        int
+}
+
+// newBloom sizes a filter for n keys with a false positive rate of p.
+func newBloom(n int, p float64) *bloom {
+	if n < 1 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := int(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloom{counters: make([]uint8, m), k: k}
+}
+
+// WithBloomFilter keeps a Bloom filter of the keys of the cache, sized for n
+// entries with a false positive rate of p, so that Gets and Exists of keys
+// which aren't cached skip the Index lookup. It only has an effect with
+// WithMemoryBudget, where entries may be only in the Index.
+func WithBloomFilter(n int, p float64) Option {
+	return func(c *FsCache) {
+		c.streams.filter = newBloom(n, p)
+	}
+}
+
+// each calls fn with the index of every counter of key.
+func (b *bloom) each(key string, fn func(i int)) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	for i := 0; i < b.k; i++ {
+		fn(int((h1 + uint32(i)*h2) % uint32(len(b.counters))))
+	}
+}
+
+func (b *bloom) add(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.each(key, func(i int) {
+		if b.counters[i] < math.MaxUint8 {
+			b.counters[i]++
+		}
+	})
+}
+
+func (b *bloom) remove(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.each(key, func(i int) {
+		if c := b.counters[i]; c > 0 && c < math.MaxUint8 {
+			b.counters[i]--
+		}
+	})
+}
+
+// mayContain reports whether key may have been added, false if it surely
+// wasn't.
+func (b *bloom) mayContain(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	found := true
+	b.each(key, func(i int) {
+		if b.counters[i] == 0 {
+			found = false
+		}
+	})
+	return found
+}
@@ -0,0 +1,146 @@
+// Package boltindex provides a persistent fscache.Index stored in a bbolt
+// file, so a cache starts without listing its files and the state of its
+// entries survives crashes.
+package boltindex
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/amozoss/fscache"
+	bolt "go.etcd.io/bbolt"
+)
+
+var bucket = []byte("entries")
+
+// Index is an fscache.Index in a bbolt file. Every update is committed in
+// its own transaction, unless WithWAL is used.
+type Index struct {
+	db         *bolt.DB
+	checkpoint time.Duration // see WithWAL
+	wal        *wal          // nil unless WithWAL
+}
+
+var _ fscache.Persistent = (*Index)(nil)
+
+// Open opens or creates the index at path.
+func Open(path string, opts ...Option) (*Index, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	i := &Index{db: db}
+	for _, opt := range opts {
+		opt(i)
+	}
+	if i.checkpoint > 0 {
+		i.wal, err = openWAL(db, path+".wal")
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		go i.wal.run(db, i.checkpoint)
+	}
+	return i, nil
+}
+
+// Close closes the index file, checkpointing its WAL first.
+func (i *Index) Close() error {
+	var err error
+	if i.wal != nil {
+		err = i.wal.close(i.db)
+	}
+	if cerr := i.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Persistent reports that the index outlives the process.
+func (i *Index) Persistent() bool {
+	return true
+}
+
+func (i *Index) Put(e fscache.IndexEntry) error {
+	if i.wal != nil {
+		return i.wal.append(walRecord{Entry: e})
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return i.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(e.Key), data)
+	})
+}
+
+func (i *Index) Get(key string) (e fscache.IndexEntry, ok bool, err error) {
+	if i.wal != nil {
+		if rec, ok := i.wal.get(key); ok {
+			return rec.Entry, !rec.Delete, nil
+		}
+	}
+	err = i.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(data, &e)
+	})
+	return e, ok, err
+}
+
+func (i *Index) Delete(key string) error {
+	if i.wal != nil {
+		return i.wal.append(walRecord{
+			Delete: true,
+			Entry:  fscache.IndexEntry{Key: key},
+		})
+	}
+	return i.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
+
+func (i *Index) Iterate(fn func(fscache.IndexEntry) bool) error {
+	var pending map[string]walRecord
+	if i.wal != nil {
+		pending = i.wal.snapshot()
+	}
+	stopped := false
+	err := i.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if _, ok := pending[string(k)]; ok {
+				continue
+			}
+			var e fscache.IndexEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if !fn(e) {
+				stopped = true
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil || stopped {
+		return err
+	}
+	for _, rec := range pending {
+		if !rec.Delete && !fn(rec.Entry) {
+			return nil
+		}
+	}
+	return nil
+}
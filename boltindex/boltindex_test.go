@@ -0,0 +1,155 @@
+package boltindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amozoss/fscache"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache_dir := filepath.Join(dir, "cache")
+	path := filepath.Join(dir, "index.db")
+
+	idx, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := fscache.New(cache_dir, 0700, time.Hour,
+		fscache.WithIndex(idx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := cache.Get("complete", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	w.Close()
+	r.Close()
+
+	// crash while filling.
+	r, w, err = cache.Get("unfinished", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hel"))
+	if err := idx.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	cache, err = fscache.New(cache_dir, 0700, time.Hour,
+		fscache.WithIndex(idx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := cache.LoadReport()
+	if report.Entries != 1 || report.Bytes != 5 || report.Unfinished != 1 {
+		t.Fatalf("unexpected load report %+v", report)
+	}
+	if !cache.Exists("complete") || cache.Exists("unfinished") {
+		t.Fatal("expected only the complete entry to be loaded")
+	}
+	info, err := cache.Info("complete")
+	if err != nil || info.Name != "complete" {
+		t.Fatalf("expected name from the index, got %+v: %v", info, err)
+	}
+	r, w, err = cache.Get("complete", 5)
+	if err != nil || w != nil {
+		t.Fatalf("expected a hit: %v", err)
+	}
+	p, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(p) != "hello" {
+		t.Fatalf("unexpected read %q: %v", p, err)
+	}
+	if _, ok, _ := idx.Get(fscache.MD5Keys.Encode("unfinished")); ok {
+		t.Fatal("expected unfinished entry to be unindexed")
+	}
+}
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index.db")
+
+	idx, err := Open(path, WithWAL(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		err := idx.Put(fscache.IndexEntry{Key: key, Size: 1,
+			State: fscache.EntryComplete})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := idx.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := idx.Get("a"); !ok {
+		t.Fatal("expected a logged entry to be found")
+	}
+	if _, ok, _ := idx.Get("b"); ok {
+		t.Fatal("expected a logged delete to hide the entry")
+	}
+	// nothing was committed to the index file yet.
+	idx.db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket(bucket).Stats().KeyN; n != 0 {
+			t.Fatalf("expected no committed entries, got %d", n)
+		}
+		return nil
+	})
+
+	// crash before a checkpoint, the log is replayed.
+	close(idx.wal.stop)
+	idx.wal.file.Close()
+	idx.db.Close()
+	idx, err = Open(path, WithWAL(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	var keys []string
+	err = idx.Iterate(func(e fscache.IndexEntry) bool {
+		keys = append(keys, e.Key)
+		return true
+	})
+	if err != nil || len(keys) != 2 || keys[0] != "a" || keys[1] != "c" {
+		t.Fatalf("unexpected replayed entries %v: %v", keys, err)
+	}
+	fi, err := os.Stat(path + ".wal")
+	if err != nil || fi.Size() != 0 {
+		t.Fatalf("expected the log to be emptied on open: %v", err)
+	}
+
+	if err := idx.Put(fscache.IndexEntry{Key: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := idx.wal.get("d"); ok {
+		t.Fatal("expected the checkpoint to apply pending updates")
+	}
+	if e, ok, err := idx.Get("d"); !ok || err != nil || e.Key != "d" {
+		t.Fatalf("expected checkpointed entry, got %+v: %v", e, err)
+	}
+}
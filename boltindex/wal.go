@@ -0,0 +1,175 @@
+package boltindex
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/amozoss/fscache"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Option configures an Index.
+type Option func(*Index)
+
+// WithWAL batches updates: they're appended to a write-ahead log next to the
+// index file and applied to it in a single transaction every checkpoint,
+// instead of committing (and fsyncing) a transaction per update. The log
+// isn't synced either, so the updates since the last checkpoint survive a
+// crash of the process but not of the host. They're replayed by Open.
+func WithWAL(checkpoint time.Duration) Option {
+	return func(i *Index) {
+		i.checkpoint = checkpoint
+	}
+}
+
+// walRecord is an update in the log.
+type walRecord struct {
+	Delete bool `json:",omitempty"`
+	Entry  fscache.IndexEntry
+}
+
+// wal holds the updates which weren't checkpointed yet.
+type wal struct {
+	mu      sync.Mutex // guards all fields
+	file    *os.File
+	enc     *json.Encoder
+	pending map[string]walRecord // the last update of each key
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// openWAL opens the log at path and applies the updates left in it to db.
+func openWAL(db *bolt.DB, path string) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := &wal{
+		file:    f,
+		enc:     json.NewEncoder(f),
+		pending: make(map[string]walRecord),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var rec walRecord
+		// a torn record at the end wasn't acknowledged, stop there.
+		if err := dec.Decode(&rec); err != nil {
+			break
+		}
+		w.pending[rec.Entry.Key] = rec
+	}
+	err = w.checkpoint(db)
+	if err == nil {
+		// drop a torn record too, later records would follow it.
+		err = f.Truncate(0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// run checkpoints the log to db every interval until close.
+func (w *wal) run(db *bolt.DB, interval time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// failures are retried on the next tick, or reported by Close.
+			w.checkpoint(db)
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *wal) append(rec walRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.enc.Encode(rec); err != nil {
+		return err
+	}
+	w.pending[rec.Entry.Key] = rec
+	return nil
+}
+
+// get returns the pending update of key, if any.
+func (w *wal) get(key string) (rec walRecord, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	rec, ok = w.pending[key]
+	return rec, ok
+}
+
+// snapshot returns a copy of the pending updates.
+func (w *wal) snapshot() map[string]walRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pending := make(map[string]walRecord, len(w.pending))
+	for key, rec := range w.pending {
+		pending[key] = rec
+	}
+	return pending
+}
+
+// checkpoint applies the pending updates to db in one transaction and
+// empties the log.
+func (w *wal) checkpoint(db *bolt.DB) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) == 0 {
+		return nil
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		for key, rec := range w.pending {
+			if rec.Delete {
+				if err := b.Delete([]byte(key)); err != nil {
+					return err
+				}
+				continue
+			}
+			data, err := json.Marshal(rec.Entry)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.pending = make(map[string]walRecord)
+	return w.file.Truncate(0)
+}
+
+// close stops the checkpoints and closes the log after a last checkpoint.
+func (w *wal) close(db *bolt.DB) error {
+	close(w.stop)
+	<-w.done
+	err := w.checkpoint(db)
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Checkpoint applies the updates logged since the last checkpoint to the
+// index file, see WithWAL. It's a no-op without WithWAL.
+func (i *Index) Checkpoint() error {
+	if i.wal == nil {
+		return nil
+	}
+	return i.wal.checkpoint(i.db)
+}
@@ -0,0 +1,87 @@
+package fscache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by GetAsync instead of filling an entry while
+// the circuit of its filler is open, see WithCircuitBreaker.
+var ErrCircuitOpen = errors.New("circuit open, origin is failing")
+
+// WithCircuitBreaker stops GetAsync from filling entries from an origin
+// which keeps failing: after threshold consecutive failed fills of the same
+// FillFunc (or route of a FillMux), its misses fail fast with
+// ErrCircuitOpen for cooldown. A single fill is then let through to probe
+// the origin, which closes the circuit if it succeeds and opens it again
+// otherwise. Entries which are cached are still served meanwhile.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(c *FsCache) {
+		c.breaker_n = threshold
+		c.breaker_cooldown = cooldown
+		c.breakers = make(map[string]*breaker)
+	}
+}
+
+// breaker is the circuit of a route.
+type breaker struct {
+	mu         sync.Mutex
+	failures   int // consecutive failed fills
+	open_until time.Time
+	probing    bool // a fill is probing the origin
+}
+
+// breakerFor returns the breaker of the route prefix, nil unless
+// WithCircuitBreaker.
+func (c *FsCache) breakerFor(prefix string) *breaker {
+	if c.breaker_n <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.breakers[prefix]
+	if !ok {
+		b = &breaker{}
+		c.breakers[prefix] = b
+	}
+	return b
+}
+
+// allow reports whether a fill may start. If the circuit was open it becomes
+// the probe, which must call done or abandon.
+func (b *breaker) allow(now time.Time, threshold int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < threshold {
+		return true
+	}
+	if now.Before(b.open_until) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// done records the outcome of a fill allowed by allow.
+func (b *breaker) done(err error, now time.Time, threshold int,
+	cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= threshold {
+		b.open_until = now.Add(cooldown)
+	}
+}
+
+// abandon records that a fill allowed by allow didn't start.
+func (b *breaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
@@ -0,0 +1,420 @@
+package fscache
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/djherbis/atime.v1"
+)
+
+// DefaultChunkSize is the chunk size used by NewChunkedFs when chunkSize <= 0.
+const DefaultChunkSize = 64 << 20
+
+type chunkedFs struct {
+	root       string
+	mode       os.FileMode
+	chunk_size int64
+	store      *chunkStore // nil unless NewDedupFs
+}
+
+// NewChunkedFs returns a FileSystem rooted at directory dir which stores each
+// File as a directory of chunk files of up to chunkSize bytes, so that very
+// large entries don't have to live in one giant file. Dir is created with
+// perms if it doesn't exist.
+//
+// Chunks are named after the offset of their first byte, so entries remain
+// readable if chunkSize changes between runs. See Compact.
+func NewChunkedFs(dir string, mode os.FileMode, chunkSize int64) (FileSystem,
+	error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	return &chunkedFs{
+		root:       dir,
+		mode:       mode,
+		chunk_size: chunkSize,
+	}, os.MkdirAll(dir, mode)
+}
+
+func chunkName(name string, off int64) string {
+	return filepath.Join(name, fmt.Sprintf("%016x", off))
+}
+
+// parseChunkName returns the offset of the chunk file base, and the hash of
+// its content if it's in the name, see NewDedupFs.
+func parseChunkName(base string) (off int64, hash string, ok bool) {
+	if len(base) > 16 {
+		if base[16] != '.' || !isChunkHash(base[17:]) {
+			return 0, "", false
+		}
+		hash = base[17:]
+	} else if len(base) != 16 {
+		return 0, "", false
+	}
+	off, err := strconv.ParseInt(base[:16], 16, 64)
+	return off, hash, err == nil
+}
+
+type chunkInfo struct {
+	off  int64
+	size int64
+	path string
+	hash string // empty unless the chunk is in the store of a dedup fs
+}
+
+// layout returns the chunks of name sorted by offset, and the paths of any
+// other files found in its directory.
+func (fs *chunkedFs) layout(name string) (chunks []chunkInfo, stray []string,
+	err error) {
+	files, err := ioutil.ReadDir(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, f := range files {
+		path := filepath.Join(name, f.Name())
+		off, hash, ok := parseChunkName(f.Name())
+		if !ok || f.IsDir() {
+			stray = append(stray, path)
+			continue
+		}
+		chunks = append(chunks, chunkInfo{off: off, size: f.Size(),
+			path: path, hash: hash})
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].off < chunks[j].off
+	})
+	return chunks, stray, nil
+}
+
+// contiguous returns the end offset of the data readable from offset 0.
+func contiguous(chunks []chunkInfo) (end int64) {
+	for _, c := range chunks {
+		if c.off > end {
+			break
+		}
+		if c.off+c.size > end {
+			end = c.off + c.size
+		}
+	}
+	return end
+}
+
+func (fs *chunkedFs) Create(name string) (File, error) {
+	if err := fs.removeAll(name); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(name, fs.mode); err != nil {
+		return nil, err
+	}
+	f := &chunkedFile{fs: fs, name: name}
+	if fs.store != nil {
+		f.cdc = newChunker(fs.store.avg)
+	}
+	if err := f.nextChunk(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fs *chunkedFs) Open(name string) (File, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a chunked file", name)
+	}
+	return &chunkedFile{fs: fs, name: name}, nil
+}
+
+func (fs *chunkedFs) Remove(name string) error {
+	if _, err := os.Stat(name); err != nil {
+		return err
+	}
+	return fs.removeAll(name)
+}
+
+// removeAll removes the directory of name, if any, releasing its chunks
+// from the store of a dedup fs.
+func (fs *chunkedFs) removeAll(name string) error {
+	if fs.store == nil {
+		return os.RemoveAll(name)
+	}
+	chunks, _, err := fs.layout(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.RemoveAll(name); err != nil {
+		return err
+	}
+	fs.store.release(chunks)
+	return nil
+}
+
+// List returns the names of the entries in the root of fs.
+func (fs *chunkedFs) List() ([]string, error) {
+	dir, err := os.Open(fs.root)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	keys := names[:0]
+	for _, name := range names {
+		if name != storeDir {
+			keys = append(keys, name)
+		}
+	}
+	return keys, nil
+}
+
+// AccessTimes returns the latest access and modification times of any chunk.
+func (fs *chunkedFs) AccessTimes(name string) (rt, wt time.Time, err error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return rt, wt, err
+	}
+	rt, wt = atime.Get(fi), fi.ModTime()
+	chunks, _, err := fs.layout(name)
+	if err != nil {
+		return rt, wt, err
+	}
+	for _, chunk := range chunks {
+		fi, err := os.Stat(chunk.path)
+		if err != nil {
+			continue
+		}
+		if t := atime.Get(fi); t.After(rt) {
+			rt = t
+		}
+		if t := fi.ModTime(); t.After(wt) {
+			wt = t
+		}
+	}
+	return rt, wt, nil
+}
+
+func (fs *chunkedFs) Size(name string) (size int64, err error) {
+	chunks, _, err := fs.layout(name)
+	if err != nil {
+		return 0, err
+	}
+	return contiguous(chunks), nil
+}
+
+// chunkedFile is a File backed by a directory of chunk files. A File returned
+// by Create is only used for writing, and one returned by Open for reading.
+type chunkedFile struct {
+	fs   *chunkedFs
+	name string
+	mu   sync.Mutex
+
+	// writing
+	w     *os.File
+	w_off int64    // offset of the first byte of w
+	w_n   int64    // bytes written to w
+	cdc   *chunker // nil unless the fs dedups, see NewDedupFs
+	cut   bool     // the chunk in w ended at a content-defined boundary
+
+	// reading
+	chunks []*openChunk // sorted by offset
+	rd_off int64
+}
+
+type openChunk struct {
+	off  int64
+	path string
+	f    *os.File // opened lazily
+}
+
+func (f *chunkedFile) Name() string {
+	return f.name
+}
+
+func (f *chunkedFile) nextChunk() error {
+	if f.w != nil {
+		if err := f.closeChunk(); err != nil {
+			return err
+		}
+		f.w_off += f.w_n
+	}
+	w, err := os.OpenFile(chunkName(f.name, f.w_off),
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.fs.mode&0666)
+	if err != nil {
+		return err
+	}
+	f.w, f.w_n = w, 0
+	return nil
+}
+
+func (f *chunkedFile) Write(p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.w == nil {
+		return 0, os.ErrInvalid
+	}
+	for len(p) > 0 {
+		if f.cut || f.cdc == nil && f.w_n == f.fs.chunk_size {
+			if err = f.nextChunk(); err != nil {
+				return n, err
+			}
+			f.cut = false
+		}
+		var m int64
+		if f.cdc != nil {
+			m, f.cut = f.cdc.next(p, f.w_n)
+		} else {
+			m = int64(len(p))
+			if room := f.fs.chunk_size - f.w_n; m > room {
+				m = room
+			}
+		}
+		wrote, err := f.w.Write(p[:m])
+		n += wrote
+		f.w_n += int64(wrote)
+		if f.cdc != nil {
+			f.cdc.hash.Write(p[:wrote])
+		}
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// closeChunk closes the chunk being written, moving it to the store of a
+// dedup fs.
+func (f *chunkedFile) closeChunk() error {
+	err := f.w.Close()
+	f.w = nil
+	if err != nil || f.cdc == nil || f.w_n == 0 {
+		return err
+	}
+	hash := hex.EncodeToString(f.cdc.hash.Sum(nil))
+	f.cdc.reset()
+	return f.fs.store.link(chunkName(f.name, f.w_off), f.name, f.w_off, hash)
+}
+
+// relist refreshes the known chunks, keeping already open handles.
+func (f *chunkedFile) relist() error {
+	layout, _, err := f.fs.layout(f.name)
+	if err != nil {
+		return err
+	}
+	open := make(map[string]*openChunk, len(f.chunks))
+	for _, c := range f.chunks {
+		open[c.path] = c
+	}
+	f.chunks = f.chunks[:0]
+	for _, c := range layout {
+		if oc, ok := open[c.path]; ok {
+			f.chunks = append(f.chunks, oc)
+			delete(open, c.path)
+		} else {
+			f.chunks = append(f.chunks, &openChunk{off: c.off, path: c.path})
+		}
+	}
+	for _, oc := range open {
+		if oc.f != nil {
+			oc.f.Close()
+		}
+	}
+	return nil
+}
+
+// find returns the last known chunk starting at or before off.
+func (f *chunkedFile) find(off int64) *openChunk {
+	i := sort.Search(len(f.chunks), func(i int) bool {
+		return f.chunks[i].off > off
+	})
+	if i == 0 {
+		return nil
+	}
+	return f.chunks[i-1]
+}
+
+func (f *chunkedFile) ReadAt(p []byte, off int64) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for n < len(p) {
+		c := f.find(off)
+		if c == nil {
+			if err := f.relist(); err != nil {
+				return n, err
+			}
+			if c = f.find(off); c == nil {
+				return n, io.EOF
+			}
+		}
+		if c.f == nil {
+			c.f, err = os.Open(c.path)
+			if os.IsNotExist(err) {
+				// merged away by Compact, or moved to the store.
+				if err := f.relist(); err != nil {
+					return n, err
+				}
+				continue
+			}
+			if err != nil {
+				return n, err
+			}
+		}
+
+		m, err := c.f.ReadAt(p[n:], off-c.off)
+		n += m
+		off += int64(m)
+		switch {
+		case err == io.EOF && m == 0:
+			// the end of this chunk, check for a chunk starting after it.
+			if err := f.relist(); err != nil {
+				return n, err
+			}
+			if next := f.find(off); next == nil || next.off == c.off {
+				return n, io.EOF
+			}
+		case err != nil && err != io.EOF:
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (f *chunkedFile) Read(p []byte) (n int, err error) {
+	n, err = f.ReadAt(p, f.rd_off)
+	f.rd_off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *chunkedFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var err error
+	if f.w != nil {
+		err = f.closeChunk()
+	}
+	for _, c := range f.chunks {
+		if c.f == nil {
+			continue
+		}
+		if cerr := c.f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	f.chunks = nil
+	return err
+}
@@ -0,0 +1,165 @@
+package fscache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunkedFs(t *testing.T) {
+	test := Wrap(t, "chunkfs")
+	defer test.Close()
+	fs, err := NewChunkedFs(test.Dir(), 0700, 4)
+	test.AssertNoError(err)
+	cache, err := NewCache(test.Dir(), fs, 0)
+	test.AssertNoError(err)
+
+	to_write := []byte("hello world")
+	r, w, err := cache.Get("stream", int64(len(to_write)))
+	test.AssertNoError(err)
+	_, err = w.Write(to_write[:3])
+	test.AssertNoError(err)
+	_, err = w.Write(to_write[3:])
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual(to_write, p)
+	q := make([]byte, 6)
+	_, err = r.ReadAt(q, 2)
+	test.AssertNoError(err)
+	test.AssertByteEqual(to_write[2:8], q)
+	test.AssertNoError(r.Close())
+
+	chunks, err := ioutil.ReadDir(filepath.Join(test.Dir(), fileName("stream")))
+	test.AssertNoError(err)
+	test.Assert(len(chunks) == 3, "expected 3 chunks")
+	size, err := cache.Size("stream")
+	test.AssertNoError(err)
+	test.Assert(size == int64(len(to_write)), "unexpected size")
+
+	cache, err = NewCache(test.Dir(), fs, 0)
+	test.AssertNoError(err)
+	r, w, err = cache.Get("stream", int64(len(to_write)))
+	test.AssertNoError(err)
+	test.Assert(w == nil, "expected chunked entry to be reloaded")
+	p, err = ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual(to_write, p)
+	test.AssertNoError(r.Close())
+
+	test.AssertNoError(cache.Remove("stream"))
+	files, err := ioutil.ReadDir(test.Dir())
+	test.AssertNoError(err)
+	test.Assert(len(files) == 0, "expected empty directory")
+}
+
+func TestCompact(t *testing.T) {
+	test := Wrap(t, "chunkfs")
+	defer test.Close()
+	fs, err := NewChunkedFs(test.Dir(), 0700, 4)
+	test.AssertNoError(err)
+	cache, err := NewCache(test.Dir(), fs, 0)
+	test.AssertNoError(err)
+
+	to_write := []byte("hello world")
+	w, err := cache.GetWriterOnly("stream", int64(len(to_write)))
+	test.AssertNoError(err)
+	_, err = w.Write(to_write)
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+
+	entry := filepath.Join(test.Dir(), fileName("stream"))
+	test.AssertNoError(ioutil.WriteFile(filepath.Join(entry, "junk"),
+		[]byte("junk"), 0600))
+	test.AssertNoError(ioutil.WriteFile(chunkName(entry, 100), []byte("zzz"),
+		0600))
+
+	// entries are compacted to the new chunk size.
+	fs, err = NewChunkedFs(test.Dir(), 0700, 16)
+	test.AssertNoError(err)
+	cache, err = NewCache(test.Dir(), fs, 0)
+	test.AssertNoError(err)
+
+	r, _, err := cache.Get("stream", int64(len(to_write)))
+	test.AssertNoError(err)
+	stats, err := cache.Compact()
+	test.AssertNoError(err)
+	test.Assert(stats.Entries == 0, "open entries should not be compacted")
+	test.AssertNoError(r.Close())
+
+	stats, err = cache.Compact()
+	test.AssertNoError(err)
+	test.Assert(stats == CompactStats{Entries: 1, Merged: 2, Removed: 2,
+		Reclaimed: 7}, fmt.Sprintf("unexpected stats %+v", stats))
+	chunks, err := ioutil.ReadDir(entry)
+	test.AssertNoError(err)
+	test.Assert(len(chunks) == 1, "expected chunks to be merged")
+
+	r, _, err = cache.Get("stream", int64(len(to_write)))
+	test.AssertNoError(err)
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual(to_write, p)
+	test.AssertNoError(r.Close())
+
+	mem, err := NewCache(test.Dir(), NewMemFs(), 0)
+	test.AssertNoError(err)
+	_, err = mem.Compact()
+	test.Assert(err == ErrCompactNotSupported, "expected ErrCompactNotSupported")
+}
+
+func TestDedupFs(t *testing.T) {
+	test := Wrap(t, "chunkfs")
+	defer test.Close()
+	fs, err := NewDedupFs(test.Dir(), 0700, 64)
+	test.AssertNoError(err)
+	cache, err := NewCache(test.Dir(), fs, 0)
+	test.AssertNoError(err)
+
+	shared := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(shared)
+	entries := map[string][]byte{
+		"a": shared,
+		// the same content shifted, boundaries resynchronize.
+		"b": append([]byte("prefix"), shared...),
+	}
+	for name, data := range entries {
+		w, err := cache.GetWriterOnly(name, int64(len(data)))
+		test.AssertNoError(err)
+		_, err = w.Write(data)
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+	}
+	store := filepath.Join(test.Dir(), storeDir)
+	stored, err := ioutil.ReadDir(store)
+	test.AssertNoError(err)
+	chunks, err := ioutil.ReadDir(filepath.Join(test.Dir(), fileName("b")))
+	test.AssertNoError(err)
+	test.Assert(len(stored) < len(chunks)+len(chunks)/4, fmt.Sprintf(
+		"expected shared chunks, %d stored for %d", len(stored),
+		len(chunks)))
+
+	// reloaded, then the chunks of a removed entry still used by another
+	// are kept.
+	fs, err = NewDedupFs(test.Dir(), 0700, 64)
+	test.AssertNoError(err)
+	cache, err = NewCache(test.Dir(), fs, 0)
+	test.AssertNoError(err)
+	test.Assert(!cache.Exists(storeDir), "expected the store not to load")
+	test.AssertNoError(cache.Remove("a"))
+	r, _, err := cache.Get("b", int64(len(entries["b"])))
+	test.AssertNoError(err)
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual(entries["b"], p)
+	test.AssertNoError(r.Close())
+
+	test.AssertNoError(cache.Remove("b"))
+	stored, err = ioutil.ReadDir(store)
+	test.AssertNoError(err)
+	test.Assert(len(stored) == 0, "expected unused chunks to be deleted")
+}
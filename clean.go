@@ -0,0 +1,82 @@
+package fscache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// renameDir moves a directory, tests replace it to fail.
+var renameDir = os.Rename
+
+// removeAside deletes dir in the background after moving it out of the way
+// next to the directory of the cache, so that the entries in it are gone
+// right away however many files it holds. If it can't be moved, e.g. because
+// the parent of the cache isn't writable or the cache is a mount point, it's
+// deleted in place.
+func (c *FsCache) removeAside(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	aside, err := ioutil.TempDir(filepath.Dir(c.root), c.asidePattern())
+	if err == nil {
+		err = renameDir(dir, filepath.Join(aside, "data"))
+		if err != nil {
+			os.Remove(aside)
+		}
+	}
+	if err != nil {
+		logger.Warnf("deleting %s in place: %s", dir, err)
+		return c.removeInPlace(dir)
+	}
+	c.deleteInBackground(aside)
+	return nil
+}
+
+// removeInPlace deletes dir, but only the contents of the directory of the
+// cache, which may not be removable itself.
+func (c *FsCache) removeInPlace(dir string) error {
+	if filepath.Clean(dir) != filepath.Clean(c.root) {
+		return os.RemoveAll(dir)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if err := os.RemoveAll(filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// asidePattern matches the names of the directories moved aside by
+// removeAside.
+func (c *FsCache) asidePattern() string {
+	return "." + filepath.Base(c.root) + ".deleting-*"
+}
+
+func (c *FsCache) deleteInBackground(dir string) {
+	c.deleting.Add(1)
+	go func() {
+		defer c.deleting.Done()
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Errorf("deleting %s: %s", dir, err)
+		}
+	}()
+}
+
+// removeLeftovers deletes the directories which were moved aside but not
+// deleted before the process exited.
+func (c *FsCache) removeLeftovers() {
+	dirs, err := filepath.Glob(filepath.Join(filepath.Dir(c.root),
+		c.asidePattern()))
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	for _, dir := range dirs {
+		c.deleteInBackground(dir)
+	}
+}
@@ -0,0 +1,81 @@
+package fscache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanInBackground(t *testing.T) {
+	test := Wrap(t, "clean")
+	defer test.Close()
+	root := filepath.Join(test.Dir(), "cache")
+	leftover := filepath.Join(test.Dir(), ".cache.deleting-1")
+	test.AssertNoError(os.MkdirAll(filepath.Join(leftover, "data"), 0700))
+	cache, err := New(root, 0700, 0)
+	test.AssertNoError(err)
+	fill := func(name string) {
+		r, w, err := cache.Get(name, UnknownSize)
+		test.AssertNoError(err)
+		test.Assert(w != nil, "expected a miss")
+		_, err = w.Write([]byte(name))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+		test.AssertNoError(r.Close())
+	}
+	fill("a")
+	fill("b")
+
+	test.AssertNoError(cache.Clean())
+	_, err = os.Stat(root)
+	test.Assert(os.IsNotExist(err), "expected the folder to be moved aside")
+	test.Assert(!cache.Exists("a"), "expected the cache to be empty")
+	fill("a")
+	r, ok, err := cache.GetIfExists("a")
+	test.AssertNoError(err)
+	test.Assert(ok, "expected the cache to be usable")
+	test.AssertNoError(r.Close())
+
+	test.AssertNoError(cache.Close())
+	files, err := ioutil.ReadDir(test.Dir())
+	test.AssertNoError(err)
+	test.Assert(len(files) == 1 && files[0].Name() == "cache",
+		"expected the folders moved aside to be deleted")
+}
+
+func TestCleanInPlace(t *testing.T) {
+	test := Wrap(t, "clean")
+	defer test.Close()
+	defer func(rename func(string, string) error) { renameDir = rename }(
+		renameDir)
+	renameDir = func(string, string) error {
+		return &os.LinkError{Op: "rename", Err: os.ErrPermission}
+	}
+	root := filepath.Join(test.Dir(), "cache")
+	cache, err := New(root, 0700, 0,
+		WithKeyEncoding(HierarchicalKeys(0)))
+	test.AssertNoError(err)
+	for _, name := range []string{"a", "b/c", "d/e"} {
+		r, w, err := cache.Get(name, UnknownSize)
+		test.AssertNoError(err)
+		_, err = w.Write([]byte(name))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+		test.AssertNoError(r.Close())
+	}
+
+	test.AssertNoError(cache.RemovePrefix("b"))
+	_, err = os.Stat(filepath.Join(root, "b"))
+	test.Assert(os.IsNotExist(err), "expected b to be deleted in place")
+	test.Assert(cache.Exists("d/e"), "expected d/e to be kept")
+
+	test.AssertNoError(cache.Clean())
+	files, err := ioutil.ReadDir(root)
+	test.AssertNoError(err)
+	test.Assert(len(files) == 0, "expected the folder to be emptied")
+	test.Assert(!cache.Exists("a"), "expected the cache to be empty")
+	files, err = ioutil.ReadDir(test.Dir())
+	test.AssertNoError(err)
+	test.Assert(len(files) == 1, "expected nothing to be moved aside")
+}
@@ -0,0 +1,25 @@
+package fscache
+
+import "time"
+
+// Clock tells the time. It can be replaced with WithClock and
+// NewMemFsWithClock to test expiry policies.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a func to a Clock.
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time { return f() }
+
+var systemClock Clock = ClockFunc(time.Now)
+
+// WithClock makes the cache use clock instead of the system time, e.g. to
+// decide which entries have expired. The clock of a memory FileSystem is set
+// with NewMemFsWithClock.
+func WithClock(clock Clock) Option {
+	return func(c *FsCache) {
+		c.clock = clock
+	}
+}
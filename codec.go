@@ -0,0 +1,181 @@
+package fscache
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+)
+
+// Codec transforms the bytes of every entry on their way to and from the
+// FileSystem, e.g. to compress or encrypt them. Codecs are configured with
+// WithCodec.
+type Codec interface {
+	// Encode returns a writer which encodes into w. Closing it must flush
+	// the encoded bytes but not close w.
+	Encode(w io.Writer) io.WriteCloser
+
+	// Decode returns a reader which decodes r. It must not read from r
+	// before its first Read, as r blocks while the entry is being written.
+	Decode(r io.Reader) io.ReadCloser
+}
+
+// CodecReaderAt is implemented by Codecs which can decode at an offset, e.g.
+// block based ones. ReadAt on an entry whose codecs don't all implement it
+// decodes the entry from the start up to the requested offset.
+type CodecReaderAt interface {
+	DecodeAt(r io.ReaderAt) io.ReaderAt
+}
+
+// WithCodec encodes entries with codecs, the first codec sees the written
+// bytes first. Sizes, including the sizes given to Get and checked against
+// the entries on disk, refer to the encoded bytes, so Get doesn't replace
+// entries of a different size when codecs are configured.
+func WithCodec(codecs ...Codec) Option {
+	return func(c *FsCache) {
+		c.codecs = append(c.codecs, codecs...)
+	}
+}
+
+// encodeWriter returns w wrapped with the encoders of the cache.
+func (c *FsCache) encodeWriter(w io.WriteCloser) io.WriteCloser {
+	if len(c.codecs) == 0 {
+		return w
+	}
+	mw := &middlewareWriter{w: w, Writer: w}
+	for i := len(c.codecs) - 1; i >= 0; i-- {
+		enc := c.codecs[i].Encode(mw.Writer)
+		mw.closers = append([]io.Closer{enc}, mw.closers...)
+		mw.Writer = enc
+	}
+	return mw
+}
+
+// codecReader decodes a Reader of encoded bytes.
+type codecReader struct {
+	*Reader
+	codecs  []Codec
+	r       io.Reader
+	closers []io.Closer // outermost first
+	at      io.ReaderAt // nil unless all codecs implement CodecReaderAt
+}
+
+func newCodecReader(r *Reader, codecs []Codec) *codecReader {
+	cr := &codecReader{Reader: r, codecs: codecs}
+	cr.r, cr.closers = cr.decode(r)
+
+	var at io.ReaderAt = r
+	for i := len(codecs) - 1; i >= 0 && at != nil; i-- {
+		if dec, ok := codecs[i].(CodecReaderAt); ok {
+			at = dec.DecodeAt(at)
+		} else {
+			at = nil
+		}
+	}
+	cr.at = at
+	return cr
+}
+
+func (cr *codecReader) decode(r io.Reader) (io.Reader, []io.Closer) {
+	var closers []io.Closer
+	for i := len(cr.codecs) - 1; i >= 0; i-- {
+		dec := cr.codecs[i].Decode(r)
+		closers = append([]io.Closer{dec}, closers...)
+		r = dec
+	}
+	return r, closers
+}
+
+func (cr *codecReader) Read(p []byte) (int, error) {
+	return cr.r.Read(p)
+}
+
+// ReadAt reads decoded bytes. Unless all codecs implement CodecReaderAt, it
+// decodes the entry from the start.
+func (cr *codecReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if cr.at != nil {
+		return cr.at.ReadAt(p, off)
+	}
+	r, closers := cr.decode(io.NewSectionReader(cr.Reader, 0, math.MaxInt64))
+	defer closeAll(closers[:len(closers)-1], closers[len(closers)-1])
+	if _, err := io.CopyN(ioutil.Discard, r, off); err != nil {
+		return 0, err
+	}
+	n, err = io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// ReadRanges is like Reader.ReadRanges for the decoded bytes.
+func (cr *codecReader) ReadRanges(ranges []Range) ([][]byte, error) {
+	return readRanges(cr, ranges)
+}
+
+// Section is like Reader.Section for the decoded bytes.
+func (cr *codecReader) Section(off, n int64) *io.SectionReader {
+	return newSection(cr, cr.stream, off, n)
+}
+
+// ContentLength returns the size the entry was requested with, as the size
+// of the decoded bytes isn't known.
+func (cr *codecReader) ContentLength() int64 {
+	if cr.stream == nil {
+		return -1
+	}
+	return cr.stream.expected
+}
+
+func (cr *codecReader) Close() error {
+	return closeAll(cr.closers, cr.Reader)
+}
+
+type gzipCodec struct {
+	level int
+}
+
+// GzipCodec returns a Codec which compresses entries with gzip at level, see
+// compress/gzip.
+func GzipCodec(level int) Codec {
+	return gzipCodec{level: level}
+}
+
+func (c gzipCodec) Encode(w io.Writer) io.WriteCloser {
+	zw, err := gzip.NewWriterLevel(w, c.level)
+	if err != nil {
+		zw = gzip.NewWriter(w)
+	}
+	return zw
+}
+
+func (c gzipCodec) Decode(r io.Reader) io.ReadCloser {
+	return &gzipReader{r: r}
+}
+
+// gzipReader creates its gzip.Reader on the first Read, since that reads the
+// gzip header.
+type gzipReader struct {
+	once sync.Once
+	r    io.Reader
+	zr   *gzip.Reader
+	err  error
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	r.once.Do(func() {
+		r.zr, r.err = gzip.NewReader(r.r)
+	})
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.zr.Read(p)
+}
+
+func (r *gzipReader) Close() error {
+	if r.zr == nil {
+		return nil
+	}
+	return r.zr.Close()
+}
@@ -0,0 +1,88 @@
+package fscache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// xorCodec is a codec which supports random access.
+type xorCodec byte
+
+func (c xorCodec) Encode(w io.Writer) io.WriteCloser {
+	return nopWriteCloser{&funcWriter{func(p []byte) (int, error) {
+		return w.Write(c.xor(p))
+	}}}
+}
+
+func (c xorCodec) Decode(r io.Reader) io.ReadCloser {
+	return ioutil.NopCloser(&funcReader{func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		copy(p, c.xor(p[:n]))
+		return n, err
+	}})
+}
+
+func (c xorCodec) DecodeAt(r io.ReaderAt) io.ReaderAt {
+	return readerAtFunc(func(p []byte, off int64) (int, error) {
+		n, err := r.ReadAt(p, off)
+		copy(p, c.xor(p[:n]))
+		return n, err
+	})
+}
+
+func (c xorCodec) xor(p []byte) []byte {
+	q := make([]byte, len(p))
+	for i := range p {
+		q[i] = p[i] ^ byte(c)
+	}
+	return q
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+type readerAtFunc func(p []byte, off int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, off int64) (int, error) { return f(p, off) }
+
+func TestCodec(t *testing.T) {
+	test := Wrap(t, "codec")
+	defer test.Close()
+	to_write := bytes.Repeat([]byte("hello world "), 100)
+
+	for _, codecs := range [][]Codec{
+		{GzipCodec(gzip.BestCompression)},
+		{xorCodec(0x55)},
+		{xorCodec(0x55), GzipCodec(gzip.DefaultCompression)},
+	} {
+		cache, err := New(test.Dir(), 0700, 0, WithCodec(codecs...))
+		test.AssertNoError(err)
+		test.AssertNoError(cache.Remove("stream"))
+
+		r, w, err := cache.Get("stream", int64(len(to_write)))
+		test.AssertNoError(err)
+		_, err = w.Write(to_write)
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+
+		p, err := ioutil.ReadAll(r)
+		test.AssertNoError(err)
+		test.AssertByteEqual(to_write, p)
+		q := make([]byte, 5)
+		_, err = r.ReadAt(q, 606)
+		test.AssertNoError(err)
+		test.AssertByteEqual([]byte("world"), q)
+		test.AssertNoError(r.Close())
+
+		size, err := cache.Size("stream")
+		test.AssertNoError(err)
+		raw, err := ioutil.ReadFile(cache.getPath(fileName("stream")))
+		test.AssertNoError(err)
+		test.Assert(size == int64(len(raw)) && !bytes.Equal(raw, to_write),
+			"expected encoded bytes on disk")
+	}
+}
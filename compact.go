@@ -0,0 +1,184 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrCompactNotSupported is returned by Compact if the FileSystem of the
+// cache doesn't implement Compacter.
+var ErrCompactNotSupported = errors.New("file system does not support compaction")
+
+// CompactStats summarizes the work done by a compaction.
+type CompactStats struct {
+	Entries   int   // entries which were compacted
+	Merged    int   // chunks which were merged into their predecessors
+	Removed   int   // stray files and unreachable chunks which were deleted
+	Reclaimed int64 // bytes freed
+}
+
+func (s *CompactStats) add(o CompactStats) {
+	s.Entries += o.Entries
+	s.Merged += o.Merged
+	s.Removed += o.Removed
+	s.Reclaimed += o.Reclaimed
+}
+
+// Compacter is implemented by FileSystems which can reorganize the storage of
+// a File. Compact is never called on a File which is open.
+type Compacter interface {
+	Compact(name string) (CompactStats, error)
+}
+
+// Compact compacts every entry which isn't currently being read or written.
+// Readers opened while an entry is compacted block until it's done.
+func (c *FsCache) Compact() (stats CompactStats, err error) {
+	compacter, ok := c.fs.(Compacter)
+	if !ok {
+		return stats, ErrCompactNotSupported
+	}
+	c.mu.RLock()
+	if c.snapshots > 0 {
+		c.mu.RUnlock()
+		return stats, ErrSnapshotInProgress
+	}
+	streams := c.streams.list()
+	c.mu.RUnlock()
+
+	for _, s := range streams {
+		var entry CompactStats
+		ran, cerr := s.exclusive(func() (err error) {
+			entry, err = compacter.Compact(s.Name())
+			return err
+		})
+		if cerr != nil {
+			logger.Errorf("compacting %s: %s", s.Name(), cerr)
+			if err == nil {
+				err = cerr
+			}
+		}
+		if ran {
+			stats.add(entry)
+		}
+	}
+	return stats, err
+}
+
+// CompactEvery runs Compact every interval until ctx is done.
+func (c *FsCache) CompactEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	done := ctx.Done()
+	for {
+		select {
+		case <-ticker.C:
+			stats, err := c.Compact()
+			if err != nil {
+				logger.Error(err)
+			}
+			logger.Debugf("compacted %d entries, reclaimed %d bytes",
+				stats.Entries, stats.Reclaimed)
+		case <-done:
+			return
+		}
+	}
+}
+
+// Compact removes stray files and chunks which are unreachable because of a
+// hole left by an aborted write, and merges runs of undersized chunks (e.g.
+// written with a smaller chunk size) into chunks of up to the chunk size.
+//
+// Merged chunks are written under the name of the first chunk of the run
+// before the rest are deleted, so an interrupted compaction leaves chunks
+// which overlap with identical bytes and the File stays readable.
+func (fs *chunkedFs) Compact(name string) (stats CompactStats, err error) {
+	if fs.store != nil {
+		// chunks are shared, and merging them would defeat deduplication.
+		return stats, ErrCompactNotSupported
+	}
+	chunks, stray, err := fs.layout(name)
+	if err != nil {
+		return stats, err
+	}
+	for _, path := range stray {
+		if fi, err := os.Stat(path); err == nil {
+			stats.Reclaimed += fi.Size()
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return stats, err
+		}
+		stats.Removed++
+	}
+
+	// drop chunks which are unreachable or entirely covered by another.
+	var end int64
+	keep := chunks[:0]
+	for i, c := range chunks {
+		if c.off > end || c.off+c.size <= end && i > 0 {
+			if err := os.Remove(c.path); err != nil {
+				return stats, err
+			}
+			stats.Removed++
+			stats.Reclaimed += c.size
+			continue
+		}
+		keep = append(keep, c)
+		end = c.off + c.size
+	}
+	chunks = keep
+
+	for i := 0; i < len(chunks); {
+		j, run_end := i+1, chunks[i].off+chunks[i].size
+		for ; j < len(chunks); j++ {
+			next_end := chunks[j].off + chunks[j].size
+			if next_end-chunks[i].off > fs.chunk_size {
+				break
+			}
+			run_end = next_end
+		}
+		if j-i > 1 {
+			if err := fs.merge(name, chunks[i:j], run_end); err != nil {
+				return stats, err
+			}
+			stats.Merged += j - i - 1
+		}
+		i = j
+	}
+	if stats.Merged > 0 || stats.Removed > 0 {
+		stats.Entries = 1
+	}
+	return stats, nil
+}
+
+// merge rewrites the bytes of run up to end into its first chunk.
+func (fs *chunkedFs) merge(name string, run []chunkInfo, end int64) error {
+	src := &chunkedFile{fs: fs, name: name}
+	defer src.Close()
+	tmp := run[0].path + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		fs.mode&0666)
+	if err != nil {
+		return err
+	}
+	_, err = copyFile(dst, io.NewSectionReader(src, run[0].off,
+		end-run[0].off))
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, run[0].path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	for _, c := range run[1:] {
+		if err := os.Remove(c.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package fscache
+
+import (
+	"sort"
+	"time"
+)
+
+// Config holds the settings of an FsCache which can be changed while it's
+// running, see Reconfigure.
+type Config struct {
+	// Expiry is the duration after which an un-accessed key is removed from
+	// the cache, zero means never expire.
+	Expiry time.Duration
+
+	// MaxSize is the number of bytes the cache may hold before the least
+	// recently accessed entries are evicted, lowest priority first. Zero means
+	// unlimited.
+	MaxSize int64
+
+	// MaxWriters limits the number of concurrently open writers of the cache,
+	// zero means unlimited. Limiters added WithLimiter are not affected.
+	MaxWriters int
+
+	// MaxReaders limits the number of Readers open at once on each entry,
+	// zero means unlimited.
+	MaxReaders int
+
+	// WriteRate limits the fills of the cache to that many bytes per second
+	// in total, zero means unlimited. Throttles added WithThrottle are not
+	// affected.
+	WriteRate int64
+
+	// DryRun makes expiry and MaxSize only report the entries they would
+	// evict, see WithEvictionDryRun.
+	DryRun bool
+}
+
+// WithMaxSize limits the total size of the cache to n bytes, see
+// Config.MaxSize.
+func WithMaxSize(n int64) Option {
+	return func(c *FsCache) {
+		c.max_size = n
+	}
+}
+
+// WithSegmentedLRU makes the WithMaxSize evictor a segmented LRU: entries
+// start in a probation segment and are promoted to a protected one once
+// they're hit, i.e. requested again after being filled. Probation entries
+// are evicted first, so a large one-pass scan only displaces other entries
+// on probation. The protected segment holds at most the protected share of
+// MaxSize, e.g. 0.8, its least recently accessed entries beyond that are
+// demoted back to probation. Priorities still take precedence.
+func WithSegmentedLRU(protected float64) Option {
+	return func(c *FsCache) {
+		c.protected = protected
+	}
+}
+
+// Config returns the current settings of the cache.
+func (c *FsCache) Config() Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cfg := Config{
+		Expiry:     c.expiry,
+		MaxSize:    c.max_size,
+		MaxReaders: c.max_readers,
+		DryRun:     c.dry_run,
+	}
+	if c.max_writers != nil {
+		cfg.MaxWriters = c.max_writers.Limit()
+	}
+	if c.write_rate != nil {
+		cfg.WriteRate = c.write_rate.Rate()
+	}
+	return cfg
+}
+
+// Reconfigure changes the settings of a live cache without losing any of its
+// entries. Entries over a lowered MaxSize are evicted immediately.
+func (c *FsCache) Reconfigure(cfg Config) {
+	c.mu.Lock()
+	if cfg.Expiry != c.expiry {
+		c.expiry = cfg.Expiry
+		c.startReaper()
+	}
+	c.max_size = cfg.MaxSize
+	c.max_readers = cfg.MaxReaders
+	c.dry_run = cfg.DryRun
+	if c.max_writers != nil {
+		c.max_writers.SetLimit(cfg.MaxWriters)
+	} else if cfg.MaxWriters > 0 {
+		c.max_writers = NewLimiter(cfg.MaxWriters)
+		// copy so that in-flight writers release the limiters they took.
+		c.limiters = append(append([]*Limiter(nil), c.limiters...),
+			c.max_writers)
+	}
+	if c.write_rate != nil {
+		c.write_rate.SetRate(cfg.WriteRate)
+	} else if cfg.WriteRate > 0 {
+		c.write_rate = NewThrottle(cfg.WriteRate)
+		// copy so that open writers keep the throttles they took.
+		c.throttles = append(append([]*Throttle(nil), c.throttles...),
+			c.write_rate)
+	}
+	c.mu.Unlock()
+	c.enforceMaxSize()
+}
+
+// enforceMaxSize evicts entries which aren't open until the cache fits in
+// MaxSize again. The entries are only listed once their running total
+// exceeds it.
+func (c *FsCache) enforceMaxSize() {
+	c.mu.Lock()
+	defer c.unlock()
+	if c.max_size <= 0 || c.paused > 0 || c.streams.size() <= c.max_size {
+		return
+	}
+
+	type candidate struct {
+		key      string
+		size     int64
+		priority Priority
+		accessed time.Time
+		protect  bool // in the protected segment, see WithSegmentedLRU
+	}
+	var total int64
+	var candidates []candidate
+	c.streams.each(func(key string, s *Stream) bool {
+		size, err := s.Size()
+		if err != nil {
+			return true
+		}
+		total += size
+		if s.IsOpen() {
+			return true
+		}
+		accessed, _, err := c.fs.AccessTimes(s.Name())
+		if err != nil {
+			logger.Error(err)
+			return true
+		}
+		candidates = append(candidates, candidate{
+			key:      key,
+			size:     size,
+			priority: s.priority(),
+			accessed: accessed,
+			protect:  c.protected > 0 && s.hits() > 0,
+		})
+		return true
+	})
+	if total <= c.max_size {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].accessed.After(candidates[j].accessed)
+	})
+	// demote the protected entries which don't fit in their segment.
+	capacity := int64(c.protected * float64(c.max_size))
+	for i := range candidates {
+		if candidates[i].protect {
+			capacity -= candidates[i].size
+			candidates[i].protect = capacity >= 0
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].priority != candidates[j].priority {
+			return candidates[i].priority < candidates[j].priority
+		}
+		if candidates[i].protect != candidates[j].protect {
+			return !candidates[i].protect
+		}
+		return candidates[i].accessed.Before(candidates[j].accessed)
+	})
+	for _, cand := range candidates {
+		if total <= c.max_size {
+			break
+		}
+		if err := c.evict(cand.key, EvictionSize); err != nil {
+			logger.Error(err)
+			continue
+		}
+		total -= cand.size
+	}
+}
@@ -0,0 +1,163 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestMaxSize(t *testing.T) {
+	test := Wrap(t, "config")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0, WithMaxSize(10))
+	test.AssertNoError(err)
+
+	low := WithPriority(context.Background(), PriorityLow)
+	for _, name := range []string{"b", "a", "c"} {
+		ctx := context.Background()
+		if name == "a" {
+			ctx = low
+		}
+		r, w, err := cache.GetContext(ctx, name, 5)
+		test.AssertNoError(err)
+		test.AssertNoError(r.Close())
+		_, err = w.Write([]byte("hello"))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+	}
+	test.Assert(!cache.Exists("a"), "expected low priority entry to be evicted")
+	test.Assert(cache.Exists("b") && cache.Exists("c"), "expected b and c to fit")
+	test.Assert(cache.streams.size() == 10, "expected a running total of 10")
+
+	cache.Reconfigure(Config{MaxSize: 5})
+	test.Assert(cache.Exists("b") != cache.Exists("c"),
+		"expected one entry to be evicted")
+	test.Assert(cache.Config() == Config{MaxSize: 5}, "unexpected config")
+	test.Assert(cache.streams.size() == 5, "expected a running total of 5")
+	test.AssertNoError(cache.Remove("b"))
+	test.AssertNoError(cache.Remove("c"))
+	test.Assert(cache.streams.size() == 0, "expected a running total of 0")
+}
+
+func TestReconfigure(t *testing.T) {
+	test := Wrap(t, "config")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0)
+	test.AssertNoError(err)
+
+	cache.Reconfigure(Config{MaxWriters: 1})
+	w, err := cache.GetWriterOnly("a", 5)
+	test.AssertNoError(err)
+	_, err = cache.GetWriterOnly("b", 5)
+	test.Assert(errors.Is(err, ErrTooManyWriters), "expected ErrTooManyWriters")
+	cache.Reconfigure(Config{})
+	w2, err := cache.GetWriterOnly("b", 5)
+	test.AssertNoError(err)
+	for _, w := range []io.WriteCloser{w2, w} {
+		_, err = w.Write([]byte("hello"))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+	}
+
+	cache.Reconfigure(Config{Expiry: 10 * time.Millisecond})
+	for i := 0; i < 100 && cache.Exists("a"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Assert(!cache.Exists("a"), "expected the reaper to be started")
+	test.AssertNoError(cache.Shutdown(context.Background()))
+}
+
+func TestEvictionDryRun(t *testing.T) {
+	test := Wrap(t, "config")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0, WithMaxSize(5),
+		WithEvictionDryRun())
+	test.AssertNoError(err)
+	events, cancel := cache.Subscribe()
+	defer cancel()
+
+	for _, name := range []string{"a", "b"} {
+		r, w, err := cache.Get(name, 5)
+		test.AssertNoError(err)
+		test.AssertNoError(r.Close())
+		_, err = w.Write([]byte("hello"))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+	}
+	ev := <-events
+	test.Assert(ev.DryRun && ev.Reason == EvictionSize,
+		"expected a dry run size eviction")
+	test.Assert(cache.Exists("a") && cache.Exists("b"),
+		"expected nothing to be evicted")
+
+	cache.Reconfigure(Config{MaxSize: 5})
+	test.Assert(cache.Exists("a") != cache.Exists("b"),
+		"expected one entry to be evicted")
+	ev = <-events
+	test.Assert(!ev.DryRun, "expected a real eviction")
+}
+
+func TestSegmentedLRU(t *testing.T) {
+	test := Wrap(t, "config")
+	defer test.Close()
+	clock := &testClock{}
+	cache, err := NewCache(test.Dir(), NewMemFsWithClock(clock), 0,
+		WithClock(clock), WithMaxSize(15), WithSegmentedLRU(0.8))
+	test.AssertNoError(err)
+
+	sec := 0
+	tick := func() {
+		sec++
+		clock.Set(time.Date(2016, time.September, 1, 0, 0, sec, 0, time.UTC))
+	}
+	get := func(name string) {
+		tick()
+		r, w, err := cache.Get(name, 5)
+		test.AssertNoError(err)
+		if w != nil {
+			_, err = w.Write([]byte("hello"))
+			test.AssertNoError(err)
+			test.AssertNoError(w.Close())
+		}
+		// reading records the access time.
+		_, err = ioutil.ReadAll(r)
+		test.AssertNoError(err)
+		test.AssertNoError(r.Close())
+	}
+	get("a")
+	get("a")
+	// a one-pass scan only displaces entries on probation.
+	for _, name := range []string{"b", "c", "d", "e"} {
+		get(name)
+	}
+	test.Assert(cache.Exists("a"), "expected the protected entry to be kept")
+	test.Assert(!cache.Exists("b") && !cache.Exists("c"),
+		"expected the oldest probation entries to be evicted")
+	test.Assert(cache.Exists("d") && cache.Exists("e"), "expected d and e")
+}
+
+func TestGhosts(t *testing.T) {
+	test := Wrap(t, "config")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0, WithMaxSize(5), WithGhosts(1))
+	test.AssertNoError(err)
+
+	for _, name := range []string{"a", "b", "c", "a", "c"} {
+		r, w, err := cache.Get(name, 5)
+		test.AssertNoError(err)
+		if w != nil {
+			_, err = w.Write([]byte("hello"))
+			test.AssertNoError(err)
+			test.AssertNoError(w.Close())
+		}
+		test.AssertNoError(r.Close())
+	}
+	// a was forgotten for b, c was evicted for a.
+	stats := cache.GhostStats()
+	test.Assert(stats == GhostStats{Hits: 1, HitBytes: 5, Tracked: 1},
+		fmt.Sprintf("unexpected stats %+v", stats))
+}
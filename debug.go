@@ -0,0 +1,74 @@
+package fscache
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// ErrExpvarExists is returned by PublishExpvar if its name is already in
+// use.
+var ErrExpvarExists = errors.New("expvar name already in use")
+
+// publishing serializes PublishExpvar, so that two caches can't both find a
+// name free.
+var publishing sync.Mutex
+
+// DebugState is a snapshot of the state of a cache for troubleshooting, see
+// FsCache.DebugState.
+type DebugState struct {
+	Entries     int            // the entries in the cache
+	OpenStreams int            // the entries with an open Reader or Writer
+	Writers     int            // the fills in progress
+	Tombstones  int            // removed entries waiting for their Readers
+	Readers     map[string]int // the open Readers of each entry which has any
+	LastReap    time.Time      // when the reaper last ran, zero if never
+	Reconciled  ReconcileStats // the totals of the Reconcile calls
+}
+
+// DebugState returns a snapshot of the state of the cache. It's safe to call
+// at any time, e.g. from a debug handler.
+func (c *FsCache) DebugState() DebugState {
+	c.mu.RLock()
+	streams := c.streams.list()
+	state := DebugState{
+		Entries:    len(streams),
+		Writers:    c.nwriters,
+		Tombstones: len(c.tombstones),
+		Readers:    make(map[string]int),
+		LastReap:   c.last_reap,
+		Reconciled: c.reconciled,
+	}
+	c.mu.RUnlock()
+	for _, s := range streams {
+		s.mu.Lock()
+		if s.cnt > 0 {
+			state.OpenStreams++
+		}
+		if s.nreaders > 0 {
+			name := s.info.Name
+			if name == "" {
+				name = s.info.Key
+			}
+			state.Readers[name] = s.nreaders
+		}
+		s.mu.Unlock()
+	}
+	return state
+}
+
+// PublishExpvar publishes the DebugState of the cache as the expvar name,
+// so it's served on /debug/vars next to net/http/pprof. Unlike
+// expvar.Publish it fails with ErrExpvarExists if name is already in use.
+func (c *FsCache) PublishExpvar(name string) error {
+	publishing.Lock()
+	defer publishing.Unlock()
+	if expvar.Get(name) != nil {
+		return ErrExpvarExists
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return c.DebugState()
+	}))
+	return nil
+}
@@ -0,0 +1,48 @@
+package fscache
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDebugState(t *testing.T) {
+	test := Wrap(t, "debug")
+	defer test.Close()
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0)
+	test.AssertNoError(err)
+	r, w, err := cache.Get("a", UnknownSize)
+	test.AssertNoError(err)
+
+	state := cache.DebugState()
+	test.Assert(state.Entries == 1, "expected 1 entry")
+	test.Assert(state.OpenStreams == 1, "expected 1 open stream")
+	test.Assert(state.Writers == 1, "expected 1 writer")
+	test.Assert(state.Readers["a"] == 1, "expected 1 reader of a")
+	test.Assert(state.LastReap.IsZero(), "expected no reap yet")
+
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+	cache.reap(time.Hour)
+	state = cache.DebugState()
+	test.Assert(state.OpenStreams == 0, "expected no open streams")
+	test.Assert(state.Writers == 0, "expected no writers")
+	test.Assert(len(state.Readers) == 0, "expected no readers")
+	test.Assert(!state.LastReap.IsZero(), "expected the reap to be recorded")
+
+	name := fmt.Sprintf("fscache_debug_test_%d", atomic.AddInt32(&expvars, 1))
+	test.AssertNoError(cache.PublishExpvar(name))
+	v := expvar.Get(name).String()
+	test.Assert(strings.Contains(v, `"Writers":0`), "unexpected expvar "+v)
+	test.Assert(cache.PublishExpvar(name) == ErrExpvarExists,
+		"expected the name to be taken")
+}
+
+// expvars numbers the names published by the tests, expvar names can't be
+// reused.
+var expvars int32
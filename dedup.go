@@ -0,0 +1,195 @@
+package fscache
+
+import (
+	"crypto/sha256"
+	"hash"
+	"math/bits"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultDedupChunkSize is the average chunk size used by NewDedupFs when
+// avgChunkSize <= 0.
+const DefaultDedupChunkSize = 64 << 10
+
+// storeDir is the directory of a dedup fs which holds the shared chunks.
+const storeDir = ".chunks"
+
+// NewDedupFs is like NewChunkedFs, but cuts Files into chunks at boundaries
+// defined by their content, averaging avgChunkSize bytes (rounded up to a
+// power of two), and stores identical chunks once. Entries sharing content,
+// even at different offsets, then share the disk space of their common
+// chunks, e.g. container layers or successive builds of an artifact.
+//
+// A chunk is written to the directory of its File like with NewChunkedFs, so
+// it can be read while the File is still being written, and moved to a
+// shared store once complete: the File keeps a hard link to it, named after
+// its offset and sha256. A stored chunk is deleted with the last File
+// linking to it. The sizes of Files, and so the size of the cache, count
+// shared chunks in full. Compact isn't supported.
+func NewDedupFs(dir string, mode os.FileMode, avgChunkSize int64) (
+	FileSystem, error) {
+	if avgChunkSize <= 0 {
+		avgChunkSize = DefaultDedupChunkSize
+	}
+	avgChunkSize = 1 << bits.Len64(uint64(avgChunkSize-1))
+	fs := &chunkedFs{
+		root:       dir,
+		mode:       mode,
+		chunk_size: 4 * avgChunkSize,
+		store: &chunkStore{
+			dir:  filepath.Join(dir, storeDir),
+			avg:  avgChunkSize,
+			refs: make(map[string]int),
+		},
+	}
+	if err := os.MkdirAll(fs.store.dir, mode); err != nil {
+		return nil, err
+	}
+	return fs, fs.store.load(fs)
+}
+
+// chunkStore holds the chunks of a dedup fs by their sha256, and counts the
+// Files linking to each.
+type chunkStore struct {
+	dir  string
+	avg  int64 // the average chunk size
+	mu   sync.Mutex
+	refs map[string]int
+}
+
+// load counts the links to the stored chunks and deletes the unused ones,
+// e.g. left by a crash.
+func (s *chunkStore) load(fs *chunkedFs) error {
+	names, err := fs.List()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		chunks, _, err := fs.layout(filepath.Join(fs.root, name))
+		if err != nil {
+			continue
+		}
+		for _, c := range chunks {
+			if c.hash != "" {
+				s.refs[c.hash]++
+			}
+		}
+	}
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	stored, err := dir.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+	for _, hash := range stored {
+		if s.refs[hash] == 0 {
+			if err := os.Remove(filepath.Join(s.dir, hash)); err != nil {
+				logger.Error(err)
+			}
+		}
+	}
+	return nil
+}
+
+// link moves the complete chunk pending of the File name at off to the
+// store, unless it already holds a chunk with the same hash, and links it
+// back into the File.
+func (s *chunkStore) link(pending, name string, off int64,
+	hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := filepath.Join(s.dir, hash)
+	if err := os.Link(pending, stored); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := os.Link(stored, chunkName(name, off)+"."+hash); err != nil {
+		return err
+	}
+	s.refs[hash]++
+	return os.Remove(pending)
+}
+
+// release drops the links of a removed File to stored chunks.
+func (s *chunkStore) release(chunks []chunkInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range chunks {
+		if c.hash == "" {
+			continue
+		}
+		s.refs[c.hash]--
+		if s.refs[c.hash] > 0 {
+			continue
+		}
+		delete(s.refs, c.hash)
+		if err := os.Remove(filepath.Join(s.dir, c.hash)); err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// isChunkHash reports whether s is the hex sha256 of a stored chunk.
+func isChunkHash(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !('0' <= s[i] && s[i] <= '9' || 'a' <= s[i] && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// gear holds the random values of the gear rolling hash. It's seeded with a
+// constant, so chunk boundaries stay the same across runs.
+var gear = func() (table [256]uint64) {
+	r := rand.New(rand.NewSource(0x5eed))
+	for i := range table {
+		table[i] = r.Uint64()
+	}
+	return table
+}()
+
+// chunker finds content-defined chunk boundaries with a gear hash, and
+// hashes the content of the current chunk.
+type chunker struct {
+	min, max int64
+	mask     uint64 // of the high bits of gear, which depend on more bytes
+	gear     uint64
+	hash     hash.Hash
+}
+
+func newChunker(avg int64) *chunker {
+	n := uint(bits.Len64(uint64(avg)) - 1)
+	return &chunker{
+		min:  avg / 4,
+		max:  4 * avg,
+		mask: (1<<n - 1) << (64 - n),
+		hash: sha256.New(),
+	}
+}
+
+// next returns how many bytes of p belong to the current chunk, which holds
+// n bytes so far, and whether the chunk ends after them.
+func (c *chunker) next(p []byte, n int64) (int64, bool) {
+	for i, b := range p {
+		c.gear = c.gear<<1 + gear[b]
+		n++
+		if n >= c.max || n >= c.min && c.gear&c.mask == 0 {
+			return int64(i + 1), true
+		}
+	}
+	return int64(len(p)), false
+}
+
+// reset starts the hash of the next chunk.
+func (c *chunker) reset() {
+	c.hash.Reset()
+}
@@ -0,0 +1,51 @@
+package fscache
+
+// Detach forcibly removes name: its open Readers and Writer fail with
+// ErrDetached from their next operation on, and no longer hold the entry, so
+// its file is deleted right away. It recovers entries pinned by stuck clients,
+// including ones already being removed, without restarting the process.
+// Detached Readers and Writers must still be Closed. Errors are CacheErrors,
+// ErrNotFound if name isn't in the cache.
+func (c *FsCache) Detach(name string) error {
+	key := c.key(name)
+	c.mu.Lock()
+	streams := make([]*Stream, 0, 2)
+	live, ok := c.streams.delete(key)
+	if ok {
+		streams = append(streams, live)
+	}
+	if s := c.tombstones[key]; s != nil {
+		streams = append(streams, s)
+	}
+	if live != nil {
+		// replaces a pending tombstone, which shared the file of live.
+		live.markRemoving()
+		c.tombstones[key] = live
+	}
+	var writers []*cacheWriter
+	for w := range c.writing {
+		for _, s := range streams {
+			if w.stream == s {
+				writers = append(writers, w)
+			}
+		}
+	}
+	c.unlock()
+	if len(streams) == 0 {
+		return wrapError(OpDetach, name, ErrNotFound)
+	}
+
+	for _, w := range writers {
+		w.abort(ErrDetached)
+	}
+	for _, s := range streams {
+		s.markRemoving()
+		if n := s.detachReaders(ErrDetached); n > 0 {
+			logger.Warnf("detached %d readers of %s", n, truncateKey(key))
+		}
+	}
+	if live != nil {
+		c.bury(key, live)
+	}
+	return nil
+}
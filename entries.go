@@ -0,0 +1,387 @@
+package fscache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// entries holds the streams of the cache by key and keeps its Index, if any,
+// in sync with them. With a budget only the most recently used streams are
+// kept in memory, the others are hydrated from the index when needed.
+//
+// Writes to the index are queued while the lock of the cache is held and
+// applied in order by flush once it's released, see FsCache.unlock, so that
+// a slow index, e.g. over the network, doesn't hold up the whole cache.
+type entries struct {
+	mu      sync.Mutex               // guards all but index and flushing
+	streams map[string]*list.Element // of *resident
+	lru     *list.List               // most recently used first
+	index   Index                    // nil unless WithIndex
+	budget  int                      // see WithMemoryBudget
+	clock   Clock
+	hydrate func(IndexEntry) *Stream
+	filter  *bloom           // of the keys, nil unless WithBloomFilter
+	sizes   map[string]int64 // of the complete entries
+	total   int64            // the sum of sizes
+
+	queue    []*indexWrite          // not yet applied, oldest first
+	pending  map[string]*indexWrite // the last queued write of each key
+	flushing sync.Mutex             // held while applying the queue
+}
+
+// indexWrite is a Put or Delete of the index queued by entries.
+type indexWrite struct {
+	key    string
+	entry  IndexEntry // unless delete
+	delete bool
+}
+
+type resident struct {
+	key string
+	s   *Stream
+}
+
+func newEntries() *entries {
+	return &entries{
+		streams: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// bounded reports whether streams may be kept only in the index.
+func (e *entries) bounded() bool {
+	return e.budget > 0 && e.index != nil
+}
+
+func (e *entries) get(key string) (*Stream, bool) {
+	e.mu.Lock()
+	if el, ok := e.streams[key]; ok {
+		e.lru.MoveToFront(el)
+		e.mu.Unlock()
+		return el.Value.(*resident).s, true
+	}
+	e.mu.Unlock()
+	if !e.bounded() {
+		return nil, false
+	}
+	if e.filter != nil && !e.filter.mayContain(key) {
+		return nil, false
+	}
+
+	entry, ok, err := e.indexed(key)
+	if err != nil {
+		logger.Errorf("hydrating %s: %s", key, err)
+		return nil, false
+	}
+	if !ok || entry.State != EntryComplete {
+		return nil, false
+	}
+	s := e.hydrate(entry)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if el, ok := e.streams[key]; ok {
+		// hydrated concurrently.
+		e.lru.MoveToFront(el)
+		return el.Value.(*resident).s, true
+	}
+	e.add(key, s)
+	return s, true
+}
+
+// indexed returns the entry of key in the index, or the one queued for it.
+func (e *entries) indexed(key string) (IndexEntry, bool, error) {
+	e.mu.Lock()
+	w, queued := e.pending[key]
+	e.mu.Unlock()
+	if queued {
+		return w.entry, !w.delete, nil
+	}
+	return e.index.Get(key)
+}
+
+// add makes s the resident stream of key, e.mu must be held.
+func (e *entries) add(key string, s *Stream) {
+	if el, ok := e.streams[key]; ok {
+		el.Value.(*resident).s = s
+		e.lru.MoveToFront(el)
+	} else {
+		e.streams[key] = e.lru.PushFront(&resident{key: key, s: s})
+	}
+	e.trim()
+}
+
+// remember adds key to the Bloom filter, if there's one.
+func (e *entries) remember(key string) {
+	if e.filter != nil {
+		e.filter.add(key)
+	}
+}
+
+// trim drops the least recently used idle streams beyond the budget, e.mu
+// must be held. Their entries stay in the index.
+func (e *entries) trim() {
+	if !e.bounded() {
+		return
+	}
+	el := e.lru.Back()
+	for len(e.streams) > e.budget && el != nil {
+		prev := el.Prev()
+		r := el.Value.(*resident)
+		if r.s.idle() {
+			e.lru.Remove(el)
+			delete(e.streams, r.key)
+		}
+		el = prev
+	}
+}
+
+// full reports whether no more streams should be kept in memory.
+func (e *entries) full() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.bounded() && len(e.streams) >= e.budget
+}
+
+// put adds s as the stream of key, indexed in state.
+func (e *entries) put(key string, s *Stream, state EntryState) {
+	e.update(s, state)
+	e.remember(key)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.add(key, s)
+}
+
+// load adds s as the stream of key, which is already indexed.
+func (e *entries) load(key string, s *Stream) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.add(key, s)
+}
+
+// update records the state of s in the index, and the size of s once it's
+// complete.
+func (e *entries) update(s *Stream, state EntryState) {
+	var size int64
+	if state == EntryComplete {
+		var err error
+		if size, err = s.Size(); err != nil {
+			return
+		}
+		e.account(s.info.Key, size)
+	}
+	if e.index == nil {
+		return
+	}
+	entry := IndexEntry{
+		Key:      s.info.Key,
+		Name:     s.entryName(),
+		Modified: e.clock.Now(),
+		State:    state,
+		Origin:   s.origin(),
+		ModTime:  s.modTime(),
+		Hashes:   s.hashTree(),
+		Version:  s.Version(),
+		Size:     size,
+	}
+	e.enqueue(&indexWrite{key: entry.Key, entry: entry})
+}
+
+// account records size as the size of the complete entry key.
+func (e *entries) account(key string, size int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.sizes == nil {
+		e.sizes = make(map[string]int64)
+	}
+	e.total += size - e.sizes[key]
+	e.sizes[key] = size
+}
+
+// size returns the total size of the complete entries, kept as they're
+// added and deleted so that it doesn't stat each of them.
+func (e *entries) size() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.total
+}
+
+// enqueue queues w to be applied to the index by flush.
+func (e *entries) enqueue(w *indexWrite) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pending == nil {
+		e.pending = make(map[string]*indexWrite)
+	}
+	e.queue = append(e.queue, w)
+	e.pending[w.key] = w
+}
+
+// flush applies the queued writes to the index in the order they were
+// queued. Once it returns, the writes queued before it was called have been
+// applied, also if a concurrent flush took them.
+func (e *entries) flush() {
+	if e.index == nil {
+		return
+	}
+	e.flushing.Lock()
+	defer e.flushing.Unlock()
+	for {
+		e.mu.Lock()
+		queue := e.queue
+		e.queue = nil
+		e.mu.Unlock()
+		if len(queue) == 0 {
+			return
+		}
+		for _, w := range queue {
+			if w.delete {
+				if err := e.index.Delete(w.key); err != nil {
+					logger.Errorf("unindexing %s: %s", w.key, err)
+				}
+			} else if err := e.index.Put(w.entry); err != nil {
+				logger.Errorf("indexing %s: %s", w.key, err)
+			}
+		}
+		e.mu.Lock()
+		for _, w := range queue {
+			if e.pending[w.key] == w {
+				delete(e.pending, w.key)
+			}
+		}
+		e.mu.Unlock()
+	}
+}
+
+// delete removes the stream of key and returns it.
+func (e *entries) delete(key string) (*Stream, bool) {
+	s, ok := e.get(key)
+	if !ok {
+		return nil, false
+	}
+	e.mu.Lock()
+	if el, ok := e.streams[key]; ok {
+		e.lru.Remove(el)
+		delete(e.streams, key)
+	}
+	e.total -= e.sizes[key]
+	delete(e.sizes, key)
+	e.mu.Unlock()
+	if e.filter != nil {
+		e.filter.remove(key)
+	}
+	if e.index != nil {
+		e.enqueue(&indexWrite{key: key, delete: true})
+	}
+	return s, true
+}
+
+// each calls fn for every stream until it returns false, including the
+// streams which are only in the index. fn may delete the stream it's called
+// with.
+func (e *entries) each(fn func(key string, s *Stream) bool) {
+	e.mu.Lock()
+	residents := make([]resident, 0, len(e.streams))
+	for _, el := range e.streams {
+		residents = append(residents, *el.Value.(*resident))
+	}
+	e.mu.Unlock()
+	for _, r := range residents {
+		if !fn(r.key, r.s) {
+			return
+		}
+	}
+	if !e.bounded() {
+		return
+	}
+
+	// the queued writes take precedence over the index.
+	e.mu.Lock()
+	pending := make(map[string]*indexWrite, len(e.pending))
+	for key, w := range e.pending {
+		pending[key] = w
+	}
+	e.mu.Unlock()
+	var cold []IndexEntry
+	cold_entry := func(entry IndexEntry) {
+		if entry.State != EntryComplete {
+			return
+		}
+		e.mu.Lock()
+		_, ok := e.streams[entry.Key]
+		e.mu.Unlock()
+		if !ok {
+			cold = append(cold, entry)
+		}
+	}
+	err := e.index.Iterate(func(entry IndexEntry) bool {
+		if _, ok := pending[entry.Key]; !ok {
+			cold_entry(entry)
+		}
+		return true
+	})
+	if err != nil {
+		logger.Errorf("iterating index: %s", err)
+	}
+	for _, w := range pending {
+		if !w.delete {
+			cold_entry(w.entry)
+		}
+	}
+	for _, entry := range cold {
+		if !fn(entry.Key, e.hydrate(entry)) {
+			return
+		}
+	}
+}
+
+// list returns all streams, see each.
+func (e *entries) list() []*Stream {
+	var streams []*Stream
+	e.each(func(key string, s *Stream) bool {
+		streams = append(streams, s)
+		return true
+	})
+	return streams
+}
+
+// resident returns the streams in memory.
+func (e *entries) resident() []*Stream {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	streams := make([]*Stream, 0, len(e.streams))
+	for _, el := range e.streams {
+		streams = append(streams, el.Value.(*resident).s)
+	}
+	return streams
+}
+
+// clear removes all streams.
+func (e *entries) clear() {
+	e.each(func(key string, s *Stream) bool {
+		e.delete(key)
+		return true
+	})
+}
+
+// prune deletes the entries of the index whose key isn't in loaded.
+func (e *entries) prune(loaded map[string]bool) error {
+	if e.index == nil {
+		return nil
+	}
+	var stale []string
+	err := e.index.Iterate(func(entry IndexEntry) bool {
+		if !loaded[entry.Key] {
+			stale = append(stale, entry.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if err := e.index.Delete(key); err != nil {
+			logger.Errorf("unindexing %s: %s", key, err)
+		}
+	}
+	return nil
+}
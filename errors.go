@@ -0,0 +1,77 @@
+package fscache
+
+import (
+	"fmt"
+	"io"
+)
+
+// The operations of a CacheError.
+const (
+	OpGet     = "get"
+	OpRemove  = "remove"
+	OpSize    = "size"
+	OpInfo    = "info"
+	OpRead    = "read"
+	OpWrite   = "write"
+	OpClose   = "close"
+	OpRestore = "restore"
+	OpDetach  = "detach"
+	OpModTime = "modtime"
+	OpAdopt   = "adopt"
+	OpExport  = "export"
+	OpWait    = "wait"
+)
+
+// CacheError is an error of an operation of the cache on an entry. The Key is
+// the name of the entry, truncated if it's long so errors stay readable. The
+// errors of the cache and of the Readers and Writers it returns are
+// CacheErrors, use errors.Is and errors.As to inspect the underlying error.
+type CacheError struct {
+	Op  string // one of the Op constants
+	Key string
+	Err error
+}
+
+func (e *CacheError) Error() string {
+	return fmt.Sprintf("fscache: %s %q: %s", e.Op, e.Key, e.Err)
+}
+
+// Unwrap returns the underlying error, e.g. for errors.Is(err, ErrNotFound).
+func (e *CacheError) Unwrap() error {
+	return e.Err
+}
+
+// wrapError returns err as a CacheError of op on name, or nil.
+func wrapError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*CacheError); ok {
+		return err
+	}
+	return &CacheError{Op: op, Key: truncateKey(name), Err: err}
+}
+
+// wrapStreamError returns err as a CacheError of op on the entry of s, unless
+// it's nil or io.EOF or s doesn't belong to a cache.
+func wrapStreamError(op string, s *Stream, err error) error {
+	if err == nil || err == io.EOF || s == nil || s.info.Key == "" {
+		return err
+	}
+	name := s.entryName()
+	if name == "" {
+		name = s.info.Key
+	}
+	return wrapError(op, name, err)
+}
+
+// truncateKey shortens long names for errors and logs, keeping their start,
+// their end and their length.
+func truncateKey(name string) string {
+	const head, tail = 48, 16
+	if len(name) <= head+tail+16 {
+		return name
+	}
+	return fmt.Sprintf("%s...(%d bytes)...%s", name[:head], len(name),
+		name[len(name)-tail:])
+}
@@ -0,0 +1,93 @@
+package fscache
+
+// EvictionReason tells why the cache dropped an entry.
+type EvictionReason int
+
+const (
+	// EvictionExpired entries weren't accessed within the expiry.
+	EvictionExpired EvictionReason = iota
+	// EvictionSize entries were dropped to keep the cache within its
+	// WithMaxSize limit.
+	EvictionSize
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionExpired:
+		return "expired"
+	case EvictionSize:
+		return "size"
+	}
+	return "unknown"
+}
+
+// EvictionEvent is delivered to subscribers when the cache drops an entry on
+// its own, or would have in a dry run. Explicit Removes aren't reported.
+type EvictionEvent struct {
+	Key    string // the key of the entry on disk
+	Name   string // the name of the entry, empty if unknown
+	Size   int64  // the size of the entry when it was dropped
+	Reason EvictionReason
+	DryRun bool // the entry was kept, see WithEvictionDryRun
+}
+
+// WithEvictionDryRun makes the reaper and the WithMaxSize evictor only log
+// the entries they would delete, and report them to subscribers as
+// EvictionEvents with DryRun set, without deleting anything. It lets new
+// expiry and size policies be checked against real traffic safely.
+func WithEvictionDryRun() Option {
+	return func(c *FsCache) {
+		c.dry_run = true
+	}
+}
+
+// subscriberBuffer is the number of events buffered for each subscriber.
+const subscriberBuffer = 64
+
+// Subscribe returns a channel receiving an EvictionEvent for every entry
+// which expires or is evicted, e.g. to invalidate data derived from it.
+// Events are dropped rather than stall the cache if the channel is full.
+// cancel unsubscribes and closes the channel.
+func (c *FsCache) Subscribe() (events <-chan EvictionEvent, cancel func()) {
+	ch := make(chan EvictionEvent, subscriberBuffer)
+	c.mu.Lock()
+	if c.subscribers == nil {
+		c.subscribers = make(map[chan EvictionEvent]struct{})
+	}
+	c.subscribers[ch] = struct{}{}
+	c.mu.Unlock()
+
+	cancel = func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if _, ok := c.subscribers[ch]; ok {
+			delete(c.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// notifyEvicted sends an EvictionEvent for s to the subscribers, c.mu must
+// be held.
+func (c *FsCache) notifyEvicted(s *Stream, reason EvictionReason) {
+	if len(c.subscribers) == 0 {
+		return
+	}
+	size, _ := s.Size()
+	ev := EvictionEvent{
+		Key:    s.info.Key,
+		Name:   s.entryName(),
+		Size:   size,
+		Reason: reason,
+		DryRun: c.dry_run,
+	}
+	for ch := range c.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			logger.Warnf("dropping eviction event of %s, subscriber is full",
+				truncateKey(ev.Key))
+		}
+	}
+}
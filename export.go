@@ -0,0 +1,88 @@
+package fscache
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ErrIncomplete is returned by Export for an entry which is still being
+// filled.
+var ErrIncomplete = errors.New("entry is incomplete")
+
+// Export materializes the complete entry name at dst, replacing dst if it
+// exists, e.g. to check a cached build artifact out where a build expects
+// it. The file is hard linked if possible, in which case dst must not be
+// modified, and copied otherwise, see Adopt. The entry is pinned until unpin
+// is called: it isn't evicted or expired, and removing it waits like for an
+// open Reader.
+func (c *FsCache) Export(name, dst string) (unpin func() error, err error) {
+	if err := c.validate(name); err != nil {
+		return nil, wrapError(OpExport, name, err)
+	}
+	s, ok := c.getStream(name)
+	if !ok {
+		return nil, wrapError(OpExport, name, ErrNotFound)
+	}
+	if s.State() != StreamComplete {
+		return nil, wrapError(OpExport, name, ErrIncomplete)
+	}
+	r, err := s.NextReader()
+	if err != nil {
+		return nil, wrapError(OpExport, name, err)
+	}
+	c.recordAccess(s.info.Key)
+
+	linker, ok := c.fs.(Linker)
+	if ok && len(c.codecs) == 0 && len(c.reader_mw) == 0 {
+		err := replaceFile(dst, func(tmp string) error {
+			return linker.LinkTo(s.Name(), tmp)
+		})
+		if err == nil {
+			return r.Close, nil
+		}
+		logger.Debugf("linking %s, copying it instead: %s", name, err)
+	}
+
+	rd := c.wrapReader(name, r)
+	err = replaceFile(dst, func(tmp string) error {
+		f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+			0666)
+		if err != nil {
+			return err
+		}
+		_, err = copyFile(f, rd)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+	if err != nil {
+		rd.Close()
+		return nil, wrapError(OpExport, name, err)
+	}
+	return rd.Close, nil
+}
+
+// replaceFile atomically replaces dst with the file fn creates at the
+// temporary path it's passed, which may already exist.
+func replaceFile(dst string, fn func(tmp string) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	// links can't replace a file.
+	os.Remove(tmp)
+	if err := fn(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
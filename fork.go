@@ -0,0 +1,76 @@
+package fscache
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Fork creates a cache in dir seeded with the complete entries of c, e.g. a
+// sandbox for a job from a warm base cache. The entries are hard linked if
+// the FileSystem is a Linker, so forking copies no data and takes no space
+// until either cache replaces an entry: entries are never written in place,
+// a replacement is a new file. Entries which can't be linked, e.g. across
+// volumes, are copied. Entries being filled are left out, and files which
+// are already in dir are kept.
+//
+// The fork is created with New, with the permissions of the folder of c and
+// its expiry, KeyEncoding and Codecs, then opts.
+func (c *FsCache) Fork(dir string, opts ...Option) (*FsCache, error) {
+	perms := os.FileMode(0700)
+	if fi, err := os.Stat(c.root); err == nil {
+		perms = fi.Mode().Perm()
+	}
+	if err := os.MkdirAll(dir, perms); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	streams := c.streams.list()
+	expiry := c.expiry
+	c.mu.RUnlock()
+	for _, s := range streams {
+		if s.State() != StreamComplete {
+			continue
+		}
+		if err := c.forkEntry(s, dir, perms); err != nil {
+			return nil, err
+		}
+	}
+	opts = append([]Option{WithKeyEncoding(c.key_enc),
+		WithCodec(c.codecs...)}, opts...)
+	return New(dir, perms, expiry, opts...)
+}
+
+// forkEntry links or copies the file of s into dir.
+func (c *FsCache) forkEntry(s *Stream, dir string, perms os.FileMode) error {
+	// pinned so that it isn't removed meanwhile.
+	r, err := s.NextReader()
+	if err != nil {
+		// removed since it was listed.
+		return nil
+	}
+	defer r.Close()
+	dst := filepath.Join(dir, s.info.Key)
+	if err := os.MkdirAll(filepath.Dir(dst), perms); err != nil {
+		return err
+	}
+	if linker, ok := c.fs.(Linker); ok {
+		err := linker.LinkTo(s.Name(), dst)
+		if err == nil || os.IsExist(err) {
+			return nil
+		}
+		logger.Debugf("linking %s, copying it instead: %s", s.Name(), err)
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// r isn't wrapped, the entry stays encoded with the Codecs of c.
+	_, err = copyFile(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
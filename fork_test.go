@@ -0,0 +1,57 @@
+package fscache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFork(t *testing.T) {
+	test := Wrap(t, "fork")
+	defer test.Close()
+	base, err := New(filepath.Join(test.Dir(), "base"), 0700, 0)
+	test.AssertNoError(err)
+	fill := func(cache *FsCache, name, data string) {
+		r, w, err := cache.Get(name, UnknownSize)
+		test.AssertNoError(err)
+		test.Assert(w != nil, "expected a miss")
+		_, err = w.Write([]byte(data))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+		test.AssertNoError(r.Close())
+	}
+	read := func(cache *FsCache, name string) string {
+		r, ok, err := cache.GetIfExists(name)
+		test.AssertNoError(err)
+		if !ok {
+			return ""
+		}
+		defer r.Close()
+		p, err := ioutil.ReadAll(r)
+		test.AssertNoError(err)
+		return string(p)
+	}
+	fill(base, "a", "base a")
+	fill(base, "b", "base b")
+	r, w, err := base.Get("filling", UnknownSize)
+	test.AssertNoError(err)
+
+	fork, err := base.Fork(filepath.Join(test.Dir(), "fork"))
+	test.AssertNoError(err)
+	test.Assert(read(fork, "a") == "base a" && read(fork, "b") == "base b",
+		"expected the entries of the base")
+	test.Assert(!fork.Exists("filling"), "expected fills to be left out")
+	src, err := os.Stat(base.getPath(base.key("a")))
+	test.AssertNoError(err)
+	dst, err := os.Stat(fork.getPath(fork.key("a")))
+	test.AssertNoError(err)
+	test.Assert(os.SameFile(src, dst), "expected a to be linked")
+
+	test.AssertNoError(fork.Remove("a"))
+	fill(fork, "a", "fork a")
+	test.Assert(read(fork, "a") == "fork a", "expected the new a")
+	test.Assert(read(base, "a") == "base a", "expected the base to be kept")
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+}
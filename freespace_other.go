@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package fscache
+
+import "errors"
+
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.New("free space not supported on this platform")
+}
@@ -3,6 +3,9 @@ package fscache
 import (
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/djherbis/atime.v1"
@@ -19,6 +22,12 @@ type FileSystem interface {
 	Size(name string) (int64, error)
 }
 
+// Lister is implemented by FileSystems which don't keep all of their Files in
+// the directory of the cache. List returns the keys of the Files it holds.
+type Lister interface {
+	List() ([]string, error)
+}
+
 type File interface {
 	Name() string
 	io.Writer
@@ -38,16 +47,47 @@ type ReadFile interface {
 	io.ReadCloser
 }
 
-type stdFs struct{}
+type stdFs struct {
+	mode    os.FileMode // of the directories created for hierarchical keys
+	root    string
+	durable bool // see NewDurableFs
+}
 
 // NewFs returns a FileSystem rooted at directory dir.
 // Dir is created with perms if it doesn't exist.
 func NewFs(dir string, mode os.FileMode) (FileSystem, error) {
-	return &stdFs{}, os.MkdirAll(dir, mode)
+	return &stdFs{mode: mode, root: filepath.Clean(dir)},
+		os.MkdirAll(dir, mode)
+}
+
+// NewDurableFs is like NewFs, but fsyncs the parent directory of Files after
+// creating, removing or renaming them, so that new entries and removals
+// survive a crash on filesystems which need it. The content of Files isn't
+// synced.
+func NewDurableFs(dir string, mode os.FileMode) (FileSystem, error) {
+	return &stdFs{mode: mode, root: filepath.Clean(dir), durable: true},
+		os.MkdirAll(dir, mode)
 }
 
 func (fs *stdFs) Create(name string) (File, error) {
-	return os.Create(name)
+	f, err := os.Create(name)
+	created_dirs := false
+	if os.IsNotExist(err) {
+		// the parent of a hierarchical key, see HierarchicalKeys.
+		if err := os.MkdirAll(filepath.Dir(name), fs.mode); err != nil {
+			return nil, err
+		}
+		created_dirs = true
+		f, err = os.Create(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.syncDirs(name, created_dirs); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
 }
 
 func (fs *stdFs) Open(name string) (File, error) {
@@ -55,7 +95,39 @@ func (fs *stdFs) Open(name string) (File, error) {
 }
 
 func (fs *stdFs) Remove(name string) error {
-	return os.Remove(name)
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	return fs.syncDirs(name, false)
+}
+
+// syncDirs fsyncs the parent directory of name if fs is durable, and its
+// ancestors up to the root of fs too if all is true, e.g. after creating the
+// directories of a hierarchical key.
+func (fs *stdFs) syncDirs(name string, all bool) error {
+	if !fs.durable {
+		return nil
+	}
+	dir := filepath.Dir(name)
+	for {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if !all || !strings.HasPrefix(parent, fs.root) || parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
 }
 
 func (fs *stdFs) AccessTimes(name string) (rt, wt time.Time, err error) {
@@ -73,3 +145,19 @@ func (fs *stdFs) Size(name string) (size int64, err error) {
 	}
 	return fi.Size(), nil
 }
+
+// copyBufs pools the buffers of copyFile, so moving and merging Files
+// doesn't allocate a new buffer each time.
+var copyBufs = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
+// copyFile copies src to dst with a pooled buffer, see io.Copy.
+func copyFile(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBufs.Get().(*[]byte)
+	defer copyBufs.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
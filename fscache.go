@@ -3,21 +3,25 @@ package fscache
 import (
 	"context"
 	"crypto/md5"
+	"encoding/hex"
 	"errors"
-	"fmt"
 	"io"
-	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/spacemonkeygo/spacelog"
 )
 
 var (
-	logger  = spacelog.GetLogger()
-	nowHook = time.Now // used for testing
+	logger = spacelog.GetLogger()
+
+	// ErrNotFound is returned when the requested key is not in the cache.
+	ErrNotFound = errors.New("file not found")
 )
 
 // Cache works like a concurrent-safe map for streams.
@@ -28,11 +32,15 @@ type Cache interface {
 	// If the key does exist, w == nil.
 	// r will always be non-nil as long as err == nil and you must close r when you're done reading.
 	// Get can be called concurrently, and writing and reading is concurrent safe.
+	// Whether w is nil is decided atomically, so of concurrent Gets of a
+	// missing key exactly one gets the writer: check it rather than Exists.
 	Get(name string, size int64) (ReaderAtCloser, io.WriteCloser, error)
 
 	// Remove deletes the stream from the cache, blocking until the underlying
 	// file can be deleted (all active streams finish with it).
-	// It is safe to call Remove concurrently with Get.
+	// It is safe to call Remove concurrently with Get. A Get while Remove
+	// waits doesn't see the removed stream: it fills a new one from a fresh
+	// file, and the Readers of the removed one keep reading theirs.
 	Remove(name string) error
 
 	// Exists checks if a key is in the cache.
@@ -48,13 +56,93 @@ type Cache interface {
 	Clean() error
 }
 
+// WriterOnlyCache is implemented by Caches which can hand out the writer of
+// a missing key alone, like FsCache.
+type WriterOnlyCache interface {
+	// GetWriterOnly is like Get but only returns the writer for a missing
+	// key, without opening a reader the producer would have to close. If the
+	// key already exists w == nil.
+	GetWriterOnly(name string, size int64) (w io.WriteCloser, err error)
+}
+
 type FsCache struct {
-	mu      sync.RWMutex // used to sync streams
-	streams map[string]*Stream
-	fs      FileSystem
-	root    string
+	mu         sync.RWMutex // used to sync streams, tombstones and writers
+	streams    *entries
+	tombstones map[string]*Stream       // removed streams waiting for readers
+	removing   map[string]chan struct{} // dirs being removed, see RemovePrefix
+	fs         FileSystem
+	root       string
+	locks      *keyLocks
+	key_enc    KeyEncoding
+	max_key    int // see WithStrictKeys
+	keep_empty bool
+	stale      time.Duration // see WithStaleWriterTimeout
+	read_limit time.Duration // see WithReaderTimeout
+
+	load_report LoadReport
+	leaks       *leakTracker // nil unless leak detection is enabled
+	sniff       bool
+	limiters    []*Limiter
+
+	wake_granularity int64 // see WithWakeGranularity
+	pprof_labels     bool  // see WithProfilerLabels
+
+	clock       Clock
+	expiry      time.Duration
+	max_size    int64
+	max_writers *Limiter // nil unless configured
+	max_readers int      // per entry, see WithMaxReaders
+	throttles   []*Throttle
+	write_rate  *Throttle // nil unless configured
+	paused      int       // see PauseJanitor
+	reap_pacing reapPacing
+	reap_jitter time.Duration
+	last_reap   time.Time      // see DebugState
+	reconciled  ReconcileStats // see Reconcile
+	txn_seq     uint64         // the id of the last Txn, see Begin
+	version_seq atomic.Uint64  // the last Version, see nextVersion
+	access      *accessLog     // nil unless WithAccessTracking
+	prefetch_n  int            // see WithPrefetchConcurrency
+	verify      int64          // see WithVerification
+	load_n      int            // see WithLoadConcurrency
+	prefetching map[string]struct{}
+	warmup      *warmup                         // see WithWarmup
+	fillers     *FillMux                        // see WithFillMux
+	fill_retry  FillRetry                       // see WithFillRetry
+	failures    map[string]fillFailure          // see FillRetry.NegativeTTL
+	breakers    map[string]*breaker             // see WithCircuitBreaker
+	adaptive    *adaptiveTTL                    // nil unless WithAdaptiveTTL
+	protected   float64                         // see WithSegmentedLRU
+	ghosts      *ghostList                      // nil unless WithGhosts
+	subscribers map[chan EvictionEvent]struct{} // see Subscribe
+	trash       *trashBin                       // nil unless WithTrash
+	dry_run     bool                            // see WithEvictionDryRun
+
+	shutdown    bool
+	stop_reaper context.CancelFunc
+	nwriters    int             // open writers
+	drained     []chan struct{} // closed when nwriters drops to 0
+	writing     map[*cacheWriter]struct{}
+	deleting    sync.WaitGroup // directories deleted in the background
+
+	breaker_n        int // see WithCircuitBreaker
+	breaker_cooldown time.Duration
+
+	snapshots    int           // see BeginSnapshot
+	snapshot_end chan struct{} // closed when the last snapshot ends
+
+	archiver  Archiver
+	archiving map[string]chan struct{} // closed once archived
+	archived  map[string]int64         // sizes of restorable entries
+
+	codecs    []Codec
+	writer_mw []WriterMiddleware
+	reader_mw []ReaderMiddleware
 }
 
+// Option configures optional behaviour of an FsCache.
+type Option func(*FsCache)
+
 type ReaderAtCloser interface {
 	io.ReadCloser
 	io.ReaderAt
@@ -63,203 +151,972 @@ type ReaderAtCloser interface {
 // New creates a new Cache using NewFs(dir, perms).
 // expiry is the duration after which an un-accessed key will be removed from
 // the cache, a zero value expiro means never expire.
-func New(dir string, perms os.FileMode, expiry time.Duration) (*FsCache,
-	error) {
+func New(dir string, perms os.FileMode, expiry time.Duration,
+	opts ...Option) (*FsCache, error) {
 	fs, err := NewFs(dir, perms)
 	if err != nil {
 		return nil, err
 	}
-	return NewCache(dir, fs, expiry)
+	return NewCache(dir, fs, expiry, opts...)
 }
 
 // NewCache creates a new Cache based on FileSystem fs.
 // fs.Files() are loaded using the name they were created with as a key.
-func NewCache(dir string, fs FileSystem, expiry time.Duration) (*FsCache,
-	error) {
+func NewCache(dir string, fs FileSystem, expiry time.Duration,
+	opts ...Option) (*FsCache, error) {
 	c := &FsCache{
-		streams: make(map[string]*Stream),
-		fs:      fs,
-		root:    dir,
+		streams:     newEntries(),
+		tombstones:  make(map[string]*Stream),
+		fs:          fs,
+		root:        dir,
+		locks:       newKeyLocks(),
+		key_enc:     MD5Keys,
+		clock:       systemClock,
+		writing:     make(map[*cacheWriter]struct{}),
+		archiving:   make(map[string]chan struct{}),
+		archived:    make(map[string]int64),
+		prefetching: make(map[string]struct{}),
+		failures:    make(map[string]fillFailure),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.leaks != nil {
+		c.leaks.clock = c.clock
 	}
+	c.streams.clock = c.clock
+	c.streams.hydrate = c.hydrate
 	err := c.load()
 	if err != nil {
 		return nil, err
 	}
-	if expiry > 0 {
-		ctx := context.Background()
-		go c.ReapEvery(ctx, expiry)
-	}
+	c.removeLeftovers()
+	c.mu.Lock()
+	c.expiry = expiry
+	c.startReaper()
+	c.mu.Unlock()
+	c.startAccessLog()
+	c.startWarmup()
 	return c, nil
 }
 
 func (c *FsCache) load() error {
-	files, err := ioutil.ReadDir(c.root)
+	if p, ok := c.streams.index.(Persistent); ok && p.Persistent() {
+		return c.loadIndex()
+	}
+
+	n := c.load_n
+	if n <= 0 {
+		n = DefaultLoadConcurrency
+	}
+	state := &loadState{loaded: make(map[string]bool)}
+	keys := make(chan string, loadPage)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				c.loadKey(key, state)
+			}
+		}()
+	}
+	err := c.scanKeys(func(page []string) {
+		for _, key := range page {
+			keys <- key
+		}
+	})
+	close(keys)
+	wg.Wait()
 	if err != nil {
 		return err
 	}
 
-	for _, f := range files {
-		// TODO Check expire time and remove old files
-		key := f.Name()
-		s := NewStream(c.getPath(key), c.fs)
-		c.putKeyStream(key, s)
+	report := state.report
+	sort.Strings(report.Unreadable)
+	logger.Infof("loaded %d entries (%d bytes) from %s", report.Entries,
+		report.Bytes, c.root)
+	c.load_report = report
+	return c.streams.prune(state.loaded)
+}
+
+// DefaultLoadConcurrency is the number of files a new cache examines at once
+// unless WithLoadConcurrency is used.
+const DefaultLoadConcurrency = 8
+
+// loadPage is the number of names read from the directory of the cache at
+// once when loading it.
+const loadPage = 1024
+
+// WithLoadConcurrency sets how many files are examined at once while loading
+// the files of a new cache, e.g. more on network FileSystems with high
+// latency.
+func WithLoadConcurrency(n int) Option {
+	return func(c *FsCache) {
+		c.load_n = n
 	}
-	return nil
 }
 
+// loadState collects what the workers of load found.
+type loadState struct {
+	mu     sync.Mutex
+	report LoadReport
+	loaded map[string]bool
+}
+
+// loadKey adds the file of key found when loading to the cache.
+func (c *FsCache) loadKey(key string, state *loadState) {
+	if isTrash(key) {
+		c.adoptTrash(key)
+		return
+	}
+	if isTxn(key) {
+		// staged by a Txn which was never committed.
+		if err := c.fs.Remove(c.getPath(key)); err != nil {
+			logger.Error(err)
+		}
+		return
+	}
+	// TODO Check expire time and remove old files
+	s := c.newStream(key)
+	s.markComplete()
+	size, err := s.Size()
+	switch {
+	case err != nil:
+		logger.Warnf("loading %s: %s", key, err)
+		state.mu.Lock()
+		state.report.Unreadable = append(state.report.Unreadable, key)
+		state.mu.Unlock()
+	case size == 0:
+		state.mu.Lock()
+		state.report.Empty++
+		state.mu.Unlock()
+		if !c.keep_empty {
+			if err := s.fs.Remove(s.Name()); err != nil {
+				logger.Error(err)
+			}
+			return
+		}
+	}
+	c.putKeyStream(key, s, EntryComplete)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.loaded[key] = true
+	state.report.Entries++
+	state.report.Bytes += size
+}
+
+// LoadReport summarizes the entries found when a cache is created.
+type LoadReport struct {
+	Entries    int      // entries loaded
+	Bytes      int64    // their total size
+	Empty      int      // empty files, removed unless WithKeepEmpty
+	Unreadable []string // keys of entries whose size couldn't be read
+	Unfinished int      // fills interrupted by a crash, see Persistent
+}
+
+// LoadReport returns what was found when the cache was created, e.g. to alert
+// on an unexpectedly empty or damaged cache after a deploy.
+func (c *FsCache) LoadReport() LoadReport {
+	return c.load_report
+}
+
+// keys returns the keys of the files stored by the FileSystem.
+func (c *FsCache) keys() ([]string, error) {
+	var keys []string
+	err := c.scanKeys(func(page []string) {
+		keys = append(keys, page...)
+	})
+	return keys, err
+}
+
+// scanKeys calls fn with the keys of the files stored by the FileSystem, a
+// page at a time when they're read from a directory so that a huge cache
+// doesn't have to be listed at once.
+func (c *FsCache) scanKeys(fn func(keys []string)) error {
+	if lister, ok := c.fs.(Lister); ok {
+		keys, err := lister.List()
+		if err != nil {
+			return err
+		}
+		fn(keys)
+		return nil
+	}
+	if _, ok := c.key_enc.(hierarchicalKeys); ok {
+		keys, err := walkKeys(c.root)
+		if err != nil {
+			return err
+		}
+		fn(keys)
+		return nil
+	}
+	dir, err := os.Open(c.root)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	for {
+		names, err := dir.Readdirnames(loadPage)
+		fn(names)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// walkKeys returns the paths of the files below root.
+func walkKeys(root string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(root, func(path string, fi os.FileInfo,
+		err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		key, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(key))
+		return nil
+	})
+	return keys, err
+}
+
+// Exists reports whether name is in the cache. The entry may be removed or
+// added right after, so Exists followed by Get is racy: use Get, which
+// returns a nil writer on a hit and the writer of the only fill on a miss,
+// or GetIfExists to read the entry only if it's cached.
 func (c *FsCache) Exists(name string) bool {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
 	_, ok := c.getStream(name)
 	return ok
 }
 
+// Size returns the size of the entry name on disk. Errors are CacheErrors,
+// ErrNotFound if there's no such entry.
 func (c *FsCache) Size(name string) (int64, error) {
 	s, ok := c.getStream(name)
 	if !ok {
-		return 0, errors.New("file not found")
+		return 0, wrapError(OpSize, name, ErrNotFound)
 	}
 	size, err := s.Size()
 	if err != nil {
-		return 0, err
+		return 0, wrapError(OpSize, name, err)
 	}
 	return size, nil
 }
 
+// Done returns a channel which is closed once the entry name is quiescent,
+// i.e. its writer has been closed and all of its readers have finished. ok is
+// false if name is not in the cache.
+func (c *FsCache) Done(name string) (done <-chan struct{}, ok bool) {
+	s, ok := c.getStream(name)
+	if !ok {
+		return nil, false
+	}
+	return s.Done(), true
+}
+
+// WaitComplete blocks until the entry name has been completely written,
+// without reading it, e.g. to await a fill started elsewhere. It returns the
+// error the fill failed with if it did, or ctx.Err() if ctx is done first.
+// Errors are CacheErrors, ErrNotFound if there's no such entry.
+func (c *FsCache) WaitComplete(ctx context.Context, name string) error {
+	s, ok := c.getStream(name)
+	if !ok {
+		return wrapError(OpWait, name, ErrNotFound)
+	}
+	return wrapError(OpWait, name, s.WaitComplete(ctx))
+}
+
+// fileName returns the hex md5 of name. It's on the path of every Get, so it
+// encodes into a stack buffer to allocate only the returned string.
 func fileName(name string) string {
 	md5sum := md5.Sum([]byte(name))
-	return fmt.Sprintf("%x", md5sum[:])
+	var buf [2 * md5.Size]byte
+	hex.Encode(buf[:], md5sum[:])
+	return string(buf[:])
 }
 
-func (c *FsCache) putKeyStream(key string, s *Stream) {
+func (c *FsCache) putKeyStream(key string, s *Stream, state EntryState) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.streams[key] = s
+	defer c.unlock()
+	// the file now belongs to s, a pending tombstone must not delete it.
+	c.retireTombstone(key)
+	c.streams.put(key, s, state)
 }
 
-func (c *FsCache) putStream(name string, s *Stream) {
-	key := fileName(name)
-	c.putKeyStream(key, s)
-}
-
-func (c *FsCache) deleteStream(key string, lock bool) error {
-	if lock {
-		c.mu.Lock()
-	}
-	s, ok := c.streams[key]
-	if ok {
-		delete(c.streams, key)
-	}
-	if lock {
-		c.mu.Unlock()
-	}
-	if ok {
-		return s.Remove()
-	}
-	return nil
+// unlock releases c.mu, then applies the Index writes queued while it was
+// held. Use it instead of c.mu.Unlock once the streams were changed.
+func (c *FsCache) unlock() {
+	c.mu.Unlock()
+	c.streams.flush()
 }
 
 func (c *FsCache) getStream(name string) (*Stream, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	key := fileName(name)
-	f, ok := c.streams[key]
-	return f, ok
+	key := c.key(name)
+	return c.streams.get(key)
 }
 
-func (c *FsCache) createStream(name string) *Stream {
-	key := fileName(name)
+func (c *FsCache) newStream(key string) *Stream {
 	s := NewStream(c.getPath(key), c.fs)
-	c.putStream(name, s)
+	s.leaks = c.leaks
+	s.sniff = c.sniff
+	s.wake = c.wake_granularity
+	if c.verify > 0 {
+		s.verify = c.verify
+		s.on_corrupt = func() { c.corrupted(s) }
+	}
+	s.info.Key = key
+	s.info.Name, _ = c.key_enc.Decode(key)
+	s.info.Version = c.nextVersion()
 	return s
 }
 
-func (c *FsCache) Get(name string, size int64) (r ReaderAtCloser, w io.WriteCloser, err error) {
+// createStream adds a new stream for name to the cache, unless another Get
+// added one since the lookup, in which case it returns nil. While a
+// RemovePrefix of name is in progress it returns nil and the channel closed
+// once it's done.
+func (c *FsCache) createStream(ctx context.Context, name string,
+	size int64) (*Stream, <-chan struct{}) {
+	key := c.key(name)
+	s := c.newStream(key)
+	s.expected = size
+	s.info.Name = name
+	s.info.Priority = PriorityFrom(ctx)
+	s.info.Origin = OriginFrom(ctx)
+	c.mu.Lock()
+	defer c.unlock()
+	if done := c.removingDir(key); done != nil {
+		return nil, done
+	}
+	if _, ok := c.streams.get(key); ok {
+		return nil, nil
+	}
+	c.retireTombstone(key)
+	c.streams.put(key, s, EntryFilling)
+	return s, nil
+}
+
+// UnknownSize can be passed to Get for entries whose size isn't known in
+// advance, an existing entry of any size is then a hit.
+const UnknownSize int64 = -1
+
+// lookup returns the Stream for name if it exists and can be used to serve
+// size bytes, a Stream of the wrong size is removed.
+func (c *FsCache) lookup(name string, size int64) (*Stream, error) {
 	s, ok := c.getStream(name)
-	if ok {
-		actual_size, err := s.Size()
-		if err != nil && !os.IsNotExist(err) {
-			return nil, nil, err
+	if !ok {
+		return nil, nil
+	}
+	if s.IsOpen() {
+		// its file may not have been created yet.
+		return s, nil
+	}
+	actual_size, err := s.Size()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil && (size == actual_size || size == UnknownSize ||
+		len(c.codecs) > 0) {
+		return s, nil
+	}
+
+	if size != actual_size {
+		// its Readers keep its file while the new entry gets a fresh one.
+		c.discard(s)
+	}
+	return nil, nil
+}
+
+// Get implements Cache.Get, its errors are CacheErrors.
+func (c *FsCache) Get(name string, size int64) (r ReaderAtCloser, w io.WriteCloser, err error) {
+	r, w, err = c.get(context.Background(), name, size, false)
+	return r, w, wrapError(OpGet, name, err)
+}
+
+// GetContext is like Get, but if filling name would exceed one of the writer
+// limits of the cache it waits for a free slot until ctx is done. The entry
+// is tagged with the priority of ctx, see WithPriority.
+func (c *FsCache) GetContext(ctx context.Context, name string, size int64) (
+	r ReaderAtCloser, w io.WriteCloser, err error) {
+	r, w, err = c.get(ctx, name, size, true)
+	return r, w, wrapError(OpGet, name, err)
+}
+
+// GetResult is the outcome of GetEntry.
+type GetResult struct {
+	Reader ReaderAtCloser // must be Closed
+	Writer io.WriteCloser // the writer of the fill on a miss, nil on a hit
+
+	// Hit reports whether the entry was already cached, possibly still
+	// being filled by another caller, or is being restored by the cache.
+	// Otherwise the caller must fill the entry with Writer and Close it.
+	Hit bool
+
+	// Version is the Version of the entry Reader reads, see Replace.
+	Version Version
+}
+
+// GetEntry is like GetContext but returns a GetResult, so that hits don't
+// have to be told from misses by a nil writer. On errors, including a miss
+// whose fill couldn't be started, no Reader or Writer is left open.
+func (c *FsCache) GetEntry(ctx context.Context, name string, size int64) (
+	GetResult, error) {
+	s, r, w, err := c.getEntry(ctx, name, size, true)
+	if err != nil {
+		return GetResult{}, wrapError(OpGet, name, err)
+	}
+	return GetResult{Reader: r, Writer: w, Hit: w == nil,
+		Version: s.Version()}, nil
+}
+
+func (c *FsCache) get(ctx context.Context, name string, size int64,
+	wait bool) (r ReaderAtCloser, w io.WriteCloser, err error) {
+	_, r, w, err = c.getEntry(ctx, name, size, wait)
+	return r, w, err
+}
+
+// getEntry is like get but also returns the Stream r reads.
+func (c *FsCache) getEntry(ctx context.Context, name string, size int64,
+	wait bool) (s *Stream, r ReaderAtCloser, w io.WriteCloser, err error) {
+	for {
+		s, r, w, err = c.getOnce(ctx, name, size, wait)
+		if err != ErrEntryExists && err != ErrRemoving {
+			return s, r, w, err
 		}
+		// another Get created the entry after the lookup, or it's being
+		// removed: look it up again, and fill a fresh one if needed.
+	}
+}
+
+func (c *FsCache) getOnce(ctx context.Context, name string, size int64,
+	wait bool) (s *Stream, r ReaderAtCloser, w io.WriteCloser, err error) {
+	if err := c.validate(name); err != nil {
+		return nil, nil, nil, err
+	}
+	s, err = c.lookup(name, size)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if s != nil {
+		r, err := c.open(ctx, name, s, wait)
+		return s, r, nil, err
+	}
+
+	s, r, w, err = c.miss(ctx, name, size, wait)
+	if err != nil || w == nil {
+		return s, r, nil, err
+	}
+
+	reader, err := s.NextReader()
+	if err != nil {
+		w.Close()
+		c.discard(s)
+		return nil, nil, nil, err
+	}
+
+	return s, c.wrapReader(name, reader), w, nil
+}
+
+// miss starts filling name, which isn't in the cache. If it's archived it's
+// restored instead and r reads the restored entry, w is nil then. If filling
+// it failed recently that error is returned, see FillRetry.NegativeTTL.
+func (c *FsCache) miss(ctx context.Context, name string, size int64,
+	wait bool) (s *Stream, r ReaderAtCloser, w io.WriteCloser, err error) {
+	key := c.key(name)
+	if err := c.failure(key); err != nil {
+		return nil, nil, nil, err
+	}
+	if r, s, err := c.restore(ctx, name, size, wait); s != nil ||
+		err != nil {
+		return s, r, nil, err
+	}
+
+	c.ghostMiss(key)
+	s, w, err = c.create(ctx, name, size, wait)
+	return s, nil, w, err
+}
+
+// open returns a Reader of the cached entry s, recording the hit. If s has
+// WithMaxReaders open it waits for one to be closed if wait is true.
+func (c *FsCache) open(ctx context.Context, name string, s *Stream,
+	wait bool) (ReaderAtCloser, error) {
+	c.mu.RLock()
+	max := c.max_readers
+	c.mu.RUnlock()
+	r, err := s.nextReader(ctx, max, wait)
+	if err != nil {
+		return nil, err
+	}
+	s.raisePriority(PriorityFrom(ctx))
+	s.hit()
+	c.indexHit(s.info.Key)
+	c.recordAccess(s.info.Key)
+	return c.wrapReader(name, r), nil
+}
 
-		if err == nil && (s.IsOpen() || size == actual_size) {
-			r, err := s.NextReader()
-			return r, nil, err
+// GetIfExists returns a Reader of name if it's in the cache, atomically
+// unlike Exists followed by Get, and ok is false otherwise. It never starts
+// a fill. Errors are CacheErrors.
+func (c *FsCache) GetIfExists(name string) (r ReaderAtCloser, ok bool,
+	err error) {
+	if err := c.validate(name); err != nil {
+		return nil, false, wrapError(OpGet, name, err)
+	}
+	s, err := c.lookup(name, UnknownSize)
+	if err != nil || s == nil {
+		return nil, false, wrapError(OpGet, name, err)
+	}
+	r, err = c.open(context.Background(), name, s, false)
+	if err == ErrRemoving {
+		// removed since the lookup.
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, wrapError(OpGet, name, err)
+	}
+	return r, true, nil
+}
+
+// GetWriterOnly implements WriterOnlyCache.GetWriterOnly, its errors are
+// CacheErrors.
+func (c *FsCache) GetWriterOnly(name string, size int64) (w io.WriteCloser, err error) {
+	if err := c.validate(name); err != nil {
+		return nil, wrapError(OpGet, name, err)
+	}
+	s, err := c.lookup(name, size)
+	if err != nil || s != nil {
+		return nil, wrapError(OpGet, name, err)
+	}
+
+	_, r, w, err := c.miss(context.Background(), name, size, false)
+	if r != nil {
+		// being restored from its archived copy.
+		return nil, wrapError(OpGet, name, r.Close())
+	}
+	switch err {
+	case ErrEntryExists:
+		// created by another Get since the lookup.
+		return nil, nil
+	case ErrRemoving:
+		// removed since the lookup, look it up again.
+		return c.GetWriterOnly(name, size)
+	}
+	return w, wrapError(OpGet, name, err)
+}
+
+// GetMulti looks up all names in one locked pass, returning a Reader for each
+// entry in the cache and the names which aren't. Unlike Get it never starts a
+// fill, misses are left to the caller. The Readers must be closed, even when
+// an error is returned for an invalid name no Readers are open.
+func (c *FsCache) GetMulti(names []string) (
+	readers map[string]ReaderAtCloser, misses []string, err error) {
+	for _, name := range names {
+		if err := c.validate(name); err != nil {
+			return nil, nil, wrapError(OpGet, name, err)
 		}
+	}
+
+	found := make([]*Stream, len(names))
+	c.mu.RLock()
+	for i, name := range names {
+		found[i], _ = c.streams.get(c.key(name))
+	}
+	c.mu.RUnlock()
 
-		if size != actual_size {
-			c.deleteStream(fileName(name), true)
+	c.mu.RLock()
+	max := c.max_readers
+	c.mu.RUnlock()
+	readers = make(map[string]ReaderAtCloser, len(names))
+	for i, name := range names {
+		if _, ok := readers[name]; ok {
+			continue
+		}
+		s := found[i]
+		if s == nil {
+			misses = append(misses, name)
+			continue
+		}
+		r, err := s.nextReader(context.Background(), max, false)
+		if err == ErrTooManyReaders {
+			for _, r := range readers {
+				r.Close()
+			}
+			return nil, nil, wrapError(OpGet, name, err)
 		}
+		if err != nil {
+			// removed since the lookup.
+			misses = append(misses, name)
+			continue
+		}
+		s.hit()
+		c.indexHit(s.info.Key)
+		c.recordAccess(s.info.Key)
+		readers[name] = c.wrapReader(name, r)
 	}
+	return readers, misses, nil
+}
 
-	s = c.createStream(name)
-	writer, err := s.GetWriter()
+// create adds a new stream for name to the cache and returns its writer.
+func (c *FsCache) create(ctx context.Context, name string, size int64,
+	wait bool) (*Stream, io.WriteCloser, error) {
+	if writeAtFrom(ctx) && !c.supportsWriteAt() {
+		return nil, nil, ErrWriteAtUnsupported
+	}
+	s, w, err := c.fill(ctx, name, size, wait)
 	if err != nil {
 		return nil, nil, err
 	}
+	if writeAtFrom(ctx) {
+		w.Writer.writeAt()
+		return s, w, nil
+	}
+	return s, c.wrapWriter(name, w), nil
+}
 
-	r, err = s.NextReader()
+// fill is like create but returns the writer without middleware. It fails
+// with ErrEntryExists if another Get created the entry since the lookup, and
+// with ErrRemoving if it was removed before the writer was handed out, or
+// once the RemovePrefix of name it waited for is done.
+func (c *FsCache) fill(ctx context.Context, name string, size int64,
+	wait bool) (*Stream, *cacheWriter, error) {
+	if err := c.beginWrite(ctx, wait); err != nil {
+		return nil, nil, err
+	}
+	release, err := c.acquireWriter(ctx, wait)
 	if err != nil {
-		writer.Close()
-		s.Remove()
+		c.endWrite()
 		return nil, nil, err
 	}
 
-	return r, writer, err
+	s, removing := c.createStream(ctx, name, size)
+	if s == nil {
+		release()
+		c.endWrite()
+		if removing == nil {
+			return nil, nil, ErrEntryExists
+		}
+		select {
+		case <-removing:
+			return nil, nil, ErrRemoving
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+	writer, err := s.GetWriter()
+	if err == NoWriter {
+		// removed since it was created.
+		err = ErrRemoving
+	}
+	if err != nil {
+		release()
+		c.endWrite()
+		return nil, nil, err
+	}
+	return s, c.trackWriter(s, writer, release), nil
 }
 
+// Remove implements Cache.Remove, its errors are CacheErrors.
 func (c *FsCache) Remove(name string) error {
-	key := fileName(name)
-	return c.deleteStream(key, true)
+	_, err := c.RemoveInfo(name)
+	return err
 }
 
-func (c *FsCache) Clean() error {
+// RemoveResult describes what RemoveInfo deleted.
+type RemoveResult struct {
+	Existed bool  // whether name was in the cache
+	Freed   int64 // the bytes reclaimed on disk, after the grace of WithTrash
+}
+
+// RemoveInfo is like Remove, and also reports whether the entry existed and
+// how many bytes deleting it freed, so callers can keep their own accounting.
+func (c *FsCache) RemoveInfo(name string) (RemoveResult, error) {
+	key := c.key(name)
+	defer c.unarchive(key)
+	s, ok := c.popRemoving(key)
+	if !ok {
+		return RemoveResult{}, nil
+	}
+
+	// files are not deleted while a snapshot is being taken.
+	c.awaitSnapshot()
+	s.grp.Wait()
+	size, err := s.Size()
+	if err != nil {
+		// a fill which never wrote anything.
+		size = 0
+	}
+	if err := c.removeTombstone(key, s); err != nil {
+		return RemoveResult{Existed: true}, wrapError(OpRemove, name, err)
+	}
+	return RemoveResult{Existed: true, Freed: size}, nil
+}
+
+// RemoveContext is like Remove but gives up when ctx is done instead of
+// blocking forever on open streams. The entry is removed from the cache
+// immediately, and if ctx expires first a tombstone is left behind which
+// deletes the file once its streams have been closed.
+func (c *FsCache) RemoveContext(ctx context.Context, name string) error {
+	key := c.key(name)
+	defer c.unarchive(key)
+	s, ok := c.popRemoving(key)
+	if !ok {
+		return nil
+	}
+	select {
+	case <-s.drained():
+	case <-ctx.Done():
+		c.bury(key, s)
+		return wrapError(OpRemove, name, ctx.Err())
+	}
+	return wrapError(OpRemove, name, c.removeTombstone(key, s))
+}
+
+// ForceRemove removes the entry from the cache immediately without waiting
+// for open streams. The file is deleted once they have all been closed.
+func (c *FsCache) ForceRemove(name string) error {
+	key := c.key(name)
+	defer c.unarchive(key)
+	s, ok := c.popRemoving(key)
+	if ok {
+		c.bury(key, s)
+	}
+	return nil
+}
+
+// popRemoving removes the stream of key from the cache and makes it its
+// tombstone until its file is deleted, see retireTombstone.
+func (c *FsCache) popRemoving(key string) (*Stream, bool) {
+	c.mu.Lock()
+	defer c.unlock()
+	s, ok := c.streams.delete(key)
+	if ok {
+		s.markRemoving()
+		c.tombstones[key] = s
+	}
+	return s, ok
+}
+
+// tombstoneLocked makes the removed stream s the tombstone of key and
+// deletes its file once it has drained, c.mu must be held.
+func (c *FsCache) tombstoneLocked(key string, s *Stream) {
+	c.tombstones[key] = s
+	c.bury(key, s)
+}
+
+// bury deletes the file of the tombstone s of key once it has drained.
+func (c *FsCache) bury(key string, s *Stream) {
+	go func() {
+		<-s.drained()
+		c.awaitSnapshot()
+		if err := c.removeTombstone(key, s); err != nil {
+			logger.Error(err)
+		}
+	}()
+}
+
+// removeTombstone deletes the file of the tombstone s of key, unless a new
+// entry of key retired it in the meantime.
+func (c *FsCache) removeTombstone(key string, s *Stream) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.streams = make(map[string]*Stream)
-	return os.RemoveAll(c.root)
+	if c.tombstones[key] != s {
+		return nil
+	}
+	delete(c.tombstones, key)
+	return c.removeFile(s)
+}
+
+// retireTombstone lets a new entry of key, e.g. a Get racing a Remove, start
+// from a fresh file: the file of the tombstone of key is deleted right away,
+// its open Readers keep reading it, and the tombstone no longer touches the
+// name, see Stream.retire. c.mu must be held.
+func (c *FsCache) retireTombstone(key string) {
+	s := c.tombstones[key]
+	if s == nil {
+		return
+	}
+	delete(c.tombstones, key)
+	s.retire()
+	if err := c.removeFile(s); err != nil && !os.IsNotExist(err) {
+		logger.Error(err)
+	}
+}
+
+// TryLock acquires the advisory lock for name without blocking, and reports
+// whether it succeeded. The lock is in-process only and does not affect Get
+// or Remove, it lets callers serialize higher-level operations on a key
+// (e.g. validate-then-replace).
+func (c *FsCache) TryLock(name string) bool {
+	return c.locks.tryLock(c.key(name))
+}
+
+// Lock acquires the advisory lock for name, blocking until it is available.
+func (c *FsCache) Lock(name string) {
+	c.locks.lock(c.key(name))
+}
+
+// Unlock releases the advisory lock for name. It panics if name is not locked.
+func (c *FsCache) Unlock(name string) {
+	c.locks.unlock(c.key(name))
+}
+
+// Clean implements Cache.Clean. The cache folder is moved aside and deleted
+// in the background, so the cache is empty and can be used again right away.
+// Close waits for the deletion to finish.
+func (c *FsCache) Clean() error {
+	c.mu.Lock()
+	defer c.unlock()
+	c.streams.clear()
+	c.tombstones = make(map[string]*Stream)
+	c.stopTrash()
+	if _, ok := c.fs.(Lister); ok {
+		keys, err := c.keys()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := c.fs.Remove(c.getPath(key)); err != nil {
+				return err
+			}
+		}
+	}
+	return c.removeAside(c.root)
 }
 
 func (c *FsCache) getPath(name string) string {
 	return filepath.Join(c.root, name)
 }
 
+// startReaper (re)starts the reaper for the current expiry, c.mu must be held.
+func (c *FsCache) startReaper() {
+	if c.stop_reaper != nil {
+		c.stop_reaper()
+		c.stop_reaper = nil
+	}
+	if c.expiry <= 0 || c.shutdown {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stop_reaper = cancel
+	go c.ReapEvery(ctx, c.expiry)
+}
+
 func (c *FsCache) ReapEvery(ctx context.Context, reap_interval time.Duration) {
-	ticker := time.NewTicker(reap_interval)
-	defer ticker.Stop()
+	c.mu.RLock()
+	jitter := c.reap_jitter
+	c.mu.RUnlock()
+	next := func() time.Duration {
+		if jitter <= 0 {
+			return reap_interval
+		}
+		return reap_interval + time.Duration(rand.Int63n(int64(jitter)))
+	}
+
+	timer := time.NewTimer(next())
+	defer timer.Stop()
 	done := ctx.Done()
 	for {
 		select {
-		case <-ticker.C:
+		case <-timer.C:
 			c.reap(reap_interval)
+			c.logLeaks()
+			timer.Reset(next())
 		case <-done:
 			return
 		}
 	}
 }
 
+// WithReapJitter delays each pass of the reaper by a random duration up to
+// jitter, so that many caches started at once, e.g. by a fleet restart, don't
+// all scan their directories at the same instant.
+func WithReapJitter(jitter time.Duration) Option {
+	return func(c *FsCache) {
+		c.reap_jitter = jitter
+	}
+}
+
 func (c *FsCache) reap(reap_interval time.Duration) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	if c.paused > 0 {
+		c.mu.Unlock()
+		return
+	}
+	c.last_reap = c.clock.Now()
+	pacing := c.reap_pacing
 
-	for key, s := range c.streams {
+	var expired []string
+	var bytes int64
+	c.streams.each(func(key string, s *Stream) bool {
 		if s.IsOpen() {
-			continue
+			return true
 		}
 
 		lastRead, _, err := c.fs.AccessTimes(s.Name())
 		if err != nil {
 			logger.Error(err)
-			continue
+			return true
 		}
 
-		if lastRead.Before(nowHook().Add(-reap_interval)) {
-			err = c.deleteStream(key, false)
-			if err != nil {
+		if lastRead.Before(c.clock.Now().Add(-c.ttl(s, reap_interval))) {
+			if pacing.bytes > 0 {
+				size, _ := s.Size()
+				if bytes+size > pacing.bytes && len(expired) > 0 {
+					return false
+				}
+				bytes += size
+			}
+			expired = append(expired, key)
+		}
+		return pacing.entries <= 0 || len(expired) < pacing.entries
+	})
+	c.mu.Unlock()
+
+	for i, key := range expired {
+		if i > 0 && pacing.pause > 0 {
+			time.Sleep(pacing.pause)
+		}
+		c.mu.Lock()
+		if c.paused > 0 {
+			c.mu.Unlock()
+			return
+		}
+		if s, ok := c.streams.get(key); ok && !s.IsOpen() {
+			if err := c.evict(key, EvictionExpired); err != nil {
 				logger.Error(err)
-				continue
 			}
 		}
+		c.unlock()
+	}
+}
+
+// reapPacing limits the deletions of a pass of the reaper, see
+// WithReapPacing.
+type reapPacing struct {
+	entries int
+	bytes   int64
+	pause   time.Duration
+}
+
+// WithReapPacing makes each pass of the reaper delete at most max_entries
+// expired entries totalling at most max_bytes, zero meaning no limit, and
+// sleep for pause between deletions. A mass expiry is then spread over
+// several passes instead of competing with foreground I/O, the entries left
+// over are deleted by the following passes.
+func WithReapPacing(max_entries int, max_bytes int64,
+	pause time.Duration) Option {
+	return func(c *FsCache) {
+		c.reap_pacing = reapPacing{
+			entries: max_entries,
+			bytes:   max_bytes,
+			pause:   pause,
+		}
 	}
-	return
 }
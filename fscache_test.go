@@ -2,10 +2,18 @@ package fscache
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -37,6 +45,53 @@ func TestLoad(t *testing.T) {
 	r.Close()
 }
 
+func TestLoadReport(t *testing.T) {
+	test := Wrap(t, "fscache")
+	defer test.Close()
+	test.CreateFile("empty").Close()
+	f := test.CreateFile("full")
+	_, err := f.Write([]byte("hello"))
+	test.AssertNoError(err)
+	f.Close()
+
+	cache, err := New(test.Dir(), 0700, 0, WithKeepEmpty())
+	test.AssertNoError(err)
+	report := cache.LoadReport()
+	test.Assert(report.Entries == 2 && report.Bytes == 5 &&
+		report.Empty == 1 && len(report.Unreadable) == 0,
+		fmt.Sprintf("unexpected report %+v", report))
+
+	cache, err = New(test.Dir(), 0700, 0)
+	test.AssertNoError(err)
+	report = cache.LoadReport()
+	test.Assert(report.Entries == 1 && report.Empty == 1,
+		fmt.Sprintf("unexpected report %+v", report))
+	test.Assert(!cache.Exists("empty"), "expected empty file to be removed")
+	_, err = os.Stat(filepath.Join(test.Dir(), "empty"))
+	test.Assert(os.IsNotExist(err), "expected empty file to be removed")
+}
+
+func TestParallelLoad(t *testing.T) {
+	test := Wrap(t, "fscache")
+	defer test.Close()
+	// more than a page of the directory.
+	n := 2*loadPage + 5
+	for i := 0; i < n; i++ {
+		err := ioutil.WriteFile(filepath.Join(test.Dir(), fileName(
+			fmt.Sprint(i))), []byte("hello"), 0600)
+		test.AssertNoError(err)
+	}
+
+	cache, err := New(test.Dir(), 0700, 0, WithLoadConcurrency(4))
+	test.AssertNoError(err)
+	report := cache.LoadReport()
+	test.Assert(report.Entries == n && report.Bytes == int64(5*n),
+		fmt.Sprintf("unexpected report %+v", report))
+	for i := 0; i < n; i++ {
+		test.Assert(cache.Exists(fmt.Sprint(i)), "expected entry to load")
+	}
+}
+
 func TestReload(t *testing.T) {
 	test := Wrap(t, "fscache")
 	defer test.Close()
@@ -117,6 +172,35 @@ func TestReaperNoExpire(t *testing.T) {
 	test.Assert(test.cache.Exists("stream"), "stream should exist")
 }
 
+func TestPauseJanitor(t *testing.T) {
+	reap_interval := time.Second
+	test := NewMemFsCacheTest(t, reap_interval)
+	defer test.Close()
+
+	test.SetNow(2016, time.September, 1, 0, 0, 0, 0)
+	r, w, err := test.cache.Get("stream", 5)
+	test.AssertNoError(err)
+	n := test.AssertWrite(w, []byte("hello"))
+	test.AssertRead(r, n)
+	r.Close()
+
+	test.cache.PauseJanitor()
+	test.cache.PauseJanitor()
+	test.SetNow(2016, time.September, 1, 0, 0, 4, 0)
+	test.cache.reap(reap_interval)
+	test.Assert(test.cache.Exists("stream"), "paused janitor should not reap")
+
+	test.cache.ResumeJanitor()
+	test.Assert(test.cache.JanitorPaused(), "pauses should nest")
+	test.cache.reap(reap_interval)
+	test.Assert(test.cache.Exists("stream"), "paused janitor should not reap")
+
+	test.cache.ResumeJanitor()
+	test.Assert(!test.cache.JanitorPaused(), "expected janitor to resume")
+	test.cache.reap(reap_interval)
+	test.Assert(!test.cache.Exists("stream"), "stream should have been reaped")
+}
+
 func TestWrongSize(t *testing.T) {
 	test := NewFsCacheTest(t)
 	defer test.Close()
@@ -212,36 +296,363 @@ func TestSize(t *testing.T) {
 		fmt.Sprintf("expected: %d, got: %d", len(to_write), l))
 }
 
+func TestGetWriterOnly(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+
+	to_write := []byte("hello")
+	w, err := test.cache.GetWriterOnly("stream", int64(len(to_write)))
+	test.AssertNoError(err)
+	test.Assert(w != nil, "writer should not be nil")
+	test.AssertWrite(w, to_write)
+
+	s, ok := test.cache.getStream("stream")
+	test.Assert(ok, "expected stream to exist")
+	test.Assert(!s.IsOpen(), "no readers should be left open")
+
+	w, err = test.cache.GetWriterOnly("stream", int64(len(to_write)))
+	test.AssertNoError(err)
+	test.Assert(w == nil, "writer should be nil")
+
+	r, w, err := test.cache.Get("stream", int64(len(to_write)))
+	test.AssertNoError(err)
+	test.Assert(w == nil, "writer should be nil")
+	test.AssertRead(r, len(to_write))
+	r.Close()
+}
+
+func TestAbandonedFill(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+
+	r, w, err := test.cache.Get("stream", 5)
+	test.AssertNoError(err)
+	files, err := ioutil.ReadDir(test.Dir())
+	test.AssertNoError(err)
+	test.Assert(len(files) == 0, "expected the file to be created lazily")
+	test.AssertNoError(w.Close())
+	test.AssertRead(r, 0)
+	test.AssertNoError(r.Close())
+	test.Assert(!test.cache.Exists("stream"), "expected entry to be dropped")
+
+	r, w, err = test.cache.Get("empty", 0)
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+	r, w, err = test.cache.Get("empty", 0)
+	test.AssertNoError(err)
+	test.Assert(w == nil, "expected empty entries to be kept")
+	test.AssertNoError(r.Close())
+}
+
+func TestLeakDetection(t *testing.T) {
+	test := Wrap(t, "fstest")
+	defer test.Close()
+	clock := &testClock{}
+	clock.Set(time.Date(2016, time.September, 1, 0, 0, 0, 0, time.UTC))
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0,
+		WithLeakDetection(time.Minute), WithClock(clock))
+	test.AssertNoError(err)
+
+	r, w, err := cache.Get("stream", 5)
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.Assert(len(cache.DumpLeaks()) == 0, "nothing has leaked yet")
+
+	clock.Set(clock.Now().Add(2 * time.Minute))
+	leaks := cache.DumpLeaks()
+	test.Assert(len(leaks) == 1, fmt.Sprintf("expected 1 leak, got %d",
+		len(leaks)))
+	test.Assert(leaks[0].Kind == "reader", "expected the reader to leak")
+	test.Assert(strings.Contains(leaks[0].Stack, "TestLeakDetection"),
+		"expected the stack to point at the test")
+
+	r.Close()
+	test.Assert(len(cache.DumpLeaks()) == 0, "expected no leaks after close")
+}
+
+func TestRemoveContext(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+
+	for _, force := range []bool{false, true} {
+		r, w, err := test.cache.Get("stream", 5)
+		test.AssertNoError(err)
+		test.AssertWrite(w, []byte("hello"))
+		path := r.(*Reader).Name()
+
+		if force {
+			test.AssertNoError(test.cache.ForceRemove("stream"))
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(),
+				10*time.Millisecond)
+			err = test.cache.RemoveContext(ctx, "stream")
+			cancel()
+			test.Assert(errors.Is(err, context.DeadlineExceeded),
+				"expected remove to time out")
+		}
+		test.Assert(!test.cache.Exists("stream"), "expected entry to be removed")
+		_, err = os.Stat(path)
+		test.AssertNoError(err)
+
+		test.AssertRead(r, 5)
+		r.Close()
+		for i := 0; i < 100; i++ {
+			if _, err = os.Stat(path); os.IsNotExist(err) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		test.Assert(os.IsNotExist(err), "expected tombstone to delete the file")
+	}
+}
+
+func TestContentSniffing(t *testing.T) {
+	test := Wrap(t, "fstest")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0, WithContentSniffing())
+	test.AssertNoError(err)
+
+	_, err = cache.Info("page")
+	test.Assert(errors.Is(err, ErrNotFound), "expected ErrNotFound")
+
+	page := []byte("<html><body>" + strings.Repeat("x", 1024))
+	w, err := cache.GetWriterOnly("page", int64(len(page)))
+	test.AssertNoError(err)
+	_, err = w.Write(page)
+	test.AssertNoError(err)
+	info, err := cache.Info("page")
+	test.AssertNoError(err)
+	test.Assert(info.ContentType == "text/html; charset=utf-8",
+		"expected content type once 512 bytes are written, got "+
+			info.ContentType)
+	test.Assert(info.Key == fileName("page"), "unexpected key "+info.Key)
+	test.AssertNoError(w.Close())
+
+	w, err = cache.GetWriterOnly("text", 5)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	info, err = cache.Info("text")
+	test.AssertNoError(err)
+	test.Assert(info.ContentType == "text/plain; charset=utf-8",
+		"expected content type after close, got "+info.ContentType)
+	test.Assert(info.Size == 5, "unexpected size")
+}
+
+func TestKeyLock(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+
+	test.Assert(test.cache.TryLock("key"), "expected lock to be acquired")
+	test.Assert(!test.cache.TryLock("key"), "expected lock to be held")
+	test.Assert(test.cache.TryLock("other"), "expected other key to be free")
+
+	locked := make(chan struct{})
+	go func() {
+		test.cache.Lock("key")
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Lock should block while the key is held")
+	case <-time.After(10 * time.Millisecond):
+	}
+	test.cache.Unlock("key")
+	<-locked
+	test.cache.Unlock("key")
+	test.cache.Unlock("other")
+}
+
 ////////////////////////////////////////////////////////////////////////////
 // Helpers
 ////////////////////////////////////////////////////////////////////////////
 
+func TestDurableFs(t *testing.T) {
+	test := Wrap(t, "fscache")
+	defer test.Close()
+	fs, err := NewDurableFs(test.Dir(), 0700)
+	test.AssertNoError(err)
+	cache, err := NewCache(test.Dir(), fs, 0,
+		WithKeyEncoding(HierarchicalKeys(0)))
+	test.AssertNoError(err)
+
+	r, w, err := cache.Get("a/b/c", -1)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+	_, err = os.Stat(filepath.Join(test.Dir(), "a", "b", "c"))
+	test.AssertNoError(err)
+
+	test.AssertNoError(cache.Remove("a/b/c"))
+	_, err = os.Stat(filepath.Join(test.Dir(), "a", "b", "c"))
+	test.Assert(os.IsNotExist(err), "expected file to be removed")
+}
+
+func TestAdopt(t *testing.T) {
+	for _, mem := range []bool{false, true} {
+		var test *FsCacheTest
+		if mem {
+			test = NewMemFsCacheTest(t, time.Hour)
+		} else {
+			test = NewFsCacheTest(t)
+		}
+		src, err := ioutil.TempDir("", "adopt")
+		test.AssertNoError(err)
+		defer os.RemoveAll(src)
+		path := filepath.Join(src, "file")
+		test.AssertNoError(ioutil.WriteFile(path, []byte("hello"), 0600))
+
+		test.AssertNoError(test.cache.Adopt("adopted", path))
+		r, w, err := test.cache.Get("adopted", 5)
+		test.AssertNoError(err)
+		test.Assert(w == nil, "expected adopted entry to be complete")
+		p, err := ioutil.ReadAll(r)
+		test.AssertNoError(err)
+		test.AssertByteEqual([]byte("hello"), p)
+		test.AssertNoError(r.Close())
+		if !mem {
+			src_fi, err := os.Stat(path)
+			test.AssertNoError(err)
+			entry_fi, err := os.Stat(filepath.Join(test.Dir(),
+				fileName("adopted")))
+			test.AssertNoError(err)
+			test.Assert(os.SameFile(src_fi, entry_fi),
+				"expected the file to be linked")
+		}
+
+		err = test.cache.Adopt("adopted", path)
+		test.Assert(errors.Is(err, ErrEntryExists),
+			"expected adopting an entry twice to fail")
+		test.Close()
+	}
+}
+
+func TestExport(t *testing.T) {
+	for _, mem := range []bool{false, true} {
+		var test *FsCacheTest
+		if mem {
+			test = NewMemFsCacheTest(t, time.Hour)
+		} else {
+			test = NewFsCacheTest(t)
+		}
+		dir, err := ioutil.TempDir("", "export")
+		test.AssertNoError(err)
+		defer os.RemoveAll(dir)
+		dst := filepath.Join(dir, "artifact")
+		test.AssertNoError(ioutil.WriteFile(dst, []byte("old"), 0600))
+
+		_, err = test.cache.Export("missing", dst)
+		test.Assert(errors.Is(err, ErrNotFound), "expected ErrNotFound")
+		r, w, err := test.cache.Get("entry", -1)
+		test.AssertNoError(err)
+		test.AssertNoError(r.Close())
+		_, err = test.cache.Export("entry", dst)
+		test.Assert(errors.Is(err, ErrIncomplete),
+			"expected ErrIncomplete while filling")
+		test.AssertWrite(w, []byte("hello"))
+
+		unpin, err := test.cache.Export("entry", dst)
+		test.AssertNoError(err)
+		p, err := ioutil.ReadFile(dst)
+		test.AssertNoError(err)
+		test.AssertByteEqual([]byte("hello"), p)
+		s, ok := test.cache.getStream("entry")
+		test.Assert(ok && s.IsOpen(), "expected exported entry to be pinned")
+		test.AssertNoError(unpin())
+		test.Assert(!s.IsOpen(), "expected entry to be unpinned")
+		test.Close()
+	}
+}
+
+func TestVerification(t *testing.T) {
+	test := Wrap(t, "fscache")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0, WithVerification(4))
+	test.AssertNoError(err)
+	data := []byte("hello world!")
+	r, w, err := cache.Get("entry", -1)
+	test.AssertNoError(err)
+	_, err = w.Write(data)
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+
+	r, _, err = cache.Get("entry", -1)
+	test.AssertNoError(err)
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual(data, p)
+	test.AssertNoError(r.Close())
+
+	// flip a byte of the second chunk on disk.
+	f, err := os.OpenFile(filepath.Join(test.Dir(), fileName("entry")),
+		os.O_WRONLY, 0)
+	test.AssertNoError(err)
+	_, err = f.WriteAt([]byte("X"), 5)
+	test.AssertNoError(err)
+	f.Close()
+
+	r, _, err = cache.Get("entry", -1)
+	test.AssertNoError(err)
+	buf := make([]byte, 4)
+	_, err = r.ReadAt(buf, 0)
+	test.AssertNoError(err)
+	_, err = r.ReadAt(buf, 4)
+	test.Assert(errors.Is(err, ErrCorrupted), "expected ErrCorrupted")
+	test.AssertNoError(r.Close())
+	test.Assert(!cache.Exists("entry"), "expected corrupted entry removed")
+}
+
+func TestEntryReader(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+
+	r, w, err := test.cache.Get("stream", 10)
+	test.AssertNoError(err)
+	er, ok := r.(EntryReader)
+	test.Assert(ok, "expected Get to return an EntryReader")
+	test.Assert(!er.Complete(), "expected entry to be incomplete")
+	test.Assert(er.ContentLength() == 10, "expected requested size")
+
+	test.AssertWrite(w, []byte("hello"))
+	test.Assert(er.Complete(), "expected entry to be complete")
+	test.Assert(er.ContentLength() == 5, "expected written size")
+	test.Assert(!er.ModTime().IsZero(), "expected a modification time")
+	test.AssertNoError(r.Close())
+}
+
 type FsCacheTest struct {
 	*Test
-	cache             *FsCache
-	original_now_hook func() time.Time
+	cache *FsCache
+	clock *testClock
 }
 
 func NewFsCacheTest(t *testing.T) *FsCacheTest {
 	test := Wrap(t, "fstest")
-	c, err := New(test.Dir(), 0700, 1*time.Hour)
+	clock := &testClock{}
+	c, err := New(test.Dir(), 0700, 1*time.Hour, WithClock(clock))
 	test.AssertNoError(err)
 	return &FsCacheTest{
-		Test:              test,
-		cache:             c,
-		original_now_hook: nowHook,
+		Test:  test,
+		cache: c,
+		clock: clock,
 	}
 }
 
 func NewMemFsCacheTest(t *testing.T, expiry time.Duration) *FsCacheTest {
 	test := Wrap(t, "fstest")
-	fs := NewMemFs()
-	c, err := NewCache(test.Dir(), fs, expiry)
+	clock := &testClock{}
+	fs := NewMemFsWithClock(clock)
+	c, err := NewCache(test.Dir(), fs, expiry, WithClock(clock))
 	test.AssertNoError(err)
 	return &FsCacheTest{
-		Test:              test,
-		cache:             c,
-		original_now_hook: nowHook,
+		Test:  test,
+		cache: c,
+		clock: clock,
 	}
 }
 
@@ -262,12 +673,991 @@ func (t *FsCacheTest) AssertRead(r ReaderAtCloser, n int) {
 
 func (t *FsCacheTest) SetNow(year int, month time.Month, day, hour, min, sec,
 	nsec int) {
-	nowHook = func() time.Time {
-		return time.Date(year, month, day, hour, min, sec, nsec, time.UTC)
-	}
+	t.clock.Set(time.Date(year, month, day, hour, min, sec, nsec, time.UTC))
 }
 
 func (t *FsCacheTest) Close() {
 	t.Test.Close()
-	nowHook = t.original_now_hook
+}
+
+// testClock is a Clock which returns the system time until it's Set.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.now.IsZero() {
+		return time.Now()
+	}
+	return c.now
+}
+
+func (c *testClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func TestReadAtDuringRead(t *testing.T) {
+	for _, mem := range []bool{false, true} {
+		var test *FsCacheTest
+		if mem {
+			test = NewMemFsCacheTest(t, time.Hour)
+		} else {
+			test = NewFsCacheTest(t)
+		}
+		data := bytes.Repeat([]byte("0123456789"), 1000)
+		r, w, err := test.cache.Get("stream", int64(len(data)))
+		test.AssertNoError(err)
+		go func() {
+			for i := 0; i < len(data); i += 100 {
+				w.Write(data[i : i+100])
+			}
+			w.Close()
+		}()
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 5)
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				p := make([]byte, 7)
+				for i := 0; i < 200; i++ {
+					off := int64((g*7919 + i*131) % (len(data) - len(p)))
+					if _, err := r.ReadAt(p, off); err != nil {
+						errs <- err
+						return
+					}
+					if !bytes.Equal(p, data[off:off+int64(len(p))]) {
+						errs <- fmt.Errorf("ReadAt %d: got %q", off, p)
+						return
+					}
+				}
+			}(g)
+		}
+		var buf bytes.Buffer
+		p := make([]byte, 13)
+		for {
+			n, err := r.Read(p)
+			buf.Write(p[:n])
+			if err == io.EOF {
+				break
+			}
+			test.AssertNoError(err)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			test.AssertNoError(err)
+		}
+		test.AssertByteEqual(data, buf.Bytes())
+		test.AssertNoError(r.Close())
+		test.Close()
+	}
+}
+
+func TestSection(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+	r, w, err := test.cache.Get("stream", 10)
+	test.AssertNoError(err)
+	section := r.(EntryReader).Section(3, 4)
+
+	done := make(chan []byte)
+	go func() {
+		p, _ := ioutil.ReadAll(section)
+		done <- p
+	}()
+	_, err = w.Write([]byte("0123"))
+	test.AssertNoError(err)
+	select {
+	case <-done:
+		t.Fatal("section should block until its bytes are written")
+	case <-time.After(10 * time.Millisecond):
+	}
+	test.AssertWrite(w, []byte("456789"))
+	test.AssertByteEqual([]byte("3456"), <-done)
+
+	_, err = section.Seek(1, io.SeekStart)
+	test.AssertNoError(err)
+	p := make([]byte, 2)
+	_, err = io.ReadFull(section, p)
+	test.AssertNoError(err)
+	test.AssertByteEqual([]byte("45"), p)
+
+	test.AssertNoError(test.cache.ForceRemove("stream"))
+	_, err = section.ReadAt(p, 0)
+	test.Assert(err == ErrEntryRemoved, "expected ErrEntryRemoved")
+	test.AssertNoError(r.Close())
+}
+
+func TestReapPacing(t *testing.T) {
+	test := Wrap(t, "fscache")
+	defer test.Close()
+	clock := &testClock{}
+	clock.Set(time.Date(2016, time.September, 1, 0, 0, 0, 0, time.UTC))
+	c, err := NewCache(test.Dir(), NewMemFsWithClock(clock), 0,
+		WithClock(clock), WithReapPacing(3, 12, time.Millisecond))
+	test.AssertNoError(err)
+
+	names := []string{"a", "b", "c", "d", "e"}
+	for _, name := range names {
+		r, w, err := c.Get(name, 5)
+		test.AssertNoError(err)
+		_, err = w.Write([]byte("hello"))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+		test.AssertNoError(r.Close())
+	}
+	count := func() int {
+		n := 0
+		for _, name := range names {
+			if c.Exists(name) {
+				n++
+			}
+		}
+		return n
+	}
+
+	clock.Set(clock.Now().Add(time.Hour))
+	c.reap(time.Minute)
+	test.Assert(count() == 3, "expected 2 entries reaped")
+	c.reap(time.Minute)
+	test.Assert(count() == 1, "expected 2 more entries reaped")
+	c.reap(time.Minute)
+	test.Assert(count() == 0, "expected all entries reaped")
+}
+
+func TestReapJitter(t *testing.T) {
+	test := Wrap(t, "fscache")
+	defer test.Close()
+	c, err := NewCache(test.Dir(), NewMemFs(), 10*time.Millisecond,
+		WithReapJitter(10*time.Millisecond))
+	test.AssertNoError(err)
+	r, w, err := c.Get("stream", 5)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+
+	deadline := time.Now().Add(time.Second)
+	for c.Exists("stream") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	test.Assert(!c.Exists("stream"), "expected the jittered reaper to run")
+}
+
+func TestCacheError(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+	long := strings.Repeat("tenant/", 100) + "object"
+	_, err := test.cache.Size(long)
+	test.Assert(errors.Is(err, ErrNotFound), "expected ErrNotFound")
+	cerr, ok := err.(*CacheError)
+	test.Assert(ok && cerr.Op == "size", "expected a CacheError")
+	test.Assert(len(cerr.Key) < 100 && strings.HasPrefix(long, cerr.Key[:48]),
+		"expected the key to be truncated")
+	test.Assert(strings.Contains(err.Error(), "706 bytes"),
+		"expected the key length in "+err.Error())
+}
+
+func TestStreamCacheError(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+	r, w, err := test.cache.Get("stream", 5)
+	test.AssertNoError(err)
+	test.AssertWrite(w, []byte("hello"))
+	err = w.Close()
+	var cerr *CacheError
+	test.Assert(errors.As(err, &cerr) && cerr.Op == OpClose &&
+		cerr.Key == "stream" && errors.Is(err, ErrClosed),
+		"expected a CacheError closing twice")
+	_, err = w.Write([]byte("again"))
+	test.Assert(errors.As(err, &cerr) && cerr.Op == OpWrite,
+		"expected a CacheError writing after close")
+	test.AssertRead(r, 5)
+	test.AssertNoError(r.Close())
+}
+
+func TestRemoveInfo(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+	r, w, err := test.cache.Get("stream", 5)
+	test.AssertNoError(err)
+	test.AssertWrite(w, []byte("hello"))
+	test.AssertNoError(r.Close())
+
+	res, err := test.cache.RemoveInfo("stream")
+	test.AssertNoError(err)
+	test.Assert(res.Existed && res.Freed == 5, "expected 5 bytes freed")
+	res, err = test.cache.RemoveInfo("stream")
+	test.AssertNoError(err)
+	test.Assert(!res.Existed && res.Freed == 0, "expected already gone")
+}
+
+func TestGetMulti(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+	for _, name := range []string{"a", "b"} {
+		r, w, err := test.cache.Get(name, UnknownSize)
+		test.AssertNoError(err)
+		test.AssertWrite(w, []byte(name))
+		test.AssertNoError(r.Close())
+	}
+
+	readers, misses, err := test.cache.GetMulti([]string{"a", "c", "b", "a"})
+	test.AssertNoError(err)
+	test.Assert(len(readers) == 2, "expected 2 hits")
+	test.Assert(len(misses) == 1 && misses[0] == "c", "expected c to miss")
+	for name, r := range readers {
+		p, err := ioutil.ReadAll(r)
+		test.AssertNoError(err)
+		test.AssertByteEqual([]byte(name), p)
+		test.AssertNoError(r.Close())
+	}
+	test.Assert(!test.cache.Exists("c"), "GetMulti should not start fills")
+}
+
+func TestPrefetch(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+	r, w, err := test.cache.Get("cached", UnknownSize)
+	test.AssertNoError(err)
+	test.AssertWrite(w, []byte("old"))
+	test.AssertNoError(r.Close())
+
+	var mu sync.Mutex
+	fills := make(map[string]int)
+	p := test.cache.Prefetch(context.Background(),
+		[]string{"a", "cached", "b", "a", "fail"},
+		func(ctx context.Context, name string, w io.Writer) error {
+			mu.Lock()
+			fills[name]++
+			mu.Unlock()
+			if name == "fail" {
+				return errFail
+			}
+			_, err := w.Write([]byte(name))
+			return err
+		})
+	test.Assert(errors.Is(p.Wait(), errFail), "expected the fill error")
+	test.Assert(len(fills) == 3 && fills["a"] == 1,
+		fmt.Sprintf("unexpected fills %v", fills))
+	test.Assert(!test.cache.Exists("fail"), "failed fills should be removed")
+	for name, want := range map[string]string{
+		"a": "a", "b": "b", "cached": "old"} {
+		r, w, err := test.cache.Get(name, UnknownSize)
+		test.AssertNoError(err)
+		test.Assert(w == nil, "expected "+name+" to be cached")
+		p, err := ioutil.ReadAll(r)
+		test.AssertNoError(err)
+		test.AssertByteEqual([]byte(want), p)
+		test.AssertNoError(r.Close())
+	}
+}
+
+func TestPrefetchCancel(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+	started := make(chan struct{})
+	p := test.cache.Prefetch(context.Background(), []string{"slow"},
+		func(ctx context.Context, name string, w io.Writer) error {
+			w.Write([]byte("partial"))
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	<-started
+	p.Cancel()
+	test.Assert(errors.Is(p.Wait(), context.Canceled), "expected Canceled")
+	test.Assert(!test.cache.Exists("slow"), "canceled fills should be removed")
+}
+
+func TestGetAsync(t *testing.T) {
+	test := Wrap(t, "fstest")
+	defer test.Close()
+	release := make(chan struct{})
+	var fills int32
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0, WithFiller(
+		func(ctx context.Context, name string, w io.Writer) error {
+			atomic.AddInt32(&fills, 1)
+			<-release
+			if name == "fail" {
+				return errFail
+			}
+			_, err := w.Write([]byte(name))
+			return err
+		}))
+	test.AssertNoError(err)
+
+	// both Readers are returned while the fill is blocked.
+	r1, err := cache.GetAsync(context.Background(), "a")
+	test.AssertNoError(err)
+	r2, err := cache.GetAsync(context.Background(), "a")
+	test.AssertNoError(err)
+	rf, err := cache.GetAsync(context.Background(), "fail")
+	test.AssertNoError(err)
+	close(release)
+	for _, r := range []ReaderAtCloser{r1, r2} {
+		p, err := ioutil.ReadAll(r)
+		test.AssertNoError(err)
+		test.AssertByteEqual([]byte("a"), p)
+		test.AssertNoError(r.Close())
+	}
+	_, err = ioutil.ReadAll(rf)
+	test.Assert(errors.Is(err, errFail), "expected the fill error")
+	test.AssertNoError(rf.Close())
+	test.Assert(atomic.LoadInt32(&fills) == 2, "expected one fill per entry")
+	test.Assert(!cache.Exists("fail"), "failed fills should be removed")
+
+	cache, err = NewCache(test.Dir(), NewMemFs(), 0)
+	test.AssertNoError(err)
+	_, err = cache.GetAsync(context.Background(), "a")
+	test.Assert(errors.Is(err, ErrNoFiller), "expected ErrNoFiller")
+}
+
+func TestFillMux(t *testing.T) {
+	test := Wrap(t, "fstest")
+	defer test.Close()
+	origin := func(prefix string) FillFunc {
+		return func(ctx context.Context, name string, w io.Writer) error {
+			_, err := w.Write([]byte(prefix + name))
+			return err
+		}
+	}
+	mux := NewFillMux()
+	mux.Handle("img/", origin("images:"))
+	mux.Handle("img/thumb/", origin("thumbs:"))
+	mux.Handle("doc/", origin("docs:"))
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0, WithFillMux(mux))
+	test.AssertNoError(err)
+
+	for name, want := range map[string]string{
+		"img/a":       "images:img/a",
+		"img/thumb/a": "thumbs:img/thumb/a",
+		"doc/a":       "docs:doc/a",
+	} {
+		r, err := cache.GetAsync(context.Background(), name)
+		test.AssertNoError(err)
+		p, err := ioutil.ReadAll(r)
+		test.AssertNoError(err)
+		test.AssertByteEqual([]byte(want), p)
+		test.AssertNoError(r.Close())
+	}
+	_, err = cache.GetAsync(context.Background(), "video/a")
+	test.Assert(errors.Is(err, ErrNoFiller), "expected ErrNoFiller")
+
+	mux.Handle("doc/", nil)
+	mux.Handle("", origin("default:"))
+	test.Assert(mux.Match("img/b") != nil, "expected img/ to be routed")
+	var buf bytes.Buffer
+	test.AssertNoError(mux.Fill(context.Background(), "doc/b", &buf))
+	test.AssertByteEqual([]byte("default:doc/b"), buf.Bytes())
+}
+
+func TestFillRetry(t *testing.T) {
+	test := Wrap(t, "fstest")
+	defer test.Close()
+	errPermanent := errors.New("permanent")
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	clock := &testClock{}
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0, WithClock(clock),
+		WithFillRetry(FillRetry{
+			Attempts:    3,
+			MinBackoff:  time.Millisecond,
+			MaxBackoff:  time.Millisecond,
+			Timeout:     20 * time.Millisecond,
+			Retryable:   func(err error) bool { return err != errPermanent },
+			NegativeTTL: time.Minute,
+		}),
+		WithFiller(func(ctx context.Context, name string, w io.Writer) error {
+			mu.Lock()
+			attempts[name]++
+			attempt := attempts[name]
+			mu.Unlock()
+			switch name {
+			case "flaky":
+				if attempt == 1 {
+					w.Write([]byte("hel"))
+					return errFail
+				}
+			case "slow":
+				<-ctx.Done()
+				return ctx.Err()
+			case "permanent":
+				return errPermanent
+			}
+			_, err := w.Write([]byte("hello"))
+			return err
+		}))
+	test.AssertNoError(err)
+	read := func(name string) ([]byte, error) {
+		r, err := cache.GetAsync(context.Background(), name)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+
+	// the second attempt resumes after the bytes of the first.
+	p, err := read("flaky")
+	test.AssertNoError(err)
+	test.AssertByteEqual([]byte("hello"), p)
+	info, err := cache.Info("flaky")
+	test.AssertNoError(err)
+	test.Assert(info.FillAttempts == 2, "expected 2 attempts")
+
+	_, err = read("slow")
+	test.Assert(errors.Is(err, context.DeadlineExceeded),
+		"expected every attempt to time out")
+	_, err = read("permanent")
+	test.Assert(errors.Is(err, errPermanent), "expected errPermanent")
+	test.Assert(attempts["slow"] == 3 && attempts["permanent"] == 1,
+		fmt.Sprintf("unexpected attempts %v", attempts))
+
+	// failures are remembered until NegativeTTL.
+	_, err = read("permanent")
+	test.Assert(errors.Is(err, errPermanent), "expected a negative entry")
+	_, err = cache.GetWriterOnly("permanent", UnknownSize)
+	test.Assert(errors.Is(err, errPermanent), "expected a negative entry")
+	test.Assert(attempts["permanent"] == 1, "expected no new attempt")
+	clock.Set(time.Now().Add(2 * time.Minute))
+	_, err = read("permanent")
+	test.Assert(errors.Is(err, errPermanent), "expected errPermanent")
+	test.Assert(attempts["permanent"] == 2, "expected a new attempt")
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	test := Wrap(t, "fstest")
+	defer test.Close()
+	var mu sync.Mutex
+	fills := 0
+	failing := true
+	mux := NewFillMux()
+	mux.Handle("bad/", func(ctx context.Context, name string,
+		w io.Writer) error {
+		mu.Lock()
+		defer mu.Unlock()
+		fills++
+		if failing {
+			return errFail
+		}
+		_, err := w.Write([]byte(name))
+		return err
+	})
+	mux.Handle("good/", func(ctx context.Context, name string,
+		w io.Writer) error {
+		_, err := w.Write([]byte(name))
+		return err
+	})
+	clock := &testClock{}
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0, WithClock(clock),
+		WithFillMux(mux), WithCircuitBreaker(2, time.Minute))
+	test.AssertNoError(err)
+	read := func(name string) error {
+		r, err := cache.GetAsync(context.Background(), name)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = ioutil.ReadAll(r)
+		return err
+	}
+	fillCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fills
+	}
+
+	test.Assert(errors.Is(read("bad/1"), errFail), "expected errFail")
+	test.Assert(errors.Is(read("bad/2"), errFail), "expected errFail")
+	test.Assert(errors.Is(read("bad/3"), ErrCircuitOpen),
+		"expected the circuit to open")
+	test.Assert(fillCount() == 2, "expected no fill while open")
+	test.AssertNoError(read("good/1"))
+
+	// a probe which fails opens the circuit again.
+	now := time.Now()
+	clock.Set(now.Add(2 * time.Minute))
+	test.Assert(errors.Is(read("bad/4"), errFail), "expected a probe")
+	test.Assert(errors.Is(read("bad/5"), ErrCircuitOpen),
+		"expected the circuit to open again")
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	clock.Set(now.Add(4 * time.Minute))
+	test.AssertNoError(read("bad/6"))
+	test.AssertNoError(read("bad/7"))
+	test.Assert(fillCount() == 5, "expected the circuit to close")
+}
+
+func TestSubscribe(t *testing.T) {
+	test := NewMemFsCacheTest(t, time.Second)
+	defer test.Close()
+	events, cancel := test.cache.Subscribe()
+
+	test.SetNow(2016, time.September, 1, 0, 0, 0, 0)
+	r, w, err := test.cache.Get("stream", 5)
+	test.AssertNoError(err)
+	test.AssertWrite(w, []byte("hello"))
+	test.AssertNoError(r.Close())
+	test.AssertNoError(test.cache.Remove("stream"))
+	r, w, err = test.cache.Get("stream", 5)
+	test.AssertNoError(err)
+	test.AssertWrite(w, []byte("hello"))
+	test.AssertNoError(r.Close())
+
+	test.SetNow(2016, time.September, 1, 0, 0, 4, 0)
+	test.cache.reap(time.Second)
+	ev := <-events
+	test.Assert(ev == EvictionEvent{Key: ev.Key, Name: "stream", Size: 5,
+		Reason: EvictionExpired}, fmt.Sprintf("unexpected event %+v", ev))
+
+	cancel()
+	_, ok := <-events
+	test.Assert(!ok, "expected the channel to be closed")
+
+	sized, err := New(test.Dir(), 0700, 0, WithMaxSize(5))
+	test.AssertNoError(err)
+	events, cancel = sized.Subscribe()
+	defer cancel()
+	for _, name := range []string{"a", "b"} {
+		r, w, err := sized.Get(name, 5)
+		test.AssertNoError(err)
+		test.AssertWrite(w, []byte("hello"))
+		test.AssertNoError(r.Close())
+	}
+	ev = <-events
+	test.Assert(ev.Reason == EvictionSize, "expected a size eviction")
+}
+
+func TestReaderTimeout(t *testing.T) {
+	test := Wrap(t, "fscache")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0,
+		WithReaderTimeout(20*time.Millisecond))
+	test.AssertNoError(err)
+
+	r, w, err := cache.Get("stream", UnknownSize)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	p := make([]byte, 10)
+	n, err := r.Read(p)
+	test.AssertNoError(err)
+	test.AssertByteEqual([]byte("hello"), p[:n])
+	// blocks for the writer until the timeout.
+	_, err = r.Read(p)
+	test.Assert(errors.Is(err, ErrReaderTimeout), "expected ErrReaderTimeout")
+	_, err = r.ReadAt(p, 0)
+	test.Assert(errors.Is(err, ErrReaderTimeout), "expected ErrReaderTimeout")
+
+	// the timed out reader doesn't hold the entry anymore.
+	test.AssertNoError(w.Close())
+	test.AssertNoError(cache.Remove("stream"))
+	test.AssertNoError(r.Close())
+}
+
+func TestDetach(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+	r, w, err := test.cache.Get("stream", UnknownSize)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(r)
+		errs <- err
+	}()
+	test.AssertNoError(test.cache.Detach("stream"))
+	test.Assert(errors.Is(<-errs, ErrDetached), "expected the reader to fail")
+	_, err = w.Write([]byte("world"))
+	test.Assert(errors.Is(err, ErrDetached), "expected the writer to fail")
+	test.Assert(!test.cache.Exists("stream"), "expected stream to be gone")
+
+	// a stuck force removal is finished.
+	r, w, err = test.cache.Get("stream", UnknownSize)
+	test.AssertNoError(err)
+	test.AssertWrite(w, []byte("hello"))
+	test.AssertNoError(test.cache.ForceRemove("stream"))
+	test.AssertNoError(test.cache.Detach("stream"))
+	_, err = r.Read(make([]byte, 5))
+	test.Assert(errors.Is(err, ErrDetached), "expected ErrDetached")
+	test.AssertNoError(r.Close())
+
+	err = test.cache.Detach("missing")
+	test.Assert(errors.Is(err, ErrNotFound), "expected ErrNotFound")
+}
+
+func TestWarmup(t *testing.T) {
+	test := Wrap(t, "fscache")
+	defer test.Close()
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "# hot keys\na\n\nb\n")
+		}))
+	defer srv.Close()
+
+	fill := func(ctx context.Context, name string, w io.Writer) error {
+		_, err := w.Write([]byte(name))
+		return err
+	}
+	cache, err := New(test.Dir(), 0700, 0,
+		WithWarmup(ManifestURL(srv.URL), fill))
+	test.AssertNoError(err)
+	<-cache.Warm()
+	test.Assert(cache.Exists("a") && cache.Exists("b"), "expected a and b")
+	test.Assert(len(cache.Names()) == 2, "expected only a and b")
+
+	cold, err := New(test.Dir(), 0700, 0)
+	test.AssertNoError(err)
+	<-cold.Warm()
+}
+
+func TestAdaptiveTTL(t *testing.T) {
+	test := Wrap(t, "fscache")
+	defer test.Close()
+	clock := &testClock{}
+	expiry := 10 * time.Second
+	cache, err := NewCache(test.Dir(), NewMemFsWithClock(clock), 0,
+		WithClock(clock), WithAdaptiveTTL(time.Second, 40*time.Second, 2))
+	test.AssertNoError(err)
+
+	clock.Set(time.Date(2016, time.September, 1, 0, 0, 0, 0, time.UTC))
+	for _, name := range []string{"cold", "hot"} {
+		r, w, err := cache.Get(name, 5)
+		test.AssertNoError(err)
+		_, err = w.Write([]byte("hello"))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+		test.AssertNoError(r.Close())
+	}
+	for i := 0; i < 4; i++ {
+		r, _, err := cache.Get("hot", 5)
+		test.AssertNoError(err)
+		test.AssertNoError(r.Close())
+	}
+	info, err := cache.Info("hot")
+	test.AssertNoError(err)
+	test.Assert(info.Hits == 4, "expected 4 hits")
+
+	clock.Set(time.Date(2016, time.September, 1, 0, 0, 5, 0, time.UTC))
+	cache.reap(expiry)
+	test.Assert(!cache.Exists("cold"), "expected cold to expire after min")
+	test.Assert(cache.Exists("hot"), "expected hot to be kept")
+
+	clock.Set(time.Date(2016, time.September, 1, 0, 0, 15, 0, time.UTC))
+	cache.reap(expiry)
+	test.Assert(cache.Exists("hot"), "expected hot to outlive the expiry")
+	clock.Set(time.Date(2016, time.September, 1, 0, 0, 25, 0, time.UTC))
+	cache.reap(expiry)
+	test.Assert(!cache.Exists("hot"), "expected hot to expire after 20s")
+}
+
+func TestSizeInfo(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+	r, w, err := test.cache.Get("stream", 10)
+	test.AssertNoError(err)
+	defer r.Close()
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+
+	info, err := test.cache.SizeInfo("stream")
+	test.AssertNoError(err)
+	test.Assert(info == SizeInfo{WrittenBytes: 5, ExpectedBytes: 10},
+		fmt.Sprintf("unexpected info %+v", info))
+	_, err = w.Write([]byte("world"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	info, err = test.cache.SizeInfo("stream")
+	test.AssertNoError(err)
+	test.Assert(info == SizeInfo{WrittenBytes: 10, Complete: true,
+		ExpectedBytes: 10}, fmt.Sprintf("unexpected info %+v", info))
+
+	_, err = test.cache.SizeInfo("missing")
+	test.Assert(errors.Is(err, ErrNotFound), "expected ErrNotFound")
+}
+
+// allocTargets are the most allocations per call allowed on the hot paths,
+// see TestAllocs and the benchmarks below.
+var allocTargets = map[string]float64{
+	"fileName": 1, // the returned string
+	"Get":      3, // the Reader, its File and the key
+	"ReadAt":   0,
+}
+
+func TestAllocs(t *testing.T) {
+	test := NewMemFsCacheTest(t, time.Hour)
+	defer test.Close()
+	r, w, err := test.cache.Get("key", -1)
+	test.AssertNoError(err)
+	test.AssertWrite(w, bytes.Repeat([]byte("0123456789"), 100))
+	defer r.Close()
+
+	buf := make([]byte, 100)
+	fns := map[string]func(){
+		"fileName": func() { fileName("key") },
+		"Get": func() {
+			r, _, _ := test.cache.Get("key", -1)
+			r.Read(buf)
+			r.Close()
+		},
+		"ReadAt": func() { r.ReadAt(buf, 10) },
+	}
+	for name, fn := range fns {
+		allocs := testing.AllocsPerRun(100, fn)
+		test.Assert(allocs <= allocTargets[name], fmt.Sprintf(
+			"%s: %v allocs, want at most %v", name, allocs,
+			allocTargets[name]))
+	}
+}
+
+// newBenchCache returns a cache holding a complete entry "key" of n bytes.
+func newBenchCache(b *testing.B, n int) *FsCache {
+	dir, err := ioutil.TempDir("", "fsbench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { os.RemoveAll(dir) })
+	c, err := NewCache(dir, NewMemFs(), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	r, w, err := c.Get("key", -1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w.Write(make([]byte, n))
+	w.Close()
+	r.Close()
+	return c
+}
+
+func BenchmarkFileName(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		fileName("key")
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	c := newBenchCache(b, 1024)
+	buf := make([]byte, 512)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, _, err := c.Get("key", -1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		r.Read(buf)
+		r.Close()
+	}
+}
+
+func BenchmarkReadAt(b *testing.B) {
+	c := newBenchCache(b, 1024)
+	r, _, err := c.Get("key", -1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer r.Close()
+	buf := make([]byte, 512)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.ReadAt(buf, int64(i%512))
+	}
+}
+
+func TestWaitComplete(t *testing.T) {
+	test := Wrap(t, "fstest")
+	defer test.Close()
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0)
+	test.AssertNoError(err)
+	ctx := context.Background()
+
+	err = cache.WaitComplete(ctx, "a")
+	test.Assert(errors.Is(err, ErrNotFound), "expected ErrNotFound")
+
+	r, w, err := cache.Get("a", UnknownSize)
+	test.AssertNoError(err)
+	test.AssertNoError(r.Close())
+	short, cancel := context.WithTimeout(ctx, time.Millisecond)
+	err = cache.WaitComplete(short, "a")
+	cancel()
+	test.Assert(errors.Is(err, context.DeadlineExceeded),
+		"expected WaitComplete to time out")
+
+	done := make(chan error)
+	go func() { done <- cache.WaitComplete(ctx, "a") }()
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(<-done)
+	test.AssertNoError(cache.WaitComplete(ctx, "a"))
+
+	r, w, err = cache.Get("b", UnknownSize)
+	test.AssertNoError(err)
+	defer r.Close()
+	go func() { done <- cache.WaitComplete(ctx, "b") }()
+	_, err = w.Write([]byte("hel"))
+	test.AssertNoError(err)
+	w.(*cacheWriter).abort(errFail)
+	test.Assert(errors.Is(<-done, errFail), "expected the fill error")
+}
+
+func TestGetIfExists(t *testing.T) {
+	test := Wrap(t, "fstest")
+	defer test.Close()
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0)
+	test.AssertNoError(err)
+
+	_, ok, err := cache.GetIfExists("a")
+	test.AssertNoError(err)
+	test.Assert(!ok, "expected a miss")
+	test.Assert(!cache.Exists("a"), "GetIfExists shouldn't start a fill")
+
+	r, w, err := cache.Get("a", UnknownSize)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+
+	r, ok, err = cache.GetIfExists("a")
+	test.AssertNoError(err)
+	test.Assert(ok, "expected a hit")
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual([]byte("hello"), p)
+	test.AssertNoError(r.Close())
+}
+
+func TestGetEntry(t *testing.T) {
+	test := Wrap(t, "fstest")
+	defer test.Close()
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0)
+	test.AssertNoError(err)
+	ctx := context.Background()
+
+	miss, err := cache.GetEntry(ctx, "a", UnknownSize)
+	test.AssertNoError(err)
+	test.Assert(!miss.Hit && miss.Writer != nil, "expected a miss")
+	hit, err := cache.GetEntry(ctx, "a", UnknownSize)
+	test.AssertNoError(err)
+	test.Assert(hit.Hit && hit.Writer == nil, "expected a hit on the fill")
+
+	_, err = miss.Writer.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(miss.Writer.Close())
+	for _, res := range []GetResult{miss, hit} {
+		p, err := ioutil.ReadAll(res.Reader)
+		test.AssertNoError(err)
+		test.AssertByteEqual([]byte("hello"), p)
+		test.AssertNoError(res.Reader.Close())
+	}
+}
+
+func TestGetDuringRemove(t *testing.T) {
+	test := Wrap(t, "fstest")
+	defer test.Close()
+	disk, err := New(filepath.Join(test.Dir(), "disk"), 0700, 0)
+	test.AssertNoError(err)
+	mem, err := NewCache(filepath.Join(test.Dir(), "mem"), NewMemFs(), 0)
+	test.AssertNoError(err)
+
+	for _, cache := range []*FsCache{disk, mem} {
+		var gen int32
+		get := func() error {
+			r, w, err := cache.Get("key", UnknownSize)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			if w != nil {
+				n := atomic.AddInt32(&gen, 1)
+				payload := bytes.Repeat([]byte{byte('a' + n%26)}, 1024)
+				_, err := w.Write(payload[:512])
+				if err == nil {
+					_, err = w.Write(payload[512:])
+				}
+				if cerr := w.Close(); err == nil {
+					err = cerr
+				}
+				if err != nil && !errors.Is(err, ErrEntryRemoved) {
+					return err
+				}
+			}
+			p, err := ioutil.ReadAll(r)
+			if errors.Is(err, ErrEntryRemoved) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if len(p) != 0 && (len(p) != 1024 ||
+				!bytes.Equal(p, bytes.Repeat(p[:1], 1024))) {
+				return fmt.Errorf("read %d bytes of different fills", len(p))
+			}
+			return nil
+		}
+
+		errs := make(chan error, 8)
+		stop := make(chan struct{})
+		removed := make(chan struct{})
+		go func() {
+			defer close(removed)
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				var err error
+				if i%2 == 0 {
+					err = cache.Remove("key")
+				} else {
+					err = cache.ForceRemove("key")
+				}
+				if err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}
+		}()
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 200; j++ {
+					if err := get(); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(stop)
+		<-removed
+		close(errs)
+		for err := range errs {
+			test.AssertNoError(err)
+		}
+	}
 }
@@ -0,0 +1,92 @@
+package fscache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// GhostStats counts the misses which would have been hits with a larger
+// cache, see WithGhosts.
+type GhostStats struct {
+	Hits     int64 // misses of entries recently evicted for size
+	HitBytes int64 // the sizes of those entries when they were evicted
+	Tracked  int   // the evicted keys currently remembered
+}
+
+type ghost struct {
+	key  string
+	size int64
+}
+
+// ghostList remembers the keys of the most recently evicted entries.
+type ghostList struct {
+	max   int
+	mu    sync.Mutex
+	lru   *list.List // of ghost, most recent first
+	keys  map[string]*list.Element
+	stats GhostStats
+}
+
+// WithGhosts remembers the keys of the last n entries evicted to keep the
+// cache within WithMaxSize, and counts the later misses of those keys in
+// GhostStats. Many such hits mean raising MaxSize would pay off.
+func WithGhosts(n int) Option {
+	return func(c *FsCache) {
+		c.ghosts = &ghostList{
+			max:  n,
+			lru:  list.New(),
+			keys: make(map[string]*list.Element),
+		}
+	}
+}
+
+// GhostStats returns the ghost hits counted so far, see WithGhosts.
+func (c *FsCache) GhostStats() GhostStats {
+	if c.ghosts == nil {
+		return GhostStats{}
+	}
+	g := c.ghosts
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	stats := g.stats
+	stats.Tracked = g.lru.Len()
+	return stats
+}
+
+// addGhost remembers the evicted entry s.
+func (c *FsCache) addGhost(key string, s *Stream) {
+	g := c.ghosts
+	if g == nil || g.max <= 0 {
+		return
+	}
+	size, _ := s.Size()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if el, ok := g.keys[key]; ok {
+		g.lru.Remove(el)
+	}
+	g.keys[key] = g.lru.PushFront(ghost{key: key, size: size})
+	for g.lru.Len() > g.max {
+		el := g.lru.Back()
+		g.lru.Remove(el)
+		delete(g.keys, el.Value.(ghost).key)
+	}
+}
+
+// ghostMiss counts a miss of key if it was evicted recently.
+func (c *FsCache) ghostMiss(key string) {
+	g := c.ghosts
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	el, ok := g.keys[key]
+	if !ok {
+		return
+	}
+	g.lru.Remove(el)
+	delete(g.keys, key)
+	g.stats.Hits++
+	g.stats.HitBytes += el.Value.(ghost).size
+}
@@ -0,0 +1,159 @@
+// Package grpcfill fills fscache entries from server-streaming gRPC calls,
+// appending each received message to the entry and resuming the call from
+// the bytes already written when it fails with a transient error.
+package grpcfill
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/amozoss/fscache"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Recv returns the bytes of the next message of a stream, or io.EOF once the
+// stream has ended.
+type Recv func() ([]byte, error)
+
+// Call starts a server-streaming call which sends the entry from offset
+// onwards. It typically wraps a generated client:
+//
+//	func(ctx context.Context, offset int64) (grpcfill.Recv, error) {
+//		stream, err := client.Fetch(ctx, &pb.FetchRequest{Offset: offset})
+//		if err != nil {
+//			return nil, err
+//		}
+//		return func() ([]byte, error) {
+//			msg, err := stream.Recv()
+//			if err != nil {
+//				return nil, err
+//			}
+//			return msg.Data, nil
+//		}, nil
+//	}
+type Call func(ctx context.Context, offset int64) (Recv, error)
+
+// Retry configures how failed calls are retried.
+type Retry struct {
+	// Attempts is the number of consecutive failed calls before giving up.
+	// Receiving data resets the count.
+	Attempts int
+
+	// MinBackoff is the wait after the first failure, doubled after each
+	// further failure up to MaxBackoff.
+	MinBackoff, MaxBackoff time.Duration
+
+	// Retryable reports whether a call which failed with err should be
+	// retried, Transient if nil.
+	Retryable func(err error) bool
+}
+
+// DefaultRetry retries transient failures a few times within seconds.
+var DefaultRetry = Retry{
+	Attempts:   5,
+	MinBackoff: 100 * time.Millisecond,
+	MaxBackoff: 10 * time.Second,
+}
+
+// Transient reports whether err is a gRPC status which is worth retrying.
+func Transient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+func (r Retry) retryable(err error) bool {
+	if r.Retryable == nil {
+		return Transient(err)
+	}
+	return r.Retryable(err)
+}
+
+// Fill writes the messages of call to w until the stream ends, returning the
+// number of bytes written. Failed calls are restarted from that offset as
+// configured by retry. w isn't closed.
+func Fill(ctx context.Context, w io.Writer, call Call, retry Retry) (
+	written int64, err error) {
+	failures := 0
+	backoff := retry.MinBackoff
+	for {
+		progress, err := fill(ctx, w, call, written)
+		written += progress
+		if err == nil {
+			return written, nil
+		}
+		if progress > 0 {
+			failures = 0
+			backoff = retry.MinBackoff
+		}
+		failures++
+		if ctx.Err() != nil || failures >= retry.Attempts ||
+			!retry.retryable(err) {
+			return written, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return written, ctx.Err()
+		}
+		backoff *= 2
+		if backoff > retry.MaxBackoff {
+			backoff = retry.MaxBackoff
+		}
+	}
+}
+
+// fill makes a single call from offset, returning the bytes it wrote.
+func fill(ctx context.Context, w io.Writer, call Call, offset int64) (
+	written int64, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	recv, err := call(ctx, offset)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		p, err := recv()
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(p)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// Get returns a reader for key in c, filling it from call on a miss. The fill
+// runs in the background so the reader streams messages as they're received.
+// If the fill fails the entry is removed once its readers are closed.
+func Get(ctx context.Context, c fscache.Cache, key string, size int64,
+	call Call, retry Retry) (fscache.ReaderAtCloser, error) {
+	r, w, err := c.Get(key, size)
+	if err != nil {
+		return nil, err
+	}
+	if w != nil {
+		go func() {
+			_, err := Fill(ctx, w, call, retry)
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				c.Remove(key)
+			}
+		}()
+	}
+	return r, nil
+}
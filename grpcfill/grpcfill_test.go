@@ -0,0 +1,119 @@
+package grpcfill
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/amozoss/fscache"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var data = []byte("hello grpc streaming world")
+
+// flaky returns a Call sending data in chunks of 4 bytes, failing with err
+// after every fail_after messages.
+func flaky(fail_after int, err error, offsets *[]int64) Call {
+	return func(ctx context.Context, offset int64) (Recv, error) {
+		*offsets = append(*offsets, offset)
+		sent := 0
+		return func() ([]byte, error) {
+			if offset >= int64(len(data)) {
+				return nil, io.EOF
+			}
+			if sent == fail_after {
+				return nil, err
+			}
+			end := offset + 4
+			if end > int64(len(data)) {
+				end = int64(len(data))
+			}
+			p := data[offset:end]
+			offset = end
+			sent++
+			return p, nil
+		}, nil
+	}
+}
+
+var fast = Retry{Attempts: 3, MinBackoff: time.Millisecond,
+	MaxBackoff: 4 * time.Millisecond}
+
+func TestFillResume(t *testing.T) {
+	var offsets []int64
+	var buf bytes.Buffer
+	unavailable := status.Error(codes.Unavailable, "try again")
+	n, err := Fill(context.Background(), &buf, flaky(3, unavailable, &offsets),
+		fast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("unexpected fill %d %q", n, buf.Bytes())
+	}
+	if len(offsets) != 3 || offsets[1] != 12 || offsets[2] != 24 {
+		t.Fatalf("expected calls resumed from written bytes, got %v", offsets)
+	}
+}
+
+func TestFillGivesUp(t *testing.T) {
+	var offsets []int64
+	unavailable := status.Error(codes.Unavailable, "down")
+	_, err := Fill(context.Background(), ioutil.Discard,
+		flaky(0, unavailable, &offsets), fast)
+	if status.Code(err) != codes.Unavailable || len(offsets) != 3 {
+		t.Fatalf("expected 3 attempts, got %d: %v", len(offsets), err)
+	}
+
+	offsets = nil
+	denied := status.Error(codes.PermissionDenied, "no")
+	_, err = Fill(context.Background(), ioutil.Discard,
+		flaky(0, denied, &offsets), fast)
+	if status.Code(err) != codes.PermissionDenied || len(offsets) != 1 {
+		t.Fatalf("expected no retries, got %d: %v", len(offsets), err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpcfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := fscache.New(dir, 0700, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var offsets []int64
+	call := flaky(2, status.Error(codes.Aborted, "retry"), &offsets)
+	r, err := Get(context.Background(), cache, "shard", int64(len(data)),
+		call, fast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(p, data) {
+		t.Fatalf("unexpected read %q: %v", p, err)
+	}
+
+	r, err = Get(context.Background(), cache, "shard", int64(len(data)),
+		func(context.Context, int64) (Recv, error) {
+			return nil, errors.New("should be cached")
+		}, fast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(p, data) {
+		t.Fatalf("unexpected cached read %q: %v", p, err)
+	}
+}
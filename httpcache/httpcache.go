@@ -0,0 +1,74 @@
+// Package httpcache stores http.Responses in an fscache.Cache, streaming
+// their bodies to readers while they're being cached.
+package httpcache
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+
+	"github.com/amozoss/fscache"
+)
+
+// Store writes resp, including its body, to w in HTTP/1.1 wire format and
+// closes w and the body of resp.
+func Store(w io.WriteCloser, resp *http.Response) error {
+	err := resp.Write(w)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Load reads a response written by Store from r. The body is streamed from r
+// as it's read, and closing it closes r. req is the request the response is
+// for, it may be nil.
+func Load(r io.ReadCloser, req *http.Request) (*http.Response, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(r), req)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	resp.Body = &body{ReadCloser: resp.Body, r: r}
+	return resp, nil
+}
+
+type body struct {
+	io.ReadCloser
+	r io.Closer
+}
+
+func (b *body) Close() error {
+	err := b.ReadCloser.Close()
+	if cerr := b.r.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Fetch returns the response for req cached under key, or calls fetch on a
+// miss and caches its response while streaming it to the caller. Concurrent
+// Fetches of a key being filled read the response as it's cached. If caching
+// the response fails the entry is removed.
+func Fetch(c fscache.Cache, key string, req *http.Request,
+	fetch func(*http.Request) (*http.Response, error)) (*http.Response,
+	error) {
+	r, w, err := c.Get(key, fscache.UnknownSize)
+	if err != nil {
+		return nil, err
+	}
+	if w != nil {
+		resp, err := fetch(req)
+		if err != nil {
+			w.Close()
+			r.Close()
+			return nil, err
+		}
+		go func() {
+			if err := Store(w, resp); err != nil {
+				c.Remove(key)
+			}
+		}()
+	}
+	return Load(r, req)
+}
@@ -0,0 +1,61 @@
+package httpcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amozoss/fscache"
+)
+
+func TestFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := fscache.New(dir, 0700, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetches := 0
+	fetch := func(req *http.Request) (*http.Response, error) {
+		fetches++
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       ioutil.NopCloser(strings.NewReader("hello world")),
+			// unknown length, stored chunked.
+			ContentLength: -1,
+		}, nil
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+
+	for i := 0; i < 2; i++ {
+		resp, err := Fetch(cache, req.URL.String(), req, fetch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK ||
+			resp.Header.Get("Content-Type") != "text/plain" ||
+			!bytes.Equal(body, []byte("hello world")) {
+			t.Fatalf("unexpected response %d %v %q", resp.StatusCode,
+				resp.Header, body)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expected 1 fetch, got %d", fetches)
+	}
+}
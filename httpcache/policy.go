@@ -0,0 +1,175 @@
+package httpcache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StoredHeader records when a response was stored, to compute its age.
+const StoredHeader = "X-Fscache-Stored"
+
+// cacheControl holds the directives of a Cache-Control header, lower cased.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range h["Cache-Control"] {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value := part, ""
+			if i := strings.IndexByte(part, '='); i >= 0 {
+				name, value = part[:i], strings.Trim(part[i+1:], `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the delta-seconds value of directive.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// status codes which are cacheable without explicit freshness, see RFC 7231
+// section 6.1.
+var cacheableByDefault = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 404: true,
+	405: true, 410: true, 414: true, 501: true,
+}
+
+// Storable reports whether a shared cache may store resp, the response to
+// req, following RFC 7234 section 3.
+func Storable(req *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	reqcc, cc := parseCacheControl(req.Header), parseCacheControl(resp.Header)
+	if reqcc.has("no-store") || cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" && !cc.has("must-revalidate") &&
+		!cc.has("public") && !cc.has("s-maxage") {
+		return false
+	}
+	if cacheableByDefault[resp.StatusCode] {
+		return true
+	}
+	_, explicit := freshness(resp)
+	return explicit || cc.has("public")
+}
+
+// freshness returns the explicit freshness lifetime of resp, if any.
+func freshness(resp *http.Response) (ttl time.Duration, ok bool) {
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-cache") {
+		return 0, true
+	}
+	if ttl, ok := cc.seconds("s-maxage"); ok {
+		return ttl, true
+	}
+	if ttl, ok := cc.seconds("max-age"); ok {
+		return ttl, true
+	}
+	if v := resp.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// invalid dates mean already expired.
+			return 0, true
+		}
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			date = storedAt(resp)
+		}
+		return expires.Sub(date), true
+	}
+	return 0, false
+}
+
+// Lifetime returns the freshness lifetime of resp: its explicit lifetime if
+// it has one, otherwise 10% of the time since it was last modified, or
+// defaultTTL.
+func Lifetime(resp *http.Response, defaultTTL time.Duration) time.Duration {
+	if ttl, ok := freshness(resp); ok {
+		return ttl
+	}
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err == nil {
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			date = storedAt(resp)
+		}
+		if date.After(modified) {
+			return date.Sub(modified) / 10
+		}
+	}
+	return defaultTTL
+}
+
+// storedAt returns the time resp was stored, or the zero time.
+func storedAt(resp *http.Response) time.Time {
+	t, _ := http.ParseTime(resp.Header.Get(StoredHeader))
+	return t
+}
+
+// age returns the age of a stored response at now.
+func age(resp *http.Response, now time.Time) time.Duration {
+	age := now.Sub(storedAt(resp))
+	if v, err := strconv.ParseInt(resp.Header.Get("Age"), 10, 64); err == nil {
+		age += time.Duration(v) * time.Second
+	}
+	return age
+}
+
+// conditional returns a copy of req which revalidates the stored resp, or nil
+// if resp has no validators.
+func conditional(req *http.Request, resp *http.Response) *http.Request {
+	etag := resp.Header.Get("ETag")
+	modified := resp.Header.Get("Last-Modified")
+	if etag == "" && modified == "" {
+		return nil
+	}
+	cond := req.Clone(req.Context())
+	if etag != "" {
+		cond.Header.Set("If-None-Match", etag)
+	}
+	if modified != "" {
+		cond.Header.Set("If-Modified-Since", modified)
+	}
+	return cond
+}
+
+// headers which a 304 response must not update, see RFC 7232 section 4.1.
+var keepOn304 = map[string]bool{
+	"Content-Length":    true,
+	"Content-Encoding":  true,
+	"Transfer-Encoding": true,
+}
+
+// refresh updates the stored resp with the headers of a 304 response.
+func refresh(resp, not_modified *http.Response) {
+	for k, v := range not_modified.Header {
+		if !keepOn304[k] {
+			resp.Header[k] = v
+		}
+	}
+	resp.Header.Del("Age")
+}
@@ -0,0 +1,456 @@
+package httpcache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amozoss/fscache"
+)
+
+func TestStorable(t *testing.T) {
+	get, _ := http.NewRequest("GET", "http://example.com/", nil)
+	post, _ := http.NewRequest("POST", "http://example.com/", nil)
+	auth, _ := http.NewRequest("GET", "http://example.com/", nil)
+	auth.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+
+	cases := []struct {
+		req      *http.Request
+		status   int
+		cc       string
+		storable bool
+	}{
+		{get, 200, "", true},
+		{get, 404, "", true},
+		{get, 500, "", false},
+		{get, 500, "max-age=60", true},
+		{get, 200, "no-store", false},
+		{get, 200, "private, max-age=60", false},
+		{post, 200, "max-age=60", false},
+		{auth, 200, "max-age=60", false},
+		{auth, 200, "public", true},
+	}
+	for _, c := range cases {
+		resp := &http.Response{StatusCode: c.status, Header: http.Header{}}
+		if c.cc != "" {
+			resp.Header.Set("Cache-Control", c.cc)
+		}
+		if Storable(c.req, resp) != c.storable {
+			t.Errorf("%s %d %q: expected storable %v", c.req.Method,
+				c.status, c.cc, c.storable)
+		}
+	}
+}
+
+func TestLifetime(t *testing.T) {
+	date := time.Date(2016, time.September, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		header http.Header
+		ttl    time.Duration
+	}{
+		{http.Header{}, time.Minute},
+		{http.Header{"Cache-Control": {"max-age=30"}}, 30 * time.Second},
+		{http.Header{"Cache-Control": {"max-age=30, s-maxage=10"}},
+			10 * time.Second},
+		{http.Header{"Cache-Control": {"no-cache"}}, 0},
+		{http.Header{
+			"Date":    {date.Format(http.TimeFormat)},
+			"Expires": {date.Add(time.Hour).Format(http.TimeFormat)},
+		}, time.Hour},
+		{http.Header{"Expires": {"0"}}, 0},
+		{http.Header{
+			"Date":          {date.Format(http.TimeFormat)},
+			"Last-Modified": {date.Add(-10 * time.Hour).Format(http.TimeFormat)},
+		}, time.Hour},
+	}
+	for _, c := range cases {
+		ttl := Lifetime(&http.Response{Header: c.header}, time.Minute)
+		if ttl != c.ttl {
+			t.Errorf("%v: expected %v, got %v", c.header, c.ttl, ttl)
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTransportRevalidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := fscache.New(dir, 0700, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2016, time.September, 1, 0, 0, 0, 0, time.UTC)
+	var requests []*http.Request
+	origin := func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req)
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header: http.Header{
+				"Cache-Control": {"max-age=60"},
+				"Etag":          {`"v1"`},
+			},
+			Body:          ioutil.NopCloser(strings.NewReader("hello")),
+			ContentLength: 5,
+		}
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			resp.StatusCode = http.StatusNotModified
+			resp.Header.Set("Cache-Control", "max-age=120")
+			resp.Body = ioutil.NopCloser(strings.NewReader(""))
+			resp.ContentLength = 0
+		}
+		return resp, nil
+	}
+	client := &http.Client{Transport: &Transport{
+		Cache:     cache,
+		Transport: roundTripFunc(origin),
+		Clock:     fscache.ClockFunc(func() time.Time { return now }),
+	}}
+
+	get := func() {
+		resp, err := client.Get("http://example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+			t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+		}
+	}
+
+	get()
+	now = now.Add(30 * time.Second)
+	get()
+	if len(requests) != 1 {
+		t.Fatalf("expected fresh response to be cached, got %d requests",
+			len(requests))
+	}
+
+	// stale, revalidated with the stored ETag.
+	now = now.Add(time.Minute)
+	get()
+	if len(requests) != 2 ||
+		requests[1].Header.Get("If-None-Match") != `"v1"` {
+		t.Fatalf("expected a conditional request, got %d requests",
+			len(requests))
+	}
+
+	// refreshed by the 304, fresh for another two minutes.
+	now = now.Add(90 * time.Second)
+	get()
+	if len(requests) != 2 {
+		t.Fatalf("expected refreshed response, got %d requests",
+			len(requests))
+	}
+}
+
+func TestTransportNoStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := fscache.New(dir, 0700, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetches := 0
+	origin := func(req *http.Request) (*http.Response, error) {
+		fetches++
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Cache-Control": {"no-store"}},
+			Body:          ioutil.NopCloser(strings.NewReader("secret")),
+			ContentLength: 6,
+		}, nil
+	}
+	client := &http.Client{Transport: &Transport{
+		Cache:     cache,
+		Transport: roundTripFunc(origin),
+	}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "secret" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	}
+	if fetches != 2 || cache.Exists("http://example.com/") {
+		t.Fatalf("expected no-store response not to be cached")
+	}
+}
+
+func TestTransportVary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := fscache.New(dir, 0700, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetches := 0
+	origin := func(req *http.Request) (*http.Response, error) {
+		fetches++
+		vary := "Accept-Language"
+		if req.URL.Path == "/star" {
+			vary = "*"
+		}
+		lang := req.Header.Get("Accept-Language")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header: http.Header{
+				"Cache-Control": {"max-age=60"},
+				"Vary":          {vary},
+			},
+			Body:          ioutil.NopCloser(strings.NewReader(lang)),
+			ContentLength: int64(len(lang)),
+		}, nil
+	}
+	client := &http.Client{Transport: &Transport{
+		Cache:     cache,
+		Transport: roundTripFunc(origin),
+	}}
+	get := func(path, lang string) {
+		req, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Set("Accept-Language", lang)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != lang {
+			t.Fatalf("expected %q, got %q", lang, body)
+		}
+	}
+
+	get("/", "en")
+	get("/", "fr")
+	get("/", "en")
+	get("/", "fr")
+	if fetches != 2 {
+		t.Fatalf("expected a response per language, got %d fetches", fetches)
+	}
+
+	get("/star", "en")
+	get("/star", "en")
+	if fetches != 4 {
+		t.Fatalf("expected Vary: * not to be cached, got %d fetches", fetches)
+	}
+}
+
+func TestTransportStaleIfError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := fscache.New(dir, 0700, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2016, time.September, 1, 0, 0, 0, 0, time.UTC)
+	errDown := errors.New("origin is down")
+	var fail func() (*http.Response, error)
+	origin := func(req *http.Request) (*http.Response, error) {
+		if fail != nil {
+			return fail()
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header: http.Header{
+				"Cache-Control": {"max-age=60"},
+				"Etag":          {`"v1"`},
+			},
+			Body:          ioutil.NopCloser(strings.NewReader("hello")),
+			ContentLength: 5,
+		}, nil
+	}
+	client := &http.Client{Transport: &Transport{
+		Cache:        cache,
+		Transport:    roundTripFunc(origin),
+		Clock:        fscache.ClockFunc(func() time.Time { return now }),
+		StaleIfError: time.Minute,
+	}}
+
+	get := func() (*http.Response, error) {
+		resp, err := client.Get("http://example.com/")
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode == http.StatusOK && string(body) != "hello" {
+			t.Fatalf("unexpected body %q", body)
+		}
+		return resp, nil
+	}
+
+	if _, err := get(); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(90 * time.Second)
+	fail = func() (*http.Response, error) { return nil, errDown }
+	resp, err := get()
+	if err != nil || resp.Header.Get("Warning") == "" {
+		t.Fatalf("expected a stale response, got %v", err)
+	}
+	fail = func() (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	}
+	resp, err = get()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a stale response on a 503, got %v", err)
+	}
+
+	// past the stale-if-error window.
+	now = now.Add(time.Minute)
+	fail = func() (*http.Response, error) { return nil, errDown }
+	if _, err := get(); err == nil {
+		t.Fatalf("expected the error once the response is too stale")
+	}
+}
+
+func TestTransportSlices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := fscache.New(dir, 0700, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 95)
+	for i := range content {
+		content[i] = byte('a' + i%26)
+	}
+	var mu sync.Mutex
+	var ranges []string
+	origin := func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		ranges = append(ranges, req.Header.Get("Range"))
+		mu.Unlock()
+		rng, ok := parseRange(req.Header.Get("Range"))
+		start, end, ok2 := rng.resolve(int64(len(content)))
+		if !ok || !ok2 {
+			t.Fatalf("unexpected range %q", req.Header.Get("Range"))
+		}
+		return &http.Response{
+			StatusCode: http.StatusPartialContent,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header: http.Header{
+				"Cache-Control": {"max-age=3600"},
+				"Etag":          {`"v1"`},
+				"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", start, end,
+					len(content))},
+			},
+			Body: ioutil.NopCloser(bytes.NewReader(
+				content[start : end+1])),
+			ContentLength: end - start + 1,
+		}, nil
+	}
+	transport := &Transport{
+		Cache:     cache,
+		Transport: roundTripFunc(origin),
+		SliceSize: 10,
+	}
+	client := &http.Client{Transport: transport}
+
+	get := func(rng string, start, end int) {
+		req, _ := http.NewRequest("GET", "http://example.com/video", nil)
+		req.Header.Set("Range", rng)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := fmt.Sprintf("bytes %d-%d/%d", start, end, len(content))
+		if resp.StatusCode != http.StatusPartialContent ||
+			resp.Header.Get("Content-Range") != want ||
+			!bytes.Equal(body, content[start:end+1]) {
+			t.Fatalf("unexpected response to %s: %d %s %q", rng,
+				resp.StatusCode, resp.Header.Get("Content-Range"), body)
+		}
+	}
+	expect := func(want ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Join(ranges, " ") != strings.Join(want, " ") {
+			t.Fatalf("expected origin requests %q, got %q", want, ranges)
+		}
+		ranges = nil
+	}
+
+	// the first request learns the size with the slices it needs.
+	get("bytes=15-34", 15, 34)
+	expect("bytes=10-39")
+	get("bytes=12-18", 12, 18)
+	expect()
+	// only the hole after the cached slices is fetched.
+	get("bytes=30-49", 30, 49)
+	expect("bytes=40-49")
+	get("bytes=-7", 88, 94)
+	expect("bytes=80-94")
+	get("bytes=85-", 85, 94)
+	expect()
+
+	req, _ := http.NewRequest("GET", "http://example.com/video", nil)
+	cached, size, err := transport.CachedRanges(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 95 || len(cached) != 2 ||
+		cached[0] != (fscache.Range{Off: 10, Len: 40}) ||
+		cached[1] != (fscache.Range{Off: 80, Len: 15}) {
+		t.Fatalf("unexpected cached ranges %v of %d", cached, size)
+	}
+}
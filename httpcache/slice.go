@@ -0,0 +1,473 @@
+package httpcache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/amozoss/fscache"
+)
+
+// SizeHeader records the size of a resource cached in slices, see
+// Transport.SliceSize.
+const SizeHeader = "X-Fscache-Size"
+
+// errSliceMismatch is returned when the origin answers a request for a range
+// of slices with something else, e.g. because the resource changed.
+var errSliceMismatch = errors.New("origin didn't return the requested range")
+
+// byteRange is the range of a Range header: bytes start through end, to the
+// end of the resource if end < 0, or the last end bytes if start < 0.
+type byteRange struct {
+	start, end int64
+}
+
+// parseRange parses a Range header with a single byte range.
+func parseRange(h string) (byteRange, bool) {
+	if !strings.HasPrefix(h, "bytes=") || strings.Contains(h, ",") {
+		return byteRange{}, false
+	}
+	spec := strings.TrimSpace(h[len("bytes="):])
+	i := strings.IndexByte(spec, '-')
+	if i < 0 {
+		return byteRange{}, false
+	}
+	first, last := spec[:i], spec[i+1:]
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return byteRange{}, false
+		}
+		return byteRange{start: -1, end: n}, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false
+	}
+	if last == "" {
+		return byteRange{start: start, end: -1}, true
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return byteRange{}, false
+	}
+	return byteRange{start: start, end: end}, true
+}
+
+// resolve returns the bytes r covers in a resource of size bytes, ok is
+// false if none.
+func (r byteRange) resolve(size int64) (start, end int64, ok bool) {
+	start, end = r.start, r.end
+	if start < 0 {
+		start, end = size-r.end, size-1
+		if start < 0 {
+			start = 0
+		}
+	}
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+	return start, end, start <= end
+}
+
+// parseContentRange parses the Content-Range header of a 206 response.
+func parseContentRange(h string) (start, end, size int64, ok bool) {
+	n, _ := fmt.Sscanf(h, "bytes %d-%d/%d", &start, &end, &size)
+	return start, end, size, n == 3 && start <= end && end < size
+}
+
+// slice is a slice of a resource, see Transport.SliceSize.
+type slice struct {
+	key       string
+	off, size int64
+	r         fscache.ReaderAtCloser
+	w         io.WriteCloser // nil unless it's missing
+}
+
+// roundTripRange serves a Range request from the slices of its resource,
+// fetching those missing.
+func (t *Transport) roundTripRange(req *http.Request) (*http.Response,
+	error) {
+	rng, ok := parseRange(req.Header.Get("Range"))
+	if !ok {
+		return t.fetch(req)
+	}
+	key := t.key(req)
+	meta, mr, mw, err := t.loadMeta(key, req)
+	if err != nil {
+		return nil, err
+	}
+	var probe *http.Response
+	if meta == nil {
+		if rng.start < 0 {
+			// the size isn't known, so the slices of the suffix aren't.
+			mw.Close()
+			mr.Close()
+			return t.fetch(req)
+		}
+		probe, meta, err = t.probe(key, req, rng, mr, mw)
+		if err != nil {
+			return nil, err
+		}
+		if probe == nil {
+			return t.fetch(req)
+		}
+	}
+
+	size, _ := strconv.ParseInt(meta.Header.Get(SizeHeader), 10, 64)
+	start, end, ok := rng.resolve(size)
+	if !ok {
+		if probe != nil {
+			probe.Body.Close()
+		}
+		return t.fetch(req)
+	}
+	slices, err := t.getSlices(key, meta, size, start, end)
+	if err != nil {
+		if probe != nil {
+			probe.Body.Close()
+		}
+		return nil, err
+	}
+	if probe != nil {
+		go t.fillSlices(slices, probe.Body)
+	} else if err := t.fetchSlices(key, req, meta, slices); err != nil {
+		closeSlices(slices)
+		return nil, err
+	}
+	return rangeResponse(req, meta, slices, start, end, size), nil
+}
+
+// loadMeta returns the stored meta response of the resource of key if it's
+// fresh, and otherwise the reader and writer to store a new one with.
+func (t *Transport) loadMeta(key string, req *http.Request) (
+	*http.Response, io.ReadCloser, io.WriteCloser, error) {
+	meta_key := metaKey(key)
+	for {
+		r, w, err := t.Cache.Get(meta_key, fscache.UnknownSize)
+		if err != nil || w != nil {
+			return nil, r, w, err
+		}
+		meta, err := Load(r, req)
+		if err != nil {
+			t.Cache.Remove(meta_key)
+			continue
+		}
+		meta.Body.Close()
+		if age(meta, t.now()) < Lifetime(meta, t.DefaultTTL) &&
+			!parseCacheControl(req.Header).has("no-cache") {
+			return meta, nil, nil, nil
+		}
+		t.Cache.Remove(meta_key)
+	}
+}
+
+// probe fetches the slices covering rng from the origin while the size of
+// the resource isn't known, and stores its meta response in mw. It returns
+// a nil probe if the response can't be cached in slices.
+func (t *Transport) probe(key string, req *http.Request, rng byteRange,
+	mr io.ReadCloser, mw io.WriteCloser) (probe, meta *http.Response,
+	err error) {
+	defer mr.Close()
+	start := rng.start / t.SliceSize * t.SliceSize
+	end := int64(-1)
+	if rng.end >= 0 {
+		end = (rng.end/t.SliceSize+1)*t.SliceSize - 1
+	}
+	probe, err = t.fetch(rangeRequest(req, start, end, ""))
+	if err != nil {
+		mw.Close()
+		return nil, nil, err
+	}
+	cr_start, _, size, ok := parseContentRange(probe.Header.Get(
+		"Content-Range"))
+	stored := *probe
+	stored.StatusCode = http.StatusOK
+	if probe.StatusCode != http.StatusPartialContent || !ok ||
+		cr_start != start || !Storable(req, &stored) || !t.keyed(probe) {
+		probe.Body.Close()
+		mw.Close()
+		return nil, nil, nil
+	}
+
+	meta = &http.Response{
+		StatusCode: http.StatusOK,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     probe.Header.Clone(),
+		Body:       http.NoBody,
+	}
+	meta.Header.Del("Content-Range")
+	meta.Header.Del("Content-Length")
+	meta.Header.Set(SizeHeader, strconv.FormatInt(size, 10))
+	meta.Header.Set(StoredHeader, t.now().UTC().Format(http.TimeFormat))
+	if err := Store(mw, meta); err != nil {
+		t.Cache.Remove(metaKey(key))
+	}
+	return probe, meta, nil
+}
+
+// metaKey is the key of the meta response of the resource of key, which
+// records its headers and size.
+func metaKey(key string) string {
+	return key + "\nslices"
+}
+
+// sliceKey is the key of the slice i of the resource of key described by
+// meta.
+func sliceKey(key string, meta *http.Response, i int64) string {
+	return fmt.Sprintf("%s\nslice %s %d", key, validator(meta), i)
+}
+
+// validator identifies the version of the resource described by meta, so
+// the slices of different versions aren't mixed.
+func validator(meta *http.Response) string {
+	if etag := meta.Header.Get("ETag"); etag != "" {
+		return etag
+	}
+	return meta.Header.Get("Last-Modified")
+}
+
+// getSlices gets the slices of bytes start through end of the resource of
+// key from the cache.
+func (t *Transport) getSlices(key string, meta *http.Response, size, start,
+	end int64) ([]*slice, error) {
+	var slices []*slice
+	for i := start / t.SliceSize; i <= end/t.SliceSize; i++ {
+		s := &slice{
+			key:  sliceKey(key, meta, i),
+			off:  i * t.SliceSize,
+			size: t.SliceSize,
+		}
+		if s.off+s.size > size {
+			s.size = size - s.off
+		}
+		var err error
+		s.r, s.w, err = t.Cache.Get(s.key, s.size)
+		if err != nil {
+			abandonSlices(slices)
+			closeSlices(slices)
+			return nil, err
+		}
+		slices = append(slices, s)
+	}
+	return slices, nil
+}
+
+// fetchSlices fetches each run of missing slices of the resource of key from
+// the origin and fills them in the background.
+func (t *Transport) fetchSlices(key string, req *http.Request,
+	meta *http.Response, slices []*slice) error {
+	for i := 0; i < len(slices); {
+		if slices[i].w == nil {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(slices) && slices[j].w != nil {
+			j++
+		}
+		run := slices[i:j]
+		last := run[len(run)-1]
+		resp, err := t.fetch(rangeRequest(req, run[0].off,
+			last.off+last.size-1, validator(meta)))
+		if err == nil {
+			start, _, _, ok := parseContentRange(
+				resp.Header.Get("Content-Range"))
+			if resp.StatusCode != http.StatusPartialContent || !ok ||
+				start != run[0].off {
+				resp.Body.Close()
+				// the resource changed, fetch its new size next time.
+				go t.Cache.Remove(metaKey(key))
+				err = errSliceMismatch
+			}
+		}
+		if err != nil {
+			abandonSlices(slices[i:])
+			return err
+		}
+		go t.fillSlices(run, resp.Body)
+		i = j
+	}
+	return nil
+}
+
+// fillSlices writes body to the missing slices, skipping the bytes of those
+// which are cached. Slices which aren't filled completely are removed.
+func (t *Transport) fillSlices(slices []*slice, body io.ReadCloser) {
+	defer body.Close()
+	var err error
+	var failed []string
+	for _, s := range slices {
+		if s.w == nil {
+			if err == nil {
+				_, err = io.CopyN(ioutil.Discard, body, s.size)
+			}
+			continue
+		}
+		if err == nil {
+			_, err = io.CopyN(s.w, body, s.size)
+		}
+		s.w.Close()
+		if err != nil {
+			failed = append(failed, s.key)
+		}
+	}
+	if len(failed) > 0 {
+		logger.Warnf("filling slices: %s", err)
+		// after closing every writer, Remove waits for the readers.
+		go func() {
+			for _, key := range failed {
+				t.Cache.Remove(key)
+			}
+		}()
+	}
+}
+
+// rangeRequest returns a copy of req for bytes start through end (to the end
+// if end < 0), which fails unless the resource still matches if_range.
+func rangeRequest(req *http.Request, start, end int64,
+	if_range string) *http.Request {
+	r := req.Clone(req.Context())
+	r.Header.Del("If-Range")
+	if end < 0 {
+		r.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	} else {
+		r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	}
+	if if_range != "" {
+		r.Header.Set("If-Range", if_range)
+	}
+	return r
+}
+
+// rangeResponse returns the 206 response for bytes start through end of the
+// resource described by meta, read from slices.
+func rangeResponse(req *http.Request, meta *http.Response,
+	slices []*slice, start, end, size int64) *http.Response {
+	header := meta.Header.Clone()
+	header.Del(SizeHeader)
+	header.Del(StoredHeader)
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end,
+		size))
+	header.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	readers := make([]io.Reader, 0, len(slices))
+	for _, s := range slices {
+		lo, hi := int64(0), s.size
+		if start > s.off {
+			lo = start - s.off
+		}
+		if end+1 < s.off+s.size {
+			hi = end + 1 - s.off
+		}
+		readers = append(readers, &exactReader{
+			r: io.NewSectionReader(s.r, lo, hi-lo),
+			n: hi - lo,
+		})
+	}
+	return &http.Response{
+		Status:        "206 Partial Content",
+		StatusCode:    http.StatusPartialContent,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: end - start + 1,
+		Body: &sliceBody{
+			Reader: io.MultiReader(readers...),
+			slices: slices,
+		},
+		Request: req,
+	}
+}
+
+// abandonSlices closes the writers of the slices which weren't filled, so
+// their empty entries are dropped.
+func abandonSlices(slices []*slice) {
+	for _, s := range slices {
+		if s.w != nil {
+			s.w.Close()
+			s.w = nil
+		}
+	}
+}
+
+// closeSlices closes the readers of slices.
+func closeSlices(slices []*slice) {
+	for _, s := range slices {
+		s.r.Close()
+	}
+}
+
+// exactReader fails with io.ErrUnexpectedEOF if r ends before n bytes, e.g.
+// a slice whose fill failed.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *exactReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	if err == io.EOF && r.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// sliceBody is the body of a response read from slices.
+type sliceBody struct {
+	io.Reader
+	slices []*slice
+}
+
+func (b *sliceBody) Close() error {
+	var err error
+	for _, s := range b.slices {
+		if cerr := s.r.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// CachedRanges returns the byte ranges of the resource requested by req
+// which are cached in slices, and its size, see SliceSize. The size is -1 if
+// it isn't known.
+func (t *Transport) CachedRanges(req *http.Request) ([]fscache.Range,
+	int64, error) {
+	if t.SliceSize <= 0 {
+		return nil, -1, nil
+	}
+	key := t.key(req)
+	meta, mr, mw, err := t.loadMeta(key, req)
+	if err != nil || meta == nil {
+		if mw != nil {
+			mw.Close()
+			mr.Close()
+		}
+		return nil, -1, err
+	}
+	size, _ := strconv.ParseInt(meta.Header.Get(SizeHeader), 10, 64)
+	var ranges []fscache.Range
+	for off := int64(0); off < size; off += t.SliceSize {
+		if !t.Cache.Exists(sliceKey(key, meta, off/t.SliceSize)) {
+			continue
+		}
+		n := t.SliceSize
+		if off+n > size {
+			n = size - off
+		}
+		if last := len(ranges) - 1; last >= 0 &&
+			ranges[last].Off+ranges[last].Len == off {
+			ranges[last].Len += n
+		} else {
+			ranges = append(ranges, fscache.Range{Off: off, Len: n})
+		}
+	}
+	return ranges, size, nil
+}
@@ -0,0 +1,269 @@
+package httpcache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/amozoss/fscache"
+	"github.com/spacemonkeygo/spacelog"
+)
+
+var logger = spacelog.GetLogger()
+
+// Transport is an http.RoundTripper which caches GET responses in Cache
+// according to their Cache-Control, Expires and validator headers (RFC 7234).
+// Stale responses are revalidated with If-None-Match and If-Modified-Since.
+type Transport struct {
+	Cache fscache.Cache
+
+	// Transport fetches responses, http.DefaultTransport if nil.
+	Transport http.RoundTripper
+
+	// DefaultTTL is the lifetime of storable responses without explicit or
+	// heuristic freshness. Zero means they're revalidated on every request.
+	DefaultTTL time.Duration
+
+	// Clock tells the time, the system time if nil.
+	Clock fscache.Clock
+
+	// Vary lists the request headers which are part of the cache key, so
+	// responses negotiated on them are cached separately. Responses which
+	// Vary on any other header aren't stored. DefaultVary is used if nil.
+	Vary []string
+
+	// StaleIfError is how long after they expire stored responses are
+	// served when revalidating them fails, i.e. the origin can't be reached
+	// or answers with a 5xx status (RFC 5861). A stale-if-error directive
+	// of the response or request takes precedence. Zero means stale
+	// responses are only served if a directive allows it.
+	StaleIfError time.Duration
+
+	// SliceSize, if positive, makes the Transport cache the responses to
+	// single Range requests in slices of that many bytes, e.g. for seeking
+	// in videos without downloading them whole. A request is served from
+	// the slices it overlaps, and only those missing are fetched from the
+	// origin, with If-Range so that slices of different versions aren't
+	// mixed. The headers and size of the resource are cached separately,
+	// and expire like other responses.
+	SliceSize int64
+}
+
+// DefaultVary is the Vary allowlist of a Transport without one.
+var DefaultVary = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+
+func (t *Transport) vary() []string {
+	if t.Vary == nil {
+		return DefaultVary
+	}
+	return t.Vary
+}
+
+func (t *Transport) fetch(req *http.Request) (*http.Response, error) {
+	if t.Transport == nil {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	return t.Transport.RoundTrip(req)
+}
+
+func (t *Transport) now() time.Time {
+	if t.Clock == nil {
+		return time.Now()
+	}
+	return t.Clock.Now()
+}
+
+// key returns the cache key of req, its URL followed by the values of the
+// allowlisted headers it has.
+func (t *Transport) key(req *http.Request) string {
+	names := make([]string, 0, len(t.vary()))
+	for _, name := range t.vary() {
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	key.WriteString(req.URL.String())
+	for _, name := range names {
+		if values, ok := req.Header[name]; ok {
+			key.WriteString("\n" + name + ": " + strings.Join(values, ", "))
+		}
+	}
+	return key.String()
+}
+
+// keyed reports whether every header resp Varies on is part of the key.
+func (t *Transport) keyed(resp *http.Response) bool {
+	for _, line := range resp.Header["Vary"] {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			found := false
+			for _, allowed := range t.vary() {
+				if strings.EqualFold(name, allowed) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				// includes Vary: *
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// RoundTrip serves req from the cache if a fresh response is stored, and
+// otherwise fetches and possibly stores it.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet ||
+		parseCacheControl(req.Header).has("no-store") {
+		return t.fetch(req)
+	}
+	if t.SliceSize > 0 && req.Header.Get("Range") != "" {
+		return t.roundTripRange(req)
+	}
+	key := t.key(req)
+	r, w, err := t.Cache.Get(key, fscache.UnknownSize)
+	if err != nil {
+		return nil, err
+	}
+	if w != nil {
+		resp, err := t.fetch(req)
+		return t.fill(key, req, resp, err, r, w)
+	}
+
+	resp, err := Load(r, req)
+	if err != nil {
+		// a damaged entry, replace it.
+		go t.Cache.Remove(key)
+		return t.fetch(req)
+	}
+	if age(resp, t.now()) < Lifetime(resp, t.DefaultTTL) &&
+		!parseCacheControl(req.Header).has("no-cache") {
+		return resp, nil
+	}
+	return t.revalidate(key, req, resp)
+}
+
+// staleIfError reports whether the stale stored resp may be served to req
+// because revalidating it failed, see StaleIfError.
+func (t *Transport) staleIfError(req *http.Request,
+	resp *http.Response) bool {
+	cc := parseCacheControl(resp.Header)
+	if cc.has("must-revalidate") || cc.has("proxy-revalidate") ||
+		cc.has("no-cache") {
+		return false
+	}
+	window := t.StaleIfError
+	if d, ok := cc.seconds("stale-if-error"); ok {
+		window = d
+	}
+	if d, ok := parseCacheControl(req.Header).seconds("stale-if-error"); ok {
+		window = d
+	}
+	return age(resp, t.now()) < Lifetime(resp, t.DefaultTTL)+window
+}
+
+// originFailed reports whether a revalidation failed, rather than being
+// answered with a new response.
+func originFailed(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500 && resp.StatusCode < 600
+}
+
+// fill stores resp in the writer of a miss if it's storable.
+func (t *Transport) fill(key string, req *http.Request, resp *http.Response,
+	err error, r io.ReadCloser, w io.WriteCloser) (*http.Response, error) {
+	if err != nil || !Storable(req, resp) || !t.keyed(resp) {
+		// abandoned fills aren't kept.
+		w.Close()
+		r.Close()
+		return resp, err
+	}
+	resp.Header.Set(StoredHeader, t.now().UTC().Format(http.TimeFormat))
+	go func() {
+		if err := Store(w, resp); err != nil {
+			t.Cache.Remove(key)
+		}
+	}()
+	return Load(r, req)
+}
+
+// revalidate checks the stale stored resp with the origin, replacing it with
+// the refreshed or new response.
+func (t *Transport) revalidate(key string, req *http.Request,
+	resp *http.Response) (*http.Response, error) {
+	cond := conditional(req, resp)
+	if cond == nil {
+		// fetched before replacing resp, so it can be served on errors.
+		cond = req
+	}
+	fresh, err := t.fetch(cond)
+	if originFailed(fresh, err) && t.staleIfError(req, resp) {
+		if err == nil {
+			fresh.Body.Close()
+			err = fmt.Errorf("status %d", fresh.StatusCode)
+		}
+		logger.Warnf("serving stale %s, revalidating failed: %s", key, err)
+		resp.Header.Add("Warning", `111 - "Revalidation Failed"`)
+		return resp, nil
+	}
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if fresh.StatusCode != http.StatusNotModified {
+		resp.Body.Close()
+		return t.replace(key, req, fresh)
+	}
+	fresh.Body.Close()
+	refresh(resp, fresh)
+	return t.replace(key, req, resp)
+}
+
+// forceRemover is implemented by caches which can remove an entry while it's
+// being read, like fscache.FsCache.
+type forceRemover interface {
+	ForceRemove(name string) error
+}
+
+// replace stores resp as the new entry for key, fetching it if it's nil. The
+// old entry is removed once its readers are done. Without ForceRemove the old
+// entry is removed in the background and resp is returned without being
+// stored.
+func (t *Transport) replace(key string, req *http.Request,
+	resp *http.Response) (*http.Response, error) {
+	fr, ok := t.Cache.(forceRemover)
+	if !ok {
+		go t.Cache.Remove(key)
+		if resp == nil {
+			return t.fetch(req)
+		}
+		return resp, nil
+	}
+	fr.ForceRemove(key)
+	r, w, err := t.Cache.Get(key, fscache.UnknownSize)
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, err
+	}
+	if w == nil {
+		// replaced concurrently.
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return Load(r, req)
+	}
+	if resp == nil {
+		resp, err = t.fetch(req)
+	}
+	return t.fill(key, req, resp, err, r, w)
+}
@@ -0,0 +1,201 @@
+package fscache
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// EntryState is the state of an entry in an Index.
+type EntryState int
+
+const (
+	EntryFilling  EntryState = iota // its writer is still open
+	EntryComplete                   // its writer has been closed
+)
+
+// IndexEntry is the metadata an Index keeps about an entry.
+type IndexEntry struct {
+	Key      string // the key of the entry on disk
+	Name     string // the name of the entry, empty if unknown
+	Size     int64  // its size once complete
+	Modified time.Time
+	Accessed time.Time // zero unless WithAccessTracking
+	State    EntryState
+	Origin   string    // see WithOrigin
+	ModTime  time.Time // the logical mtime, see SetModTime
+	Hashes   *HashTree // nil unless WithVerification
+	Version  Version   // see Replace
+}
+
+// Index keeps the metadata of the entries of a cache, in memory or in a
+// persistent store, e.g. one shared by several hosts while the data stays on
+// their local disks. The cache keeps it in sync with its streams.
+type Index interface {
+	Put(e IndexEntry) error
+	Get(key string) (e IndexEntry, ok bool, err error)
+	Delete(key string) error
+
+	// Iterate calls fn for each entry until it returns false. fn must not
+	// modify the index.
+	Iterate(fn func(IndexEntry) bool) error
+}
+
+// Persistent is implemented by Indexes which outlive the process. A cache
+// with a Persistent index loads its entries from it instead of listing the
+// files of its FileSystem, and removes the fills which didn't complete.
+type Persistent interface {
+	Persistent() bool
+}
+
+// HitRecorder is implemented by Indexes which count the hits of entries.
+type HitRecorder interface {
+	Hit(key string) error
+}
+
+// WithIndex makes the cache record its entries in idx. Entries found on load
+// are put in idx, and entries of idx which aren't on disk are deleted.
+// Failing to update idx is logged, it doesn't fail the cache operation.
+func WithIndex(idx Index) Option {
+	return func(c *FsCache) {
+		c.streams.index = idx
+	}
+}
+
+// Index returns the Index of the cache, nil unless WithIndex was used.
+func (c *FsCache) Index() Index {
+	return c.streams.index
+}
+
+// WithMemoryBudget keeps at most n idle streams in memory, the least
+// recently used are dropped and hydrated from the Index when they're needed
+// again. It requires WithIndex, ideally with a Persistent index so loading
+// doesn't hydrate every entry. Iterating the entries, e.g. to expire them,
+// still visits those only in the index.
+func WithMemoryBudget(n int) Option {
+	return func(c *FsCache) {
+		c.streams.budget = n
+	}
+}
+
+// hydrate returns a stream for an entry of the index.
+func (c *FsCache) hydrate(e IndexEntry) *Stream {
+	s := c.newStream(e.Key)
+	s.markComplete()
+	if e.Name != "" {
+		s.info.Name = e.Name
+	}
+	s.info.Origin = e.Origin
+	s.info.ModTime = e.ModTime
+	if e.Version != 0 {
+		// its content didn't change while it was only in the index.
+		c.seenVersion(e.Version)
+		s.info.Version = e.Version
+	}
+	if s.verify > 0 && e.Hashes != nil {
+		if e.Hashes.valid() {
+			s.hashes = e.Hashes
+		} else {
+			logger.Warnf("invalid hashes of %s, not verifying it", e.Key)
+		}
+	}
+	return s
+}
+
+// loadIndex loads the entries of a Persistent index.
+func (c *FsCache) loadIndex() error {
+	var report LoadReport
+	var remove []string
+	err := c.streams.index.Iterate(func(e IndexEntry) bool {
+		switch {
+		case e.State != EntryComplete:
+			report.Unfinished++
+			remove = append(remove, e.Key)
+		case e.Size == 0 && !c.keep_empty:
+			report.Empty++
+			remove = append(remove, e.Key)
+		default:
+			c.streams.remember(e.Key)
+			c.streams.account(e.Key, e.Size)
+			if !c.streams.full() {
+				c.streams.load(e.Key, c.hydrate(e))
+			}
+			report.Entries++
+			report.Bytes += e.Size
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range remove {
+		err := c.fs.Remove(c.getPath(key))
+		if err != nil && !os.IsNotExist(err) {
+			logger.Error(err)
+		}
+		if err := c.streams.index.Delete(key); err != nil {
+			logger.Errorf("unindexing %s: %s", key, err)
+		}
+	}
+	logger.Infof("loaded %d entries (%d bytes) from the index of %s",
+		report.Entries, report.Bytes, c.root)
+	c.load_report = report
+	return nil
+}
+
+func (c *FsCache) indexHit(key string) {
+	hits, ok := c.streams.index.(HitRecorder)
+	if !ok {
+		return
+	}
+	if err := hits.Hit(key); err != nil {
+		logger.Errorf("recording hit of %s: %s", key, err)
+	}
+}
+
+// memIndex is an Index in memory.
+type memIndex struct {
+	mu      sync.Mutex
+	entries map[string]IndexEntry
+}
+
+// NewMemIndex returns an Index kept in memory.
+func NewMemIndex() Index {
+	return &memIndex{entries: make(map[string]IndexEntry)}
+}
+
+func (i *memIndex) Put(e IndexEntry) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.entries[e.Key] = e
+	return nil
+}
+
+func (i *memIndex) Get(key string) (IndexEntry, bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	e, ok := i.entries[key]
+	return e, ok, nil
+}
+
+func (i *memIndex) Delete(key string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.entries, key)
+	return nil
+}
+
+func (i *memIndex) Iterate(fn func(IndexEntry) bool) error {
+	i.mu.Lock()
+	entries := make([]IndexEntry, 0, len(i.entries))
+	for _, e := range i.entries {
+		entries = append(entries, e)
+	}
+	i.mu.Unlock()
+	for _, e := range entries {
+		if !fn(e) {
+			break
+		}
+	}
+	return nil
+}
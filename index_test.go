@@ -0,0 +1,283 @@
+package fscache
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIndex(t *testing.T) {
+	test := Wrap(t, "index")
+	defer test.Close()
+	idx := NewMemIndex()
+	idx.Put(IndexEntry{Key: "gone", State: EntryComplete})
+	cache, err := New(test.Dir(), 0700, time.Hour, WithIndex(idx))
+	test.AssertNoError(err)
+	_, ok, _ := idx.Get("gone")
+	test.Assert(!ok, "expected entry missing on disk to be unindexed")
+
+	r, w, err := cache.Get("stream", 5)
+	test.AssertNoError(err)
+	e, ok, _ := idx.Get(fileName("stream"))
+	test.Assert(ok && e.State == EntryFilling, "expected filling entry")
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+	e, ok, _ = idx.Get(fileName("stream"))
+	test.Assert(ok && e.State == EntryComplete && e.Size == 5 &&
+		e.Name == "stream", "expected complete entry")
+
+	// a new cache indexes the entries it loads.
+	idx = NewMemIndex()
+	cache, err = New(test.Dir(), 0700, time.Hour, WithIndex(idx))
+	test.AssertNoError(err)
+	_, ok, _ = idx.Get(fileName("stream"))
+	test.Assert(ok, "expected loaded entry to be indexed")
+
+	test.AssertNoError(cache.Remove("stream"))
+	_, ok, _ = idx.Get(fileName("stream"))
+	test.Assert(!ok, "expected removed entry to be unindexed")
+}
+
+func TestMemoryBudget(t *testing.T) {
+	test := Wrap(t, "index")
+	defer test.Close()
+	idx := NewMemIndex()
+	cache, err := New(test.Dir(), 0700, time.Hour, WithIndex(idx),
+		WithMemoryBudget(2))
+	test.AssertNoError(err)
+
+	names := []string{"a", "b", "c", "d", "e"}
+	for _, name := range names {
+		r, w, err := cache.Get(name, 5)
+		test.AssertNoError(err)
+		_, err = w.Write([]byte(name + "ello"))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+		test.AssertNoError(r.Close())
+	}
+	test.Assert(len(cache.streams.resident()) == 2,
+		"expected idle streams beyond the budget to be dropped")
+
+	// cold entries are hydrated from the index.
+	for _, name := range names {
+		test.Assert(cache.Exists(name), "expected "+name+" to exist")
+	}
+	r, w, err := cache.Get("a", 5)
+	test.AssertNoError(err)
+	test.Assert(w == nil, "expected a hit")
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual([]byte("aello"), p)
+	test.AssertNoError(r.Close())
+	test.Assert(len(cache.Names()) == 5, "expected all names")
+
+	test.AssertNoError(cache.Remove("b"))
+	test.Assert(!cache.Exists("b"), "expected b to be removed")
+	_, ok, _ := idx.Get(fileName("b"))
+	test.Assert(!ok, "expected b to be unindexed")
+	test.Assert(len(cache.streams.resident()) <= 2, "expected budget kept")
+}
+
+func TestAccessTracking(t *testing.T) {
+	test := Wrap(t, "index")
+	defer test.Close()
+	clock := &testClock{}
+	clock.Set(time.Date(2016, time.September, 1, 0, 0, 0, 0, time.UTC))
+	idx := NewMemIndex()
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0, WithClock(clock),
+		WithIndex(idx), WithAccessTracking(time.Hour))
+	test.AssertNoError(err)
+
+	r, w, err := cache.Get("stream", 5)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+
+	for i := 0; i < 3; i++ {
+		clock.Set(clock.Now().Add(time.Minute))
+		r, _, err := cache.Get("stream", 5)
+		test.AssertNoError(err)
+		test.AssertNoError(r.Close())
+	}
+	e, _, _ := idx.Get(fileName("stream"))
+	test.Assert(e.Accessed.IsZero(), "expected accesses to be batched")
+
+	test.AssertNoError(cache.Close())
+	e, _, _ = idx.Get(fileName("stream"))
+	test.Assert(e.Accessed.Equal(clock.Now()),
+		"expected the last access to be flushed")
+}
+
+func TestOrigin(t *testing.T) {
+	test := Wrap(t, "index")
+	defer test.Close()
+	idx := NewMemIndex()
+	cache, err := New(test.Dir(), 0700, time.Hour, WithIndex(idx))
+	test.AssertNoError(err)
+
+	ctx := WithOrigin(context.Background(), "https://example.com/a")
+	r, w, err := cache.GetContext(ctx, "a", 5)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+
+	info, err := cache.Info("a")
+	test.AssertNoError(err)
+	test.Assert(info.Origin == "https://example.com/a", "expected the origin")
+	entries := cache.Entries()
+	test.Assert(len(entries) == 1 && entries[0].Origin == info.Origin,
+		"expected the origin in the listing")
+
+	e, _, _ := idx.Get(fileName("a"))
+	test.Assert(e.Origin == info.Origin, "expected the origin to be indexed")
+}
+
+// countingIndex counts the Gets of an Index.
+type countingIndex struct {
+	Index
+	gets int
+}
+
+func (i *countingIndex) Get(key string) (IndexEntry, bool, error) {
+	i.gets++
+	return i.Index.Get(key)
+}
+
+func TestBloomFilter(t *testing.T) {
+	test := Wrap(t, "index")
+	defer test.Close()
+	idx := &countingIndex{Index: NewMemIndex()}
+	cache, err := New(test.Dir(), 0700, time.Hour, WithIndex(idx),
+		WithMemoryBudget(1), WithBloomFilter(100, 0.01))
+	test.AssertNoError(err)
+
+	for _, name := range []string{"a", "b", "c"} {
+		r, w, err := cache.Get(name, 5)
+		test.AssertNoError(err)
+		_, err = w.Write([]byte("hello"))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+		test.AssertNoError(r.Close())
+	}
+	test.Assert(cache.Exists("a"), "expected a cold entry to be found")
+
+	idx.gets = 0
+	for i := 0; i < 50; i++ {
+		test.Assert(!cache.Exists(fmt.Sprint("missing", i)), "unexpected hit")
+	}
+	test.Assert(idx.gets < 5, "expected misses to skip the index")
+
+	test.AssertNoError(cache.Remove("a"))
+	idx.gets = 0
+	test.Assert(!cache.Exists("a"), "expected a to be removed")
+	test.Assert(idx.gets == 0, "expected removed keys to leave the filter")
+}
+
+func TestSetModTime(t *testing.T) {
+	test := Wrap(t, "index")
+	defer test.Close()
+	idx := NewMemIndex()
+	cache, err := New(test.Dir(), 0700, time.Hour, WithIndex(idx))
+	test.AssertNoError(err)
+	r, w, err := cache.Get("a", 5)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+
+	modified := time.Date(2016, time.September, 1, 0, 0, 0, 0, time.UTC)
+	test.AssertNoError(cache.SetModTime("a", modified))
+	info, err := cache.Info("a")
+	test.AssertNoError(err)
+	test.Assert(info.ModTime.Equal(modified), "expected the logical mtime")
+	e, _, _ := idx.Get(fileName("a"))
+	test.Assert(e.ModTime.Equal(modified), "expected the mtime to be indexed")
+	test.Assert(e.State == EntryComplete, "expected the entry to stay complete")
+
+	r, _, err = cache.Get("a", 5)
+	test.AssertNoError(err)
+	test.Assert(r.(EntryReader).ModTime().Equal(modified),
+		"expected readers to report the logical mtime")
+	test.AssertNoError(r.Close())
+}
+
+// slowIndex blocks the Puts of key in an Index until release is closed.
+type slowIndex struct {
+	Index
+	key     string
+	putting chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (i *slowIndex) Put(e IndexEntry) error {
+	if e.Key == i.key {
+		i.once.Do(func() { close(i.putting) })
+		<-i.release
+	}
+	return i.Index.Put(e)
+}
+
+func TestSlowIndex(t *testing.T) {
+	test := Wrap(t, "index")
+	defer test.Close()
+	idx := &slowIndex{Index: NewMemIndex(), key: fileName("miss"),
+		putting: make(chan struct{}), release: make(chan struct{})}
+	cache, err := New(test.Dir(), 0700, time.Hour, WithIndex(idx))
+	test.AssertNoError(err)
+	r, w, err := cache.Get("hit", 5)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+
+	missed := make(chan error)
+	go func() {
+		r, w, err := cache.Get("miss", 5)
+		if err == nil {
+			w.Close()
+			r.Close()
+		}
+		missed <- err
+	}()
+	<-idx.putting
+
+	// the miss is waiting for the index, not holding up the cache.
+	hit := make(chan error)
+	go func() {
+		r, w, err := cache.Get("hit", 5)
+		if err == nil && w != nil {
+			err = fmt.Errorf("expected a hit")
+		}
+		if err == nil {
+			err = r.Close()
+		}
+		hit <- err
+	}()
+	select {
+	case err := <-hit:
+		test.AssertNoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("a hit waited for the index write of a miss")
+	}
+	select {
+	case <-missed:
+		t.Fatal("the miss returned before it was indexed")
+	default:
+	}
+	close(idx.release)
+	test.AssertNoError(<-missed)
+	_, ok, _ := idx.Get(fileName("miss"))
+	test.Assert(!ok, "expected the empty miss to be unindexed")
+}
@@ -0,0 +1,175 @@
+package fscache
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// EntryInfo describes an entry in the cache. Metadata is kept in memory for
+// the lifetime of the entry.
+type EntryInfo struct {
+	Key         string    // the key of the entry on disk
+	Name        string    // the name of the entry, empty if unknown
+	Size        int64     // the number of bytes currently on disk
+	ContentType string    // empty unless WithContentSniffing is enabled
+	Priority    Priority  // the highest priority the entry was requested with
+	Origin      string    // where the entry was filled from, see WithOrigin
+	Hits        int64     // the Gets which found the entry since it was loaded
+	ModTime     time.Time // the logical mtime, zero unless SetModTime was used
+
+	// FillAttempts is the number of attempts GetAsync made to fill the
+	// entry so far, see WithFillRetry.
+	FillAttempts int
+
+	// Readers is the number of Readers open on the entry, see
+	// WithMaxReaders.
+	Readers int
+
+	// Version identifies the content of the entry, see Replace.
+	Version Version
+}
+
+type originKey struct{}
+
+// WithOrigin returns a copy of ctx which records origin, e.g. the URL or job
+// ID the data comes from, as the Origin of the entries filled by the Gets
+// it's passed to (see GetContext). It's kept in the Index, so operators can
+// trace bad cached bytes back to their source.
+func WithOrigin(ctx context.Context, origin string) context.Context {
+	return context.WithValue(ctx, originKey{}, origin)
+}
+
+// OriginFrom returns the origin ctx was tagged with, or "".
+func OriginFrom(ctx context.Context) string {
+	origin, _ := ctx.Value(originKey{}).(string)
+	return origin
+}
+
+// Info returns the EntryInfo of the stream.
+func (s *Stream) Info() (EntryInfo, error) {
+	size, err := s.Size()
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := s.info
+	info.Size = size
+	info.Readers = s.nreaders
+	return info, nil
+}
+
+func (s *Stream) entryName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info.Name
+}
+
+func (s *Stream) modTime() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info.ModTime
+}
+
+// SetModTime sets the logical modification time of name to t, e.g. the
+// Last-Modified time of its origin, independent of when it was written
+// locally. Reader.ModTime returns it. It's kept in the Index, without one
+// it's lost when the cache restarts. Errors are CacheErrors, ErrNotFound if
+// there's no such entry.
+func (c *FsCache) SetModTime(name string, t time.Time) error {
+	s, ok := c.getStream(name)
+	if !ok {
+		return wrapError(OpModTime, name, ErrNotFound)
+	}
+	s.mu.Lock()
+	s.info.ModTime = t
+	state := EntryFilling
+	if s.state == StreamComplete {
+		state = EntryComplete
+	}
+	s.mu.Unlock()
+	c.mu.Lock()
+	defer c.unlock()
+	if current, _ := c.streams.get(s.info.Key); current == s {
+		c.streams.update(s, state)
+	}
+	return nil
+}
+
+func (s *Stream) origin() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info.Origin
+}
+
+func (s *Stream) setContentType(content_type string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.info.ContentType = content_type
+}
+
+// Info returns the EntryInfo for name, or a CacheError of ErrNotFound.
+func (c *FsCache) Info(name string) (EntryInfo, error) {
+	s, ok := c.getStream(name)
+	if !ok {
+		return EntryInfo{}, wrapError(OpInfo, name, ErrNotFound)
+	}
+	info, err := s.Info()
+	return info, wrapError(OpInfo, name, err)
+}
+
+// Entries returns the EntryInfo of every entry in the cache, e.g. for an
+// admin listing. Entries whose files can't be read are skipped.
+func (c *FsCache) Entries() []EntryInfo {
+	c.mu.RLock()
+	streams := c.streams.list()
+	c.mu.RUnlock()
+	infos := make([]EntryInfo, 0, len(streams))
+	for _, s := range streams {
+		if info, err := s.Info(); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// SizeInfo describes the size of an entry which may still be filled.
+type SizeInfo struct {
+	WrittenBytes  int64 // the bytes written so far
+	Complete      bool  // whether the entry has been completely written
+	ExpectedBytes int64 // the requested or final size, -1 if unknown
+}
+
+// SizeInfo returns the size of the entry name. Unlike Size, which stats the
+// file, the size of a fill in progress is that of the bytes its Writer
+// committed, and whether more is coming is reported. Errors are CacheErrors,
+// ErrNotFound if there's no such entry.
+func (c *FsCache) SizeInfo(name string) (SizeInfo, error) {
+	s, ok := c.getStream(name)
+	if !ok {
+		return SizeInfo{}, wrapError(OpSize, name, ErrNotFound)
+	}
+	info := SizeInfo{ExpectedBytes: s.expected}
+	s.mu.Lock()
+	w := s.writer
+	state := s.state
+	s.mu.Unlock()
+	if w != nil {
+		size, open := w.written()
+		if open {
+			info.WrittenBytes = size
+			return info, nil
+		}
+	}
+	size, err := s.Size()
+	if err != nil && !(state == StreamFailed && os.IsNotExist(err)) {
+		return SizeInfo{}, wrapError(OpSize, name, err)
+	}
+	info.WrittenBytes = size
+	info.Complete = state == StreamComplete
+	if info.Complete && info.ExpectedBytes < 0 {
+		info.ExpectedBytes = size
+	}
+	return info, nil
+}
@@ -0,0 +1,31 @@
+package fscache
+
+// PauseJanitor stops the reaper and the max size evictor from removing
+// entries until ResumeJanitor is called, e.g. during a bulk import or a
+// backup. Pauses nest: the janitor resumes once every PauseJanitor has been
+// matched by a ResumeJanitor.
+func (c *FsCache) PauseJanitor() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused++
+}
+
+// ResumeJanitor undoes a PauseJanitor, evicting entries over the max size
+// right away once the janitor is no longer paused.
+func (c *FsCache) ResumeJanitor() {
+	c.mu.Lock()
+	if c.paused == 0 {
+		c.mu.Unlock()
+		panic("fscache: ResumeJanitor without PauseJanitor")
+	}
+	c.paused--
+	c.mu.Unlock()
+	c.enforceMaxSize()
+}
+
+// JanitorPaused reports whether the janitor is paused.
+func (c *FsCache) JanitorPaused() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.paused > 0
+}
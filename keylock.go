@@ -0,0 +1,48 @@
+package fscache
+
+import "sync"
+
+// keyLocks is a set of advisory, in-process locks keyed by string.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]chan struct{} // closed on unlock
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: make(map[string]chan struct{})}
+}
+
+func (l *keyLocks) tryLock(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.locks[key]; ok {
+		return false
+	}
+	l.locks[key] = make(chan struct{})
+	return true
+}
+
+func (l *keyLocks) lock(key string) {
+	for {
+		l.mu.Lock()
+		ch, ok := l.locks[key]
+		if !ok {
+			l.locks[key] = make(chan struct{})
+			l.mu.Unlock()
+			return
+		}
+		l.mu.Unlock()
+		<-ch
+	}
+}
+
+func (l *keyLocks) unlock(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ch, ok := l.locks[key]
+	if !ok {
+		panic("fscache: unlock of unlocked key")
+	}
+	delete(l.locks, key)
+	close(ch)
+}
@@ -0,0 +1,368 @@
+package fscache
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeyEncoding maps the names given to Get to the names of the files which
+// store them.
+type KeyEncoding interface {
+	// Encode returns the file name for name.
+	Encode(name string) string
+	// Decode returns the name a file was encoded from, ok is false if it
+	// can't be recovered.
+	Decode(file string) (name string, ok bool)
+}
+
+// WithKeyEncoding makes the cache name its files with enc instead of the md5
+// of their key. The encoding must not change while entries are stored.
+func WithKeyEncoding(enc KeyEncoding) Option {
+	return func(c *FsCache) {
+		c.key_enc = enc
+	}
+}
+
+type md5Keys struct{}
+
+// MD5Keys is the default KeyEncoding, which names files by the md5 hash of
+// their key. Keys can't be decoded.
+var MD5Keys KeyEncoding = md5Keys{}
+
+func (md5Keys) Encode(name string) string {
+	return fileName(name)
+}
+
+func (md5Keys) Decode(file string) (string, bool) {
+	return "", false
+}
+
+const upperHex = "0123456789ABCDEF"
+
+type escapedKeys struct {
+	max int
+}
+
+// EscapedKeys returns a reversible KeyEncoding which keeps letters, digits,
+// '-', '_' and '.' and percent-encodes any other byte, so that files are named
+// after their key. File names longer than max bytes (255 if max <= 0) are
+// truncated and suffixed with '~' and the md5 of the key, those can't be
+// decoded.
+func EscapedKeys(max int) KeyEncoding {
+	if max <= 0 {
+		max = 255
+	}
+	if max < 2*md5.Size+2 {
+		max = 2*md5.Size + 2
+	}
+	return escapedKeys{max: max}
+}
+
+func (e escapedKeys) Encode(name string) string {
+	var b strings.Builder
+	b.Grow(len(name))
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '.' && i == 0:
+			// never produce ".", ".." or hidden files.
+			b.WriteString("%2E")
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z',
+			'0' <= c && c <= '9', c == '-', c == '_', c == '.':
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(upperHex[c>>4])
+			b.WriteByte(upperHex[c&0xF])
+		}
+	}
+	file := b.String()
+	if file == "" {
+		return "%"
+	}
+	if len(file) > e.max {
+		file = file[:e.max-2*md5.Size-1]
+		// don't cut an escape in half.
+		if i := strings.LastIndexByte(file, '%'); i >= len(file)-2 {
+			file = file[:i]
+		}
+		file += "~" + fileName(name)
+	}
+	return file
+}
+
+func (e escapedKeys) Decode(file string) (string, bool) {
+	if file == "%" {
+		return "", true
+	}
+	if strings.IndexByte(file, '~') >= 0 {
+		return "", false
+	}
+	name, err := url.PathUnescape(file)
+	if err != nil || e.Encode(name) != file {
+		return "", false
+	}
+	return name, true
+}
+
+type hierarchicalKeys struct {
+	seg escapedKeys
+}
+
+// HierarchicalKeys returns a KeyEncoding which maps names containing '/' to
+// nested directories, e.g. "tenant/bucket/object", encoding every segment
+// with EscapedKeys(max). Segments like ".." are escaped, so names can't
+// escape the cache directory. It enables RemovePrefix, and is supported by
+// the FileSystem returned by NewFs. As a file can't be a directory, names
+// colliding with the directory of other entries, like "a" and "a/b", are
+// rejected with an InvalidKeyError.
+func HierarchicalKeys(max int) KeyEncoding {
+	return hierarchicalKeys{seg: EscapedKeys(max).(escapedKeys)}
+}
+
+func (e hierarchicalKeys) Encode(name string) string {
+	segs := strings.Split(name, "/")
+	for i, seg := range segs {
+		segs[i] = e.seg.Encode(seg)
+	}
+	return strings.Join(segs, "/")
+}
+
+func (e hierarchicalKeys) Decode(file string) (string, bool) {
+	segs := strings.Split(filepath.ToSlash(file), "/")
+	for i, seg := range segs {
+		name, ok := e.seg.Decode(seg)
+		if !ok {
+			return "", false
+		}
+		segs[i] = name
+	}
+	return strings.Join(segs, "/"), true
+}
+
+// ErrNotHierarchical is returned by RemovePrefix unless the cache was created
+// with HierarchicalKeys.
+var ErrNotHierarchical = errors.New("keys are not hierarchical")
+
+// ErrEmptyPrefix is returned by RemovePrefix for an empty prefix, use Clean to
+// remove every entry.
+var ErrEmptyPrefix = errors.New("empty prefix")
+
+// RemovePrefix removes every entry below prefix, e.g. "tenant/bucket", and
+// its directory. Like Remove it blocks until the streams of the entries have
+// been closed, their complete files then go to the trash if WithTrash is
+// used. Entries below prefix can't be created until it returns, Gets of them
+// wait for it. The rest of the directory is then moved aside and deleted in
+// the background, like by Clean.
+func (c *FsCache) RemovePrefix(prefix string) error {
+	if _, ok := c.key_enc.(hierarchicalKeys); !ok {
+		return ErrNotHierarchical
+	}
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ErrEmptyPrefix
+	}
+	dir := c.key(prefix)
+	streams := c.beginRemovePrefix(dir)
+	defer c.endRemovePrefix(dir)
+
+	c.awaitSnapshot()
+	var errs CloseError
+	for _, s := range streams {
+		s.grp.Wait()
+		errs.add(c.removeTombstone(s.info.Key, s))
+	}
+	errs.add(c.removeAside(c.getPath(dir)))
+	return errs.err()
+}
+
+// beginRemovePrefix blocks the creation of entries below dir and turns the
+// entries below it into tombstones, which it returns. It waits for the
+// RemovePrefix of a dir above or below dir to end first.
+func (c *FsCache) beginRemovePrefix(dir string) []*Stream {
+	c.mu.Lock()
+	defer c.unlock()
+	for {
+		var busy chan struct{}
+		for other, done := range c.removing {
+			if other == dir || strings.HasPrefix(other, dir+"/") ||
+				strings.HasPrefix(dir, other+"/") {
+				busy = done
+				break
+			}
+		}
+		if busy == nil {
+			break
+		}
+		c.mu.Unlock()
+		<-busy
+		c.mu.Lock()
+	}
+	if c.removing == nil {
+		c.removing = make(map[string]chan struct{})
+	}
+	c.removing[dir] = make(chan struct{})
+
+	var streams []*Stream
+	for key, s := range c.tombstones {
+		// removed earlier, its file is deleted here once it drained.
+		if strings.HasPrefix(key, dir+"/") {
+			streams = append(streams, s)
+		}
+	}
+	c.streams.each(func(key string, s *Stream) bool {
+		if strings.HasPrefix(key, dir+"/") {
+			c.streams.delete(key)
+			s.markRemoving()
+			c.tombstones[key] = s
+			streams = append(streams, s)
+		}
+		return true
+	})
+	for key := range c.archived {
+		if strings.HasPrefix(key, dir+"/") {
+			delete(c.archived, key)
+		}
+	}
+	return streams
+}
+
+// endRemovePrefix lets entries below dir be created again.
+func (c *FsCache) endRemovePrefix(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.removing[dir])
+	delete(c.removing, dir)
+}
+
+// removingDir returns the channel closed once the RemovePrefix of a dir
+// above key is done, nil if there's none. c.mu must be held.
+func (c *FsCache) removingDir(key string) <-chan struct{} {
+	for dir, done := range c.removing {
+		if strings.HasPrefix(key, dir+"/") {
+			return done
+		}
+	}
+	return nil
+}
+
+// InvalidKeyError is returned for names rejected by WithStrictKeys, and for
+// names colliding with the directories of HierarchicalKeys.
+type InvalidKeyError struct {
+	Name   string
+	Reason string
+}
+
+func (e *InvalidKeyError) Error() string {
+	return fmt.Sprintf("invalid key %q: %s", truncateKey(e.Name), e.Reason)
+}
+
+// WithStrictKeys makes the cache reject empty names, names containing NUL
+// bytes and names longer than max bytes (1024 if max <= 0) with an
+// InvalidKeyError instead of silently storing them. With HierarchicalKeys,
+// names with empty, "." or ".." segments are rejected too.
+func WithStrictKeys(max int) Option {
+	if max <= 0 {
+		max = 1024
+	}
+	return func(c *FsCache) {
+		c.max_key = max
+	}
+}
+
+// validate checks name if strict keys are enabled, and that it doesn't
+// collide with the directories of HierarchicalKeys.
+func (c *FsCache) validate(name string) error {
+	if err := c.validateStrict(name); err != nil {
+		return err
+	}
+	if _, ok := c.key_enc.(hierarchicalKeys); ok {
+		return c.validateNesting(name)
+	}
+	return nil
+}
+
+func (c *FsCache) validateStrict(name string) error {
+	if c.max_key == 0 {
+		return nil
+	}
+	invalid := func(reason string) error {
+		return &InvalidKeyError{Name: name, Reason: reason}
+	}
+	switch {
+	case name == "":
+		return invalid("empty")
+	case len(name) > c.max_key:
+		return invalid(fmt.Sprintf("longer than %d bytes", c.max_key))
+	case strings.IndexByte(name, 0) >= 0:
+		return invalid("contains a NUL byte")
+	}
+	if _, ok := c.key_enc.(hierarchicalKeys); ok {
+		for _, seg := range strings.Split(name, "/") {
+			switch seg {
+			case "":
+				return invalid("empty path segment")
+			case ".", "..":
+				return invalid("relative path segment")
+			}
+		}
+	}
+	return nil
+}
+
+// validateNesting rejects a hierarchical name whose file would be the
+// directory of other entries, e.g. "a" once "a/b" is stored, or would be
+// below the file of another entry, e.g. "a/b" once "a" is stored.
+func (c *FsCache) validateNesting(name string) error {
+	if _, ok := c.fs.(Lister); ok {
+		// its Files aren't in directories.
+		return nil
+	}
+	key := c.key(name)
+	fi, err := os.Stat(c.getPath(key))
+	switch {
+	case err == nil && fi.IsDir():
+		return &InvalidKeyError{Name: name,
+			Reason: "is the directory of other keys"}
+	case err == nil:
+		return nil
+	}
+	// a miss, make sure no parent is the file of an entry.
+	segs := strings.Split(key, "/")
+	names := strings.Split(name, "/")
+	for i := 1; i < len(segs); i++ {
+		fi, err := os.Stat(c.getPath(strings.Join(segs[:i], "/")))
+		if err != nil {
+			return nil
+		}
+		if !fi.IsDir() {
+			return &InvalidKeyError{Name: name, Reason: fmt.Sprintf(
+				"is below the key %q", strings.Join(names[:i], "/"))}
+		}
+	}
+	return nil
+}
+
+// key returns the file name of the entry name.
+func (c *FsCache) key(name string) string {
+	return c.key_enc.Encode(name)
+}
+
+// Names returns the names of the entries in the cache, as far as they can be
+// recovered from their file names, see KeyEncoding.
+func (c *FsCache) Names() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var names []string
+	for _, s := range c.streams.list() {
+		if name := s.entryName(); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
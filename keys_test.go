@@ -0,0 +1,257 @@
+package fscache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEscapedKeys(t *testing.T) {
+	test := Wrap(t, "keys")
+	defer test.Close()
+	enc := EscapedKeys(64)
+
+	for _, name := range []string{"", "plain-name_1.txt", ".", "..",
+		".hidden", "a/b/../c", "100% ~done", "ünïcode"} {
+		file := enc.Encode(name)
+		test.Assert(file != "." && file != ".." && !strings.ContainsAny(
+			file, "/~"), "unsafe file name "+file)
+		decoded, ok := enc.Decode(file)
+		test.Assert(ok && decoded == name, "expected "+name+" to round trip")
+	}
+
+	long := strings.Repeat("/", 100)
+	file := enc.Encode(long)
+	test.Assert(len(file) <= 64, "expected long names to be truncated")
+	test.Assert(file != enc.Encode(long+"x"), "expected a hash suffix")
+	_, ok := enc.Decode(file)
+	test.Assert(!ok, "truncated names can't be decoded")
+}
+
+func TestKeyEncoding(t *testing.T) {
+	test := Wrap(t, "keys")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0, WithKeyEncoding(EscapedKeys(0)))
+	test.AssertNoError(err)
+	for _, name := range []string{"tenant/object", "other"} {
+		r, w, err := cache.Get(name, 5)
+		test.AssertNoError(err)
+		_, err = w.Write([]byte("hello"))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+		test.AssertNoError(r.Close())
+	}
+
+	cache, err = New(test.Dir(), 0700, 0, WithKeyEncoding(EscapedKeys(0)))
+	test.AssertNoError(err)
+	names := cache.Names()
+	sort.Strings(names)
+	test.Assert(len(names) == 2 && names[0] == "other" &&
+		names[1] == "tenant/object", "expected names to be recovered")
+	info, err := cache.Info("tenant/object")
+	test.AssertNoError(err)
+	test.Assert(info.Key == "tenant%2Fobject", "unexpected key "+info.Key)
+}
+
+func TestHierarchicalKeys(t *testing.T) {
+	test := Wrap(t, "keys")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0,
+		WithKeyEncoding(HierarchicalKeys(0)))
+	test.AssertNoError(err)
+	for _, name := range []string{"tenant/bucket/a", "tenant/bucket/b",
+		"tenant/other/c", "../escape"} {
+		r, w, err := cache.Get(name, 5)
+		test.AssertNoError(err)
+		_, err = w.Write([]byte("hello"))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+		test.AssertNoError(r.Close())
+	}
+	_, err = os.Stat(filepath.Join(test.Dir(), "tenant", "bucket", "a"))
+	test.AssertNoError(err)
+	_, err = os.Stat(filepath.Join(test.Dir(), "%2E.", "escape"))
+	test.AssertNoError(err)
+
+	cache, err = New(test.Dir(), 0700, 0,
+		WithKeyEncoding(HierarchicalKeys(0)))
+	test.AssertNoError(err)
+	test.Assert(len(cache.Names()) == 4, "expected nested entries to load")
+
+	test.AssertNoError(cache.RemovePrefix("tenant/bucket/"))
+	test.Assert(!cache.Exists("tenant/bucket/a") &&
+		!cache.Exists("tenant/bucket/b"), "expected subtree to be removed")
+	test.Assert(cache.Exists("tenant/other/c"), "expected c to be kept")
+	_, err = os.Stat(filepath.Join(test.Dir(), "tenant", "bucket"))
+	test.Assert(os.IsNotExist(err), "expected directory to be removed")
+	test.Assert(errors.Is(cache.RemovePrefix("/"), ErrEmptyPrefix),
+		"expected the empty prefix to be rejected")
+}
+
+func TestGetDuringRemovePrefix(t *testing.T) {
+	test := Wrap(t, "keys")
+	defer test.Close()
+	disk, err := New(filepath.Join(test.Dir(), "disk"), 0700, 0,
+		WithKeyEncoding(HierarchicalKeys(0)))
+	test.AssertNoError(err)
+	mem, err := NewCache(filepath.Join(test.Dir(), "mem"), NewMemFs(), 0,
+		WithKeyEncoding(HierarchicalKeys(0)))
+	test.AssertNoError(err)
+
+	for _, cache := range []*FsCache{disk, mem} {
+		var gen int32
+		get := func(name string) error {
+			r, w, err := cache.Get(name, UnknownSize)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			if w != nil {
+				n := atomic.AddInt32(&gen, 1)
+				payload := bytes.Repeat([]byte{byte('a' + n%26)}, 1024)
+				_, err := w.Write(payload[:512])
+				if err == nil {
+					_, err = w.Write(payload[512:])
+				}
+				if cerr := w.Close(); err == nil {
+					err = cerr
+				}
+				if err != nil {
+					return err
+				}
+			}
+			p, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if len(p) != 1024 || !bytes.Equal(p, bytes.Repeat(p[:1], 1024)) {
+				return fmt.Errorf("read %d bytes of different fills", len(p))
+			}
+			return nil
+		}
+
+		errs := make(chan error, 8)
+		stop := make(chan struct{})
+		removed := make(chan struct{})
+		go func() {
+			defer close(removed)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				err := cache.RemovePrefix("tenant/bucket")
+				if err == nil {
+					err = assertFilesExist(cache)
+				}
+				if err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}
+		}()
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					if err := get(name); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(fmt.Sprintf("tenant/bucket/%d", i%2))
+		}
+		wg.Wait()
+		close(stop)
+		<-removed
+		close(errs)
+		for err := range errs {
+			test.AssertNoError(err)
+		}
+		// the entries filled after the last removal kept their files.
+		for i := 0; i < 2; i++ {
+			test.AssertNoError(get(fmt.Sprintf("tenant/bucket/%d", i)))
+		}
+	}
+}
+
+func TestHierarchicalKeysCollide(t *testing.T) {
+	test := Wrap(t, "keys")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0,
+		WithKeyEncoding(HierarchicalKeys(0)))
+	test.AssertNoError(err)
+	for _, name := range []string{"a", "b/c"} {
+		r, w, err := cache.Get(name, 5)
+		test.AssertNoError(err)
+		_, err = w.Write([]byte("hello"))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+		test.AssertNoError(r.Close())
+	}
+	for _, name := range []string{"a/b", "a/b/c", "b"} {
+		_, _, err := cache.Get(name, 5)
+		var invalid *InvalidKeyError
+		test.Assert(errors.As(err, &invalid),
+			"expected "+name+" to collide")
+	}
+	test.Assert(cache.Exists("a") && cache.Exists("b/c"),
+		"expected the stored entries to be kept")
+
+	test.AssertNoError(cache.Remove("a"))
+	r, w, err := cache.Get("a/b", 5)
+	test.AssertNoError(err)
+	test.Assert(w != nil, "expected a/b to be filled once a is removed")
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+}
+
+func TestStrictKeys(t *testing.T) {
+	test := Wrap(t, "keys")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0, WithStrictKeys(16),
+		WithKeyEncoding(HierarchicalKeys(0)))
+	test.AssertNoError(err)
+
+	for _, name := range []string{"", "nul\x00byte", strings.Repeat("a", 17),
+		"../escape", "a//b", "a/./b", "/abs"} {
+		_, _, err := cache.Get(name, 5)
+		var invalid *InvalidKeyError
+		test.Assert(errors.As(err, &invalid),
+			"expected "+name+" to be rejected")
+	}
+	r, w, err := cache.Get("tenant/object", 5)
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+}
+
+// assertFilesExist checks that the complete entries of cache have a file.
+func assertFilesExist(cache *FsCache) error {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+	for _, s := range cache.streams.list() {
+		if s.State() != StreamComplete {
+			continue
+		}
+		if _, err := s.Size(); err != nil {
+			return fmt.Errorf("the file of %s is gone: %s", s.info.Key, err)
+		}
+	}
+	return nil
+}
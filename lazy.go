@@ -0,0 +1,155 @@
+package fscache
+
+import (
+	"io"
+	"sync"
+)
+
+// lazyFile is the WriteFile of a Stream, which only creates the underlying
+// File on the first Write so that abandoned fills don't leave empty files.
+type lazyFile struct {
+	fs    FileSystem
+	name  string
+	empty bool // create the File on Close even if nothing was written
+	mu    sync.Mutex
+	f     File // nil until the first Write
+	// the name belongs to a new entry, see Stream.retire, guarded by mu
+	retired bool
+}
+
+func (f *lazyFile) Name() string { return f.name }
+
+func (f *lazyFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	if err := f.create(); err != nil {
+		f.mu.Unlock()
+		return 0, err
+	}
+	file := f.f
+	f.mu.Unlock()
+	return file.Write(p)
+}
+
+// create creates the underlying File if it doesn't exist, f.mu must be held.
+func (f *lazyFile) create() error {
+	if f.f != nil {
+		return nil
+	}
+	if f.retired {
+		return ErrEntryRemoved
+	}
+	file, err := f.fs.Create(f.name)
+	if err != nil {
+		return err
+	}
+	f.f = file
+	return nil
+}
+
+func (f *lazyFile) retire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.retired = true
+}
+
+// open opens the underlying File for reading, nil if it hasn't been created
+// yet. It fails with ErrEntryRemoved once the name has been retired, as it
+// may then be the File of another entry.
+func (f *lazyFile) open() (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.retired {
+		return nil, ErrEntryRemoved
+	}
+	if f.f == nil {
+		return nil, nil
+	}
+	return f.fs.Open(f.name)
+}
+
+// created reports whether the underlying File exists.
+func (f *lazyFile) created() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.f != nil
+}
+
+func (f *lazyFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil && f.empty {
+		if err := f.create(); err != nil {
+			return err
+		}
+	}
+	if f.f == nil {
+		return nil
+	}
+	return f.f.Close()
+}
+
+// lazyReadFile is a ReadFile for a Stream whose File hasn't been created yet.
+// It reads as empty until the File exists, and then opens it.
+type lazyReadFile struct {
+	w  *lazyFile
+	mu sync.Mutex
+	f  File // nil until opened
+}
+
+func (r *lazyReadFile) Name() string { return r.w.name }
+
+// file returns the opened File, or nil if it doesn't exist yet.
+func (r *lazyReadFile) file() (File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		f, err := r.w.open()
+		if err != nil {
+			return nil, err
+		}
+		r.f = f
+	}
+	return r.f, nil
+}
+
+func (r *lazyReadFile) ReadAt(p []byte, off int64) (int, error) {
+	f, err := r.file()
+	if f == nil || err != nil {
+		return 0, eofOr(err)
+	}
+	return f.ReadAt(p, off)
+}
+
+func (r *lazyReadFile) Read(p []byte) (int, error) {
+	f, err := r.file()
+	if f == nil || err != nil {
+		return 0, eofOr(err)
+	}
+	return f.Read(p)
+}
+
+func (r *lazyReadFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
+
+func eofOr(err error) error {
+	if err == nil {
+		return io.EOF
+	}
+	return err
+}
+
+// removeFile deletes the File of the stream, which may never have been
+// created if its writer didn't write anything.
+func (s *Stream) removeFile() error {
+	err := s.fs.Remove(s.Name())
+	if err != nil && s.lazy != nil && !s.lazy.created() {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package fscache
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Leak describes a Reader or Writer which has been open for longer than the
+// duration configured with WithLeakDetection.
+type Leak struct {
+	Kind    string // "reader" or "writer"
+	Name    string // the name of the underlying File
+	Created time.Time
+	Stack   string // stack trace of the goroutine which opened the handle
+}
+
+func (l Leak) String() string {
+	return fmt.Sprintf("%s on %s open since %s, created at:\n%s", l.Kind,
+		l.Name, l.Created.Format(time.RFC3339), l.Stack)
+}
+
+// WithLeakDetection enables a debug mode which records a stack trace whenever
+// a Reader or Writer is created. Handles which are still open after d are
+// reported by DumpLeaks and logged on every reap.
+func WithLeakDetection(d time.Duration) Option {
+	return func(c *FsCache) {
+		c.leaks = newLeakTracker(d)
+	}
+}
+
+type leakTracker struct {
+	mu      sync.Mutex
+	after   time.Duration
+	clock   Clock
+	next    uint64
+	handles map[uint64]*Leak
+}
+
+func newLeakTracker(after time.Duration) *leakTracker {
+	return &leakTracker{
+		after:   after,
+		clock:   systemClock,
+		handles: make(map[uint64]*Leak),
+	}
+}
+
+// stackBufs pools the buffers stack traces are captured in by track.
+var stackBufs = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 4096)
+		return &buf
+	},
+}
+
+// track records a new open handle and returns the func to call on close.
+func (t *leakTracker) track(kind, name string) (release func()) {
+	buf := stackBufs.Get().(*[]byte)
+	stack := string((*buf)[:runtime.Stack(*buf, false)])
+	stackBufs.Put(buf)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := t.next
+	t.next++
+	t.handles[id] = &Leak{
+		Kind:    kind,
+		Name:    name,
+		Created: t.clock.Now(),
+		Stack:   stack,
+	}
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.handles, id)
+	}
+}
+
+func (t *leakTracker) leaks() []Leak {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	deadline := t.clock.Now().Add(-t.after)
+	var leaks []Leak
+	for _, h := range t.handles {
+		if h.Created.Before(deadline) {
+			leaks = append(leaks, *h)
+		}
+	}
+	sort.Slice(leaks, func(i, j int) bool {
+		return leaks[i].Created.Before(leaks[j].Created)
+	})
+	return leaks
+}
+
+// DumpLeaks returns the Readers and Writers which have been open for longer
+// than the leak detection duration, oldest first. It returns nil unless the
+// cache was created WithLeakDetection.
+func (c *FsCache) DumpLeaks() []Leak {
+	if c.leaks == nil {
+		return nil
+	}
+	return c.leaks.leaks()
+}
+
+func (c *FsCache) logLeaks() {
+	for _, l := range c.DumpLeaks() {
+		logger.Warnf("possible leak: %s", l)
+	}
+}
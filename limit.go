@@ -0,0 +1,183 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrTooManyWriters is returned by Get when filling a missing key would exceed
+// one of the writer limits of the cache.
+var ErrTooManyWriters = errors.New("too many concurrent writers")
+
+// ErrTooManyReaders is returned by Get when an entry already has as many open
+// Readers as WithMaxReaders allows.
+var ErrTooManyReaders = errors.New("too many concurrent readers")
+
+// Limiter bounds the number of concurrently open writers. A Limiter can be
+// shared by several caches (see WithLimiter) to enforce a global limit.
+type Limiter struct {
+	mu      sync.Mutex
+	limit   int
+	active  int
+	waiters []waiter // by priority, then FIFO
+}
+
+type waiter struct {
+	ready    chan struct{} // closed when granted a slot
+	priority Priority
+}
+
+// NewLimiter creates a Limiter which allows up to n concurrent writers, or
+// any number of them if n <= 0.
+func NewLimiter(n int) *Limiter {
+	return &Limiter{limit: n}
+}
+
+// Limit returns the current limit.
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// SetLimit changes the limit to n, or removes it if n <= 0. Lowering the
+// limit doesn't affect slots which are already taken.
+func (l *Limiter) SetLimit(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = n
+	l.grant()
+}
+
+func (l *Limiter) full() bool {
+	return l.limit > 0 && l.active >= l.limit
+}
+
+// TryAcquire takes a slot without blocking and reports whether it succeeded.
+func (l *Limiter) TryAcquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.full() || len(l.waiters) > 0 {
+		return false
+	}
+	l.active++
+	return true
+}
+
+// Acquire takes a slot, blocking until one is free or ctx is done. Waiters
+// with a higher priority (see WithPriority) are served first.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if !l.full() && len(l.waiters) == 0 {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	w := waiter{ready: ready, priority: PriorityFrom(ctx)}
+	i := len(l.waiters)
+	for i > 0 && l.waiters[i-1].priority < w.priority {
+		i--
+	}
+	l.waiters = append(l.waiters, waiter{})
+	copy(l.waiters[i+1:], l.waiters[i:])
+	l.waiters[i] = w
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i, w := range l.waiters {
+			if w.ready == ready {
+				l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// we were granted a slot concurrently, give it back.
+		l.release()
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken by Acquire or TryAcquire.
+func (l *Limiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.release()
+}
+
+func (l *Limiter) release() {
+	l.active--
+	l.grant()
+}
+
+// grant hands free slots over to waiters.
+func (l *Limiter) grant() {
+	for len(l.waiters) > 0 && !l.full() {
+		close(l.waiters[0].ready)
+		l.waiters = l.waiters[1:]
+		l.active++
+	}
+}
+
+// WithMaxWriters limits the number of concurrently open writers of the cache
+// to n. It can be changed later with Reconfigure.
+func WithMaxWriters(n int) Option {
+	return func(c *FsCache) {
+		c.max_writers = NewLimiter(n)
+		c.limiters = append(c.limiters, c.max_writers)
+	}
+}
+
+// WithMaxReaders limits the number of Readers open at once on each entry to
+// n, bounding the file descriptors and memory a hot entry can take. Get and
+// GetMulti fail with ErrTooManyReaders while an entry has n, GetContext and
+// GetAsync wait for one of them to be closed. It can be changed later with
+// Reconfigure, and EntryInfo.Readers tells how many are open.
+func WithMaxReaders(n int) Option {
+	return func(c *FsCache) {
+		c.max_readers = n
+	}
+}
+
+// WithLimiter makes the cache take a slot from l for every open writer. It
+// can be given more than once, e.g. for a per-cache and a global limit.
+func WithLimiter(l *Limiter) Option {
+	return func(c *FsCache) {
+		c.limiters = append(c.limiters, l)
+	}
+}
+
+// acquireWriter takes a slot from every limiter of the cache, waiting for
+// them if wait is true and otherwise failing with ErrTooManyWriters.
+func (c *FsCache) acquireWriter(ctx context.Context, wait bool) (release func(),
+	err error) {
+	c.mu.RLock()
+	limiters := c.limiters
+	c.mu.RUnlock()
+	for i, l := range limiters {
+		if wait {
+			err = l.Acquire(ctx)
+		} else if !l.TryAcquire() {
+			err = ErrTooManyWriters
+		}
+		if err != nil {
+			for _, l := range limiters[:i] {
+				l.Release()
+			}
+			return nil, err
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, l := range limiters {
+				l.Release()
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,173 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMaxWriters(t *testing.T) {
+	test := Wrap(t, "limit")
+	defer test.Close()
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0, WithMaxWriters(1))
+	test.AssertNoError(err)
+
+	r, w, err := cache.Get("a", 1)
+	test.AssertNoError(err)
+	defer r.Close()
+
+	_, _, err = cache.Get("b", 1)
+	test.Assert(errors.Is(err, ErrTooManyWriters), "expected ErrTooManyWriters")
+	test.Assert(!cache.Exists("b"), "b should not have been created")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	_, _, err = cache.GetContext(ctx, "b", 1)
+	cancel()
+	test.Assert(errors.Is(err, context.DeadlineExceeded),
+		"expected GetContext to time out")
+
+	done := make(chan error)
+	go func() {
+		r, w, err := cache.GetContext(context.Background(), "b", 1)
+		if err == nil {
+			r.Close()
+			err = w.Close()
+		}
+		done <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(<-done)
+}
+
+func TestGlobalLimiter(t *testing.T) {
+	test := Wrap(t, "limit")
+	defer test.Close()
+	global := NewLimiter(1)
+	a, err := NewCache(test.Dir(), NewMemFs(), 0, WithMaxWriters(2),
+		WithLimiter(global))
+	test.AssertNoError(err)
+	b, err := NewCache(test.Dir(), NewMemFs(), 0, WithLimiter(global))
+	test.AssertNoError(err)
+
+	w, err := a.GetWriterOnly("a", 1)
+	test.AssertNoError(err)
+	_, err = b.GetWriterOnly("b", 1)
+	test.Assert(errors.Is(err, ErrTooManyWriters),
+		"expected the global limit to apply")
+	test.AssertNoError(w.Close())
+	w, err = b.GetWriterOnly("b", 1)
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+}
+
+func TestLimiterPriority(t *testing.T) {
+	test := Wrap(t, "limit")
+	defer test.Close()
+	l := NewLimiter(1)
+	test.Assert(l.TryAcquire(), "expected a free slot")
+
+	order := make(chan Priority, 3)
+	for _, p := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+		ctx := WithPriority(context.Background(), p)
+		go func(p Priority) {
+			test.AssertNoError(l.Acquire(ctx))
+			order <- p
+			l.Release()
+		}(p)
+		// make sure the waiters queue up in order.
+		for {
+			l.mu.Lock()
+			n := len(l.waiters)
+			l.mu.Unlock()
+			if n == int(p)+2 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	l.Release()
+	for _, want := range []Priority{PriorityHigh, PriorityNormal, PriorityLow} {
+		got := <-order
+		test.Assert(got == want, "expected waiters to be served by priority")
+	}
+}
+
+func TestEntryPriority(t *testing.T) {
+	test := Wrap(t, "limit")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0)
+	test.AssertNoError(err)
+
+	ctx := WithPriority(context.Background(), PriorityLow)
+	r, w, err := cache.GetContext(ctx, "a", 1)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("a"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+	info, err := cache.Info("a")
+	test.AssertNoError(err)
+	test.Assert(info.Priority == PriorityLow, "expected low priority")
+
+	ctx = WithPriority(context.Background(), PriorityHigh)
+	r, w, err = cache.GetContext(ctx, "a", 1)
+	test.AssertNoError(err)
+	test.Assert(w == nil, "expected a hit")
+	test.AssertNoError(r.Close())
+	info, err = cache.Info("a")
+	test.AssertNoError(err)
+	test.Assert(info.Priority == PriorityHigh, "expected priority to be raised")
+}
+
+func TestMaxReaders(t *testing.T) {
+	test := Wrap(t, "limit")
+	defer test.Close()
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0, WithMaxReaders(2))
+	test.AssertNoError(err)
+	r1, w, err := cache.Get("a", 5)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	r2, _, err := cache.Get("a", 5)
+	test.AssertNoError(err)
+	info, err := cache.Info("a")
+	test.AssertNoError(err)
+	test.Assert(info.Readers == 2, "expected 2 readers")
+
+	_, _, err = cache.Get("a", 5)
+	test.Assert(errors.Is(err, ErrTooManyReaders), "expected ErrTooManyReaders")
+	_, _, err = cache.GetMulti([]string{"a"})
+	test.Assert(errors.Is(err, ErrTooManyReaders), "expected ErrTooManyReaders")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	_, _, err = cache.GetContext(ctx, "a", 5)
+	cancel()
+	test.Assert(errors.Is(err, context.DeadlineExceeded),
+		"expected GetContext to time out")
+
+	done := make(chan error)
+	go func() {
+		r, _, err := cache.GetContext(context.Background(), "a", 5)
+		if err == nil {
+			err = r.Close()
+		}
+		done <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	test.AssertNoError(r1.Close())
+	test.AssertNoError(<-done)
+
+	cache.Reconfigure(Config{})
+	r3, _, err := cache.Get("a", 5)
+	test.AssertNoError(err)
+	r4, _, err := cache.Get("a", 5)
+	test.AssertNoError(err)
+	for _, r := range []ReaderAtCloser{r2, r3, r4} {
+		test.AssertNoError(r.Close())
+	}
+	info, err = cache.Info("a")
+	test.AssertNoError(err)
+	test.Assert(info.Readers == 0, "expected no readers")
+}
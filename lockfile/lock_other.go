@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package lockfile
+
+import "os"
+
+func lock(f *os.File, wait bool) error {
+	return ErrUnsupported
+}
+
+func unlock(f *os.File) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,72 @@
+// Package lockfile provides exclusive advisory locks on files, held by one
+// process at a time, so that applications sharing a cache directory can
+// coordinate around it, e.g. to run a single job rebuilding it. The locks
+// are released when the file is closed, also if the process dies.
+package lockfile
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+var (
+	// ErrLocked is returned by TryAcquire if the file is locked already.
+	ErrLocked = errors.New("file is locked")
+
+	// ErrUnsupported is returned on platforms without file locking.
+	ErrUnsupported = errors.New("file locking not supported on this platform")
+)
+
+// Lock is an exclusive lock of a file.
+type Lock struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File // nil once released
+}
+
+// Acquire locks the file at path, creating it if it doesn't exist, and
+// blocks until the lock is free. Locks are per Lock rather than per process:
+// acquiring the same file twice in a process blocks as well.
+func Acquire(path string) (*Lock, error) {
+	return acquire(path, true)
+}
+
+// TryAcquire is like Acquire but fails with ErrLocked instead of blocking.
+func TryAcquire(path string) (*Lock, error) {
+	return acquire(path, false)
+}
+
+func acquire(path string, wait bool) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock(f, wait); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Lock{path: path, f: f}, nil
+}
+
+// Path returns the path of the locked file.
+func (l *Lock) Path() string {
+	return l.path
+}
+
+// Release releases the lock. The file is left in place, deleting it would
+// let another process lock a new file of the same name while a third still
+// holds the old one. Releasing a Lock again is a no-op.
+func (l *Lock) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := unlock(l.f)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
@@ -0,0 +1,61 @@
+package lockfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rebuild.lock")
+
+	l, err := Acquire(path)
+	if err == ErrUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TryAcquire(path); err != ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	acquired := make(chan *Lock)
+	go func() {
+		l, err := Acquire(path)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- l
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected Acquire to block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Release(); err != nil {
+		t.Fatalf("expected releasing twice to be a no-op, got %v", err)
+	}
+	l2 := <-acquired
+	if l2 == nil {
+		t.FailNow()
+	}
+	if err := l2.Release(); err != nil {
+		t.Fatal(err)
+	}
+	l3, err := TryAcquire(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l3.Release()
+}
@@ -2,8 +2,11 @@ package fscache
 
 import (
 	"bytes"
+	"encoding/gob"
 	"errors"
 	"io"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
@@ -11,22 +14,30 @@ import (
 type memFS struct {
 	mu    sync.RWMutex
 	files map[string]*memFile
+	clock Clock
 }
 
 // NewMemFs creates an in-memory FileSystem.
-// It does not support persistence (Reload is a nop).
+// It can be persisted with Dump and restored with Load, see Dumper.
 func NewMemFs() FileSystem {
+	return NewMemFsWithClock(systemClock)
+}
+
+// NewMemFsWithClock is like NewMemFs but records access times with clock.
+func NewMemFsWithClock(clock Clock) FileSystem {
 	return &memFS{
 		files: make(map[string]*memFile),
+		clock: clock,
 	}
 }
 
 func (fs *memFS) AccessTimes(name string) (rt, wt time.Time, err error) {
 	fs.mu.RLock()
-	defer fs.mu.RUnlock()
 	f, ok := fs.files[name]
+	fs.mu.RUnlock()
 	if ok {
-		return f.rt, f.wt, nil
+		rt, wt = f.times()
+		return rt, wt, nil
 	}
 	return rt, wt, errors.New("file has not been read")
 }
@@ -38,9 +49,10 @@ func (fs *memFS) Create(key string) (File, error) {
 		return nil, errors.New("file exists")
 	}
 	file := &memFile{
-		name: key,
-		r:    bytes.NewBuffer(nil),
-		wt:   nowHook(),
+		name:  key,
+		r:     bytes.NewBuffer(nil),
+		clock: fs.clock,
+		wt:    fs.clock.Now(),
 	}
 	file.memReader.memFile = file
 	fs.files[key] = file
@@ -48,10 +60,12 @@ func (fs *memFS) Create(key string) (File, error) {
 }
 
 func (fs *memFS) Open(name string) (File, error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 	if f, ok := fs.files[name]; ok {
-		f.rt = nowHook()
+		f.mu.Lock()
+		f.rt = fs.clock.Now()
+		f.mu.Unlock()
 		return &memReader{memFile: f}, nil
 	}
 	return nil, errors.New("file does not exist")
@@ -72,13 +86,90 @@ func (fs *memFS) RemoveAll() error {
 }
 
 func (fs *memFS) Size(name string) (int64, error) {
-	return 0, errors.New("not implemented")
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	f, ok := fs.files[name]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return int64(len(f.Bytes())), nil
+}
+
+// List returns the keys of the Files, i.e. the last element of their names.
+func (fs *memFS) List() ([]string, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	keys := make([]string, 0, len(fs.files))
+	for name := range fs.files {
+		keys = append(keys, filepath.Base(name))
+	}
+	return keys, nil
+}
+
+// Dumper is implemented by FileSystems which can be serialized, like the one
+// returned by NewMemFs, so that a cache can be persisted and restored:
+//
+//	err := fs.(Dumper).Dump(w)
+//	...
+//	fs := NewMemFs()
+//	err := fs.(Dumper).Load(r)
+//	cache, err := NewCache(dir, fs, expiry)
+type Dumper interface {
+	// Dump writes the contents of all Files to w.
+	Dump(w io.Writer) error
+	// Load adds the Files written by Dump, replacing those with the same
+	// name.
+	Load(r io.Reader) error
+}
+
+type memDump struct {
+	Name   string
+	Data   []byte
+	Rt, Wt time.Time
+}
+
+func (fs *memFS) Dump(w io.Writer) error {
+	fs.mu.RLock()
+	dump := make([]memDump, 0, len(fs.files))
+	for name, f := range fs.files {
+		rt, wt := f.times()
+		dump = append(dump, memDump{
+			Name: name,
+			Data: f.Bytes(),
+			Rt:   rt,
+			Wt:   wt,
+		})
+	}
+	fs.mu.RUnlock()
+	return gob.NewEncoder(w).Encode(dump)
+}
+
+func (fs *memFS) Load(r io.Reader) error {
+	var dump []memDump
+	if err := gob.NewDecoder(r).Decode(&dump); err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, d := range dump {
+		file := &memFile{
+			name:  d.Name,
+			r:     bytes.NewBuffer(d.Data),
+			clock: fs.clock,
+			rt:    d.Rt,
+			wt:    d.Wt,
+		}
+		file.memReader.memFile = file
+		fs.files[d.Name] = file
+	}
+	return nil
 }
 
 type memFile struct {
-	mu   sync.RWMutex
-	name string
-	r    *bytes.Buffer
+	mu    sync.RWMutex // guards r, rt and wt
+	name  string
+	r     *bytes.Buffer
+	clock Clock
 	memReader
 	rt, wt time.Time
 }
@@ -91,11 +182,32 @@ func (f *memFile) Write(p []byte) (int, error) {
 	if len(p) > 0 {
 		f.mu.Lock()
 		defer f.mu.Unlock()
+		f.wt = f.clock.Now()
 		return f.r.Write(p)
 	}
 	return len(p), nil
 }
 
+// WriteAt writes p at off, zero filling the file up to off.
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.wt = f.clock.Now()
+	if end := off + int64(len(p)); end > int64(f.r.Len()) {
+		f.r.Write(make([]byte, end-int64(f.r.Len())))
+	}
+	return copy(f.r.Bytes()[off:], p), nil
+}
+
+func (f *memFile) times() (rt, wt time.Time) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.rt, f.wt
+}
+
 func (f *memFile) Bytes() []byte {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
@@ -1,8 +1,11 @@
 package fscache
 
 import (
+	"bytes"
 	"io/ioutil"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestMemFs(t *testing.T) {
@@ -26,3 +29,61 @@ func TestMemFs(t *testing.T) {
 	r.Close()
 	test.AssertByteEqual(to_write, p)
 }
+
+func TestMemFsDump(t *testing.T) {
+	test := Wrap(t, "memfs")
+	defer test.Close()
+	fs := NewMemFs()
+	cache, err := NewCache(test.Dir(), fs, 0)
+	test.AssertNoError(err)
+	r, w, err := cache.Get("stream", 5)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+
+	var buf bytes.Buffer
+	test.AssertNoError(fs.(Dumper).Dump(&buf))
+
+	fs = NewMemFs()
+	test.AssertNoError(fs.(Dumper).Load(&buf))
+	cache, err = NewCache(test.Dir(), fs, 0)
+	test.AssertNoError(err)
+	r, w, err = cache.Get("stream", 5)
+	test.AssertNoError(err)
+	test.Assert(w == nil, "expected entry to be restored")
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual([]byte("hello"), p)
+	test.AssertNoError(r.Close())
+}
+
+func TestMemFsClock(t *testing.T) {
+	test := Wrap(t, "memfs")
+	defer test.Close()
+	now := time.Date(2016, time.September, 1, 0, 0, 0, 0, time.UTC)
+	clock := ClockFunc(func() time.Time { return now })
+	fs := NewMemFsWithClock(clock)
+	cache, err := NewCache(test.Dir(), fs, 0, WithClock(clock))
+	test.AssertNoError(err)
+
+	r, w, err := cache.Get("stream", 5)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	_, err = ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertNoError(r.Close())
+	rt, wt, err := fs.AccessTimes(filepath.Join(test.Dir(), fileName("stream")))
+	test.AssertNoError(err)
+	test.Assert(rt.Equal(now) && wt.Equal(now), "expected times from clock")
+
+	now = now.Add(time.Second)
+	cache.reap(2 * time.Second)
+	test.Assert(cache.Exists("stream"), "stream should exist")
+	now = now.Add(2 * time.Second)
+	cache.reap(2 * time.Second)
+	test.Assert(!cache.Exists("stream"), "stream should be reaped")
+}
@@ -0,0 +1,107 @@
+package fscache
+
+import "io"
+
+// WriterMiddleware wraps the writer returned for the entry name, e.g. to hash,
+// throttle, trace or transform the bytes before they reach the cache. If the
+// returned io.Writer is also an io.Closer it is Closed before the entry.
+type WriterMiddleware func(name string, w io.Writer) io.Writer
+
+// ReaderMiddleware wraps the reader returned for the entry name. It only
+// applies to Read, ReadAt always reads the cached bytes directly. If the
+// returned io.Reader is also an io.Closer it is Closed before the entry.
+type ReaderMiddleware func(name string, r io.Reader) io.Reader
+
+// WithWriterMiddleware registers middleware applied to every writer returned
+// by the cache. The first middleware sees the written bytes first.
+func WithWriterMiddleware(mw ...WriterMiddleware) Option {
+	return func(c *FsCache) {
+		c.writer_mw = append(c.writer_mw, mw...)
+	}
+}
+
+// WithReaderMiddleware registers middleware applied to every reader returned
+// by the cache. The first middleware sees the read bytes last.
+func WithReaderMiddleware(mw ...ReaderMiddleware) Option {
+	return func(c *FsCache) {
+		c.reader_mw = append(c.reader_mw, mw...)
+	}
+}
+
+func (c *FsCache) wrapWriter(name string, w io.WriteCloser) io.WriteCloser {
+	w = c.encodeWriter(w)
+	if len(c.writer_mw) == 0 {
+		return w
+	}
+	mw := &middlewareWriter{w: w, Writer: w}
+	for i := len(c.writer_mw) - 1; i >= 0; i-- {
+		next := c.writer_mw[i](name, mw.Writer)
+		if cl, ok := next.(io.Closer); ok && next != mw.Writer {
+			mw.closers = append([]io.Closer{cl}, mw.closers...)
+		}
+		mw.Writer = next
+	}
+	return mw
+}
+
+// entryReader is the interface of the Readers returned by Get.
+type entryReader interface {
+	EntryReader
+	ReadRanges(ranges []Range) ([][]byte, error)
+}
+
+func (c *FsCache) wrapReader(name string, r *Reader) ReaderAtCloser {
+	r.limit(c.read_limit)
+	c.labelReader(r)
+	var er entryReader = r
+	if len(c.codecs) > 0 {
+		er = newCodecReader(r, c.codecs)
+	}
+	if len(c.reader_mw) == 0 {
+		return er
+	}
+	mr := &middlewareReader{entryReader: er, r: er}
+	for _, m := range c.reader_mw {
+		next := m(name, mr.r)
+		if cl, ok := next.(io.Closer); ok && next != mr.r {
+			mr.closers = append([]io.Closer{cl}, mr.closers...)
+		}
+		mr.r = next
+	}
+	return mr
+}
+
+type middlewareWriter struct {
+	io.Writer
+	closers []io.Closer // outermost first
+	w       io.WriteCloser
+}
+
+func (mw *middlewareWriter) Close() error {
+	return closeAll(mw.closers, mw.w)
+}
+
+type middlewareReader struct {
+	entryReader
+	closers []io.Closer // outermost first
+	r       io.Reader
+}
+
+func (mr *middlewareReader) Read(p []byte) (int, error) {
+	return mr.r.Read(p)
+}
+
+func (mr *middlewareReader) Close() error {
+	return closeAll(mr.closers, mr.entryReader)
+}
+
+// closeAll closes every closer followed by last, returning the first error.
+func closeAll(closers []io.Closer, last io.Closer) error {
+	var err error
+	for _, cl := range append(closers, last) {
+		if cerr := cl.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package fscache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	test := Wrap(t, "middleware")
+	defer test.Close()
+
+	var order []string
+	var read_bytes int
+	upper := func(name string, w io.Writer) io.Writer {
+		order = append(order, "upper")
+		return &funcWriter{func(p []byte) (int, error) {
+			return w.Write(bytes.ToUpper(p))
+		}}
+	}
+	exclaim := func(name string, w io.Writer) io.Writer {
+		order = append(order, "exclaim")
+		return &funcWriter{func(p []byte) (int, error) {
+			n, err := w.Write(bytes.Replace(p, []byte("."), []byte("!"), -1))
+			return n, err
+		}}
+	}
+	count := func(name string, r io.Reader) io.Reader {
+		return &funcReader{func(p []byte) (int, error) {
+			n, err := r.Read(p)
+			read_bytes += n
+			return n, err
+		}}
+	}
+
+	cache, err := New(test.Dir(), 0700, 0,
+		WithWriterMiddleware(upper, exclaim),
+		WithReaderMiddleware(count))
+	test.AssertNoError(err)
+
+	r, w, err := cache.Get("stream", 6)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello."))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.Assert(len(order) == 2 && order[0] == "exclaim",
+		"expected middleware to wrap in reverse order")
+
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual([]byte("HELLO!"), p)
+	test.Assert(read_bytes == 6, "expected reader middleware to see the bytes")
+
+	q := make([]byte, 5)
+	_, err = r.ReadAt(q, 0)
+	test.AssertNoError(err)
+	test.AssertByteEqual([]byte("HELLO"), q)
+	test.Assert(read_bytes == 6, "ReadAt should bypass reader middleware")
+	test.AssertNoError(r.Close())
+}
+
+type funcWriter struct {
+	write func(p []byte) (int, error)
+}
+
+func (w *funcWriter) Write(p []byte) (int, error) { return w.write(p) }
+
+type funcReader struct {
+	read func(p []byte) (int, error)
+}
+
+func (r *funcReader) Read(p []byte) (int, error) { return r.read(p) }
@@ -0,0 +1,150 @@
+package fscache
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// DefaultPrefetchConcurrency is the number of fills a Prefetch runs at once
+// unless WithPrefetchConcurrency is used.
+const DefaultPrefetchConcurrency = 4
+
+// FillFunc writes the content of name to w. It should return early once ctx
+// is done.
+type FillFunc func(ctx context.Context, name string, w io.Writer) error
+
+// WithPrefetchConcurrency sets how many fills each Prefetch runs at once.
+func WithPrefetchConcurrency(n int) Option {
+	return func(c *FsCache) {
+		c.prefetch_n = n
+	}
+}
+
+// Prefetch is the handle of fills started by FsCache.Prefetch.
+type Prefetch struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	mu     sync.Mutex
+	err    error // the first fill error
+}
+
+// Done is closed once all fills have finished.
+func (p *Prefetch) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait blocks until all fills have finished and returns the first error
+// of a failed fill.
+func (p *Prefetch) Wait() error {
+	<-p.done
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Cancel stops the fills which haven't finished, their entries are removed.
+func (p *Prefetch) Cancel() {
+	p.cancel()
+}
+
+func (p *Prefetch) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// Prefetch fills the names which aren't in the cache in the background with
+// fill, so that later Gets hit. Names which are already cached, or being
+// filled by another Prefetch, are skipped. Failed fills are removed.
+func (c *FsCache) Prefetch(ctx context.Context, names []string,
+	fill FillFunc) *Prefetch {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &Prefetch{cancel: cancel, done: make(chan struct{})}
+
+	n := c.prefetch_n
+	if n <= 0 {
+		n = DefaultPrefetchConcurrency
+	}
+	work := make(chan string)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				if err := c.prefetch(ctx, name, fill); err != nil {
+					p.fail(wrapError(OpGet, name, err))
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(p.done)
+		defer cancel()
+		seen := make(map[string]bool, len(names))
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			select {
+			case work <- name:
+			case <-ctx.Done():
+			}
+		}
+		close(work)
+		wg.Wait()
+	}()
+	return p
+}
+
+// prefetch fills name unless it's cached or already being prefetched.
+func (c *FsCache) prefetch(ctx context.Context, name string,
+	fill FillFunc) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := c.validate(name); err != nil {
+		return err
+	}
+	key := c.key(name)
+	c.mu.Lock()
+	if _, ok := c.prefetching[key]; ok {
+		c.mu.Unlock()
+		return nil
+	}
+	c.prefetching[key] = struct{}{}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.prefetching, key)
+		c.mu.Unlock()
+	}()
+
+	s, err := c.lookup(name, UnknownSize)
+	if err != nil || s != nil {
+		return err
+	}
+	s, cw, err := c.fill(ctx, name, UnknownSize, true)
+	if err == ErrEntryExists {
+		// filled by a Get since the lookup.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	w := c.wrapWriter(name, cw)
+	c.labelled(ctx, "prefetch", key, func(ctx context.Context) {
+		err = fill(ctx, name, w)
+	})
+	if err != nil {
+		cw.abort(err)
+		c.discard(s)
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,45 @@
+package fscache
+
+import "context"
+
+// Priority ranks Gets when the cache is under pressure: waiters for a writer
+// slot are served in priority order, and lower priority entries are evicted
+// first.
+type Priority int
+
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx which tags the Gets it's passed to (see
+// GetContext) with priority p.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFrom returns the priority ctx was tagged with, or PriorityNormal.
+func PriorityFrom(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityNormal
+}
+
+// raisePriority raises the priority of the stream to at least p.
+func (s *Stream) raisePriority(p Priority) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p > s.info.Priority {
+		s.info.Priority = p
+	}
+}
+
+func (s *Stream) priority() Priority {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info.Priority
+}
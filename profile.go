@@ -0,0 +1,55 @@
+package fscache
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+// WithProfilerLabels tags the goroutines of the fills the cache runs itself
+// (GetAsync, Prefetch and archive restores) and of Readers blocked waiting
+// for a fill with runtime/pprof labels: fscache_op, the operation ("fill",
+// "prefetch", "restore" or "read"), and fscache_key, the hex md5 of the key
+// of the entry. CPU and goroutine
+// profiles then show which entries are responsible for load. The context
+// passed to FillFuncs carries the labels, so goroutines they start inherit
+// them. Readers clear the labels of their goroutine once done waiting, so
+// leave this off if callers label their goroutines themselves.
+func WithProfilerLabels() Option {
+	return func(c *FsCache) {
+		c.pprof_labels = true
+	}
+}
+
+// labels returns the profiler labels of op on the entry of key.
+func labels(op, key string) pprof.LabelSet {
+	return pprof.Labels("fscache_op", op, "fscache_key", fileName(key))
+}
+
+// labelled runs fn with the labels of op on key if WithProfilerLabels.
+func (c *FsCache) labelled(ctx context.Context, op, key string,
+	fn func(ctx context.Context)) {
+	if !c.pprof_labels {
+		fn(ctx)
+		return
+	}
+	pprof.Do(ctx, labels(op, key), fn)
+}
+
+// labelReader sets the labels r has while it's blocked, see wait.
+func (c *FsCache) labelReader(r *Reader) {
+	if c.pprof_labels && r.stream != nil {
+		r.labels = pprof.WithLabels(context.Background(),
+			labels("read", r.stream.info.Key))
+	}
+}
+
+// wait is waitUntil for the Reader, labelled while it's blocked if the cache
+// has WithProfilerLabels.
+func (r *Reader) wait(off, want int64) (n int64, open bool) {
+	if r.labels == nil {
+		return r.writer.waitUntil(off, want, r.isDetached)
+	}
+	pprof.SetGoroutineLabels(r.labels)
+	defer pprof.SetGoroutineLabels(context.Background())
+	return r.writer.waitUntil(off, want, r.isDetached)
+}
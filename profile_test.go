@@ -0,0 +1,52 @@
+package fscache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProfilerLabels(t *testing.T) {
+	test := Wrap(t, "profile")
+	defer test.Close()
+	labelled := make(chan string, 1)
+	release := make(chan struct{})
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0, WithProfilerLabels(),
+		WithFiller(func(ctx context.Context, name string, w io.Writer) error {
+			op, _ := pprof.Label(ctx, "fscache_op")
+			key, _ := pprof.Label(ctx, "fscache_key")
+			labelled <- op + " " + key
+			<-release
+			_, err := w.Write([]byte(name))
+			return err
+		}))
+	test.AssertNoError(err)
+
+	r, err := cache.GetAsync(context.Background(), "a")
+	test.AssertNoError(err)
+	key := fileName(cache.key("a"))
+	test.Assert(<-labelled == "fill "+key, "expected the fill to be labelled")
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		done <- err
+	}()
+	var profile bytes.Buffer
+	found := false
+	for i := 0; i < 100 && !found; i++ {
+		time.Sleep(time.Millisecond)
+		profile.Reset()
+		pprof.Lookup("goroutine").WriteTo(&profile, 1)
+		found = strings.Contains(profile.String(), `"fscache_op":"read"`) &&
+			strings.Contains(profile.String(), key)
+	}
+	test.Assert(found, "expected the blocked read to be labelled")
+	close(release)
+	test.AssertNoError(<-done)
+	test.AssertNoError(r.Close())
+}
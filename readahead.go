@@ -0,0 +1,12 @@
+package fscache
+
+// WithWakeGranularity makes Readers waiting on a fill wake up once n bytes
+// past their offset have been written, or fewer if that's all they asked
+// for, instead of after every Write. Live streams whose producer writes
+// small chunks are then read in fewer, larger reads, e.g. n = 64 << 10.
+// Readers still wake when the fill is closed.
+func WithWakeGranularity(n int64) Option {
+	return func(c *FsCache) {
+		c.wake_granularity = n
+	}
+}
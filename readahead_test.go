@@ -0,0 +1,59 @@
+package fscache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWakeGranularity(t *testing.T) {
+	test := Wrap(t, "readahead")
+	defer test.Close()
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0, WithWakeGranularity(8))
+	test.AssertNoError(err)
+	r, w, err := cache.Get("a", UnknownSize)
+	test.AssertNoError(err)
+
+	type result struct {
+		n   int
+		err error
+	}
+	read := func(p []byte) chan result {
+		done := make(chan result, 1)
+		go func() {
+			n, err := r.Read(p)
+			done <- result{n, err}
+		}()
+		return done
+	}
+	done := read(make([]byte, 16))
+	time.Sleep(5 * time.Millisecond)
+	_, err = w.Write([]byte("abcd"))
+	test.AssertNoError(err)
+	select {
+	case <-done:
+		t.Fatal("woke before the granularity was written")
+	case <-time.After(10 * time.Millisecond):
+	}
+	_, err = w.Write([]byte("efgh"))
+	test.AssertNoError(err)
+	res := <-done
+	test.AssertNoError(res.err)
+	test.Assert(res.n == 8, "expected 8 bytes in one read")
+
+	// reads smaller than the granularity wake once they can be served.
+	done = read(make([]byte, 2))
+	_, err = w.Write([]byte("ij"))
+	test.AssertNoError(err)
+	res = <-done
+	test.AssertNoError(res.err)
+	test.Assert(res.n == 2, "expected 2 bytes")
+
+	done = read(make([]byte, 16))
+	_, err = w.Write([]byte("k"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	res = <-done
+	test.AssertNoError(res.err)
+	test.Assert(res.n == 1, "expected the tail once closed")
+	test.AssertNoError(r.Close())
+}
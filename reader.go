@@ -1,6 +1,31 @@
 package fscache
 
-import "io"
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrEntryRemoved is returned by the Sections of a Reader once the entry
+	// they read has been removed or replaced.
+	ErrEntryRemoved = errors.New("entry was removed or replaced")
+
+	// ErrReaderTimeout is returned by a Reader which stayed on a fill for
+	// longer than allowed, see WithReaderTimeout.
+	ErrReaderTimeout = errors.New("reader attached to a fill for too long")
+
+	// ErrDetached is returned by the Readers and Writer of an entry which
+	// was Detached.
+	ErrDetached = errors.New("entry was detached")
+
+	// ErrNegativeRange is returned by ReadRanges for a Range with a negative
+	// Len.
+	ErrNegativeRange = errors.New("range has a negative length")
+)
 
 type CacheReader interface {
 	Name() string
@@ -9,12 +34,42 @@ type CacheReader interface {
 	io.Closer
 }
 
-// Reader is a concurrent-safe Stream Reader.
+// EntryReader is implemented by the Readers returned by Get. It describes the
+// entry being read, e.g. to set the Content-Length and Last-Modified headers
+// when serving it over HTTP.
+type EntryReader interface {
+	ReaderAtCloser
+
+	// ContentLength returns the size of the entry if it has been completely
+	// written, and otherwise the size it was requested with.
+	ContentLength() int64
+
+	// Complete reports whether the entry has been completely written.
+	Complete() bool
+
+	// ModTime returns the time the entry was last written to.
+	ModTime() time.Time
+
+	// Section returns a reader of n bytes of the entry starting at off, see
+	// Reader.Section.
+	Section(off, n int64) *io.SectionReader
+}
+
+// Reader is a concurrent-safe Stream Reader. ReadAt may be called from any
+// number of goroutines, also while another goroutine Reads: both read with
+// ReadAt on the underlying file, and only Read moves the offset of Read. Read
+// itself must not be called concurrently.
 type Reader struct {
 	writer   *Writer // writer can be nil if file was already written
-	on_close func()
+	stream   *Stream // nil unless created by a Stream
+	on_close func()  // may be nil
 	file     ReadFile
 	read_off int64
+	release  sync.Once       // runs closed
+	mu       sync.Mutex      // guards err and timer
+	err      error           // set once detached, see detach
+	timer    *time.Timer     // see WithReaderTimeout, nil if unbounded
+	labels   context.Context // see WithProfilerLabels, nil if off
 }
 
 func NewReader(file ReadFile, writer *Writer, on_close func()) *Reader {
@@ -30,15 +85,26 @@ func (r *Reader) Name() string { return r.file.Name() }
 
 // ReadAt blocks while waiting for the requested section of the Stream to
 // be written, unless the Stream is closed in which case it will always
-// return immediately.
+// return immediately. It doesn't affect the offset of Read.
 func (r *Reader) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = r.readAt(p, off)
+	return n, wrapStreamError(OpRead, r.stream, err)
+}
+
+func (r *Reader) readAt(p []byte, off int64) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := r.detached(); err != nil {
+		return 0, err
+	}
 	if r.writer == nil {
 		return r.file.ReadAt(p, off)
 	}
 
 	var m int = 0
 	for {
-		m, err = r.file.ReadAt(p[n:], off)
+		m, err = r.readCommitted(p[n:], off)
 		n += m
 		off += int64(m)
 
@@ -46,8 +112,12 @@ func (r *Reader) ReadAt(p []byte, off int64) (n int, err error) {
 		case n != 0 && err == nil:
 			return n, err
 		case err == io.EOF:
-			if v, open := r.writer.Wait(off); v == 0 && !open {
-				return n, io.EOF
+			v, open := r.wait(off, int64(len(p)-n))
+			if err := r.detached(); err != nil {
+				return n, err
+			}
+			if v <= 0 && !open {
+				return n, r.eof()
 			}
 		case err != nil:
 			return n, err
@@ -56,24 +126,38 @@ func (r *Reader) ReadAt(p []byte, off int64) (n int, err error) {
 }
 
 // Read reads from the Stream. If the end of an open Stream is reached, Read
-// blocks until more data is written or the Stream is Closed.
+// blocks until more data is written or the Stream is Closed. Read keeps its own
+// offset and reads with ReadAt, so it doesn't share the offset of the
+// underlying file with ReadAt or other Readers.
 func (r *Reader) Read(p []byte) (n int, err error) {
-	if r.writer == nil {
-		return r.file.Read(p)
-	}
+	n, err = r.read(p)
+	return n, wrapStreamError(OpRead, r.stream, err)
+}
 
-	var m int
+func (r *Reader) read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := r.detached(); err != nil {
+		return 0, err
+	}
 	for {
-		m, err = r.file.Read(p[n:])
-		n += m
-		r.read_off += int64(m)
+		n, err = r.readCommitted(p, r.read_off)
+		r.read_off += int64(n)
 
 		switch {
-		case n != 0 && err == nil:
+		case n != 0 && (err == nil || err == io.EOF):
 			return n, nil
 		case err == io.EOF:
-			if v, open := r.writer.Wait(r.read_off); v == 0 && !open {
-				return n, io.EOF
+			if r.writer == nil {
+				return 0, io.EOF
+			}
+			v, open := r.wait(r.read_off, int64(len(p)))
+			if err := r.detached(); err != nil {
+				return 0, err
+			}
+			if v <= 0 && !open {
+				return 0, r.eof()
 			}
 		case err != nil:
 			return n, err
@@ -81,9 +165,238 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 	}
 }
 
+// readCommitted reads at off from the file, but only bytes the writer
+// committed if it has one in WriteAt mode, whose file can have gaps.
+func (r *Reader) readCommitted(p []byte, off int64) (int, error) {
+	if r.writer != nil {
+		if n, ok := r.writer.limit(off); ok && n < int64(len(p)) {
+			if n == 0 {
+				return 0, io.EOF
+			}
+			p = p[:n]
+		}
+	}
+	return r.file.ReadAt(p, off)
+}
+
+// Offset returns the offset of the next Read, see Stream.ReaderFrom. It must
+// not be called concurrently with Read.
+func (r *Reader) Offset() int64 {
+	return r.read_off
+}
+
+// eof returns the error to report at the end of a closed stream.
+func (r *Reader) eof() error {
+	if err := r.writer.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// Complete reports whether the Stream has been completely written.
+func (r *Reader) Complete() bool {
+	return r.writer == nil || r.writer.complete()
+}
+
+// ContentLength returns the size of a complete Stream, and otherwise the size
+// it was created for or -1 if that's unknown.
+func (r *Reader) ContentLength() int64 {
+	if r.stream == nil {
+		return -1
+	}
+	if r.Complete() {
+		if size, err := r.stream.Size(); err == nil {
+			return size
+		}
+	}
+	return r.stream.expected
+}
+
+// ModTime returns the logical modification time of the Stream if it was set
+// with SetModTime, and otherwise the time it was last written to, or the zero
+// time if it's unknown.
+func (r *Reader) ModTime() time.Time {
+	if r.stream == nil {
+		return time.Time{}
+	}
+	if t := r.stream.modTime(); !t.IsZero() {
+		return t
+	}
+	_, wt, err := r.stream.fs.AccessTimes(r.stream.Name())
+	if err != nil {
+		return time.Time{}
+	}
+	return wt
+}
+
 // Close closes this Reader on the Stream. This must be called when done with the
 // Reader or else the Stream cannot be Removed.
 func (r *Reader) Close() error {
-	defer r.on_close()
+	r.mu.Lock()
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.mu.Unlock()
+	defer r.release.Do(r.closed)
 	return r.file.Close()
 }
+
+// closed releases the Stream of the Reader and runs its on_close func, once.
+func (r *Reader) closed() {
+	if r.stream != nil {
+		r.stream.closeReader(r)
+	}
+	if r.on_close != nil {
+		r.on_close()
+	}
+}
+
+// detach makes the Reader fail with err from now on, waking it up if it's
+// waiting for the writer, and releases its hold on the Stream so that it can
+// be Removed. The Reader must still be Closed.
+func (r *Reader) detach(err error) {
+	r.mu.Lock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.mu.Unlock()
+	r.release.Do(r.closed)
+	if r.writer != nil {
+		r.writer.wake()
+	}
+}
+
+// detached returns the error the Reader was detached with, if any.
+func (r *Reader) detached() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Reader) isDetached() bool {
+	return r.detached() != nil
+}
+
+// limit detaches the Reader with ErrReaderTimeout if it's still on an
+// unfinished fill after d.
+func (r *Reader) limit(d time.Duration) {
+	if d <= 0 || r.Complete() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timer = time.AfterFunc(d, func() {
+		if !r.Complete() {
+			r.detach(ErrReaderTimeout)
+		}
+	})
+}
+
+// Section returns a reader of n bytes of the Stream starting at off. Its
+// reads block until the bytes they need have been written, like ReadAt, and
+// fail with ErrEntryRemoved once the entry has been removed or replaced.
+func (r *Reader) Section(off, n int64) *io.SectionReader {
+	return newSection(r, r.stream, off, n)
+}
+
+func newSection(at io.ReaderAt, s *Stream, off, n int64) *io.SectionReader {
+	return io.NewSectionReader(&sectionReaderAt{at: at, stream: s}, off, n)
+}
+
+// sectionReaderAt fails reads of a stream which has been removed.
+type sectionReaderAt struct {
+	at     io.ReaderAt
+	stream *Stream // nil if unknown
+}
+
+func (s *sectionReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if s.removed() {
+		return 0, ErrEntryRemoved
+	}
+	n, err := s.at.ReadAt(p, off)
+	if s.removed() {
+		// the bytes may be from the replaced entry.
+		return 0, ErrEntryRemoved
+	}
+	return n, err
+}
+
+func (s *sectionReaderAt) removed() bool {
+	return s.stream != nil && s.stream.State() == StreamRemoving
+}
+
+// Range is a section of a stream starting at Off and Len bytes long.
+type Range struct {
+	Off, Len int64
+}
+
+// ReadRanges reads several byte ranges of the stream in one call, blocking
+// until each of them has been written like ReadAt. Adjacent and overlapping
+// ranges are coalesced so that each contiguous span is read only once. The
+// returned slices are in the same order as ranges. If the stream ends before
+// a range is complete its slice is truncated and io.EOF is returned. Ranges of
+// zero length get an empty slice without waiting, negative lengths fail with
+// ErrNegativeRange.
+//
+// Each span is a ReadAt of its own, they're not read with one vectored
+// read like preadv: the Files of a FileSystem needn't be *os.File, each span
+// may have to wait for the writer, and syscall has no preadv without
+// golang.org/x/sys.
+func (r *Reader) ReadRanges(ranges []Range) ([][]byte, error) {
+	return readRanges(r, ranges)
+}
+
+func readRanges(r io.ReaderAt, ranges []Range) ([][]byte, error) {
+	results := make([][]byte, len(ranges))
+	order := make([]int, 0, len(ranges))
+	for i, rng := range ranges {
+		switch {
+		case rng.Len < 0:
+			return nil, ErrNegativeRange
+		case rng.Len == 0:
+			results[i] = []byte{}
+		default:
+			order = append(order, i)
+		}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return ranges[order[i]].Off < ranges[order[j]].Off
+	})
+
+	var rerr error
+	for i := 0; i < len(order); {
+		// find the contiguous span starting at order[i].
+		span := ranges[order[i]]
+		j := i + 1
+		for ; j < len(order); j++ {
+			next := ranges[order[j]]
+			if next.Off > span.Off+span.Len {
+				break
+			}
+			if end := next.Off + next.Len; end > span.Off+span.Len {
+				span.Len = end - span.Off
+			}
+		}
+
+		buf := make([]byte, span.Len)
+		n, err := r.ReadAt(buf, span.Off)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = buf[:n]
+		for _, k := range order[i:j] {
+			start := ranges[k].Off - span.Off
+			end := start + ranges[k].Len
+			if end > int64(n) {
+				end = int64(n)
+				rerr = io.EOF
+			}
+			if start > end {
+				start = end
+			}
+			results[k] = buf[start:end:end]
+		}
+		i = j
+	}
+	return results, rerr
+}
@@ -0,0 +1,93 @@
+package fscache
+
+import "os"
+
+// ReconcileStats summarizes the work done by Reconcile.
+type ReconcileStats struct {
+	Adopted  int // untracked files which were added as entries
+	Deleted  int // untracked files which were deleted
+	Vanished int // entries whose file had vanished, which were removed
+}
+
+func (s *ReconcileStats) add(o ReconcileStats) {
+	s.Adopted += o.Adopted
+	s.Deleted += o.Deleted
+	s.Vanished += o.Vanished
+}
+
+// Reconcile brings the entries of the cache back in sync with its files,
+// e.g. after files were deleted or copied into its directory by hand. Files
+// which aren't entries are added as complete entries if adopt is true and
+// deleted otherwise, empty ones unless WithKeepEmpty is used. Complete
+// entries whose file vanished are removed, their open Readers keep reading
+// it. The files of Txns, of the trash and of removed entries waiting for
+// their Readers are left alone. The stats are also added to the Reconciled
+// stats of DebugState.
+func (c *FsCache) Reconcile(adopt bool) (ReconcileStats, error) {
+	var stats ReconcileStats
+	keys, err := c.keys()
+	if err != nil {
+		return stats, err
+	}
+	// files are not deleted while a snapshot is being taken.
+	c.awaitSnapshot()
+	for _, key := range keys {
+		if isTrash(key) || isTxn(key) {
+			continue
+		}
+		c.mu.Lock()
+		_, tracked := c.streams.get(key)
+		if !tracked && c.tombstones[key] == nil &&
+			c.removingDir(key) == nil {
+			c.reconcileFile(key, adopt, &stats)
+		}
+		c.unlock()
+	}
+
+	c.mu.Lock()
+	c.streams.each(func(key string, s *Stream) bool {
+		if s.State() != StreamComplete || s.IsOpen() {
+			return true
+		}
+		if _, err := s.Size(); os.IsNotExist(err) {
+			logger.Warnf("the file of %s vanished, removing it", key)
+			c.streams.delete(key)
+			s.markRemoving()
+			stats.Vanished++
+		}
+		return true
+	})
+	c.reconciled.add(stats)
+	c.unlock()
+
+	if stats.Adopted > 0 {
+		c.enforceMaxSize()
+	}
+	return stats, nil
+}
+
+// reconcileFile adopts or deletes the untracked file of key. c.mu must be
+// held.
+func (c *FsCache) reconcileFile(key string, adopt bool,
+	stats *ReconcileStats) {
+	s := c.newStream(key)
+	size, err := s.Size()
+	if err != nil {
+		// unless it was removed since it was listed.
+		if !os.IsNotExist(err) {
+			logger.Warnf("reconciling %s: %s", key, err)
+		}
+		return
+	}
+	if !adopt || size == 0 && !c.keep_empty {
+		if err := c.fs.Remove(s.Name()); err != nil {
+			logger.Error(err)
+			return
+		}
+		stats.Deleted++
+		return
+	}
+	s.markComplete()
+	c.streams.put(key, s, EntryComplete)
+	stats.Adopted++
+}
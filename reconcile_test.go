@@ -0,0 +1,49 @@
+package fscache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	test := Wrap(t, "reconcile")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0)
+	test.AssertNoError(err)
+	r, w, err := cache.Get("a", UnknownSize)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("a"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+
+	test.AssertNoError(os.Remove(cache.getPath(cache.key("a"))))
+	test.AssertNoError(ioutil.WriteFile(cache.getPath(cache.key("b")),
+		[]byte("b"), 0600))
+	stats, err := cache.Reconcile(true)
+	test.AssertNoError(err)
+	test.Assert(stats == ReconcileStats{Adopted: 1, Vanished: 1},
+		"expected b to be adopted and a to vanish")
+	test.Assert(!cache.Exists("a"), "expected a to be removed")
+	r, ok, err := cache.GetIfExists("b")
+	test.AssertNoError(err)
+	test.Assert(ok, "expected b to be adopted")
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual([]byte("b"), p)
+	test.AssertNoError(r.Close())
+
+	stray := cache.getPath(cache.key("c"))
+	test.AssertNoError(ioutil.WriteFile(stray, []byte("c"), 0600))
+	stats, err = cache.Reconcile(false)
+	test.AssertNoError(err)
+	test.Assert(stats == ReconcileStats{Deleted: 1},
+		"expected c to be deleted")
+	_, err = os.Stat(stray)
+	test.Assert(os.IsNotExist(err), "expected the file of c to be deleted")
+	test.Assert(cache.Exists("b"), "expected b to be kept")
+	test.Assert(cache.DebugState().Reconciled ==
+		ReconcileStats{Adopted: 1, Deleted: 1, Vanished: 1},
+		"expected the totals in DebugState")
+}
@@ -0,0 +1,116 @@
+// Package redisindex provides an fscache.Index stored in Redis, so the
+// entries cached on the local disks of a fleet of hosts can be queried from
+// any of them.
+package redisindex
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/amozoss/fscache"
+	"github.com/redis/go-redis/v9"
+)
+
+// Index is the index of the cache of one host. Its entries are kept in the
+// hash <prefix>:entries:<host>, the hosts holding a key in the set
+// <prefix>:owners:<key>, and hit counts across all hosts in the hash
+// <prefix>:hits.
+type Index struct {
+	client redis.UniversalClient
+	prefix string
+	host   string
+}
+
+// New returns the Index of host, storing its keys under prefix.
+func New(client redis.UniversalClient, prefix, host string) *Index {
+	return &Index{client: client, prefix: prefix, host: host}
+}
+
+var _ fscache.Index = (*Index)(nil)
+var _ fscache.HitRecorder = (*Index)(nil)
+
+func (i *Index) entries() string {
+	return i.prefix + ":entries:" + i.host
+}
+
+func (i *Index) owners(key string) string {
+	return i.prefix + ":owners:" + key
+}
+
+func (i *Index) hits() string {
+	return i.prefix + ":hits"
+}
+
+func (i *Index) Put(e fscache.IndexEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	_, err = i.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, i.entries(), e.Key, data)
+		p.SAdd(ctx, i.owners(e.Key), i.host)
+		return nil
+	})
+	return err
+}
+
+func (i *Index) Get(key string) (e fscache.IndexEntry, ok bool, err error) {
+	data, err := i.client.HGet(context.Background(), i.entries(),
+		key).Bytes()
+	if err == redis.Nil {
+		return e, false, nil
+	}
+	if err != nil {
+		return e, false, err
+	}
+	return e, true, json.Unmarshal(data, &e)
+}
+
+func (i *Index) Delete(key string) error {
+	ctx := context.Background()
+	_, err := i.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HDel(ctx, i.entries(), key)
+		p.SRem(ctx, i.owners(key), i.host)
+		return nil
+	})
+	return err
+}
+
+func (i *Index) Iterate(fn func(fscache.IndexEntry) bool) error {
+	ctx := context.Background()
+	it := i.client.HScan(ctx, i.entries(), 0, "", 0).Iterator()
+	for it.Next(ctx) {
+		// fields and values alternate.
+		if !it.Next(ctx) {
+			break
+		}
+		var e fscache.IndexEntry
+		if err := json.Unmarshal([]byte(it.Val()), &e); err != nil {
+			return err
+		}
+		if !fn(e) {
+			return nil
+		}
+	}
+	return it.Err()
+}
+
+// Hit counts a hit of key.
+func (i *Index) Hit(key string) error {
+	return i.client.HIncrBy(context.Background(), i.hits(), key, 1).Err()
+}
+
+// Owners returns the hosts which have key cached.
+func (i *Index) Owners(key string) ([]string, error) {
+	return i.client.SMembers(context.Background(), i.owners(key)).Result()
+}
+
+// Hits returns the number of hits of key across all hosts.
+func (i *Index) Hits(key string) (int64, error) {
+	n, err := i.client.HGet(context.Background(), i.hits(), key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
@@ -0,0 +1,103 @@
+package redisindex
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/amozoss/fscache"
+	"github.com/redis/go-redis/v9"
+)
+
+func newCache(t *testing.T, idx fscache.Index) (*fscache.FsCache, func()) {
+	dir, err := ioutil.TempDir("", "redisindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := fscache.New(dir, 0700, time.Hour, fscache.WithIndex(idx))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return cache, func() { os.RemoveAll(dir) }
+}
+
+func fill(t *testing.T, c *fscache.FsCache, name string) {
+	r, w, err := c.Get(name, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w != nil {
+		w.Write([]byte("hello"))
+		w.Close()
+	}
+	r.Close()
+}
+
+func TestIndex(t *testing.T) {
+	srv, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	defer client.Close()
+
+	a, b := New(client, "fscache", "a"), New(client, "fscache", "b")
+	cache_a, cleanup := newCache(t, a)
+	defer cleanup()
+	cache_b, cleanup := newCache(t, b)
+	defer cleanup()
+
+	fill(t, cache_a, "shared")
+	fill(t, cache_b, "shared")
+	fill(t, cache_b, "shared")
+	fill(t, cache_a, "only-a")
+
+	info, err := cache_a.Info("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok, err := a.Get(info.Key)
+	if err != nil || !ok {
+		t.Fatalf("expected entry in index: %v", err)
+	}
+	if e.Name != "shared" || e.Size != 5 || e.State != fscache.EntryComplete {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+
+	owners, err := a.Owners(info.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(owners)
+	if len(owners) != 2 || owners[0] != "a" || owners[1] != "b" {
+		t.Fatalf("unexpected owners %v", owners)
+	}
+	hits, err := a.Hits(info.Key)
+	if err != nil || hits != 1 {
+		t.Fatalf("expected 1 hit, got %d: %v", hits, err)
+	}
+
+	n := 0
+	if err := a.Iterate(func(fscache.IndexEntry) bool {
+		n++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 entries for a, got %d", n)
+	}
+
+	if err := cache_b.Remove("shared"); err != nil {
+		t.Fatal(err)
+	}
+	owners, err = a.Owners(info.Key)
+	if err != nil || len(owners) != 1 || owners[0] != "a" {
+		t.Fatalf("unexpected owners after remove %v: %v", owners, err)
+	}
+}
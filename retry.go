@@ -0,0 +1,134 @@
+package fscache
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// FillRetry configures how GetAsync retries failed fills, see
+// WithFillRetry.
+type FillRetry struct {
+	// Attempts is the number of times a fill is attempted before giving up,
+	// once if <= 0.
+	Attempts int
+
+	// MinBackoff is the wait after the first failed attempt, doubled after
+	// each further one up to MaxBackoff.
+	MinBackoff, MaxBackoff time.Duration
+
+	// Timeout bounds each attempt, zero means no bound.
+	Timeout time.Duration
+
+	// Retryable reports whether an attempt which failed with err should be
+	// retried, every error is if nil.
+	Retryable func(err error) bool
+
+	// NegativeTTL is how long a fill which failed for good is remembered:
+	// GetAsync, and Gets of the missing entry, fail with its error until
+	// then instead of filling it again. Zero means failures aren't
+	// remembered.
+	NegativeTTL time.Duration
+}
+
+// WithFillRetry makes GetAsync retry failed fills as configured by retry. A
+// retried FillFunc must write the same bytes again: those already written
+// by earlier attempts are skipped, so Readers see each byte once.
+func WithFillRetry(retry FillRetry) Option {
+	return func(c *FsCache) {
+		c.fill_retry = retry
+	}
+}
+
+func (r FillRetry) retryable(err error) bool {
+	return r.Retryable == nil || r.Retryable(err)
+}
+
+// fillFailure is a negative entry, see FillRetry.NegativeTTL.
+type fillFailure struct {
+	err     error
+	expires time.Time
+}
+
+// retryFill fills the entry s of name with fill, retrying as configured by
+// WithFillRetry.
+func (c *FsCache) retryFill(ctx context.Context, name string, s *Stream,
+	w io.Writer, fill FillFunc) error {
+	retry := c.fill_retry
+	backoff := retry.MinBackoff
+	var written int64
+	for attempt := 1; ; attempt++ {
+		s.mu.Lock()
+		s.info.FillAttempts = attempt
+		s.mu.Unlock()
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if retry.Timeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, retry.Timeout)
+		}
+		err := fill(actx, name, &resumeWriter{w: w, skip: written,
+			written: &written})
+		cancel()
+		if err == nil || attempt >= retry.Attempts || !retry.retryable(err) {
+			return err
+		}
+		logger.Warnf("filling %s, attempt %d failed: %s", name, attempt, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > retry.MaxBackoff {
+			backoff = retry.MaxBackoff
+		}
+	}
+}
+
+// resumeWriter skips the bytes an attempt writes again, those which earlier
+// attempts wrote already.
+type resumeWriter struct {
+	w       io.Writer
+	skip    int64
+	written *int64 // the bytes written by all attempts
+}
+
+func (w *resumeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.skip >= int64(n) {
+		w.skip -= int64(n)
+		return n, nil
+	}
+	p = p[w.skip:]
+	w.skip = 0
+	m, err := w.w.Write(p)
+	*w.written += int64(m)
+	return n - len(p) + m, err
+}
+
+// failed remembers that filling key failed with err, see
+// FillRetry.NegativeTTL.
+func (c *FsCache) failed(key string, err error) {
+	if c.fill_retry.NegativeTTL <= 0 {
+		return
+	}
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, f := range c.failures {
+		if !now.Before(f.expires) {
+			delete(c.failures, key)
+		}
+	}
+	c.failures[key] = fillFailure{
+		err:     err,
+		expires: now.Add(c.fill_retry.NegativeTTL),
+	}
+}
+
+// failure returns the error filling key failed with, if it's still
+// remembered.
+func (c *FsCache) failure(key string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	f, ok := c.failures[key]
+	if !ok || !c.clock.Now().Before(f.expires) {
+		return nil
+	}
+	return f.err
+}
@@ -0,0 +1,229 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrShutdown is returned when filling a key after Shutdown was called, and
+// by the Readers and Writer of a fill which Shutdown aborted.
+var ErrShutdown = errors.New("cache is shut down")
+
+// cacheWriter is the writer of a fill, which lets the cache account for and
+// abort its open writers.
+type cacheWriter struct {
+	last_write int64 // unix nanos, accessed atomically, first for alignment
+	*Writer
+	stream    *Stream
+	clock     Clock
+	once      sync.Once
+	on_close  func()
+	throttles []*Throttle
+}
+
+func (w *cacheWriter) Write(p []byte) (n int, err error) {
+	if len(w.throttles) > 0 {
+		n, err = w.throttledWrite(p)
+	} else {
+		w.touch()
+		n, err = w.Writer.Write(p)
+	}
+	return n, wrapStreamError(OpWrite, w.stream, err)
+}
+
+// touch records a write, see WithStaleWriterTimeout.
+func (w *cacheWriter) touch() {
+	atomic.StoreInt64(&w.last_write, w.clock.Now().UnixNano())
+}
+
+func (w *cacheWriter) Close() error {
+	defer w.once.Do(w.on_close)
+	return wrapStreamError(OpClose, w.stream, w.Writer.Close())
+}
+
+func (w *cacheWriter) abort(err error) {
+	defer w.once.Do(w.on_close)
+	w.Writer.abort(err)
+}
+
+// beginWrite registers a new fill, unless the cache is shut down. While a
+// snapshot is in progress it waits for it to end if wait is true, and
+// otherwise fails with ErrSnapshotInProgress.
+func (c *FsCache) beginWrite(ctx context.Context, wait bool) error {
+	for {
+		c.mu.Lock()
+		if c.shutdown {
+			c.mu.Unlock()
+			return ErrShutdown
+		}
+		end := c.snapshot_end
+		if end == nil {
+			c.nwriters++
+			c.mu.Unlock()
+			return nil
+		}
+		c.mu.Unlock()
+
+		if !wait {
+			return ErrSnapshotInProgress
+		}
+		select {
+		case <-end:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// endWrite unregisters a fill.
+func (c *FsCache) endWrite() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nwriters--
+	if c.nwriters == 0 {
+		for _, ch := range c.drained {
+			close(ch)
+		}
+		c.drained = nil
+	}
+}
+
+// writersDrained returns a channel which is closed once there are no open
+// writers.
+func (c *FsCache) writersDrained() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan struct{})
+	if c.nwriters == 0 {
+		close(ch)
+	} else {
+		c.drained = append(c.drained, ch)
+	}
+	return ch
+}
+
+// trackWriter wraps the writer of s so the cache knows when it's closed.
+func (c *FsCache) trackWriter(s *Stream, writer *Writer,
+	release func()) *cacheWriter {
+	w := &cacheWriter{Writer: writer, stream: s, clock: c.clock}
+	w.on_close = func() {
+		release()
+		c.mu.Lock()
+		delete(c.writing, w)
+		c.mu.Unlock()
+		if !s.lazy.created() {
+			// nothing was written, don't keep an entry without a file.
+			c.discard(s)
+		} else if writer.Err() == ErrGaps {
+			// an incomplete WriteAt fill, see WithWriteAt.
+			c.discard(s)
+		} else if writer.complete() {
+			c.mu.Lock()
+			if current, _ := c.streams.get(s.info.Key); current == s {
+				c.streams.update(s, EntryComplete)
+			}
+			c.unlock()
+		}
+		c.endWrite()
+		c.enforceMaxSize()
+	}
+	c.mu.Lock()
+	c.writing[w] = struct{}{}
+	w.throttles = c.throttles
+	stale := c.stale
+	c.mu.Unlock()
+	if stale > 0 {
+		w.last_write = c.clock.Now().UnixNano()
+		c.watchStale(w, stale)
+	}
+	return w
+}
+
+// Shutdown stops the cache from accepting new writers and stops its reaper,
+// then waits for the writes in progress to finish. If ctx is done first, the
+// remaining writes are aborted: their entries are removed and their Readers
+// and Writers fail with ErrShutdown. Unlike Clean, the cached data is kept
+// and reads of complete entries can continue.
+func (c *FsCache) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.shutdown = true
+	c.startReaper()
+	c.mu.Unlock()
+	c.stopAccessLog()
+	c.stopWarmup()
+
+	select {
+	case <-c.writersDrained():
+		return nil
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	writing := make([]*cacheWriter, 0, len(c.writing))
+	for w := range c.writing {
+		writing = append(writing, w)
+	}
+	c.mu.Unlock()
+	for _, w := range writing {
+		logger.Warnf("aborting write of %s", w.stream.Name())
+		w.abort(ErrShutdown)
+		c.discard(w.stream)
+	}
+	return ctx.Err()
+}
+
+// Close shuts the cache down like Shutdown and closes all of its streams: open
+// Writers are aborted like by Shutdown, their entries are removed, and Close
+// blocks until all Readers have been closed too, and until the folders
+// deleted by Clean and RemovePrefix are gone. The cached data of complete
+// entries is kept. Errors closing the streams are returned as a CloseError.
+func (c *FsCache) Close() error {
+	c.mu.Lock()
+	c.shutdown = true
+	c.startReaper()
+	writing := make([]*cacheWriter, 0, len(c.writing))
+	for w := range c.writing {
+		writing = append(writing, w)
+	}
+	c.mu.Unlock()
+	c.stopAccessLog()
+	c.stopTrash()
+	c.stopWarmup()
+
+	for _, w := range writing {
+		logger.Warnf("aborting write of %s", w.stream.Name())
+		w.abort(ErrShutdown)
+		c.discard(w.stream)
+	}
+	c.mu.RLock()
+	streams := c.streams.resident()
+	c.mu.RUnlock()
+
+	var errs CloseError
+	for _, s := range streams {
+		errs.add(s.Close())
+	}
+	for _, w := range writing {
+		// delete the partial file now, it would be loaded as complete.
+		<-w.stream.drained()
+		c.awaitSnapshot()
+		errs.add(c.removeTombstone(w.stream.info.Key, w.stream))
+	}
+	c.deleting.Wait()
+	return errs.err()
+}
+
+// discard removes s from the cache if it's still there, deleting its file
+// once it has drained.
+func (c *FsCache) discard(s *Stream) {
+	key := s.info.Key
+	c.mu.Lock()
+	defer c.unlock()
+	if current, _ := c.streams.get(key); current == s {
+		c.streams.delete(key)
+		s.markRemoving()
+		c.tombstoneLocked(key, s)
+	}
+}
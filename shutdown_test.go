@@ -0,0 +1,187 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+
+	r, w, err := test.cache.Get("done", 5)
+	test.AssertNoError(err)
+	test.AssertWrite(w, []byte("hello"))
+	test.AssertNoError(r.Close())
+
+	r, w, err = test.cache.Get("finishing", 5)
+	test.AssertNoError(err)
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		w.Write([]byte("hello"))
+		w.Close()
+	}()
+	test.AssertNoError(test.cache.Shutdown(context.Background()))
+	test.AssertRead(r, 5)
+	test.AssertNoError(r.Close())
+
+	_, _, err = test.cache.Get("new", 5)
+	test.Assert(errors.Is(err, ErrShutdown), "expected ErrShutdown")
+
+	r, w, err = test.cache.Get("done", 5)
+	test.AssertNoError(err)
+	test.Assert(w == nil, "complete entries should still be served")
+	test.AssertRead(r, 5)
+	test.AssertNoError(r.Close())
+}
+
+func TestShutdownAbort(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+
+	r, w, err := test.cache.Get("stuck", 10)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	err = test.cache.Shutdown(ctx)
+	test.Assert(err == context.DeadlineExceeded, "expected writes to be aborted")
+	test.Assert(!test.cache.Exists("stuck"), "aborted entries should be removed")
+
+	_, err = ioutil.ReadAll(r)
+	test.Assert(errors.Is(err, ErrShutdown), "readers should see the abort")
+	test.AssertNoError(r.Close())
+	_, err = w.Write([]byte("world"))
+	test.Assert(errors.Is(err, ErrShutdown),
+		"writes should fail after the abort")
+	test.Assert(errors.Is(w.Close(), ErrClosed), "expected writer to be closed")
+}
+
+func TestClose(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+
+	r, w, err := test.cache.Get("done", 5)
+	test.AssertNoError(err)
+	test.AssertWrite(w, []byte("hello"))
+
+	closed := make(chan error)
+	go func() { closed <- test.cache.Close() }()
+	select {
+	case <-closed:
+		t.Fatal("Close should wait for readers")
+	case <-time.After(5 * time.Millisecond):
+	}
+	test.AssertRead(r, 5)
+	test.AssertNoError(r.Close())
+	test.AssertNoError(<-closed)
+
+	cache, err := New(test.Dir(), 0700, 0)
+	test.AssertNoError(err)
+	r, w, err = cache.Get("done", 5)
+	test.AssertNoError(err)
+	test.Assert(w == nil, "expected data to be kept")
+	test.AssertRead(r, 5)
+	test.AssertNoError(r.Close())
+}
+
+func TestCloseDuringFill(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+
+	r, w, err := test.cache.Get("filling", UnknownSize)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+
+	closed := make(chan error)
+	go func() { closed <- test.cache.Close() }()
+	_, err = ioutil.ReadAll(r)
+	test.Assert(errors.Is(err, ErrShutdown), "readers should see the abort")
+	select {
+	case <-closed:
+		t.Fatal("Close should wait for readers")
+	case <-time.After(5 * time.Millisecond):
+	}
+	test.AssertNoError(r.Close())
+	test.AssertNoError(<-closed)
+	test.Assert(errors.Is(w.Close(), ErrClosed), "expected writer to be closed")
+
+	cache, err := New(test.Dir(), 0700, 0)
+	test.AssertNoError(err)
+	defer cache.Close()
+	test.Assert(!cache.Exists("filling"),
+		"the partial fill should not be reloaded")
+	r, w, err = cache.Get("filling", UnknownSize)
+	test.AssertNoError(err)
+	test.Assert(w != nil, "expected the entry to be filled again")
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+}
+
+func TestCloseErrorIs(t *testing.T) {
+	var errs CloseError
+	errs.add(ErrClosed)
+	errs.add(CloseError{ErrShutdown})
+	err := errs.err()
+	if !errors.Is(err, ErrClosed) || !errors.Is(err, ErrShutdown) {
+		t.Fatalf("expected errors.Is to find both errors in %v", err)
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Fatalf("unexpected ErrNotFound in %v", err)
+	}
+}
+
+func TestStaleWriter(t *testing.T) {
+	test := Wrap(t, "stale")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0,
+		WithStaleWriterTimeout(50*time.Millisecond))
+	test.AssertNoError(err)
+
+	r, w, err := cache.Get("stream", 10)
+	test.AssertNoError(err)
+	for i := 0; i < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, err = w.Write([]byte("a"))
+		test.AssertNoError(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	test.Assert(errors.Is(err, ErrStaleWriter), "expected ErrStaleWriter")
+	test.AssertNoError(r.Close())
+	test.Assert(!cache.Exists("stream"), "expected entry to be removed")
+	_, err = w.Write([]byte("a"))
+	test.Assert(errors.Is(err, ErrStaleWriter),
+		"expected writer to be aborted")
+}
+
+func TestStaleWriterClock(t *testing.T) {
+	test := Wrap(t, "stale")
+	defer test.Close()
+	clock := &testClock{}
+	now := time.Now()
+	clock.Set(now)
+	cache, err := NewCache(test.Dir(), NewMemFsWithClock(clock), 0,
+		WithClock(clock), WithStaleWriterTimeout(10*time.Millisecond))
+	test.AssertNoError(err)
+
+	r, w, err := cache.Get("stream", 10)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("a"))
+	test.AssertNoError(err)
+	// idle by the system time, but not by the clock of the cache.
+	time.Sleep(50 * time.Millisecond)
+	_, err = w.Write([]byte("a"))
+	test.AssertNoError(err)
+
+	clock.Set(now.Add(time.Minute))
+	_, err = ioutil.ReadAll(r)
+	test.Assert(errors.Is(err, ErrStaleWriter), "expected ErrStaleWriter")
+	test.AssertNoError(r.Close())
+	test.Assert(!cache.Exists("stream"), "expected entry to be removed")
+}
@@ -0,0 +1,67 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrSnapshotInProgress is returned by Get and Compact while a snapshot is
+// being taken, see BeginSnapshot.
+var ErrSnapshotInProgress = errors.New("snapshot in progress")
+
+// BeginSnapshot quiesces the cache directory so that external backup tools
+// can copy it consistently, while the cache keeps serving reads. It pauses
+// the janitor, stops new fills (Get fails with ErrSnapshotInProgress, and
+// GetContext waits for the snapshot to end), defers file deletions, and then
+// waits for the writes in progress to finish. If ctx is done first the
+// snapshot is abandoned and ctx.Err() is returned.
+//
+// Every successful BeginSnapshot must be followed by EndSnapshot. Snapshots
+// can overlap, the cache resumes once the last one ends.
+func (c *FsCache) BeginSnapshot(ctx context.Context) error {
+	c.mu.Lock()
+	c.snapshots++
+	if c.snapshots == 1 {
+		c.snapshot_end = make(chan struct{})
+	}
+	c.paused++
+	c.mu.Unlock()
+
+	select {
+	case <-c.writersDrained():
+		return nil
+	case <-ctx.Done():
+		c.EndSnapshot()
+		return ctx.Err()
+	}
+}
+
+// EndSnapshot ends a snapshot started by BeginSnapshot.
+func (c *FsCache) EndSnapshot() {
+	c.mu.Lock()
+	if c.snapshots == 0 {
+		c.mu.Unlock()
+		panic("fscache: EndSnapshot without BeginSnapshot")
+	}
+	c.snapshots--
+	c.paused--
+	if c.snapshots == 0 {
+		close(c.snapshot_end)
+		c.snapshot_end = nil
+	}
+	c.mu.Unlock()
+	c.enforceMaxSize()
+}
+
+// awaitSnapshot blocks until no snapshot is being taken.
+func (c *FsCache) awaitSnapshot() {
+	for {
+		c.mu.RLock()
+		end := c.snapshot_end
+		c.mu.RUnlock()
+		if end == nil {
+			return
+		}
+		<-end
+	}
+}
@@ -0,0 +1,67 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+
+	r, w, err := test.cache.Get("old", 5)
+	test.AssertNoError(err)
+	test.AssertWrite(w, []byte("hello"))
+	test.AssertNoError(r.Close())
+
+	r, w, err = test.cache.Get("writing", 5)
+	test.AssertNoError(err)
+	test.AssertNoError(r.Close())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	err = test.cache.BeginSnapshot(ctx)
+	cancel()
+	test.Assert(err == context.DeadlineExceeded,
+		"expected snapshot to wait for writers")
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		w.Write([]byte("hello"))
+		w.Close()
+	}()
+	test.AssertNoError(test.cache.BeginSnapshot(context.Background()))
+
+	_, _, err = test.cache.Get("new", 5)
+	test.Assert(errors.Is(err, ErrSnapshotInProgress),
+		"expected fills to be stopped")
+	r, w, err = test.cache.Get("old", 5)
+	test.AssertNoError(err)
+	test.Assert(w == nil, "expected reads to be served")
+	test.AssertRead(r, 5)
+	test.AssertNoError(r.Close())
+
+	removed := make(chan error)
+	go func() { removed <- test.cache.Remove("old") }()
+	filled := make(chan error)
+	go func() {
+		r, w, err := test.cache.GetContext(context.Background(), "new", 5)
+		if err == nil {
+			r.Close()
+			err = w.Close()
+		}
+		filled <- err
+	}()
+	select {
+	case <-removed:
+		t.Fatal("files should not be deleted during a snapshot")
+	case <-filled:
+		t.Fatal("fills should wait for the snapshot to end")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	test.cache.EndSnapshot()
+	test.AssertNoError(<-removed)
+	test.AssertNoError(<-filled)
+}
@@ -0,0 +1,53 @@
+package fscache
+
+import "net/http"
+
+// sniffLen is the number of bytes http.DetectContentType considers.
+const sniffLen = 512
+
+// WithContentSniffing enables detection of the content type of every entry
+// from the first 512 bytes written to it. The result is available from
+// EntryInfo.ContentType once those bytes have been written or the writer is
+// closed.
+func WithContentSniffing() Option {
+	return func(c *FsCache) {
+		c.sniff = true
+	}
+}
+
+// sniffer buffers the first sniffLen bytes of a stream.
+type sniffer struct {
+	buf  []byte
+	done bool
+	set  func(content_type string)
+}
+
+func newSniffer(set func(content_type string)) *sniffer {
+	return &sniffer{
+		buf: make([]byte, 0, sniffLen),
+		set: set,
+	}
+}
+
+func (s *sniffer) write(p []byte) {
+	if s.done {
+		return
+	}
+	n := sniffLen - len(s.buf)
+	if n > len(p) {
+		n = len(p)
+	}
+	s.buf = append(s.buf, p[:n]...)
+	if len(s.buf) == sniffLen {
+		s.flush()
+	}
+}
+
+func (s *sniffer) flush() {
+	if s.done || len(s.buf) == 0 {
+		return
+	}
+	s.done = true
+	s.set(http.DetectContentType(s.buf))
+	s.buf = nil
+}
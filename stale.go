@@ -0,0 +1,67 @@
+package fscache
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrStaleWriter is returned by the Readers and Writer of a fill which was
+// aborted because its writer stopped writing, see WithStaleWriterTimeout.
+var ErrStaleWriter = errors.New("writer stopped writing")
+
+// WithKeepEmpty keeps empty files found when the cache is created. By
+// default they are removed, as they're usually left behind by fills which
+// never completed.
+func WithKeepEmpty() Option {
+	return func(c *FsCache) {
+		c.keep_empty = true
+	}
+}
+
+// WithStaleWriterTimeout aborts fills whose writer hasn't written anything for
+// d and removes their entries, so that a producer which neither writes nor
+// closes doesn't block readers and pin the entry forever.
+func WithStaleWriterTimeout(d time.Duration) Option {
+	return func(c *FsCache) {
+		c.stale = d
+	}
+}
+
+// WithReaderTimeout bounds how long a Reader may stay on a fill which is in
+// progress. Once d has passed since Get, unless the fill has completed, its
+// reads fail with ErrReaderTimeout and it no longer holds the entry, so a
+// client which stopped reading can't keep it from being removed. It must
+// still be Closed.
+func WithReaderTimeout(d time.Duration) Option {
+	return func(c *FsCache) {
+		c.read_limit = d
+	}
+}
+
+// watchStale aborts w once it hasn't been written to for d, as told by the
+// clock of the cache.
+func (c *FsCache) watchStale(w *cacheWriter, d time.Duration) {
+	go func() {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		for range timer.C {
+			c.mu.RLock()
+			_, open := c.writing[w]
+			c.mu.RUnlock()
+			if !open {
+				return
+			}
+			last := time.Unix(0, atomic.LoadInt64(&w.last_write))
+			idle := c.clock.Now().Sub(last)
+			if idle < d {
+				timer.Reset(d - idle)
+				continue
+			}
+			logger.Warnf("aborting stale write of %s", w.stream.Name())
+			w.abort(ErrStaleWriter)
+			c.discard(w.stream)
+			return
+		}
+	}()
+}
@@ -2,7 +2,9 @@
 package fscache
 
 import (
+	"context"
 	"errors"
+	"strings"
 	"sync"
 )
 
@@ -12,15 +14,103 @@ var (
 	NoWriter    = errors.New("No writer available, was close or never created")
 )
 
+// CloseError holds the errors which occurred while closing several streams.
+type CloseError []error
+
+func (e CloseError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the errors, so that errors.Is and errors.As look at each of
+// them.
+func (e CloseError) Unwrap() []error {
+	return e
+}
+
+func (e *CloseError) add(err error) {
+	switch err := err.(type) {
+	case nil:
+	case CloseError:
+		*e = append(*e, err...)
+	default:
+		*e = append(*e, err)
+	}
+}
+
+func (e CloseError) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// StreamState is the state of a Stream. Its transitions are:
+//
+//	StreamEmpty    -> StreamWriting   GetWriter
+//	StreamEmpty    -> StreamComplete  its file was written before, e.g. when
+//	                                  a cache loads it
+//	StreamWriting  -> StreamComplete  its Writer is Closed
+//	StreamWriting  -> StreamFailed    its write is aborted
+//	any            -> StreamRemoving  Remove or RemoveContext
+//
+// Readers opened on an Empty stream wait for its Writer, like the Readers
+// opened while it's Writing.
+type StreamState int
+
+const (
+	StreamEmpty StreamState = iota
+	StreamWriting
+	StreamComplete
+	StreamRemoving
+	StreamFailed
+)
+
+func (st StreamState) String() string {
+	switch st {
+	case StreamEmpty:
+		return "empty"
+	case StreamWriting:
+		return "writing"
+	case StreamComplete:
+		return "complete"
+	case StreamRemoving:
+		return "removing"
+	case StreamFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
 // Stream has one writer and can have many readers
 type Stream struct {
 	name     string
-	writer   *Writer
+	writer   *Writer // nil until GetWriter or a Reader needs it
 	grp      sync.WaitGroup
 	fs       FileSystem
-	removing bool
-	mu       sync.Mutex // Used to sync removing and cnt
-	cnt      int64      // keeps track of open streams, used for IsOpen
+	state    StreamState   // guarded by mu
+	mu       sync.Mutex    // Used to sync state, writer and cnt
+	cnt      int64         // keeps track of open streams, used for IsOpen
+	done     chan struct{} // closed when cnt drops to 0, see Done
+	busy     chan struct{} // non-nil while exclusive, closed when it ends
+	leaks    *leakTracker
+	sniff    bool                 // detect the content type of the first written bytes
+	wake     int64                // see WithWakeGranularity
+	info     EntryInfo            // guarded by mu
+	expected int64                // the size the stream was created for, -1 if unknown
+	lazy     *lazyFile            // the file of writer, nil if loaded from disk
+	complete bool                 // it was Complete before Removing, guarded by mu
+	retired  bool                 // its file name was reused, guarded by mu
+	readers  map[*Reader]struct{} // the open Readers, guarded by mu
+	nreaders int                  // the Readers open or opening, guarded by mu
+	freed    chan struct{}        // closed when a Reader closes, guarded by mu
+
+	verify     int64     // the chunk size of WithVerification, 0 if off
+	hashes     *HashTree // set once complete if verify > 0, guarded by mu
+	on_corrupt func()    // called when a Reader finds the file corrupted
 }
 
 // Creates a new Stream with Name "name" in FileSystem fs.
@@ -28,22 +118,106 @@ func NewStream(name string, fs FileSystem) *Stream {
 	sf := &Stream{
 		name:     name,
 		fs:       fs,
-		removing: false,
+		state:    StreamEmpty,
+		expected: -1,
 	}
 	return sf
 }
 
-// Assumes file is written
+// GetWriter returns the Writer of an Empty stream, which becomes Writing.
+// Later calls return the same Writer, and NoWriter if the stream never had
+// one. The underlying File is created by the first Write, so errors creating
+// it are returned from there.
 func (s *Stream) GetWriter() (*Writer, error) {
+	s.mu.Lock()
+	if s.state != StreamEmpty {
+		w := s.writer
+		s.mu.Unlock()
+		if w == nil {
+			return nil, NoWriter
+		}
+		return w, nil
+	}
+	s.mu.Unlock()
+
+	release := s.onClose("writer")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != StreamEmpty {
+		// raced with another GetWriter or Remove.
+		release()
+		if s.writer == nil {
+			return nil, NoWriter
+		}
+		return s.writer, nil
+	}
 	if s.writer == nil {
-		f, err := s.fs.Create(s.Name())
-		if err != nil {
-			return nil, err
+		s.newWriter()
+	}
+	w := s.writer
+	w.on_close = func() {
+		s.finishWrite(w)
+		release()
+	}
+	s.state = StreamWriting
+	s.incLocked()
+	return w, nil
+}
+
+// newWriter creates the Writer of the stream, s.mu must be held.
+func (s *Stream) newWriter() {
+	s.lazy = &lazyFile{fs: s.fs, name: s.Name(), empty: s.expected == 0}
+	s.writer = NewWriter(s.lazy, nil)
+	s.writer.granularity = s.wake
+	if s.sniff {
+		s.writer.sniffer = newSniffer(s.setContentType)
+	}
+	if s.verify > 0 {
+		s.writer.hasher = newTreeHasher(s.verify)
+	}
+}
+
+// finishWrite moves a Writing stream to Complete or Failed once w is closed.
+func (s *Stream) finishWrite(w *Writer) {
+	err := w.Err()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != StreamWriting {
+		return
+	}
+	if err != nil {
+		s.state = StreamFailed
+	} else {
+		s.state = StreamComplete
+		s.complete = true
+		if w.hasher != nil {
+			s.hashes = w.hasher.sum()
 		}
-		s.writer = NewWriter(f, s.dec)
-		s.inc()
 	}
-	return s.writer, nil
+}
+
+// State returns the current state of the stream.
+func (s *Stream) State() StreamState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// markComplete marks an Empty stream whose file already exists as Complete.
+func (s *Stream) markComplete() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == StreamEmpty {
+		s.state = StreamComplete
+		s.complete = true
+	}
+}
+
+// completed reports whether the stream was ever Complete.
+func (s *Stream) completed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.complete
 }
 
 // Name returns the name of the underlying File in the FileSystem.
@@ -57,6 +231,57 @@ func (s *Stream) IsOpen() bool {
 	return s.cnt > 0
 }
 
+// Done returns a channel which is closed once the stream is quiescent: its
+// Writer and all of its Readers have been Closed. If a new Reader is opened
+// afterwards, subsequent calls to Done return a new channel.
+func (s *Stream) Done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done == nil {
+		s.done = make(chan struct{})
+		if s.cnt == 0 {
+			close(s.done)
+		}
+	}
+	return s.done
+}
+
+// WaitComplete blocks until the Writer of the stream has been Closed, and
+// returns the error its write was aborted with, if any. It returns ctx.Err()
+// if ctx is done first, and ErrRemoving if the stream was Removed before it
+// was complete.
+func (s *Stream) WaitComplete(ctx context.Context) error {
+	s.mu.Lock()
+	if s.complete {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.state == StreamRemoving {
+		s.mu.Unlock()
+		return ErrRemoving
+	}
+	if s.state == StreamEmpty && s.writer == nil {
+		// the writer hasn't been requested yet, wait for it.
+		s.newWriter()
+	}
+	w := s.writer
+	s.mu.Unlock()
+	select {
+	case <-w.finished:
+		return w.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// idle reports whether the stream has no Reader or Writer and isn't being
+// removed or compacted.
+func (s *Stream) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cnt == 0 && s.state != StreamRemoving && s.busy == nil
+}
+
 func (s *Stream) Size() (int64, error) {
 	return s.fs.Size(s.Name())
 }
@@ -65,44 +290,277 @@ func (s *Stream) Size() (int64, error) {
 // at which point it will delete the underlying file. NextReader() will return
 // ErrRemoving if called after Remove.
 func (s *Stream) Remove() error {
+	s.markRemoving()
+	s.grp.Wait()
+	return s.removeFile()
+}
+
+// Close closes the Writer of the Stream if it's still open, then blocks until
+// all of its Readers have been Closed. Unlike Remove the underlying file is
+// kept.
+func (s *Stream) Close() error {
+	var errs CloseError
+	if w := s.handedWriter(); w != nil {
+		if err := w.Close(); err != ErrClosed {
+			errs.add(err)
+		}
+	}
+	s.grp.Wait()
+	return errs.err()
+}
+
+// RemoveContext is like Remove but gives up waiting for Readers to be Closed
+// when ctx is done, in which case ctx.Err() is returned and the underlying
+// file is left in place.
+func (s *Stream) RemoveContext(ctx context.Context) error {
+	s.markRemoving()
+	select {
+	case <-s.drained():
+		return s.removeFile()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Stream) markRemoving() {
 	s.mu.Lock()
-	s.removing = true
+	defer s.mu.Unlock()
+	s.state = StreamRemoving
+	if s.freed != nil {
+		// Readers waiting for a slot fail with ErrRemoving.
+		close(s.freed)
+		s.freed = nil
+	}
+}
+
+// retire marks s, which has been removed, as no longer owning the name of
+// its file, which a new entry is about to reuse: its Writer can't create the
+// file anymore, and Readers which haven't opened it yet fail instead of
+// opening the file of the new entry.
+func (s *Stream) retire() {
+	s.mu.Lock()
+	s.retired = true
+	lazy := s.lazy
 	s.mu.Unlock()
-	s.grp.Wait()
-	return s.fs.Remove(s.Name())
+	if lazy != nil {
+		lazy.retire()
+	}
 }
 
-func (s *Stream) isRemoving() bool {
+func (s *Stream) isRetired() bool {
 	s.mu.Lock()
-	defer func() {
-		s.mu.Unlock()
-	}()
-	return s.removing
+	defer s.mu.Unlock()
+	return s.retired
+}
+
+// handedWriter returns the Writer returned by GetWriter, if any.
+func (s *Stream) handedWriter() *Writer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writer == nil || s.writer.on_close == nil {
+		return nil
+	}
+	return s.writer
+}
+
+// drained returns a channel which is closed once all Readers and the Writer
+// of the stream have been Closed. It's shared by the callers waiting for the
+// same drain, see Done.
+func (s *Stream) drained() <-chan struct{} {
+	return s.Done()
 }
 
 // NextReader will return a concurrent-safe Reader for this stream. Each Reader will
 // see a complete and independent view of the file, and can Read while the stream
 // is written to.
+//
+// Readers see the same stream whenever they're opened: before GetWriter,
+// before the first Write or after the Writer is Closed. They return io.EOF
+// once the Writer has been Closed and everything it wrote has been read, or
+// the error an aborted write failed with.
 func (s *Stream) NextReader() (*Reader, error) {
-	if s.isRemoving() {
-		return nil, ErrRemoving
-	}
-	s.inc()
+	return s.nextReader(context.Background(), 0, false)
+}
 
-	file, err := s.fs.Open(s.Name())
+// ReaderFrom is like NextReader, but the Reader's Read starts at off, e.g.
+// to resume at the Offset of a Reader closed when its client disconnected.
+// Reads wait for the bytes at off to be written like ReadAt.
+func (s *Stream) ReaderFrom(off int64) (*Reader, error) {
+	r, err := s.NextReader()
 	if err != nil {
-		s.dec()
 		return nil, err
 	}
+	r.read_off = off
+	return r, nil
+}
+
+// nextReader is like NextReader, but opens at most max Readers at once
+// unless max <= 0. While max are open it waits for one to be closed until
+// ctx is done if wait is true, and fails with ErrTooManyReaders otherwise.
+func (s *Stream) nextReader(ctx context.Context, max int, wait bool) (
+	*Reader, error) {
+	s.mu.Lock()
+	for {
+		if s.state == StreamRemoving {
+			s.mu.Unlock()
+			return nil, ErrRemoving
+		}
+		if max <= 0 || s.nreaders < max {
+			break
+		}
+		if !wait {
+			s.mu.Unlock()
+			return nil, ErrTooManyReaders
+		}
+		if s.freed == nil {
+			s.freed = make(chan struct{})
+		}
+		freed := s.freed
+		s.mu.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		s.mu.Lock()
+	}
+	if s.state == StreamEmpty && s.writer == nil {
+		// the writer hasn't been requested yet, wait for it.
+		s.newWriter()
+	}
+	writer, lazy, hashes := s.writer, s.lazy, s.hashes
+	s.nreaders++
+	s.incLocked()
+	s.mu.Unlock()
+
+	var file ReadFile
+	if lazy != nil && !lazy.created() {
+		file = &lazyReadFile{w: lazy}
+	} else {
+		f, err := s.fs.Open(s.Name())
+		if err == nil && s.isRetired() {
+			// it may have opened the file of the new entry.
+			f.Close()
+			err = ErrRemoving
+		}
+		if err != nil {
+			s.releaseReader()
+			s.dec()
+			return nil, err
+		}
+		file = f
+		if s.verify > 0 && hashes != nil {
+			file = newVerifiedFile(f, hashes, s.on_corrupt)
+		}
+	}
+
+	r := NewReader(file, writer, nil)
+	r.stream = s
+	if s.leaks != nil {
+		r.on_close = s.leaks.track("reader", s.Name())
+	}
+	s.mu.Lock()
+	if s.readers == nil {
+		s.readers = make(map[*Reader]struct{})
+	}
+	s.readers[r] = struct{}{}
+	s.mu.Unlock()
+	return r, nil
+}
+
+// detachReaders detaches all open Readers with err, see Reader.detach, and
+// returns how many there were.
+func (s *Stream) detachReaders(err error) int {
+	s.mu.Lock()
+	readers := make([]*Reader, 0, len(s.readers))
+	for r := range s.readers {
+		readers = append(readers, r)
+	}
+	s.mu.Unlock()
+	for _, r := range readers {
+		r.detach(err)
+	}
+	return len(readers)
+}
+
+// closeReader unregisters r once it's closed. It's called by the Reader
+// rather than an on_close func so that opening a Reader allocates less.
+func (s *Stream) closeReader(r *Reader) {
+	s.mu.Lock()
+	delete(s.readers, r)
+	s.mu.Unlock()
+	s.releaseReader()
+	s.dec()
+}
+
+// releaseReader frees the slot of a Reader, see nextReader.
+func (s *Stream) releaseReader() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nreaders--
+	if s.freed != nil {
+		close(s.freed)
+		s.freed = nil
+	}
+}
 
-	return NewReader(file, s.writer, s.dec), nil
+// onClose returns the func a Reader or Writer must call when it's closed.
+func (s *Stream) onClose(kind string) func() {
+	if s.leaks == nil {
+		return s.dec
+	}
+	release := s.leaks.track(kind, s.Name())
+	return func() {
+		release()
+		s.dec()
+	}
+}
+
+// exclusive runs fn while no Reader or Writer can be opened on the stream,
+// unless the stream is already open or being removed in which case it
+// returns false without running fn.
+func (s *Stream) exclusive(fn func() error) (ran bool, err error) {
+	s.mu.Lock()
+	if s.cnt > 0 || s.state == StreamRemoving || s.busy != nil {
+		s.mu.Unlock()
+		return false, nil
+	}
+	busy := make(chan struct{})
+	s.busy = busy
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.busy = nil
+		close(busy)
+		s.mu.Unlock()
+	}()
+	return true, fn()
 }
 
 func (s *Stream) inc() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.incLocked()
+}
+
+// incLocked is inc with s.mu held.
+func (s *Stream) incLocked() {
+	for s.busy != nil {
+		busy := s.busy
+		s.mu.Unlock()
+		<-busy
+		s.mu.Lock()
+	}
 	s.cnt += 1
 	s.grp.Add(1)
+	if s.done != nil {
+		select {
+		case <-s.done:
+			s.done = nil
+		default:
+		}
+	}
 }
 
 func (s *Stream) dec() {
@@ -110,4 +568,7 @@ func (s *Stream) dec() {
 	defer s.mu.Unlock()
 	s.cnt -= 1
 	s.grp.Done()
+	if s.cnt == 0 && s.done != nil {
+		close(s.done)
+	}
 }
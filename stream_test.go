@@ -2,11 +2,15 @@ package fscache
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"runtime"
 	"sync"
 	"testing"
+	"time"
 )
 
 var (
@@ -65,6 +69,131 @@ func TestRemove(t *testing.T) {
 	test.Assert(err == ErrRemoving, "Expected error")
 }
 
+func TestStreamDone(t *testing.T) {
+	test := NewStreamTest(t)
+	defer test.Close()
+
+	writer, err := test.stream.GetWriter()
+	test.AssertNoError(err)
+	r, err := test.stream.NextReader()
+	test.AssertNoError(err)
+	done := test.stream.Done()
+
+	writer.Write(testdata)
+	writer.Close()
+	select {
+	case <-done:
+		t.Fatal("stream should not be done while a reader is open")
+	default:
+	}
+
+	r.Close()
+	<-done
+	<-test.stream.Done()
+
+	r, err = test.stream.NextReader()
+	test.AssertNoError(err)
+	done = test.stream.Done()
+	select {
+	case <-done:
+		t.Fatal("stream should not be done while a reader is open")
+	default:
+	}
+	r.Close()
+	<-done
+}
+
+func TestReadRanges(t *testing.T) {
+	test := NewStreamTest(t)
+	defer test.Close()
+
+	writer, err := test.stream.GetWriter()
+	test.AssertNoError(err)
+	r, err := test.stream.NextReader()
+	test.AssertNoError(err)
+	defer r.Close()
+
+	data := bytes.Repeat(testdata, 10)
+	go func() {
+		for i := 0; i < 10; i++ {
+			writer.Write(testdata)
+		}
+		writer.Close()
+	}()
+
+	ranges := []Range{{20, 2}, {0, 5}, {3, 4}, {7, 3}, {115, 10}}
+	parts, err := r.ReadRanges(ranges)
+	test.Assert(err == io.EOF, "expected EOF for the range past the end")
+	for i, rng := range ranges {
+		end := rng.Off + rng.Len
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		test.AssertByteEqual(data[rng.Off:end], parts[i])
+	}
+}
+
+func TestReadRangesEmpty(t *testing.T) {
+	test := NewStreamTest(t)
+	defer test.Close()
+
+	writer, err := test.stream.GetWriter()
+	test.AssertNoError(err)
+	defer writer.Close()
+	r, err := test.stream.NextReader()
+	test.AssertNoError(err)
+	defer r.Close()
+	_, err = writer.Write(testdata[:4])
+	test.AssertNoError(err)
+
+	// the fill is still open, none of these may wait for it.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := r.ReadAt(nil, 2)
+		test.AssertNoError(err)
+		test.Assert(n == 0, "expected an empty read")
+		n, err = r.ReadAt([]byte{}, 100)
+		test.AssertNoError(err)
+		test.Assert(n == 0, "expected an empty read")
+
+		parts, err := r.ReadRanges([]Range{{2, 0}, {0, 2}, {100, 0}})
+		test.AssertNoError(err)
+		test.AssertByteEqual([]byte{}, parts[0])
+		test.AssertByteEqual(testdata[:2], parts[1])
+		test.AssertByteEqual([]byte{}, parts[2])
+
+		_, err = r.ReadRanges([]Range{{0, 2}, {2, -1}})
+		test.Assert(errors.Is(err, ErrNegativeRange),
+			"expected ErrNegativeRange")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("empty reads blocked on the open fill")
+	}
+}
+
+func TestRemoveContextTimeouts(t *testing.T) {
+	test := NewStreamTest(t)
+	defer test.Close()
+
+	r, err := test.stream.NextReader()
+	test.AssertNoError(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		err := test.stream.RemoveContext(ctx)
+		test.Assert(err == context.Canceled, "expected remove to time out")
+	}
+	test.Assert(runtime.NumGoroutine() < before+10,
+		"expected the timed out removals to share one drain wait")
+
+	test.AssertNoError(r.Close())
+	test.AssertNoError(test.stream.RemoveContext(context.Background()))
+}
+
 func (t *StreamTest) AssertReader(r ReaderAtCloser, errs chan error) {
 	defer r.Close()
 
@@ -107,3 +236,182 @@ func NewStreamTest(t *testing.T) *StreamTest {
 		stream: NewStream("text.txt", NewMemFs()),
 	}
 }
+
+func TestStreamState(t *testing.T) {
+	test := NewStreamTest(t)
+	defer test.Close()
+	test.Assert(test.stream.State() == StreamEmpty, "expected empty")
+
+	// a reader opened before the writer waits for it.
+	r, err := test.stream.NextReader()
+	test.AssertNoError(err)
+	w, err := test.stream.GetWriter()
+	test.AssertNoError(err)
+	test.Assert(test.stream.State() == StreamWriting, "expected writing")
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.Assert(test.stream.State() == StreamComplete, "expected complete")
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual([]byte("hello"), p)
+	test.AssertNoError(r.Close())
+
+	test.AssertNoError(test.stream.Remove())
+	test.Assert(test.stream.State() == StreamRemoving, "expected removing")
+	_, err = test.stream.NextReader()
+	test.Assert(err == ErrRemoving, "expected ErrRemoving")
+
+	failed := NewStream("failed.txt", NewMemFs())
+	w, err = failed.GetWriter()
+	test.AssertNoError(err)
+	test.AssertNoError(w.abort(ErrStaleWriter))
+	test.Assert(failed.State() == StreamFailed, "expected failed")
+}
+
+// TestReaderInterleavings opens a Reader before each step of a fill, and
+// checks that it sees the whole stream and EOF only once the writer is done.
+func TestReaderInterleavings(t *testing.T) {
+	steps := []string{"get writer", "write", "write", "close"}
+	for _, aborted := range []bool{false, true} {
+		for open := 0; open <= len(steps); open++ {
+			for _, random := range []bool{false, true} {
+				testInterleaving(t, open, aborted, random)
+			}
+		}
+	}
+}
+
+func testInterleaving(t *testing.T, open int, aborted, random bool) {
+	test := NewStreamTest(t)
+	defer test.Close()
+	name := fmt.Sprintf("open %d aborted %t random %t", open, aborted, random)
+
+	type result struct {
+		p   []byte
+		err error
+	}
+	results := make(chan result, 1)
+	read := func(r *Reader) {
+		var buf bytes.Buffer
+		var err error
+		if random {
+			_, err = io.Copy(&buf, io.NewSectionReader(r, 0, 1<<20))
+		} else {
+			_, err = io.Copy(&buf, r)
+		}
+		r.Close()
+		results <- result{buf.Bytes(), err}
+	}
+	start := func() {
+		r, err := test.stream.NextReader()
+		test.AssertNoError(err)
+		go read(r)
+	}
+	assertPending := func() {
+		select {
+		case res := <-results:
+			t.Fatalf("%s: reader finished before the writer: %q %v", name,
+				res.p, res.err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	var w *Writer
+	for step := 0; step < 4; step++ {
+		if step == open {
+			start()
+		}
+		if step >= open {
+			assertPending()
+		}
+		switch step {
+		case 0:
+			var err error
+			w, err = test.stream.GetWriter()
+			test.AssertNoError(err)
+		case 1:
+			w.Write([]byte("hel"))
+		case 2:
+			w.Write([]byte("lo"))
+		case 3:
+			if aborted {
+				test.AssertNoError(w.abort(errFail))
+			} else {
+				test.AssertNoError(w.Close())
+			}
+		}
+	}
+	if open == 4 {
+		start()
+	}
+
+	res := <-results
+	if aborted {
+		test.Assert(res.err == errFail, name+": expected the abort error")
+		return
+	}
+	test.AssertNoError(res.err)
+	test.AssertByteEqual([]byte("hello"), res.p)
+}
+
+// preadOnly is a ReadFile which fails if its file offset is used.
+type preadOnly struct {
+	ReadFile
+}
+
+func (preadOnly) Read(p []byte) (int, error) {
+	return 0, errors.New("Read called on a shared file handle")
+}
+
+func TestReaderUsesReadAt(t *testing.T) {
+	test := NewStreamTest(t)
+	defer test.Close()
+	fs := NewMemFs()
+	w, err := fs.Create("file")
+	test.AssertNoError(err)
+	w.Write(testdata)
+	w.Close()
+	f, err := fs.Open("file")
+	test.AssertNoError(err)
+
+	r := NewReader(preadOnly{f}, nil, func() {})
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual(testdata, p)
+	test.AssertNoError(r.Close())
+}
+
+func TestReaderFrom(t *testing.T) {
+	test := NewStreamTest(t)
+	defer test.Close()
+
+	writer, err := test.stream.GetWriter()
+	test.AssertNoError(err)
+	_, err = writer.Write(testdata[:4])
+	test.AssertNoError(err)
+
+	r, err := test.stream.NextReader()
+	test.AssertNoError(err)
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(r, buf)
+	test.AssertNoError(err)
+	off := r.Offset()
+	test.Assert(off == 3, "expected offset 3")
+	test.AssertNoError(r.Close())
+
+	r, err = test.stream.ReaderFrom(off)
+	test.AssertNoError(err)
+	done := make(chan []byte)
+	go func() {
+		data, err := ioutil.ReadAll(r)
+		test.AssertNoError(err)
+		done <- data
+	}()
+	_, err = writer.Write(testdata[4:])
+	test.AssertNoError(err)
+	test.AssertNoError(writer.Close())
+	test.AssertByteEqual(<-done, testdata[3:])
+	test.Assert(r.Offset() == int64(len(testdata)), "expected offset at end")
+	test.AssertNoError(r.Close())
+}
@@ -0,0 +1,140 @@
+package fscache
+
+import (
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Placement picks the directory out of dirs which a new File for key is
+// created in.
+type Placement func(key string, dirs []string) int
+
+// PlaceByHash spreads Files over the directories by the hash of their key.
+func PlaceByHash(key string, dirs []string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(dirs)))
+}
+
+// PlaceByFreeSpace creates Files in the directory with the most free space.
+// It falls back to PlaceByHash where free space can't be determined.
+func PlaceByFreeSpace(key string, dirs []string) int {
+	best, best_free := -1, uint64(0)
+	for i, dir := range dirs {
+		free, err := freeSpace(dir)
+		if err != nil {
+			return PlaceByHash(key, dirs)
+		}
+		if best < 0 || free > best_free {
+			best, best_free = i, free
+		}
+	}
+	return best
+}
+
+type stripedFs struct {
+	dirs  []string
+	place Placement
+	std   stdFs
+}
+
+// NewStripedFs returns a FileSystem which stores Files across several
+// directories, e.g. on different disks, choosing one with place (PlaceByHash
+// if nil) for every new File. The directories are created with perms if they
+// don't exist. Use dirs[0] as the directory of the cache:
+//
+//	fs, err := NewStripedFs(dirs, 0700, PlaceByFreeSpace)
+//	cache, err := NewCache(dirs[0], fs, expiry)
+//
+// Files are found in any of the directories, so dirs can be added or
+// reordered between runs.
+func NewStripedFs(dirs []string, mode os.FileMode, place Placement) (
+	FileSystem, error) {
+	if len(dirs) == 0 {
+		return nil, os.ErrInvalid
+	}
+	if place == nil {
+		place = PlaceByHash
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, mode); err != nil {
+			return nil, err
+		}
+	}
+	return &stripedFs{dirs: dirs, place: place, std: stdFs{mode: mode}}, nil
+}
+
+// locate returns the path of the File name, or the path it would be created
+// at if it doesn't exist.
+func (fs *stripedFs) locate(name string) (path string, ok bool) {
+	key := filepath.Base(name)
+	i := fs.place(key, fs.dirs)
+	path = filepath.Join(fs.dirs[i], key)
+	if _, err := os.Stat(path); err == nil {
+		return path, true
+	}
+	for j, dir := range fs.dirs {
+		if j == i {
+			continue
+		}
+		other := filepath.Join(dir, key)
+		if _, err := os.Stat(other); err == nil {
+			return other, true
+		}
+	}
+	return path, false
+}
+
+func (fs *stripedFs) Create(name string) (File, error) {
+	path, ok := fs.locate(name)
+	if ok {
+		// don't leave a stale copy behind in another directory.
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		path, _ = fs.locate(name)
+	}
+	return fs.std.Create(path)
+}
+
+func (fs *stripedFs) Open(name string) (File, error) {
+	path, _ := fs.locate(name)
+	return fs.std.Open(path)
+}
+
+func (fs *stripedFs) Remove(name string) error {
+	path, _ := fs.locate(name)
+	return fs.std.Remove(path)
+}
+
+func (fs *stripedFs) AccessTimes(name string) (rt, wt time.Time, err error) {
+	path, _ := fs.locate(name)
+	return fs.std.AccessTimes(path)
+}
+
+func (fs *stripedFs) Size(name string) (int64, error) {
+	path, _ := fs.locate(name)
+	return fs.std.Size(path)
+}
+
+// List returns the keys of the Files in all of the directories.
+func (fs *stripedFs) List() ([]string, error) {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, dir := range fs.dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if !seen[f.Name()] {
+				seen[f.Name()] = true
+				keys = append(keys, f.Name())
+			}
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,68 @@
+package fscache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestStripedFs(t *testing.T) {
+	test := Wrap(t, "stripefs")
+	defer test.Close()
+	dirs := []string{
+		filepath.Join(test.Dir(), "a"),
+		filepath.Join(test.Dir(), "b"),
+		filepath.Join(test.Dir(), "c"),
+	}
+	fs, err := NewStripedFs(dirs, 0700, nil)
+	test.AssertNoError(err)
+	cache, err := NewCache(dirs[0], fs, 0)
+	test.AssertNoError(err)
+
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("stream%d", i)
+		r, w, err := cache.Get(name, 5)
+		test.AssertNoError(err)
+		_, err = w.Write([]byte("hello"))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+		test.AssertNoError(r.Close())
+	}
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		test.AssertNoError(err)
+		test.Assert(len(files) > 0 && len(files) < 30,
+			"expected entries to be spread over the directories")
+	}
+
+	// entries are found after the placement changes.
+	fs, err = NewStripedFs(dirs, 0700, func(string, []string) int { return 2 })
+	test.AssertNoError(err)
+	cache, err = NewCache(dirs[0], fs, 0)
+	test.AssertNoError(err)
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("stream%d", i)
+		r, w, err := cache.Get(name, 5)
+		test.AssertNoError(err)
+		test.Assert(w == nil, "expected "+name+" to be reloaded")
+		p, err := ioutil.ReadAll(r)
+		test.AssertNoError(err)
+		test.AssertByteEqual([]byte("hello"), p)
+		test.AssertNoError(r.Close())
+	}
+
+	test.AssertNoError(cache.Clean())
+	for _, dir := range dirs[1:] {
+		files, err := ioutil.ReadDir(dir)
+		test.AssertNoError(err)
+		test.Assert(len(files) == 0, "expected Clean to empty every directory")
+	}
+}
+
+func TestPlaceByFreeSpace(t *testing.T) {
+	test := Wrap(t, "stripefs")
+	defer test.Close()
+	i := PlaceByFreeSpace("key", []string{test.Dir()})
+	test.Assert(i == 0, "expected the only directory")
+}
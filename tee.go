@@ -0,0 +1,186 @@
+package fscache
+
+import (
+	"io"
+	"sync"
+)
+
+// TeeCache is a Cache which writes every filled entry into two underlying
+// Caches at the same time, e.g. a local disk cache and a shared remote tier.
+// Reads are always served from the primary Cache.
+type TeeCache struct {
+	primary     Cache
+	secondary   Cache
+	best_effort bool
+}
+
+// NewTeeCache creates a Cache which fills primary and secondary together.
+// If bestEffort is false a fill only completes when both Caches succeed,
+// otherwise failures of the secondary Cache are logged and ignored.
+func NewTeeCache(primary, secondary Cache, bestEffort bool) *TeeCache {
+	return &TeeCache{
+		primary:     primary,
+		secondary:   secondary,
+		best_effort: bestEffort,
+	}
+}
+
+func (t *TeeCache) Get(name string, size int64) (ReaderAtCloser, io.WriteCloser, error) {
+	r, w, err := t.primary.Get(name, size)
+	if err != nil || w == nil {
+		return r, w, err
+	}
+
+	r2, w2, err := t.secondary.Get(name, size)
+	if err != nil {
+		if t.best_effort {
+			logger.Errorf("tee: secondary get %q failed: %s",
+				truncateKey(name), err)
+			return r, w, nil
+		}
+		w.Close()
+		r.Close()
+		// Remove blocks until readers are closed, other Gets may hold some.
+		go t.primary.Remove(name)
+		return nil, nil, err
+	}
+	r2.Close()
+
+	if w2 == nil {
+		// the secondary already has this entry.
+		return r, w, nil
+	}
+	return r, &teeWriter{tee: t, name: name, primary: w, secondary: w2}, nil
+}
+
+// GetWriterOnly implements WriterOnlyCache.GetWriterOnly, filling both
+// Caches like Get. Caches which aren't WriterOnlyCaches are filled by a Get
+// whose reader is closed right away.
+func (t *TeeCache) GetWriterOnly(name string, size int64) (io.WriteCloser, error) {
+	w, err := getWriterOnly(t.primary, name, size)
+	if err != nil || w == nil {
+		return w, err
+	}
+
+	w2, err := getWriterOnly(t.secondary, name, size)
+	if err != nil {
+		if t.best_effort {
+			logger.Errorf("tee: secondary get %q failed: %s",
+				truncateKey(name), err)
+			return w, nil
+		}
+		w.Close()
+		go t.primary.Remove(name)
+		return nil, err
+	}
+	if w2 == nil {
+		// the secondary already has this entry.
+		return w, nil
+	}
+	return &teeWriter{tee: t, name: name, primary: w, secondary: w2}, nil
+}
+
+// getWriterOnly returns the writer of name if it's missing from c, see
+// WriterOnlyCache.
+func getWriterOnly(c Cache, name string, size int64) (io.WriteCloser, error) {
+	if c, ok := c.(WriterOnlyCache); ok {
+		return c.GetWriterOnly(name, size)
+	}
+	r, w, err := c.Get(name, size)
+	if err != nil {
+		return nil, err
+	}
+	r.Close()
+	return w, nil
+}
+
+func (t *TeeCache) Remove(name string) error {
+	err := t.primary.Remove(name)
+	if err2 := t.secondary.Remove(name); err == nil && !t.best_effort {
+		err = err2
+	}
+	return err
+}
+
+func (t *TeeCache) Exists(name string) bool {
+	return t.primary.Exists(name)
+}
+
+func (t *TeeCache) Size(name string) (int64, error) {
+	return t.primary.Size(name)
+}
+
+func (t *TeeCache) Clean() error {
+	err := t.primary.Clean()
+	if err2 := t.secondary.Clean(); err == nil && !t.best_effort {
+		err = err2
+	}
+	return err
+}
+
+// teeWriter duplicates writes into the primary and secondary writers.
+type teeWriter struct {
+	tee       *TeeCache
+	name      string
+	mu        sync.Mutex
+	primary   io.WriteCloser
+	secondary io.WriteCloser // nil once dropped in best effort mode
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.primary.Write(p)
+	if err != nil || w.secondary == nil {
+		return n, err
+	}
+	if _, err = w.secondary.Write(p[:n]); err != nil {
+		if !w.tee.best_effort {
+			return n, err
+		}
+		logger.Errorf("tee: secondary write %q failed: %s",
+			truncateKey(w.name), err)
+		w.dropSecondary()
+	}
+	return n, nil
+}
+
+func (w *teeWriter) dropSecondary() {
+	w.secondary.Close()
+	w.secondary = nil
+	// Remove blocks until readers are closed, don't hold w.mu meanwhile.
+	go func(name string) {
+		if err := w.tee.secondary.Remove(name); err != nil {
+			logger.Errorf("tee: secondary remove %q failed: %s",
+				truncateKey(name), err)
+		}
+	}(w.name)
+}
+
+// Close closes both writers. In strict mode the first error is returned and
+// the partially filled entries are removed from both Caches.
+func (w *teeWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.primary.Close()
+	if w.secondary == nil {
+		return err
+	}
+	err2 := w.secondary.Close()
+	if err2 != nil && w.tee.best_effort {
+		logger.Errorf("tee: secondary close %q failed: %s",
+			truncateKey(w.name), err2)
+		go w.tee.secondary.Remove(w.name)
+		return err
+	}
+	if err == nil {
+		err = err2
+	}
+	if err != nil && !w.tee.best_effort {
+		// Remove blocks until readers are closed, and the caller may still
+		// be holding the primary reader.
+		go w.tee.primary.Remove(w.name)
+		go w.tee.secondary.Remove(w.name)
+	}
+	return err
+}
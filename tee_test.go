@@ -0,0 +1,98 @@
+package fscache
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestTeeCache(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+	other := Wrap(t, "teetest")
+	defer other.Close()
+	secondary, err := New(other.Dir(), 0700, 0)
+	test.AssertNoError(err)
+
+	tee := NewTeeCache(test.cache, secondary, false)
+	to_write := []byte("hello world")
+	r, w, err := tee.Get("stream", int64(len(to_write)))
+	test.AssertNoError(err)
+	test.Assert(w != nil, "writer should not be nil")
+	test.AssertWrite(w, to_write)
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual(to_write, p)
+	r.Close()
+
+	for _, c := range []Cache{test.cache, secondary} {
+		r, w, err := c.Get("stream", int64(len(to_write)))
+		test.AssertNoError(err)
+		test.Assert(w == nil, "expected entry to be filled")
+		p, err := ioutil.ReadAll(r)
+		test.AssertNoError(err)
+		test.AssertByteEqual(to_write, p)
+		r.Close()
+	}
+}
+
+func TestTeeCacheBestEffort(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+
+	_, _, err := NewTeeCache(test.cache, failingCache{}, false).Get("a", 1)
+	test.AssertError(err)
+	test.Assert(!test.cache.Exists("a"), "strict fill should be removed")
+
+	r, w, err := NewTeeCache(test.cache, failingCache{}, true).Get("b", 1)
+	test.AssertNoError(err)
+	test.AssertWrite(w, []byte("b"))
+	test.AssertRead(r, 1)
+	r.Close()
+}
+
+func TestTeeCacheWriterOnly(t *testing.T) {
+	test := NewFsCacheTest(t)
+	defer test.Close()
+	other := Wrap(t, "teetest")
+	defer other.Close()
+	secondary, err := New(other.Dir(), 0700, 0)
+	test.AssertNoError(err)
+
+	// the secondary isn't a WriterOnlyCache.
+	tee := NewTeeCache(test.cache, struct{ Cache }{secondary}, false)
+	w, err := tee.GetWriterOnly("stream", 5)
+	test.AssertNoError(err)
+	test.AssertWrite(w, []byte("hello"))
+	for _, c := range []Cache{test.cache, secondary} {
+		r, w, err := c.Get("stream", 5)
+		test.AssertNoError(err)
+		test.Assert(w == nil, "expected entry to be filled")
+		test.AssertRead(r, 5)
+		r.Close()
+	}
+	w, err = tee.GetWriterOnly("stream", 5)
+	test.AssertNoError(err)
+	test.Assert(w == nil, "expected no writer for an existing entry")
+
+	_, err = NewTeeCache(test.cache, failingCache{}, false).GetWriterOnly(
+		"a", 1)
+	test.AssertError(err)
+	test.Assert(!test.cache.Exists("a"), "strict fill should be removed")
+}
+
+type failingCache struct{}
+
+var errFailingCache = errors.New("failing cache")
+
+func (failingCache) Get(string, int64) (ReaderAtCloser, io.WriteCloser, error) {
+	return nil, nil, errFailingCache
+}
+func (failingCache) GetWriterOnly(string, int64) (io.WriteCloser, error) {
+	return nil, errFailingCache
+}
+func (failingCache) Remove(string) error        { return errFailingCache }
+func (failingCache) Exists(string) bool         { return false }
+func (failingCache) Size(string) (int64, error) { return 0, errFailingCache }
+func (failingCache) Clean() error               { return errFailingCache }
@@ -0,0 +1,114 @@
+package fscache
+
+import (
+	"sync"
+	"time"
+)
+
+// throttleChunk is the most bytes a throttled Write passes on at once, so
+// large Writes are paced too.
+const throttleChunk = 32 << 10
+
+// Throttle limits the rate at which fills write to the cache, so populating
+// it doesn't starve reads from the same disk. A Throttle can be shared by
+// several caches (see WithThrottle) to enforce a global rate.
+type Throttle struct {
+	mu      sync.Mutex
+	rate    int64         // bytes per second
+	next    time.Time     // when the bytes passed so far will have been paid
+	changed chan struct{} // closed by SetRate
+}
+
+// NewThrottle creates a Throttle which lets rate bytes per second through,
+// or any number of them if rate <= 0.
+func NewThrottle(rate int64) *Throttle {
+	return &Throttle{rate: rate, changed: make(chan struct{})}
+}
+
+// Rate returns the current rate in bytes per second.
+func (t *Throttle) Rate() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rate
+}
+
+// SetRate changes the rate to rate bytes per second, or removes the limit if
+// rate <= 0. Writers waiting on the Throttle resume at the new rate.
+func (t *Throttle) SetRate(rate int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rate = rate
+	t.next = time.Time{}
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// reserve accounts for n bytes and returns how long to wait before passing
+// them on.
+func (t *Throttle) reserve(n int) (time.Duration, <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.rate <= 0 {
+		return 0, nil
+	}
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	wait := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(n) * time.Second /
+		time.Duration(t.rate))
+	return wait, t.changed
+}
+
+// wait blocks until n more bytes may be written.
+func (t *Throttle) wait(n int) {
+	for {
+		d, changed := t.reserve(n)
+		if d <= 0 {
+			return
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+			return
+		case <-changed:
+			timer.Stop()
+		}
+	}
+}
+
+// WithWriteRate limits the fills of the cache to n bytes per second in
+// total. It can be changed later with Reconfigure.
+func WithWriteRate(n int64) Option {
+	return func(c *FsCache) {
+		c.write_rate = NewThrottle(n)
+		c.throttles = append(c.throttles, c.write_rate)
+	}
+}
+
+// WithThrottle makes the fills of the cache write at the rate of t. It can be
+// given more than once, e.g. for a per-cache and a global rate.
+func WithThrottle(t *Throttle) Option {
+	return func(c *FsCache) {
+		c.throttles = append(c.throttles, t)
+	}
+}
+
+// throttledWrite writes p once the throttles of w let it through.
+func (w *cacheWriter) throttledWrite(p []byte) (n int, err error) {
+	for len(p) > 0 && err == nil {
+		m := len(p)
+		if m > throttleChunk {
+			m = throttleChunk
+		}
+		for _, t := range w.throttles {
+			t.wait(m)
+		}
+		w.touch()
+		m, err = w.Writer.Write(p[:m])
+		n += m
+		p = p[m:]
+	}
+	return n, err
+}
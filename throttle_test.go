@@ -0,0 +1,69 @@
+package fscache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestWriteRate(t *testing.T) {
+	test := Wrap(t, "throttle")
+	defer test.Close()
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0, WithWriteRate(200<<10))
+	test.AssertNoError(err)
+	test.Assert(cache.Config() == Config{WriteRate: 200 << 10},
+		"unexpected config")
+
+	data := bytes.Repeat([]byte("a"), 80<<10)
+	start := time.Now()
+	r, w, err := cache.Get("a", int64(len(data)))
+	test.AssertNoError(err)
+	_, err = w.Write(data)
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	elapsed := time.Since(start)
+	// the first 32KiB pass immediately, the rest wait for them.
+	test.Assert(elapsed >= 200*time.Millisecond,
+		"expected the write to be throttled, took "+elapsed.String())
+	got, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual(got, data)
+	test.AssertNoError(r.Close())
+
+	cache.Reconfigure(Config{})
+	start = time.Now()
+	w, err = cache.GetWriterOnly("b", int64(len(data)))
+	test.AssertNoError(err)
+	_, err = w.Write(data)
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	elapsed = time.Since(start)
+	test.Assert(elapsed < 200*time.Millisecond,
+		"expected the write not to be throttled, took "+elapsed.String())
+}
+
+func TestThrottleSetRate(t *testing.T) {
+	test := Wrap(t, "throttle")
+	defer test.Close()
+	throttle := NewThrottle(1)
+	throttle.wait(1)
+
+	done := make(chan struct{})
+	go func() {
+		throttle.wait(1)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected the second byte to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	throttle.SetRate(0)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected SetRate to wake the waiter")
+	}
+	test.Assert(throttle.Rate() == 0, "unexpected rate")
+}
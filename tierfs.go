@@ -0,0 +1,188 @@
+package fscache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type tieredFs struct {
+	hot, cold string
+	mode      os.FileMode
+	idle      time.Duration
+	std       stdFs
+	mu        sync.Mutex // serializes moves between the tiers
+}
+
+// NewTieredFs returns a FileSystem which keeps recently read Files in the hot
+// directory, e.g. on an NVMe drive, and the rest in the cold directory. New
+// Files are created hot, Files which haven't been read for idle are demoted by
+// Compact (see CompactEvery) and Files are promoted back when opened. Use hot
+// as the directory of the cache.
+func NewTieredFs(hot, cold string, mode os.FileMode, idle time.Duration) (
+	FileSystem, error) {
+	for _, dir := range []string{hot, cold} {
+		if err := os.MkdirAll(dir, mode); err != nil {
+			return nil, err
+		}
+	}
+	return &tieredFs{hot: hot, cold: cold, mode: mode, idle: idle,
+		std: stdFs{mode: mode}}, nil
+}
+
+// paths returns the paths of name in the hot and the cold tier.
+func (fs *tieredFs) paths(name string) (hot, cold string) {
+	key := filepath.Base(name)
+	return filepath.Join(fs.hot, key), filepath.Join(fs.cold, key)
+}
+
+// locate returns the path of name in whichever tier it is stored in.
+func (fs *tieredFs) locate(name string) string {
+	hot, cold := fs.paths(name)
+	if _, err := os.Stat(hot); err != nil {
+		if _, err := os.Stat(cold); err == nil {
+			return cold
+		}
+	}
+	return hot
+}
+
+func (fs *tieredFs) Create(name string) (File, error) {
+	hot, cold := fs.paths(name)
+	if err := os.Remove(cold); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return fs.std.Create(hot)
+}
+
+// Open opens name, promoting it to the hot tier first if it's cold. If the
+// promotion fails the File is read from the cold tier.
+func (fs *tieredFs) Open(name string) (File, error) {
+	hot, cold := fs.paths(name)
+	if _, err := os.Stat(hot); err == nil {
+		return fs.std.Open(hot)
+	}
+	if err := fs.move(cold, hot); err != nil {
+		if !os.IsNotExist(err) {
+			logger.Errorf("promoting %s: %s", name, err)
+		}
+		return fs.std.Open(fs.locate(name))
+	}
+	return fs.std.Open(hot)
+}
+
+func (fs *tieredFs) Remove(name string) error {
+	hot, cold := fs.paths(name)
+	herr, cerr := os.Remove(hot), os.Remove(cold)
+	switch {
+	case cerr != nil && !os.IsNotExist(cerr):
+		return cerr
+	case herr == nil || cerr == nil:
+		return nil
+	}
+	return herr
+}
+
+func (fs *tieredFs) AccessTimes(name string) (rt, wt time.Time, err error) {
+	return fs.std.AccessTimes(fs.locate(name))
+}
+
+func (fs *tieredFs) Size(name string) (int64, error) {
+	return fs.std.Size(fs.locate(name))
+}
+
+// List returns the keys of the Files in both tiers.
+func (fs *tieredFs) List() ([]string, error) {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, dir := range []string{fs.hot, fs.cold} {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if !seen[f.Name()] {
+				seen[f.Name()] = true
+				keys = append(keys, f.Name())
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Compact demotes name to the cold tier if it hasn't been read for the idle
+// duration of the FileSystem. Reclaimed counts the bytes freed on the hot tier.
+func (fs *tieredFs) Compact(name string) (stats CompactStats, err error) {
+	hot, cold := fs.paths(name)
+	fi, err := os.Stat(hot)
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, err
+	}
+	rt, _, err := fs.std.AccessTimes(hot)
+	if err != nil {
+		return stats, err
+	}
+	if !rt.Before(time.Now().Add(-fs.idle)) {
+		return stats, nil
+	}
+	if err := fs.move(hot, cold); err != nil {
+		return stats, err
+	}
+	stats.Entries = 1
+	stats.Reclaimed = fi.Size()
+	return stats, nil
+}
+
+// move moves the file at src to dst, copying it if they're on different
+// devices. Access times are preserved so that promotion doesn't count as a
+// read.
+func (fs *tieredFs) move(src, dst string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	rt, wt, err := fs.std.AccessTimes(src)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		if err := fs.copy(src, dst, fi.Mode()); err != nil {
+			return err
+		}
+		if err := os.Remove(src); err != nil {
+			return err
+		}
+	}
+	return os.Chtimes(dst, rt, wt)
+}
+
+func (fs *tieredFs) copy(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = copyFile(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
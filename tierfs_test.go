@@ -0,0 +1,58 @@
+package fscache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTieredFs(t *testing.T) {
+	test := Wrap(t, "tierfs")
+	defer test.Close()
+	hot := filepath.Join(test.Dir(), "hot")
+	cold := filepath.Join(test.Dir(), "cold")
+	fs, err := NewTieredFs(hot, cold, 0700, time.Hour)
+	test.AssertNoError(err)
+	cache, err := NewCache(hot, fs, 0)
+	test.AssertNoError(err)
+
+	r, w, err := cache.Get("stream", 5)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+
+	stats, err := cache.Compact()
+	test.AssertNoError(err)
+	test.Assert(stats.Entries == 0, "recently read entries should stay hot")
+
+	old := time.Now().Add(-2 * time.Hour)
+	test.AssertNoError(os.Chtimes(filepath.Join(hot, fileName("stream")),
+		old, old))
+	stats, err = cache.Compact()
+	test.AssertNoError(err)
+	test.Assert(stats.Entries == 1 && stats.Reclaimed == 5,
+		"expected idle entry to be demoted")
+	_, err = os.Stat(filepath.Join(cold, fileName("stream")))
+	test.AssertNoError(err)
+	size, err := cache.Size("stream")
+	test.AssertNoError(err)
+	test.Assert(size == 5, "expected cold entry to keep its size")
+
+	cache, err = NewCache(hot, fs, 0)
+	test.AssertNoError(err)
+	r, w, err = cache.Get("stream", 5)
+	test.AssertNoError(err)
+	test.Assert(w == nil, "expected cold entry to be loaded")
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual([]byte("hello"), p)
+	test.AssertNoError(r.Close())
+	_, err = os.Stat(filepath.Join(hot, fileName("stream")))
+	test.AssertNoError(err)
+	_, err = os.Stat(filepath.Join(cold, fileName("stream")))
+	test.Assert(os.IsNotExist(err), "expected entry to be promoted")
+}
@@ -0,0 +1,212 @@
+package fscache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrEntryExists is returned by Restore when name was filled again since it
+// was removed, or its old file is still being read.
+var ErrEntryExists = errors.New("entry exists")
+
+// trashPrefix is prepended to the keys of trashed files. FileSystems place
+// Files by their base name, so the trash shares the directory of the cache.
+const trashPrefix = ".trash-"
+
+// Renamer is implemented by FileSystems which can move a File, like the one
+// returned by NewFs. Without it trashing and restoring entries copies them.
+type Renamer interface {
+	Rename(oldname, newname string) error
+}
+
+// trashBin holds the removed entries which can still be restored, see
+// WithTrash.
+type trashBin struct {
+	grace   time.Duration
+	mu      sync.Mutex
+	entries map[string]*time.Timer // purges the trashed file of each key
+}
+
+// WithTrash keeps the files of removed and evicted entries for grace before
+// deleting them, during which Restore brings them back. Trashed files count
+// towards the disk usage of the cache but not its WithMaxSize. They're
+// adopted again with a new grace period after a restart, unless the cache
+// loads from a persistent Index.
+func WithTrash(grace time.Duration) Option {
+	return func(c *FsCache) {
+		c.trash = &trashBin{
+			grace:   grace,
+			entries: make(map[string]*time.Timer),
+		}
+	}
+}
+
+// isTrash reports whether key is the key of a trashed file.
+func isTrash(key string) bool {
+	return strings.HasPrefix(key, trashPrefix)
+}
+
+// removeFile deletes the file of s, an entry which was removed from the
+// cache, or moves it to the trash if it was complete. c.mu may be held.
+func (c *FsCache) removeFile(s *Stream) error {
+	if c.trash == nil || !s.completed() {
+		return s.removeFile()
+	}
+	key := s.info.Key
+	c.trash.mu.Lock()
+	defer c.trash.mu.Unlock()
+	if err := c.moveFile(s.Name(), c.getPath(trashPrefix+key)); err != nil {
+		return err
+	}
+	c.trashLocked(key)
+	return nil
+}
+
+// trashLocked starts the grace period of the trashed file of key, c.trash.mu
+// must be held.
+func (c *FsCache) trashLocked(key string) {
+	if t, ok := c.trash.entries[key]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(c.trash.grace, func() {
+		c.trash.mu.Lock()
+		defer c.trash.mu.Unlock()
+		if c.trash.entries[key] != t {
+			return
+		}
+		delete(c.trash.entries, key)
+		if err := c.fs.Remove(c.getPath(trashPrefix + key)); err != nil {
+			logger.Error(err)
+		}
+	})
+	c.trash.entries[key] = t
+}
+
+// adoptTrash puts a trashed file found when loading back in the trash, or
+// deletes it if the trash is disabled.
+func (c *FsCache) adoptTrash(trash_key string) {
+	if c.trash == nil {
+		if err := c.fs.Remove(c.getPath(trash_key)); err != nil {
+			logger.Error(err)
+		}
+		return
+	}
+	c.trash.mu.Lock()
+	c.trashLocked(strings.TrimPrefix(trash_key, trashPrefix))
+	c.trash.mu.Unlock()
+}
+
+// Restore brings back name from the trash, see WithTrash. It fails with
+// ErrNotFound if name isn't in the trash, e.g. because its grace period is
+// over, and with ErrEntryExists if name was filled again since.
+func (c *FsCache) Restore(name string) error {
+	if c.trash == nil {
+		return wrapError(OpRestore, name, ErrNotFound)
+	}
+	key := c.key(name)
+	c.mu.Lock()
+	defer c.unlock()
+	c.trash.mu.Lock()
+	defer c.trash.mu.Unlock()
+	t, ok := c.trash.entries[key]
+	if !ok {
+		return wrapError(OpRestore, name, ErrNotFound)
+	}
+	if _, ok := c.streams.get(key); ok || c.tombstones[key] != nil ||
+		c.removingDir(key) != nil {
+		return wrapError(OpRestore, name, ErrEntryExists)
+	}
+	s := c.newStream(key)
+	if err := c.moveFile(c.getPath(trashPrefix+key), s.Name()); err != nil {
+		return wrapError(OpRestore, name, err)
+	}
+	t.Stop()
+	delete(c.trash.entries, key)
+	s.markComplete()
+	c.streams.put(key, s, EntryComplete)
+	return nil
+}
+
+// stopTrash stops purging the trash, its files are left for the next start.
+func (c *FsCache) stopTrash() {
+	if c.trash == nil {
+		return
+	}
+	c.trash.mu.Lock()
+	defer c.trash.mu.Unlock()
+	for key, t := range c.trash.entries {
+		t.Stop()
+		delete(c.trash.entries, key)
+	}
+}
+
+// moveFile moves the File from to to, renaming it if the FileSystem can.
+func (c *FsCache) moveFile(from, to string) error {
+	if r, ok := c.fs.(Renamer); ok {
+		return r.Rename(from, to)
+	}
+	src, err := c.fs.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := c.fs.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = copyFile(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		c.fs.Remove(to)
+		return err
+	}
+	return c.fs.Remove(from)
+}
+
+func (fs *stdFs) Rename(oldname, newname string) error {
+	if err := fs.rename(oldname, newname); err != nil {
+		return err
+	}
+	if err := fs.syncDirs(newname, true); err != nil {
+		return err
+	}
+	if filepath.Dir(oldname) == filepath.Dir(newname) {
+		return nil
+	}
+	return fs.syncDirs(oldname, false)
+}
+
+func (fs *stdFs) rename(oldname, newname string) error {
+	err := os.Rename(oldname, newname)
+	if err != nil && os.IsNotExist(err) {
+		// the parent of a hierarchical key, see HierarchicalKeys.
+		if _, serr := os.Stat(oldname); serr != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(newname), fs.mode); err != nil {
+			return err
+		}
+		return os.Rename(oldname, newname)
+	}
+	return err
+}
+
+func (fs *memFS) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[oldname]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(fs.files, oldname)
+	f.name = newname
+	fs.files[newname] = f
+	return nil
+}
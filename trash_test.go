@@ -0,0 +1,105 @@
+package fscache
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	test := Wrap(t, "trash")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0, WithTrash(time.Hour))
+	test.AssertNoError(err)
+
+	fill := func(name, data string) {
+		r, w, err := cache.Get(name, int64(len(data)))
+		test.AssertNoError(err)
+		_, err = w.Write([]byte(data))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+		test.AssertNoError(r.Close())
+	}
+	fill("a", "hello")
+	test.AssertNoError(cache.Remove("a"))
+	test.Assert(!cache.Exists("a"), "expected a to be removed")
+	test.AssertNoError(cache.Restore("a"))
+	r, w, err := cache.Get("a", 5)
+	test.AssertNoError(err)
+	test.Assert(w == nil, "expected a to be restored")
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual([]byte("hello"), p)
+	test.AssertNoError(r.Close())
+
+	err = cache.Restore("a")
+	test.Assert(errors.Is(err, ErrNotFound), "expected a to be out of the trash")
+	test.AssertNoError(cache.Remove("a"))
+	fill("a", "world")
+	err = cache.Restore("a")
+	test.Assert(errors.Is(err, ErrEntryExists), "expected ErrEntryExists")
+
+	// the trash survives a restart.
+	test.AssertNoError(cache.Remove("a"))
+	test.AssertNoError(cache.Close())
+	cache, err = New(test.Dir(), 0700, 0, WithTrash(time.Hour))
+	test.AssertNoError(err)
+	test.Assert(cache.LoadReport().Entries == 0, "trash loaded as entries")
+	test.AssertNoError(cache.Restore("a"))
+	test.Assert(cache.Exists("a"), "expected a to be restored")
+}
+
+func TestTrashPurge(t *testing.T) {
+	test := Wrap(t, "trash")
+	defer test.Close()
+	fs := NewMemFs()
+	cache, err := NewCache(test.Dir(), fs, 0, WithTrash(time.Millisecond))
+	test.AssertNoError(err)
+	r, w, err := cache.Get("a", 5)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+	test.AssertNoError(cache.Remove("a"))
+
+	for i := 0; i < 100; i++ {
+		if keys, _ := fs.(Lister).List(); len(keys) == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	keys, err := fs.(Lister).List()
+	test.AssertNoError(err)
+	test.Assert(len(keys) == 0, "expected the trash to be purged")
+	err = cache.Restore("a")
+	test.Assert(errors.Is(err, ErrNotFound), "expected ErrNotFound")
+}
+
+func TestTrashRemovePrefix(t *testing.T) {
+	test := Wrap(t, "trash")
+	defer test.Close()
+	cache, err := New(test.Dir(), 0700, 0, WithTrash(time.Hour),
+		WithKeyEncoding(HierarchicalKeys(0)))
+	test.AssertNoError(err)
+
+	r, w, err := cache.Get("tenant/bucket/a", 5)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+
+	test.AssertNoError(cache.RemovePrefix("tenant/bucket"))
+	test.Assert(!cache.Exists("tenant/bucket/a"), "expected a to be removed")
+	test.AssertNoError(cache.Restore("tenant/bucket/a"))
+	r, w, err = cache.Get("tenant/bucket/a", 5)
+	test.AssertNoError(err)
+	test.Assert(w == nil, "expected a to be restored")
+	p, err := ioutil.ReadAll(r)
+	test.AssertNoError(err)
+	test.AssertByteEqual([]byte("hello"), p)
+	test.AssertNoError(r.Close())
+}
+
@@ -0,0 +1,336 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrTxnDone is returned by a Txn which was already committed or
+	// aborted.
+	ErrTxnDone = errors.New("transaction already committed or aborted")
+
+	// ErrTxnIncomplete is returned by Commit while a writer of the Txn is
+	// still open or failed.
+	ErrTxnIncomplete = errors.New("transaction has unfinished writes")
+
+	// ErrTxnConflict is returned by Commit if an entry of the Txn is being
+	// filled outside of it.
+	ErrTxnConflict = errors.New("entry is being filled outside the transaction")
+)
+
+const txnPrefix = ".txn-"
+
+// isTxn reports whether key is the key of a file staged by a Txn.
+func isTxn(key string) bool {
+	return strings.HasPrefix(key, txnPrefix)
+}
+
+// Txn groups the Sets and Removes of several entries which become visible
+// together when it's committed, e.g. an index file and the data shards it
+// refers to. Until then Gets see the entries as they were.
+type Txn struct {
+	c         *FsCache
+	id        uint64
+	mu        sync.Mutex
+	done      bool
+	sets      map[string]*txnSet // by key
+	removes   map[string]bool    // keys
+	expect    map[string]Version // by key, see Expect
+	committed map[string]Version // the new Versions of sets, by key
+}
+
+// txnSet is an entry written by a Txn, staged in a file of its own.
+type txnSet struct {
+	name string
+	s    *Stream
+	w    *cacheWriter
+}
+
+// Begin starts a Txn. It must be committed or aborted.
+func (c *FsCache) Begin() *Txn {
+	c.mu.Lock()
+	c.txn_seq++
+	id := c.txn_seq
+	c.mu.Unlock()
+	return &Txn{
+		c:         c,
+		id:        id,
+		sets:      make(map[string]*txnSet),
+		removes:   make(map[string]bool),
+		expect:    make(map[string]Version),
+		committed: make(map[string]Version),
+	}
+}
+
+// Set returns the writer of the new content of name, replacing its current
+// one once the Txn is committed. The writer must be closed before Commit.
+// size is the size of the content like for Get. The writer counts like a
+// fill: it's subject to the writer limits, waits for a snapshot in progress
+// and is aborted by Shutdown.
+func (t *Txn) Set(name string, size int64) (io.WriteCloser, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return nil, wrapError(OpWrite, name, ErrTxnDone)
+	}
+	c := t.c
+	if err := c.validate(name); err != nil {
+		return nil, wrapError(OpWrite, name, err)
+	}
+	key := c.key(name)
+	if set, ok := t.sets[key]; ok {
+		set.discard()
+	}
+	delete(t.removes, key)
+
+	ctx := context.Background()
+	if err := c.beginWrite(ctx, true); err != nil {
+		return nil, wrapError(OpWrite, name, err)
+	}
+	release, err := c.acquireWriter(ctx, true)
+	if err != nil {
+		c.endWrite()
+		return nil, wrapError(OpWrite, name, err)
+	}
+	s := c.newStream(key)
+	s.name = t.path(key, "-")
+	s.expected = size
+	s.info.Name = name
+	writer, err := s.GetWriter()
+	if err != nil {
+		release()
+		c.endWrite()
+		return nil, wrapError(OpWrite, name, err)
+	}
+	// empty content is committed as an empty entry.
+	s.lazy.empty = true
+	w := c.trackWriter(s, writer, release)
+	t.sets[key] = &txnSet{name: name, s: s, w: w}
+	return c.wrapWriter(name, w), nil
+}
+
+// path returns the path of a file of the Txn for key: its staged content
+// with sep "-", the content it replaces with sep ".".
+func (t *Txn) path(key, sep string) string {
+	return t.c.getPath(txnPrefix + strconv.FormatUint(t.id, 10) + sep + key)
+}
+
+// Remove removes name once the Txn is committed.
+func (t *Txn) Remove(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return wrapError(OpRemove, name, ErrTxnDone)
+	}
+	key := t.c.key(name)
+	if set, ok := t.sets[key]; ok {
+		set.discard()
+		delete(t.sets, key)
+	}
+	t.removes[key] = true
+	return nil
+}
+
+// Expect makes Commit fail with ErrConflict unless name still has Version v
+// then, zero if it must be missing. See Replace.
+func (t *Txn) Expect(name string, v Version) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return wrapError(OpWrite, name, ErrTxnDone)
+	}
+	if err := t.c.validate(name); err != nil {
+		return wrapError(OpWrite, name, err)
+	}
+	t.expect[t.c.key(name)] = v
+	return nil
+}
+
+// Commit makes the Sets and Removes of the Txn visible at once. It fails
+// with ErrTxnIncomplete if a writer of the Txn is open or failed, with
+// ErrConflict if an entry doesn't have the Version it Expects, and with
+// ErrTxnConflict if one of its entries is being filled outside of it, or
+// with ErrRemoving if it's below a RemovePrefix in progress, in which case
+// nothing is changed and the Txn can still be aborted. Readers of the
+// replaced entries keep reading their old content.
+//
+// The staged files are moved into place while Gets wait, which is atomic if
+// the FileSystem is a Renamer. The files they replace are moved aside first,
+// so that if moving one fails the ones moved so far are moved back: the
+// error is returned, the Txn is aborted and the cache is left as it was.
+func (t *Txn) Commit() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return ErrTxnDone
+	}
+	for _, set := range t.sets {
+		if set.s.State() != StreamComplete {
+			return wrapError(OpWrite, set.name, ErrTxnIncomplete)
+		}
+	}
+
+	c := t.c
+	keys := t.keys()
+	c.awaitSnapshot()
+	c.mu.Lock()
+	for key, v := range t.expect {
+		var current Version
+		s, ok := c.streams.get(key)
+		if ok {
+			current = s.Version()
+		}
+		if current != v || ok && s.filling() {
+			c.mu.Unlock()
+			name, _ := c.key_enc.Decode(key)
+			return wrapError(OpWrite, name, ErrConflict)
+		}
+	}
+	for key := range keys {
+		if s, ok := c.streams.get(key); ok && s.filling() {
+			c.mu.Unlock()
+			return wrapError(OpWrite, s.entryName(), ErrTxnConflict)
+		}
+		if c.removingDir(key) != nil {
+			// its directory is being removed, see RemovePrefix.
+			c.mu.Unlock()
+			name, _ := c.key_enc.Decode(key)
+			return wrapError(OpWrite, name, ErrRemoving)
+		}
+	}
+	t.done = true
+	aside, err := t.moveSets()
+	if err == nil {
+		for key, set := range t.sets {
+			if old, ok := c.streams.delete(key); ok {
+				// its file was replaced, its Readers keep the old one open.
+				old.markRemoving()
+				old.retire()
+			}
+			if old := c.tombstones[key]; old != nil {
+				delete(c.tombstones, key)
+				old.retire()
+			}
+			s := c.newStream(key)
+			s.info.Name = set.name
+			s.markComplete()
+			c.streams.put(key, s, EntryComplete)
+			t.committed[key] = s.info.Version
+		}
+		t.sets = nil
+		for key := range t.removes {
+			if s, ok := c.streams.delete(key); ok {
+				s.markRemoving()
+				c.tombstoneLocked(key, s)
+			}
+		}
+	}
+	c.unlock()
+
+	for _, set := range t.sets {
+		// left over by a failed move.
+		set.discard()
+	}
+	for _, path := range aside {
+		if err := c.fs.Remove(path); err != nil {
+			logger.Error(err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for key := range keys {
+		c.unarchive(key)
+	}
+	c.enforceMaxSize()
+	return nil
+}
+
+// moveSets moves the staged files of the Txn into place, after moving the
+// files they replace aside, and returns the paths those were moved to. If a
+// move fails, the ones done so far are undone and nothing is returned but
+// the error. c.mu must be held.
+func (t *Txn) moveSets() ([]string, error) {
+	c := t.c
+	var aside, moved []string // keys
+	undo := func() {
+		for i := len(moved) - 1; i >= 0; i-- {
+			key := moved[i]
+			err := c.moveFile(c.getPath(key), t.sets[key].s.Name())
+			if err != nil {
+				logger.Error(err)
+			}
+		}
+		for i := len(aside) - 1; i >= 0; i-- {
+			key := aside[i]
+			if err := c.moveFile(t.path(key, "."), c.getPath(key)); err != nil {
+				logger.Error(err)
+			}
+		}
+	}
+	for key, set := range t.sets {
+		err := c.moveFile(c.getPath(key), t.path(key, "."))
+		if err == nil {
+			aside = append(aside, key)
+		} else if !os.IsNotExist(err) {
+			undo()
+			return nil, wrapError(OpWrite, set.name, err)
+		}
+		if err := c.moveFile(set.s.Name(), c.getPath(key)); err != nil {
+			undo()
+			return nil, wrapError(OpWrite, set.name, err)
+		}
+		moved = append(moved, key)
+	}
+	paths := make([]string, len(aside))
+	for i, key := range aside {
+		paths[i] = t.path(key, ".")
+	}
+	return paths, nil
+}
+
+// Abort discards the Sets and Removes of the Txn. It's a no-op once the Txn
+// is committed.
+func (t *Txn) Abort() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return
+	}
+	t.done = true
+	for _, set := range t.sets {
+		set.discard()
+	}
+}
+
+// filling reports whether s is being filled, or about to be.
+func (s *Stream) filling() bool {
+	state := s.State()
+	return state == StreamEmpty || state == StreamWriting
+}
+
+// keys returns the keys the Txn sets or removes.
+func (t *Txn) keys() map[string]bool {
+	keys := make(map[string]bool, len(t.sets)+len(t.removes))
+	for key := range t.sets {
+		keys[key] = true
+	}
+	for key := range t.removes {
+		keys[key] = true
+	}
+	return keys
+}
+
+// discard aborts the writer of a staged entry and deletes its file.
+func (set *txnSet) discard() {
+	set.w.abort(ErrTxnDone)
+	if err := set.s.removeFile(); err != nil {
+		logger.Error(err)
+	}
+}
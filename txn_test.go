@@ -0,0 +1,161 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTxn(t *testing.T) {
+	test := Wrap(t, "txn")
+	defer test.Close()
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0)
+	test.AssertNoError(err)
+	fill := func(name, data string) {
+		r, w, err := cache.Get(name, UnknownSize)
+		test.AssertNoError(err)
+		_, err = w.Write([]byte(data))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+		test.AssertNoError(r.Close())
+	}
+	read := func(name string) string {
+		r, ok, err := cache.GetIfExists(name)
+		test.AssertNoError(err)
+		if !ok {
+			return ""
+		}
+		defer r.Close()
+		p, err := ioutil.ReadAll(r)
+		test.AssertNoError(err)
+		return string(p)
+	}
+	fill("index", "old")
+	fill("gone", "data")
+	old, _, err := cache.Get("index", UnknownSize)
+	test.AssertNoError(err)
+
+	txn := cache.Begin()
+	w1, err := txn.Set("index", UnknownSize)
+	test.AssertNoError(err)
+	w2, err := txn.Set("shard", UnknownSize)
+	test.AssertNoError(err)
+	test.AssertNoError(txn.Remove("gone"))
+	_, err = w1.Write([]byte("new"))
+	test.AssertNoError(err)
+	test.AssertNoError(w1.Close())
+	_, err = w2.Write([]byte("shard"))
+	test.AssertNoError(err)
+
+	test.Assert(errors.Is(txn.Commit(), ErrTxnIncomplete),
+		"expected ErrTxnIncomplete while a writer is open")
+	test.AssertNoError(w2.Close())
+	test.Assert(read("index") == "old" && read("shard") == "" &&
+		read("gone") == "data", "expected no changes before the commit")
+
+	test.AssertNoError(txn.Commit())
+	test.Assert(read("index") == "new", "expected the new index")
+	test.Assert(read("shard") == "shard", "expected the shard")
+	test.Assert(!cache.Exists("gone"), "expected gone to be removed")
+	p, err := ioutil.ReadAll(old)
+	test.AssertNoError(err)
+	test.AssertByteEqual([]byte("old"), p)
+	test.AssertNoError(old.Close())
+	test.Assert(errors.Is(txn.Commit(), ErrTxnDone), "expected ErrTxnDone")
+
+	// entries filled outside of a Txn conflict.
+	r, w, err := cache.Get("busy", UnknownSize)
+	test.AssertNoError(err)
+	txn = cache.Begin()
+	w1, err = txn.Set("busy", UnknownSize)
+	test.AssertNoError(err)
+	test.AssertNoError(w1.Close())
+	test.Assert(errors.Is(txn.Commit(), ErrTxnConflict),
+		"expected ErrTxnConflict")
+	txn.Abort()
+	_, err = w.Write([]byte("busy"))
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertNoError(r.Close())
+	test.Assert(read("busy") == "busy", "expected the outside fill to win")
+}
+
+// failingRename is a FileSystem whose Renames of fail fail.
+type failingRename struct {
+	FileSystem
+	fail string
+}
+
+func (fs *failingRename) Rename(oldname, newname string) error {
+	if oldname == fs.fail {
+		return errors.New("rename failed")
+	}
+	return fs.FileSystem.(Renamer).Rename(oldname, newname)
+}
+
+func TestTxnRollback(t *testing.T) {
+	test := Wrap(t, "txn")
+	defer test.Close()
+	fs := &failingRename{FileSystem: NewMemFs()}
+	cache, err := NewCache(test.Dir(), fs, 0)
+	test.AssertNoError(err)
+	for _, name := range []string{"a", "b"} {
+		r, w, err := cache.Get(name, UnknownSize)
+		test.AssertNoError(err)
+		_, err = w.Write([]byte("old"))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+		test.AssertNoError(r.Close())
+	}
+
+	txn := cache.Begin()
+	fs.fail = txn.path(cache.key("b"), "-")
+	for _, name := range []string{"a", "b", "c"} {
+		w, err := txn.Set(name, UnknownSize)
+		test.AssertNoError(err)
+		_, err = w.Write([]byte("new"))
+		test.AssertNoError(err)
+		test.AssertNoError(w.Close())
+	}
+	test.Assert(txn.Commit() != nil, "expected the commit to fail")
+	for _, name := range []string{"a", "b"} {
+		r, ok, err := cache.GetIfExists(name)
+		test.AssertNoError(err)
+		test.Assert(ok, "expected "+name+" to be kept")
+		p, err := ioutil.ReadAll(r)
+		test.AssertNoError(err)
+		test.AssertByteEqual([]byte("old"), p)
+		test.AssertNoError(r.Close())
+	}
+	test.Assert(!cache.Exists("c"), "expected c not to be committed")
+	_, err = fs.Size(cache.getPath(cache.key("c")))
+	test.Assert(os.IsNotExist(err), "expected the file of c to be moved back")
+	test.Assert(errors.Is(txn.Commit(), ErrTxnDone), "expected ErrTxnDone")
+}
+
+func TestTxnShutdown(t *testing.T) {
+	test := Wrap(t, "txn")
+	defer test.Close()
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0)
+	test.AssertNoError(err)
+	txn := cache.Begin()
+	w, err := txn.Set("a", UnknownSize)
+	test.AssertNoError(err)
+	_, err = w.Write([]byte("hello"))
+	test.AssertNoError(err)
+	test.Assert(cache.DebugState().Writers == 1, "expected the writer to count")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	test.Assert(cache.Shutdown(ctx) == context.DeadlineExceeded,
+		"expected the writer to be aborted")
+	test.Assert(errors.Is(w.Close(), ErrClosed), "expected writer to be closed")
+	test.Assert(errors.Is(txn.Commit(), ErrTxnIncomplete),
+		"expected ErrTxnIncomplete")
+	txn.Abort()
+	_, err = cache.Begin().Set("b", UnknownSize)
+	test.Assert(errors.Is(err, ErrShutdown), "expected ErrShutdown")
+}
@@ -0,0 +1,120 @@
+package fscache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+)
+
+// ValueCodec serializes the values of a Typed cache into entries.
+type ValueCodec interface {
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+var (
+	// JSONValueCodec stores values as JSON.
+	JSONValueCodec ValueCodec = jsonValueCodec{}
+
+	// GobValueCodec stores values with encoding/gob.
+	GobValueCodec ValueCodec = gobValueCodec{}
+)
+
+type jsonValueCodec struct{}
+
+func (jsonValueCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (jsonValueCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+type gobValueCodec struct{}
+
+func (gobValueCodec) Encode(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+func (gobValueCodec) Decode(r io.Reader, v interface{}) error {
+	return gob.NewDecoder(r).Decode(v)
+}
+
+// Typed caches values of T in a Cache, serialized with a ValueCodec, for
+// structured data rather than streams.
+type Typed[T any] struct {
+	cache Cache
+	codec ValueCodec
+}
+
+// NewTyped returns a Typed cache of values of T stored in cache with codec.
+func NewTyped[T any](cache Cache, codec ValueCodec) *Typed[T] {
+	return &Typed[T]{cache: cache, codec: codec}
+}
+
+// Get returns the value stored as name, ok is false if there's none. If the
+// value is being stored it waits for it.
+func (t *Typed[T]) Get(name string) (v T, ok bool, err error) {
+	ok, err = GetValue(t.cache, name, t.codec, &v)
+	return v, ok, err
+}
+
+// Set stores v as name, replacing the current value once the Gets reading it
+// are done. If another Set stores name concurrently, one of the values is
+// kept.
+func (t *Typed[T]) Set(name string, v T) error {
+	var buf bytes.Buffer
+	if err := t.codec.Encode(&buf, v); err != nil {
+		return err
+	}
+	if err := t.cache.Remove(name); err != nil {
+		return err
+	}
+	r, w, err := t.cache.Get(name, int64(buf.Len()))
+	if err != nil {
+		return err
+	}
+	if w == nil {
+		// set concurrently.
+		return r.Close()
+	}
+	return t.fill(name, r, w, buf.Bytes())
+}
+
+// fill writes the encoded value p to the writer of the miss of name, see
+// closeFill.
+func (t *Typed[T]) fill(name string, r io.Closer, w io.WriteCloser,
+	p []byte) error {
+	_, err := w.Write(p)
+	return closeFill(t.cache, name, r, w, err)
+}
+
+// GetOrLoad returns the value stored as name, or stores and returns the one
+// load returns if there's none. Concurrent calls for the same name wait for
+// the value of the first instead of loading it again, and fail to decode it
+// if it fails.
+func (t *Typed[T]) GetOrLoad(name string, load func() (T, error)) (v T,
+	err error) {
+	r, w, err := t.cache.Get(name, UnknownSize)
+	if err != nil {
+		return v, err
+	}
+	if w == nil {
+		defer r.Close()
+		err := t.codec.Decode(r, &v)
+		return v, err
+	}
+	var buf bytes.Buffer
+	v, err = load()
+	if err == nil {
+		err = t.codec.Encode(&buf, v)
+	}
+	if err != nil {
+		// nothing was written, so the entry isn't kept.
+		w.Close()
+		r.Close()
+		return v, err
+	}
+	return v, t.fill(name, r, w, buf.Bytes())
+}
@@ -0,0 +1,63 @@
+package fscache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type typedValue struct {
+	Name  string
+	Count int
+}
+
+func TestTyped(t *testing.T) {
+	test := Wrap(t, "typed")
+	defer test.Close()
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0)
+	test.AssertNoError(err)
+
+	for _, codec := range []ValueCodec{JSONValueCodec, GobValueCodec} {
+		cache, err := NewCache(test.Dir(), NewMemFs(), 0)
+		test.AssertNoError(err)
+		typed := NewTyped[typedValue](cache, codec)
+		_, ok, err := typed.Get("a")
+		test.AssertNoError(err)
+		test.Assert(!ok, "expected no value")
+		test.Assert(!cache.Exists("a"), "Get shouldn't leave an entry")
+
+		test.AssertNoError(typed.Set("a", typedValue{"a", 1}))
+		v, ok, err := typed.Get("a")
+		test.AssertNoError(err)
+		test.Assert(ok && v == typedValue{"a", 1}, "unexpected value")
+		test.AssertNoError(typed.Set("a", typedValue{"a", 2}))
+		v, _, err = typed.Get("a")
+		test.AssertNoError(err)
+		test.Assert(v.Count == 2, "expected Set to replace the value")
+	}
+
+	typed := NewTyped[int](cache, JSONValueCodec)
+	var loads int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := typed.GetOrLoad("n", func() (int, error) {
+				atomic.AddInt32(&loads, 1)
+				return 42, nil
+			})
+			test.AssertNoError(err)
+			test.Assert(v == 42, "unexpected loaded value")
+		}()
+	}
+	wg.Wait()
+	test.Assert(atomic.LoadInt32(&loads) == 1, "expected a single load")
+
+	_, err = typed.GetOrLoad("fail", func() (int, error) {
+		return 0, errFail
+	})
+	test.Assert(errors.Is(err, errFail), "expected the load error")
+	test.Assert(!cache.Exists("fail"), "failed loads shouldn't be kept")
+}
@@ -0,0 +1,100 @@
+package fscache
+
+import "io"
+
+// GetValue decodes the entry name into v with codec, streaming it from the
+// cache rather than reading it into memory first. ok is false if there's no
+// such entry. If it's being filled the decoding reads the bytes as they're
+// written.
+func GetValue(cache Cache, name string, codec ValueCodec, v interface{}) (
+	ok bool, err error) {
+	r, ok, err := getIfExists(cache, name)
+	if err != nil || !ok {
+		return false, err
+	}
+	defer r.Close()
+	if err := codec.Decode(r, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetValue stores v as name, encoding it with codec straight into the entry
+// so that large values aren't buffered in memory. The current value is
+// replaced once the Gets reading it are done. If encoding fails the entry is
+// removed, and concurrent Gets fail to decode it. If another SetValue stores
+// name concurrently, one of the values is kept.
+func SetValue(cache Cache, name string, codec ValueCodec,
+	v interface{}) error {
+	if err := cache.Remove(name); err != nil {
+		return err
+	}
+	r, w, err := cache.Get(name, UnknownSize)
+	if err != nil {
+		return err
+	}
+	if w == nil {
+		// set concurrently.
+		return r.Close()
+	}
+	return closeFill(cache, name, r, w, codec.Encode(w, v))
+}
+
+// GetJSON is GetValue with JSONValueCodec.
+func GetJSON(cache Cache, name string, v interface{}) (ok bool, err error) {
+	return GetValue(cache, name, JSONValueCodec, v)
+}
+
+// SetJSON is SetValue with JSONValueCodec.
+func SetJSON(cache Cache, name string, v interface{}) error {
+	return SetValue(cache, name, JSONValueCodec, v)
+}
+
+// GetGob is GetValue with GobValueCodec.
+func GetGob(cache Cache, name string, v interface{}) (ok bool, err error) {
+	return GetValue(cache, name, GobValueCodec, v)
+}
+
+// SetGob is SetValue with GobValueCodec.
+func SetGob(cache Cache, name string, v interface{}) error {
+	return SetValue(cache, name, GobValueCodec, v)
+}
+
+// ifExists is implemented by caches which can read an entry without starting
+// a fill, like FsCache.
+type ifExists interface {
+	GetIfExists(name string) (ReaderAtCloser, bool, error)
+}
+
+// getIfExists returns a Reader of name if it's in cache, without filling it.
+func getIfExists(cache Cache, name string) (ReaderAtCloser, bool, error) {
+	if c, ok := cache.(ifExists); ok {
+		return c.GetIfExists(name)
+	}
+	r, w, err := cache.Get(name, UnknownSize)
+	if err != nil {
+		return nil, false, err
+	}
+	if w != nil {
+		// abandoned fills aren't kept.
+		w.Close()
+		r.Close()
+		return nil, false, nil
+	}
+	return r, true, nil
+}
+
+// closeFill closes the writer w of the miss of name, which failed with err
+// if it isn't nil, and its Reader r. The entry is removed if the fill
+// failed.
+func closeFill(cache Cache, name string, r io.Closer, w io.WriteCloser,
+	err error) error {
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	r.Close()
+	if err != nil {
+		cache.Remove(name)
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+package fscache
+
+import "testing"
+
+func TestValues(t *testing.T) {
+	test := Wrap(t, "values")
+	defer test.Close()
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0)
+	test.AssertNoError(err)
+
+	doc := map[string][]int{"a": {1, 2, 3}, "b": make([]int, 100000)}
+	var got map[string][]int
+	ok, err := GetJSON(cache, "doc", &got)
+	test.AssertNoError(err)
+	test.Assert(!ok, "expected no value")
+	test.AssertNoError(SetJSON(cache, "doc", doc))
+	ok, err = GetJSON(cache, "doc", &got)
+	test.AssertNoError(err)
+	test.Assert(ok && len(got["a"]) == 3 && len(got["b"]) == 100000,
+		"unexpected JSON value")
+
+	test.AssertNoError(SetGob(cache, "doc", []string{"x", "y"}))
+	var list []string
+	ok, err = GetGob(cache, "doc", &list)
+	test.AssertNoError(err)
+	test.Assert(ok && len(list) == 2 && list[1] == "y",
+		"expected SetGob to replace the value")
+
+	// values which fail to encode aren't kept.
+	err = SetJSON(cache, "bad", func() {})
+	test.Assert(err != nil, "expected the encoding to fail")
+	test.Assert(!cache.Exists("bad"), "expected no entry")
+}
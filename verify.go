@@ -0,0 +1,217 @@
+package fscache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"sync"
+)
+
+// ErrCorrupted is returned by the Readers of an entry whose bytes on disk
+// don't match the hashes recorded when it was written, see WithVerification.
+var ErrCorrupted = errors.New("entry is corrupted")
+
+// DefaultVerifyChunkSize is the size of the chunks hashed by
+// WithVerification unless another one is given.
+const DefaultVerifyChunkSize = 64 << 10
+
+// HashTree holds the hashes WithVerification checks the bytes of an entry
+// against: the sha256 of each chunk of ChunkSize bytes, and Root, the sha256
+// of those.
+type HashTree struct {
+	ChunkSize int64
+	Size      int64
+	Leaves    [][]byte
+	Root      []byte
+}
+
+// WithVerification hashes entries in chunks of chunk bytes (or
+// DefaultVerifyChunkSize if chunk <= 0) while they're written, and makes
+// their Readers verify each chunk before returning any of its bytes. A
+// mismatch fails the read with ErrCorrupted and removes the entry. The
+// hashes are kept with the entry and in the Index, so entries loaded from
+// disk without a Persistent index aren't verified.
+func WithVerification(chunk int64) Option {
+	return func(c *FsCache) {
+		if chunk <= 0 {
+			chunk = DefaultVerifyChunkSize
+		}
+		c.verify = chunk
+	}
+}
+
+// valid reports whether t has a leaf per chunk which hash to its root.
+func (t *HashTree) valid() bool {
+	if t.ChunkSize <= 0 ||
+		int64(len(t.Leaves)) != (t.Size+t.ChunkSize-1)/t.ChunkSize {
+		return false
+	}
+	return bytes.Equal(t.root(), t.Root)
+}
+
+func (t *HashTree) root() []byte {
+	h := sha256.New()
+	for _, leaf := range t.Leaves {
+		h.Write(leaf)
+	}
+	return h.Sum(nil)
+}
+
+// treeHasher builds the HashTree of the bytes written to it.
+type treeHasher struct {
+	tree HashTree
+	h    hash.Hash
+	n    int64 // bytes of the current chunk
+}
+
+func newTreeHasher(chunk int64) *treeHasher {
+	return &treeHasher{tree: HashTree{ChunkSize: chunk}, h: sha256.New()}
+}
+
+func (t *treeHasher) write(p []byte) {
+	for len(p) > 0 {
+		m := t.tree.ChunkSize - t.n
+		if int64(len(p)) < m {
+			m = int64(len(p))
+		}
+		t.h.Write(p[:m])
+		t.n += m
+		t.tree.Size += m
+		p = p[m:]
+		if t.n == t.tree.ChunkSize {
+			t.leaf()
+		}
+	}
+}
+
+func (t *treeHasher) leaf() {
+	t.tree.Leaves = append(t.tree.Leaves, t.h.Sum(nil))
+	t.h.Reset()
+	t.n = 0
+}
+
+// sum returns the HashTree of the bytes written.
+func (t *treeHasher) sum() *HashTree {
+	if t.n > 0 {
+		t.leaf()
+	}
+	tree := t.tree
+	tree.Root = tree.root()
+	return &tree
+}
+
+// hashTree returns the hashes of a stream written WithVerification, nil if
+// it has none.
+func (s *Stream) hashTree() *HashTree {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hashes
+}
+
+// verifiedFile is a ReadFile which checks the chunks it reads against a
+// HashTree.
+type verifiedFile struct {
+	ReadFile
+	tree       *HashTree
+	on_corrupt func()
+
+	mu       sync.Mutex // guards the fields below
+	read_off int64
+	chunk    int64  // the index of the chunk in buf, -1 if none
+	buf      []byte // the last verified chunk
+	corrupt  bool
+}
+
+func newVerifiedFile(f ReadFile, tree *HashTree,
+	on_corrupt func()) *verifiedFile {
+	return &verifiedFile{
+		ReadFile:   f,
+		tree:       tree,
+		on_corrupt: on_corrupt,
+		chunk:      -1,
+	}
+}
+
+func (f *verifiedFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt(p, f.read_off)
+	f.read_off += int64(n)
+	return n, err
+}
+
+func (f *verifiedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readAt(p, off)
+}
+
+// readAt reads from verified chunks, f.mu must be held.
+func (f *verifiedFile) readAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		if off >= f.tree.Size {
+			return n, io.EOF
+		}
+		idx := off / f.tree.ChunkSize
+		if err := f.load(idx); err != nil {
+			return n, err
+		}
+		m := copy(p[n:], f.buf[off-idx*f.tree.ChunkSize:])
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// load reads and verifies the chunk idx into f.buf, f.mu must be held.
+func (f *verifiedFile) load(idx int64) error {
+	if f.corrupt {
+		return ErrCorrupted
+	}
+	if f.chunk == idx {
+		return nil
+	}
+	size := f.tree.Size - idx*f.tree.ChunkSize
+	if size > f.tree.ChunkSize {
+		size = f.tree.ChunkSize
+	}
+	if f.buf == nil {
+		f.buf = make([]byte, f.tree.ChunkSize)
+	}
+	f.chunk = -1
+	f.buf = f.buf[:size]
+	n, err := f.ReadFile.ReadAt(f.buf, idx*f.tree.ChunkSize)
+	if int64(n) < size {
+		if err != nil && err != io.EOF {
+			return err
+		}
+		// truncated.
+		return f.corrupted()
+	}
+	sum := sha256.Sum256(f.buf)
+	if !bytes.Equal(sum[:], f.tree.Leaves[idx]) {
+		return f.corrupted()
+	}
+	f.chunk = idx
+	return nil
+}
+
+func (f *verifiedFile) corrupted() error {
+	if !f.corrupt {
+		f.corrupt = true
+		f.on_corrupt()
+	}
+	return ErrCorrupted
+}
+
+// corrupted removes the entry of s, whose file doesn't match its hashes.
+func (c *FsCache) corrupted(s *Stream) {
+	logger.Errorf("%s is corrupted, removing it", s.Name())
+	s.mu.Lock()
+	// don't trash it either.
+	s.complete = false
+	s.mu.Unlock()
+	c.discard(s)
+}
@@ -0,0 +1,90 @@
+package fscache
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrConflict is returned by Replace if the entry changed since the Version
+// it was given was read.
+var ErrConflict = errors.New("entry changed since its version was read")
+
+// Version identifies the content of an entry. Each fill of an entry, also
+// after it was removed or replaced, gets a new Version, so that workers
+// rebuilding it can tell whether another one did, see Replace. The zero
+// Version is that of a missing entry.
+type Version uint64
+
+// nextVersion returns a Version no entry had before.
+func (c *FsCache) nextVersion() Version {
+	return Version(c.version_seq.Add(1))
+}
+
+// seenVersion makes sure nextVersion doesn't return v again, e.g. once it's
+// loaded from a Persistent index.
+func (c *FsCache) seenVersion(v Version) {
+	for {
+		last := c.version_seq.Load()
+		if uint64(v) <= last ||
+			c.version_seq.CompareAndSwap(last, uint64(v)) {
+			return
+		}
+	}
+}
+
+// Version returns the Version of the stream.
+func (s *Stream) Version() Version {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info.Version
+}
+
+// Version returns the current Version of name, zero if it's not in the
+// cache. Use the Version of GetResult to replace the entry that was read.
+func (c *FsCache) Version(name string) Version {
+	s, ok := c.getStream(name)
+	if !ok {
+		return 0
+	}
+	return s.Version()
+}
+
+// Replace fills name with fill and replaces its content, only if it still has
+// Version v, e.g. the Version of the GetResult it was rebuilt from, and
+// otherwise fails with ErrConflict. A zero v only creates a missing entry. Of
+// several workers replacing the same Version, one succeeds and the others get
+// ErrConflict, also while the entry is being filled. It returns the new
+// Version of name. Readers of the replaced content keep reading it.
+//
+// The new content is staged like the Sets of a Txn. An error of fill is
+// returned as is and leaves the entry unchanged.
+func (c *FsCache) Replace(name string, v Version,
+	fill func(w io.Writer) error) (Version, error) {
+	if err := c.validate(name); err != nil {
+		return 0, wrapError(OpWrite, name, err)
+	}
+	// fail early rather than after a fill which can't be committed.
+	if c.Version(name) != v {
+		return 0, wrapError(OpWrite, name, ErrConflict)
+	}
+	t := c.Begin()
+	defer t.Abort()
+	if err := t.Expect(name, v); err != nil {
+		return 0, err
+	}
+	w, err := t.Set(name, UnknownSize)
+	if err != nil {
+		return 0, err
+	}
+	err = fill(w)
+	if err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	if err := t.Commit(); err != nil {
+		return 0, err
+	}
+	return t.committed[c.key(name)], nil
+}
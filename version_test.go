@@ -0,0 +1,65 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestReplace(t *testing.T) {
+	test := Wrap(t, "version")
+	defer test.Close()
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0)
+	test.AssertNoError(err)
+	fill := func(data string) func(io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := w.Write([]byte(data))
+			return err
+		}
+	}
+	get := func() (string, Version) {
+		res, err := cache.GetEntry(context.Background(), "a", UnknownSize)
+		test.AssertNoError(err)
+		test.Assert(res.Hit, "expected a hit")
+		defer res.Reader.Close()
+		p, err := ioutil.ReadAll(res.Reader)
+		test.AssertNoError(err)
+		return string(p), res.Version
+	}
+
+	test.Assert(cache.Version("a") == 0, "expected no version")
+	v1, err := cache.Replace("a", 0, fill("one"))
+	test.AssertNoError(err)
+	test.Assert(v1 != 0, "expected a version")
+	data, v := get()
+	test.Assert(data == "one" && v == v1, "expected the first version")
+	_, err = cache.Replace("a", 0, fill("zero"))
+	test.Assert(errors.Is(err, ErrConflict), "expected a conflict")
+
+	// the first of two workers replacing v1 wins.
+	var v2 Version
+	_, err = cache.Replace("a", v1, func(w io.Writer) error {
+		var err error
+		v2, err = cache.Replace("a", v1, fill("two"))
+		test.AssertNoError(err)
+		return fill("lost")(w)
+	})
+	test.Assert(errors.Is(err, ErrConflict), "expected a conflict")
+	data, v = get()
+	test.Assert(data == "two" && v == v2 && v2 != v1,
+		"expected the second version")
+
+	failed := errors.New("failed")
+	_, err = cache.Replace("a", v2, func(io.Writer) error { return failed })
+	test.Assert(err == failed, "expected the error of fill")
+	test.Assert(cache.Version("a") == v2, "expected no change")
+
+	test.AssertNoError(cache.Remove("a"))
+	_, err = cache.Replace("a", v2, fill("three"))
+	test.Assert(errors.Is(err, ErrConflict), "expected a conflict")
+	v3, err := cache.Replace("a", 0, fill("three"))
+	test.AssertNoError(err)
+	test.Assert(v3 != v1 && v3 != v2, "expected a new version")
+}
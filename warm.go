@@ -0,0 +1,101 @@
+package fscache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// WarmSource returns the names to warm a new cache with, e.g. the hot keys
+// of a peer.
+type WarmSource func(ctx context.Context) ([]string, error)
+
+// ManifestURL is a WarmSource which GETs url, a manifest listing one name
+// per line. Blank lines and lines starting with # are ignored.
+func ManifestURL(url string) WarmSource {
+	return func(ctx context.Context) ([]string, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+		}
+		var names []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				names = append(names, line)
+			}
+		}
+		return names, scanner.Err()
+	}
+}
+
+// warmup prefetches the names of a WarmSource when the cache starts, see
+// WithWarmup.
+type warmup struct {
+	source WarmSource
+	fill   FillFunc
+	done   chan struct{}
+	stop   context.CancelFunc
+}
+
+// WithWarmup fetches names from source when the cache is created and fills
+// those missing with fill in the background, see Prefetch and
+// WithPrefetchConcurrency. Warm tells when it's done. Failures are logged,
+// the cache works while it's warming and whether or not warming succeeds.
+func WithWarmup(source WarmSource, fill FillFunc) Option {
+	return func(c *FsCache) {
+		c.warmup = &warmup{source: source, fill: fill}
+	}
+}
+
+// Warm returns a channel which is closed once the cache is warm: when the
+// WithWarmup prefetch is over, or right away without WithWarmup. It can
+// serve as a readiness signal.
+func (c *FsCache) Warm() <-chan struct{} {
+	return c.warmup.done
+}
+
+// startWarmup starts warming the cache.
+func (c *FsCache) startWarmup() {
+	if c.warmup == nil {
+		c.warmup = &warmup{}
+	}
+	c.warmup.done = make(chan struct{})
+	if c.warmup.source == nil {
+		close(c.warmup.done)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.warmup.stop = cancel
+	go func() {
+		defer close(c.warmup.done)
+		names, err := c.warmup.source(ctx)
+		if err != nil {
+			logger.Errorf("warming %s: %s", c.root, err)
+			return
+		}
+		err = c.Prefetch(ctx, names, c.warmup.fill).Wait()
+		if err != nil && ctx.Err() == nil {
+			logger.Errorf("warming %s: %s", c.root, err)
+		}
+		logger.Infof("warmed %s with %d entries", c.root, len(names))
+	}()
+}
+
+// stopWarmup cancels warming the cache.
+func (c *FsCache) stopWarmup() {
+	if c.warmup.stop != nil {
+		c.warmup.stop()
+	}
+}
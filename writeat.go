@@ -0,0 +1,190 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+)
+
+var (
+	// ErrWriteAtUnsupported is returned when a fill can't be written out of
+	// order, see WithWriteAt.
+	ErrWriteAtUnsupported = errors.New("WriteAt is not supported")
+
+	// ErrWriteAtMode is returned by Write on a Writer of WithWriteAt, which
+	// must be written with WriteAt.
+	ErrWriteAtMode = errors.New("writer only supports WriteAt")
+
+	// ErrGaps is returned by the Readers of an entry whose WriteAt fill was
+	// closed before all of its bytes were written.
+	ErrGaps = errors.New("writer closed with gaps")
+
+	errNegativeOffset = errors.New("negative offset")
+)
+
+type writeAtKey struct{}
+
+// WithWriteAt returns a copy of ctx which makes the fills started by the
+// GetContext calls it's passed to write out of order: their writers
+// implement io.WriterAt, e.g. for parallel chunk downloads which write
+// straight at their offsets. Readers block until the bytes they read have
+// been written, either as part of the contiguous prefix of the entry or by a
+// WriteAt which covers them. Write fails with ErrWriteAtMode, and closing the
+// writer while there are gaps aborts the fill with ErrGaps.
+//
+// Codecs, write middleware and WithVerification need the bytes in order, so
+// such caches fail these fills with ErrWriteAtUnsupported, as does WriteAt if
+// the Files of the FileSystem don't implement io.WriterAt.
+func WithWriteAt(ctx context.Context) context.Context {
+	return context.WithValue(ctx, writeAtKey{}, true)
+}
+
+func writeAtFrom(ctx context.Context) bool {
+	at, _ := ctx.Value(writeAtKey{}).(bool)
+	return at
+}
+
+// supportsWriteAt reports whether the fills of c can use WithWriteAt.
+func (c *FsCache) supportsWriteAt() bool {
+	return len(c.codecs) == 0 && len(c.writer_mw) == 0 && c.verify <= 0
+}
+
+// writeAt puts the Writer in WriteAt mode before it's handed out. Readers
+// opened earlier can't have read anything yet.
+func (w *Writer) writeAt() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.at = true
+}
+
+// WriteAt writes p at off, see WithWriteAt. Like Write it's concurrent safe.
+func (w *Writer) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	w.mu.Lock()
+	if w.closed {
+		err := w.err
+		w.mu.Unlock()
+		if err == nil {
+			err = ErrClosed
+		}
+		return 0, err
+	}
+	wa, ok := w.file.(io.WriterAt)
+	if !w.at || !ok {
+		w.mu.Unlock()
+		return 0, ErrWriteAtUnsupported
+	}
+	wrote, err := wa.WriteAt(p, off)
+	if wrote > 0 {
+		if w.sniffer != nil {
+			w.sniffer.writeAt(p[:wrote], off)
+		}
+		w.commit(off, int64(wrote))
+	}
+	w.mu.Unlock()
+	w.cond.Broadcast()
+	return wrote, err
+}
+
+// commit records that n bytes were written at off, extending the contiguous
+// prefix of the stream if they reach it. w.mu must be held.
+func (w *Writer) commit(off, n int64) {
+	if off <= w.size {
+		if off+n > w.size {
+			w.size = off + n
+		}
+	} else {
+		w.ranges = append(w.ranges, Range{Off: off, Len: n})
+		sort.Slice(w.ranges, func(i, j int) bool {
+			return w.ranges[i].Off < w.ranges[j].Off
+		})
+		merged := w.ranges[:1]
+		for _, r := range w.ranges[1:] {
+			last := &merged[len(merged)-1]
+			if r.Off > last.Off+last.Len {
+				merged = append(merged, r)
+			} else if end := r.Off + r.Len; end > last.Off+last.Len {
+				last.Len = end - last.Off
+			}
+		}
+		w.ranges = merged
+	}
+	for len(w.ranges) > 0 && w.ranges[0].Off <= w.size {
+		if end := w.ranges[0].Off + w.ranges[0].Len; end > w.size {
+			w.size = end
+		}
+		w.ranges = w.ranges[1:]
+	}
+}
+
+// readable returns the number of bytes written at off, which is negative if
+// off is past the contiguous prefix of the stream and no WriteAt covers it.
+// w.mu must be held.
+func (w *Writer) readable(off int64) int64 {
+	for _, r := range w.ranges {
+		if r.Off <= off && off < r.Off+r.Len {
+			return r.Off + r.Len - off
+		}
+	}
+	return w.size - off
+}
+
+// limit returns how many bytes a Reader may read at off if the Writer is in
+// WriteAt mode, whose file can have gaps. ok is false otherwise.
+func (w *Writer) limit(off int64) (n int64, ok bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if !w.at {
+		return 0, false
+	}
+	if n = w.readable(off); n < 0 {
+		n = 0
+	}
+	return n, true
+}
+
+// WriteAt writes p at off, see Writer.WriteAt.
+func (w *cacheWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	for len(p) > 0 && err == nil {
+		m := len(p)
+		if m > throttleChunk {
+			m = throttleChunk
+		}
+		for _, t := range w.throttles {
+			t.wait(m)
+		}
+		w.touch()
+		m, err = w.Writer.WriteAt(p[:m], off)
+		n += m
+		off += int64(m)
+		p = p[m:]
+	}
+	return n, wrapStreamError(OpWrite, w.stream, err)
+}
+
+// WriteAt creates the underlying File if needed and writes p to it at off.
+func (f *lazyFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	if err := f.create(); err != nil {
+		f.mu.Unlock()
+		return 0, err
+	}
+	file := f.f
+	f.mu.Unlock()
+	wa, ok := file.(io.WriterAt)
+	if !ok {
+		return 0, ErrWriteAtUnsupported
+	}
+	return wa.WriteAt(p, off)
+}
+
+// writeAt is write for bytes written at off, those past a gap are skipped.
+func (s *sniffer) writeAt(p []byte, off int64) {
+	n := int64(len(s.buf))
+	if !s.done && off <= n && n < off+int64(len(p)) {
+		s.write(p[n-off:])
+	}
+}
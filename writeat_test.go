@@ -0,0 +1,65 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestWriteAt(t *testing.T) {
+	test := Wrap(t, "writeat")
+	defer test.Close()
+	cache, err := NewCache(test.Dir(), NewMemFs(), 0)
+	test.AssertNoError(err)
+	ctx := WithWriteAt(context.Background())
+
+	r, w, err := cache.GetContext(ctx, "a", 10)
+	test.AssertNoError(err)
+	wa, ok := w.(io.WriterAt)
+	test.Assert(ok, "expected an io.WriterAt")
+	_, err = w.Write([]byte("hello"))
+	test.Assert(errors.Is(err, ErrWriteAtMode), "expected ErrWriteAtMode")
+
+	all := make(chan []byte)
+	go func() {
+		data, err := ioutil.ReadAll(r)
+		test.AssertNoError(err)
+		all <- data
+	}()
+	_, err = wa.WriteAt([]byte("world"), 5)
+	test.AssertNoError(err)
+	buf := make([]byte, 5)
+	_, err = r.ReadAt(buf, 5)
+	test.AssertNoError(err)
+	test.AssertByteEqual(buf, []byte("world"))
+	select {
+	case <-all:
+		t.Fatal("read past the gap")
+	case <-time.After(10 * time.Millisecond):
+	}
+	_, err = wa.WriteAt([]byte("hello"), 0)
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	test.AssertByteEqual(<-all, []byte("helloworld"))
+	test.AssertNoError(r.Close())
+	test.Assert(cache.Exists("a"), "expected the entry to be kept")
+
+	r, w, err = cache.GetContext(ctx, "b", 10)
+	test.AssertNoError(err)
+	_, err = w.(io.WriterAt).WriteAt([]byte("world"), 5)
+	test.AssertNoError(err)
+	test.AssertNoError(w.Close())
+	_, err = ioutil.ReadAll(r)
+	test.Assert(errors.Is(err, ErrGaps), "expected ErrGaps")
+	test.AssertNoError(r.Close())
+	test.Assert(!cache.Exists("b"), "expected the entry to be discarded")
+
+	cache, err = NewCache(test.Dir(), NewMemFs(), 0, WithVerification(4))
+	test.AssertNoError(err)
+	_, _, err = cache.GetContext(ctx, "a", 10)
+	test.Assert(errors.Is(err, ErrWriteAtUnsupported),
+		"expected ErrWriteAtUnsupported")
+}
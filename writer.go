@@ -5,19 +5,32 @@ import (
 	"sync"
 )
 
+// ErrClosed is returned when writing to or closing a Writer which has already
+// been Closed.
+var ErrClosed = errors.New("stream already closed")
+
 type Writer struct {
 	mu       sync.RWMutex
 	closed   bool
+	err      error // set if the stream was aborted
 	size     int64
 	on_close func()
 	cond     *sync.Cond
+	finished chan struct{} // closed by Close
 	file     WriteFile
+	sniffer  *sniffer    // nil unless content sniffing is enabled
+	hasher   *treeHasher // nil unless WithVerification
+	at       bool        // written with WriteAt, see WithWriteAt
+	ranges   []Range     // bytes written by WriteAt past size, sorted
+
+	granularity int64 // see WithWakeGranularity
 }
 
 func NewWriter(file WriteFile, on_close func()) *Writer {
 	w := &Writer{
 		closed:   false,
 		on_close: on_close,
+		finished: make(chan struct{}),
 
 		file: file,
 	}
@@ -28,9 +41,27 @@ func NewWriter(file WriteFile, on_close func()) *Writer {
 // Write writes p to the Stream. It's concurrent safe to be called with Stream's other methods.
 func (w *Writer) Write(p []byte) (int, error) {
 	w.mu.Lock()
+	if w.closed {
+		err := w.err
+		w.mu.Unlock()
+		if err == nil {
+			err = ErrClosed
+		}
+		return 0, err
+	}
+	if w.at {
+		w.mu.Unlock()
+		return 0, ErrWriteAtMode
+	}
 	wrote, err := w.file.Write(p)
 	if wrote > 0 {
 		w.size += int64(wrote)
+		if w.sniffer != nil {
+			w.sniffer.write(p[:wrote])
+		}
+		if w.hasher != nil {
+			w.hasher.write(p[:wrote])
+		}
 	}
 	w.mu.Unlock()
 	w.cond.Broadcast()
@@ -38,12 +69,34 @@ func (w *Writer) Write(p []byte) (int, error) {
 }
 
 func (w *Writer) Wait(off int64) (n int64, open bool) {
+	return w.waitUntil(off, w.granularity, nil)
+}
+
+// waitUntil is like Wait but for a read of want bytes, which wakes up once
+// they're written if that's less than the granularity. It also returns once
+// stop, if not nil, returns true. Whatever makes stop true must call wake
+// afterwards.
+func (w *Writer) waitUntil(off, want int64, stop func() bool) (n int64,
+	open bool) {
 	w.mu.RLock()
 	defer w.mu.RUnlock()
-	for !w.closed && off >= w.size {
+	if want > w.granularity {
+		want = w.granularity
+	}
+	if want < 1 {
+		want = 1
+	}
+	for !w.closed && w.readable(off) < want && (stop == nil || !stop()) {
 		w.cond.Wait()
 	}
-	return w.size - off, !w.closed
+	return w.readable(off), !w.closed
+}
+
+// wake wakes up the goroutines in Wait.
+func (w *Writer) wake() {
+	w.mu.Lock()
+	w.mu.Unlock()
+	w.cond.Broadcast()
 }
 
 // Must be read with RLock
@@ -51,15 +104,58 @@ func (w *Writer) IsOpen() bool {
 	return !w.closed
 }
 
+// written returns the number of bytes written so far, and whether more may
+// follow.
+func (w *Writer) written() (size int64, open bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.size, !w.closed
+}
+
+// Err returns the error the stream was aborted with, if any.
+func (w *Writer) Err() error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.err
+}
+
+// complete reports whether the writer was closed without being aborted.
+func (w *Writer) complete() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.closed && w.err == nil
+}
+
+// abort closes the writer, making Readers and further Writes fail with err
+// instead of seeing a truncated stream.
+func (w *Writer) abort(err error) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.err = err
+	w.mu.Unlock()
+	return w.Close()
+}
+
 // Close will close the writer. This will cause Readers to return EOF once
 // they have read the entire stream.
 func (w *Writer) Close() error {
 	w.mu.Lock()
 	if w.closed {
-		return errors.New("stream already closed")
+		w.mu.Unlock()
+		return ErrClosed
 	}
 
 	w.closed = true
+	close(w.finished)
+	if len(w.ranges) > 0 && w.err == nil {
+		w.err = ErrGaps
+	}
+	if w.sniffer != nil {
+		w.sniffer.flush()
+	}
 	w.cond.Broadcast()
 	w.mu.Unlock()
 	defer w.on_close()